@@ -0,0 +1,117 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FORMAT_APACHE_COMBINED is the format for writers of access logs.  Records
+// logged with LogAccess hold the whole line in the Apache Combined Log Format,
+// timestamp included, so the format only writes the message:
+//
+//	127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08"
+const FORMAT_APACHE_COMBINED = "%M"
+
+// An AccessLogRecord holds what the Combined Log Format records about an HTTP
+// request.
+type AccessLogRecord struct {
+	RemoteAddr string    // The client address, without the port
+	User       string    // The authenticated user, if any
+	Time       time.Time // When the request was received
+	Method     string    // The request method, such as GET
+	Path       string    // The request URI, as sent by the client
+	Proto      string    // The protocol, such as HTTP/1.1
+	Status     int       // The response status code
+	Bytes      int64     // The size of the response body
+	Referer    string    // The Referer header
+	UserAgent  string    // The User-Agent header
+}
+
+// NewAccessLogRecord fills in an AccessLogRecord from a request and the status
+// and body size of the response sent for it.  The time is the current time.
+func NewAccessLogRecord(r *http.Request, status int, bytes int64) *AccessLogRecord {
+	a := &AccessLogRecord{
+		RemoteAddr: r.RemoteAddr,
+		Time:       timeNow(),
+		Method:     r.Method,
+		Path:       r.RequestURI,
+		Proto:      r.Proto,
+		Status:     status,
+		Bytes:      bytes,
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+	}
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		a.RemoteAddr = host
+	}
+	if len(a.Path) == 0 && r.URL != nil {
+		a.Path = r.URL.RequestURI()
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		a.User = user
+	}
+	return a
+}
+
+// String renders the record as a line in the Apache Combined Log Format.
+func (a *AccessLogRecord) String() string {
+	bytes := "-"
+	if a.Bytes > 0 {
+		bytes = strconv.FormatInt(a.Bytes, 10)
+	}
+	return accessField(a.RemoteAddr) + " - " + accessField(a.User) +
+		" [" + a.Time.Format("02/Jan/2006:15:04:05 -0700") + "] " +
+		strconv.Quote(a.Method+" "+a.Path+" "+a.Proto) + " " +
+		strconv.Itoa(a.Status) + " " + bytes + " " +
+		accessQuote(a.Referer) + " " + accessQuote(a.UserAgent)
+}
+
+// accessField returns s, or "-" if it is empty, with spaces escaped.
+func accessField(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return strings.Replace(s, " ", "%20", -1)
+}
+
+// accessQuote returns s quoted, or "-" quoted if it is empty.
+func accessQuote(s string) string {
+	if len(s) == 0 {
+		s = "-"
+	}
+	return strconv.Quote(s)
+}
+
+// LogAccess logs an access log record at INFO to the "access" filter, falling
+// back like the other named logging calls.  Use FORMAT_APACHE_COMBINED for the
+// writer of that filter.
+func (log Logger) LogAccess(a *AccessLogRecord) {
+	const (
+		lvl = INFO
+	)
+	countLevel(lvl)
+
+	l, ok := log.getLogger("access", lvl)
+	if !ok || lvl < l.Level || !log.sampled(lvl) || !log.withinRate(lvl) {
+		return
+	}
+
+	rec := &LogRecord{
+		Level:   lvl,
+		Created: a.Time,
+		Seq:     log.nextSeq(),
+		Message: a.String(),
+		Topic:   "access",
+	}
+	if log.wantsSource(lvl) {
+		rec.setCaller(1)
+	}
+
+	// Dispatch the logs
+	log.dispatch(l, rec)
+}
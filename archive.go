@@ -0,0 +1,130 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// A BlobStore stores the files an Archiver uploads, such as an S3 bucket.
+// Wrap the store's SDK in one, as with S3's PutObject.
+type BlobStore interface {
+	// Put stores the size bytes read from body under key.
+	Put(key string, body io.Reader, size int64) error
+}
+
+// An Archiver compresses the files a FileLogWriter rotates out and uploads them
+// to a BlobStore, from a goroutine of its own so that logging is not held up.
+// Each Archiver serves a single FileLogWriter.
+type Archiver struct {
+	files chan string
+	done  chan struct{}
+
+	// Where to upload, and the prefix of every key
+	store  BlobStore
+	prefix string
+
+	// Remove each file once it is uploaded
+	deletelocal bool
+
+	// The gzip level of files not compressed yet
+	level int
+
+	// Files that could not be archived
+	failed uint64
+}
+
+// NewArchiver creates an Archiver uploading to store, each file under prefix
+// followed by its base name, as "logs/app.log.001.gz".  Files the writer has
+// not compressed already are gzipped first.  A file that cannot be compressed
+// or uploaded is reported on standard error and kept.
+func NewArchiver(store BlobStore, prefix string) *Archiver {
+	a := &Archiver{
+		files:  make(chan string, LogBufferLength),
+		done:   make(chan struct{}),
+		store:  store,
+		prefix: prefix,
+		level:  gzip.DefaultCompression,
+	}
+
+	go func() {
+		defer close(a.done)
+		for name := range a.files {
+			if err := a.archive(name); err != nil {
+				fmt.Fprintf(os.Stderr, "Archiver(%q): %s\n", name, err)
+				atomic.AddUint64(&a.failed, 1)
+			}
+		}
+	}()
+
+	return a
+}
+
+// archive compresses name if needed and uploads it.  It must only be called
+// from the archiver's goroutine.
+func (a *Archiver) archive(name string) (err error) {
+	defer reportPanic("Archiver", name)
+
+	if !strings.HasSuffix(name, ".gz") {
+		if err := compressFile(name, a.level); err != nil {
+			return err
+		}
+		name += ".gz"
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := a.store.Put(a.prefix+filepath.Base(name), f, fi.Size()); err != nil {
+		return err
+	}
+
+	if a.deletelocal {
+		f.Close()
+		return os.Remove(name)
+	}
+	return nil
+}
+
+// close uploads the files already handed to the archiver and stops it.
+func (a *Archiver) close() {
+	close(a.files)
+	<-a.done
+}
+
+// Failed returns the number of files that could not be archived.
+func (a *Archiver) Failed() uint64 {
+	return atomic.LoadUint64(&a.failed)
+}
+
+// SetDeleteLocal removes each file once it is uploaded (chainable), keeping
+// only the copy in the store.  Must be called before the first log message is
+// written.
+func (a *Archiver) SetDeleteLocal(deletelocal bool) *Archiver {
+	a.deletelocal = deletelocal
+	return a
+}
+
+// SetCompressLevel sets the gzip level of files not compressed by the writer
+// (chainable), as for FileLogWriter.SetCompressLevel.  Must be called before
+// the first log message is written.
+func (a *Archiver) SetCompressLevel(level int) *Archiver {
+	if level != gzip.DefaultCompression && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+		fmt.Fprintf(os.Stderr, "Archiver(%q): invalid compression level %d\n", a.prefix, level)
+		return a
+	}
+	a.level = level
+	return a
+}
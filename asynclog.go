@@ -0,0 +1,124 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// A Policy says what an AsyncLogWriter does with a record that arrives while
+// its queue is full.
+type Policy int
+
+const (
+	// Wait for room in the queue, so that no record is lost
+	OverflowBlock Policy = iota
+
+	// Drop the record, so that the caller never waits
+	OverflowDrop
+)
+
+// This log writer hands records to another on a goroutine of its own, through
+// a bounded queue, so that a slow writer such as a socket or a busy disk does
+// not hold up the code doing the logging.
+type AsyncLogWriter struct {
+	inner    LogWriter
+	queue    chan asyncItem
+	done     chan struct{}
+	overflow Policy
+
+	// Records dropped because the queue was full
+	dropped uint64
+}
+
+// An asyncItem is a record to write, or a request to flush the inner writer
+// once the records queued before it are written, closing flushed once it is.
+type asyncItem struct {
+	rec     *LogRecord
+	flushed chan struct{}
+}
+
+// WrapAsync creates a new LogWriter which queues up to queueLen records for
+// writer, handing them over in order from a goroutine of its own.  When the
+// queue is full, overflow says whether LogWrite waits for room or drops the
+// record.  Closing the writer writes out the queue and then closes writer.
+func WrapAsync(writer LogWriter, queueLen int, overflow Policy) *AsyncLogWriter {
+	w := &AsyncLogWriter{
+		inner:    writer,
+		queue:    make(chan asyncItem, queueLen),
+		done:     make(chan struct{}),
+		overflow: overflow,
+	}
+
+	go func() {
+		defer close(w.done)
+		for item := range w.queue {
+			if item.flushed != nil {
+				if f, ok := w.inner.(Flusher); ok {
+					f.Flush()
+				}
+				close(item.flushed)
+				continue
+			}
+			w.write(item.rec)
+		}
+	}()
+
+	return w
+}
+
+// write hands rec to the inner writer.  It must only be called from the
+// writer's goroutine.
+func (w *AsyncLogWriter) write(rec *LogRecord) {
+	defer reportPanic("AsyncLogWriter", fmt.Sprintf("%T", w.inner))
+	w.inner.LogWrite(rec)
+}
+
+// This is the AsyncLogWriter's output method.  With OverflowDrop, it never
+// blocks.
+func (w *AsyncLogWriter) LogWrite(rec *LogRecord) {
+	if w.overflow == OverflowBlock {
+		w.queue <- asyncItem{rec: rec}
+		return
+	}
+	select {
+	case w.queue <- asyncItem{rec: rec}:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// Flush waits until the records already queued are handed to the inner
+// writer, and for it to write them out if it can.
+func (w *AsyncLogWriter) Flush() {
+	flushed := make(chan struct{})
+	w.queue <- asyncItem{flushed: flushed}
+	<-flushed
+}
+
+// Close writes out the queued records and closes the inner writer.
+func (w *AsyncLogWriter) Close() {
+	w.CloseErr()
+}
+
+// CloseErr writes out the queued records and closes the inner writer,
+// returning its error if it implements CloserErr.
+func (w *AsyncLogWriter) CloseErr() error {
+	close(w.queue)
+	<-w.done
+	return closeWriter(w.inner)
+}
+
+// Err returns the inner writer's error if it implements HealthChecker, or nil.
+func (w *AsyncLogWriter) Err() error {
+	if hc, ok := w.inner.(HealthChecker); ok {
+		return hc.Err()
+	}
+	return nil
+}
+
+// Dropped returns the number of records dropped because the queue was full.
+func (w *AsyncLogWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
@@ -0,0 +1,152 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// This log writer writes tamper-evident audit logs.  Each line is prefixed
+// with an HMAC-SHA256 over the previous line's MAC and the formatted record,
+// so inserting, removing or modifying a line breaks the chain from that point
+// on.  Use VerifyAuditLog to check a log.
+type AuditLogWriter struct {
+	mu   sync.Mutex
+	file *FileLogWriter
+
+	// The logging format
+	format string
+
+	// The HMAC key and the MAC of the last line written
+	key []byte
+	mac []byte
+}
+
+// NewAuditLogWriter creates a new LogWriter which writes an HMAC-chained audit
+// log keyed by key to the given file.  Rotation behaves as for
+// NewFileLogWriter; the chain continues across rotated files, so they must be
+// verified together, oldest first.  If the file already holds an audit log, the
+// chain is resumed from its last line.
+func NewAuditLogWriter(fname string, key []byte, rotate bool, daily bool) *AuditLogWriter {
+	return &AuditLogWriter{
+		file:   NewFileLogWriter(fname, rotate, daily).SetFormat("%M"),
+		format: FORMAT_DEFAULT,
+		key:    append([]byte(nil), key...),
+		mac:    lastAuditMAC(fname),
+	}
+}
+
+// Escapes the line breaks of a record of an audit log
+var auditEscaper = strings.NewReplacer("\n", `\n`, "\r", `\r`)
+
+// This is the AuditLogWriter's output method
+func (w *AuditLogWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// Keep every record on a single line so the log can be verified line by
+	// line, with no carriage return for the reader to take as part of the
+	// line ending
+	text := strings.TrimSuffix(FormatLogRecord(w.format, rec), "\n")
+	text = auditEscaper.Replace(text)
+
+	w.mac = auditMAC(w.key, w.mac, text)
+	w.file.LogWrite(&LogRecord{
+		Level:   rec.Level,
+		Created: rec.Created,
+		Source:  rec.Source,
+		Message: hex.EncodeToString(w.mac) + " " + text,
+	})
+}
+
+func (w *AuditLogWriter) Close() {
+	w.CloseErr()
+}
+
+// CloseErr closes the file like Close, but waits for the remaining records to
+// be written and reports the first error that kept records from the file.
+func (w *AuditLogWriter) CloseErr() error {
+	return closeWriter(w.file)
+}
+
+// Set the logging format (chainable).  Must be called before the first log
+// message is written.
+func (w *AuditLogWriter) SetFormat(format string) *AuditLogWriter {
+	w.format = format
+	return w
+}
+
+// Reformat changes the logging format, starting with the next record.
+func (w *AuditLogWriter) Reformat(format string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.format = format
+}
+
+// VerifyAuditLog reads an audit log written by an AuditLogWriter keyed with key
+// and reports whether its chain is intact.  If it is not, the error names the
+// first line that failed to verify.  Lines dropped from the very end of a log
+// cannot be detected.
+func VerifyAuditLog(r io.Reader, key []byte) (bool, error) {
+	var prev []byte
+
+	in := bufio.NewScanner(r)
+	in.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for lineno := 1; in.Scan(); lineno++ {
+		sep := bytes.IndexByte(in.Bytes(), ' ')
+		if sep < 0 {
+			return false, fmt.Errorf("VerifyAuditLog: line %d: missing MAC", lineno)
+		}
+		mac, err := hex.DecodeString(string(in.Bytes()[:sep]))
+		if err != nil {
+			return false, fmt.Errorf("VerifyAuditLog: line %d: malformed MAC: %s", lineno, err)
+		}
+		if !hmac.Equal(mac, auditMAC(key, prev, string(in.Bytes()[sep+1:]))) {
+			return false, fmt.Errorf("VerifyAuditLog: line %d: MAC mismatch", lineno)
+		}
+		prev = mac
+	}
+	if err := in.Err(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// auditMAC chains text onto the MAC of the previous line.
+func auditMAC(key, prev []byte, text string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(prev)
+	io.WriteString(h, text)
+	return h.Sum(nil)
+}
+
+// lastAuditMAC returns the MAC of the last line of an existing audit log, or
+// nil if there is none.
+func lastAuditMAC(fname string) []byte {
+	fd, err := os.Open(fname)
+	if err != nil {
+		return nil
+	}
+	defer fd.Close()
+
+	var last []byte
+	in := bufio.NewScanner(fd)
+	in.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for in.Scan() {
+		if sep := bytes.IndexByte(in.Bytes(), ' '); sep > 0 {
+			if mac, err := hex.DecodeString(string(in.Bytes()[:sep])); err == nil {
+				last = mac
+			}
+		}
+	}
+	return last
+}
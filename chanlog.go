@@ -0,0 +1,44 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"sync/atomic"
+)
+
+// This log writer hands records to the caller over a channel, so they can be
+// processed by the caller's own code.
+type ChannelLogWriter struct {
+	rec     chan *LogRecord
+	dropped uint64
+}
+
+// NewChannelLogWriter creates a new LogWriter which sends each record on the
+// returned channel, which buffers up to bufSize records.  Records that arrive
+// while the buffer is full are dropped and counted rather than blocking the
+// logger.  Close closes the channel.
+func NewChannelLogWriter(bufSize int) (LogWriter, <-chan *LogRecord) {
+	w := &ChannelLogWriter{
+		rec: make(chan *LogRecord, bufSize),
+	}
+	return w, w.rec
+}
+
+// This is the ChannelLogWriter's output method.  It never blocks.
+func (w *ChannelLogWriter) LogWrite(rec *LogRecord) {
+	select {
+	case w.rec <- rec:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// Close closes the record channel.  LogWrite must not be called after Close.
+func (w *ChannelLogWriter) Close() {
+	close(w.rec)
+}
+
+// Dropped returns the number of records dropped because the channel was full.
+func (w *ChannelLogWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
@@ -0,0 +1,364 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+// Package cloudlog ships log4go records to cloud logging services.  It lives
+// apart from log4go so that programs which do not log to the cloud do not pull
+// in its dependencies.
+//
+// A BatchWriter collects records into batches and hands them to a Client,
+// which talks to one service.  NewGoogleLogWriter sets one up for Google Cloud
+// Logging:
+//
+//	log.AddFilter("cloud", l4g.INFO, cloudlog.NewGoogleLogWriter(cloudlog.GoogleConfig{
+//		ProjectID: "my-project",
+//		LogID:     "my-service",
+//		Token:     tokenSource,
+//	}, cloudlog.Config{}))
+//
+// NewLokiLogWriter pushes records to Grafana Loki, NewSplunkHECLogWriter sends
+// them to a Splunk HTTP Event Collector, NewDatadogLogWriter to Datadog's logs
+// intake, NewHTTPLogWriter to any endpoint taking newline-delimited JSON, and
+// NewObjectStoreLogWriter uploads each batch as a gzipped NDJSON object to an
+// object store such as S3, through an Uploader wrapping the store's SDK.
+package cloudlog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	l4g "github.com/blackbeans/log4go"
+)
+
+// A CloudLogWriter is a LogWriter which ships records to a cloud logging
+// service.
+type CloudLogWriter interface {
+	l4g.LogWriter
+
+	// Flush blocks until every record handed to the writer so far has been
+	// sent, or given up on.
+	Flush()
+
+	// Dropped returns the number of records that could not be sent.
+	Dropped() uint64
+}
+
+// An Entry is a record as sent to the logging service.
+type Entry struct {
+	Severity  string                 // The service's name for the level
+	Timestamp time.Time              // When the record was created
+	Payload   map[string]interface{} // The message and the other fields of the record
+	Record    *l4g.LogRecord         // The record itself, for clients that format it
+}
+
+// A Client sends batches of entries to a logging service.
+type Client interface {
+	// WriteEntries sends entries in a single request.  If the service is
+	// throttling requests or briefly unavailable, the error is or wraps a
+	// *RetryableError and the batch will be sent again.
+	WriteEntries(entries []Entry) error
+
+	// Severity maps a log4go level to the service's severity.
+	Severity(lvl l4g.Level) string
+}
+
+// A RetryableError is returned by a Client when sending may succeed if tried
+// again later.
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RetryableError) Unwrap() error {
+	return e.Err
+}
+
+// Config tunes how a BatchWriter batches and retries.  Zero fields take their
+// defaults.
+type Config struct {
+	BatchSize     int           // Send once this many records are waiting (default 500)
+	BatchBytes    int           // Send once the waiting messages total this many bytes (default no limit)
+	FlushInterval time.Duration // Send waiting records at least this often (default 5s)
+	MaxRetries    int           // Give up on a batch after this many retries (default 5)
+	RetryBackoff  time.Duration // Wait this long before the first retry, doubling each time (default 1s)
+
+	// Hold at most this many records waiting for the writer while it is busy
+	// sending or retrying, dropping further records instead of blocking the
+	// logger (default l4g.LogBufferLength, blocking when full)
+	MaxBuffered int
+}
+
+func (c Config) withDefaults() Config {
+	if c.BatchSize <= 0 {
+		c.BatchSize = 500
+	}
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = 5 * time.Second
+	}
+	if c.MaxRetries <= 0 {
+		c.MaxRetries = 5
+	}
+	if c.RetryBackoff <= 0 {
+		c.RetryBackoff = time.Second
+	}
+	return c
+}
+
+// This log writer batches records and sends them through a Client.
+type BatchWriter struct {
+	rec   chan *l4g.LogRecord
+	flush chan chan struct{}
+	done  chan struct{}
+
+	client     Client
+	config     Config
+	batch      []Entry
+	batchBytes int
+
+	// Records that could not be sent
+	dropped uint64
+}
+
+// NewBatchWriter creates a new CloudLogWriter which sends records to client in
+// batches, as configured by config.
+func NewBatchWriter(client Client, config Config) *BatchWriter {
+	buffered := l4g.LogBufferLength
+	if config.MaxBuffered > 0 {
+		buffered = config.MaxBuffered
+	}
+	w := &BatchWriter{
+		rec:    make(chan *l4g.LogRecord, buffered),
+		flush:  make(chan chan struct{}),
+		done:   make(chan struct{}),
+		client: client,
+		config: config.withDefaults(),
+	}
+
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(w.config.FlushInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				w.send()
+			case done := <-w.flush:
+				w.drain()
+				w.send()
+				close(done)
+			case rec, ok := <-w.rec:
+				if !ok {
+					w.send()
+					return
+				}
+				w.add(rec)
+			}
+		}
+	}()
+
+	return w
+}
+
+// This is the BatchWriter's output method.  This will block if the output
+// buffer is full, unless Config.MaxBuffered is set, in which case the record
+// is dropped.
+func (w *BatchWriter) LogWrite(rec *l4g.LogRecord) {
+	if w.config.MaxBuffered <= 0 {
+		w.rec <- rec
+		return
+	}
+	select {
+	case w.rec <- rec:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// Flush blocks until every record handed to the writer so far has been sent,
+// or given up on.  It must not be called after Close.
+func (w *BatchWriter) Flush() {
+	done := make(chan struct{})
+	select {
+	case w.flush <- done:
+		<-done
+	case <-w.done:
+	}
+}
+
+// Close sends the records still waiting and stops the writer.
+func (w *BatchWriter) Close() {
+	close(w.rec)
+	<-w.done
+}
+
+// Dropped returns the number of records that could not be sent.
+func (w *BatchWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// add batches rec, sending the batch once it is full.  It must only be called
+// from the writer's goroutine.
+func (w *BatchWriter) add(rec *l4g.LogRecord) {
+	w.batch = append(w.batch, Entry{
+		Severity:  w.client.Severity(rec.Level),
+		Timestamp: rec.Created,
+		Payload:   payload(rec),
+		Record:    rec,
+	})
+	w.batchBytes += len(rec.Message)
+	if len(w.batch) >= w.config.BatchSize || (w.config.BatchBytes > 0 && w.batchBytes >= w.config.BatchBytes) {
+		w.send()
+	}
+}
+
+// drain batches the records already handed to the writer.  It must only be
+// called from the writer's goroutine.
+func (w *BatchWriter) drain() {
+	for {
+		select {
+		case rec, ok := <-w.rec:
+			if !ok {
+				return
+			}
+			w.add(rec)
+		default:
+			return
+		}
+	}
+}
+
+// send sends the waiting batch, retrying with backoff while the client says
+// it may succeed later.  It must only be called from the writer's goroutine.
+func (w *BatchWriter) send() {
+	if len(w.batch) == 0 {
+		return
+	}
+	batch := w.batch
+	w.batch, w.batchBytes = nil, 0
+
+	backoff := w.config.RetryBackoff
+	for retry := 0; ; retry++ {
+		err := w.client.WriteEntries(batch)
+		if err == nil {
+			return
+		}
+		var retryable *RetryableError
+		if !errors.As(err, &retryable) || retry >= w.config.MaxRetries {
+			fmt.Fprintf(os.Stderr, "BatchWriter: dropping %d records: %s\n", len(batch), err)
+			atomic.AddUint64(&w.dropped, uint64(len(batch)))
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// payload returns the fields of rec sent as the entry's structured payload.
+func payload(rec *l4g.LogRecord) map[string]interface{} {
+	p := map[string]interface{}{
+		"message": rec.Message,
+	}
+	if len(rec.Source) > 0 {
+		p["source"] = rec.Source
+	}
+	if len(rec.Func) > 0 {
+		p["caller_func"] = rec.Func
+		p["caller_file"] = rec.File
+		p["caller_line"] = rec.Line
+	}
+	if len(rec.Topic) > 0 {
+		p["topic"] = rec.Topic
+	}
+	if len(rec.Category) > 0 {
+		p["category"] = rec.Category
+	}
+	if rec.Seq > 0 {
+		p["seq"] = rec.Seq
+	}
+	if len(rec.ErrorChain) > 0 {
+		p["error_chain"] = rec.ErrorChain
+	}
+	if len(rec.Stack) > 0 {
+		p["stack"] = rec.Stack
+	}
+	return p
+}
+
+// severity maps a log4go level to the lower case severity names shared by
+// Loki and Splunk, which fold the levels below DEBUG into "debug".
+func severity(lvl l4g.Level) string {
+	switch {
+	case !lvl.Valid():
+		return "unknown"
+	case lvl <= l4g.DEBUG:
+		return "debug"
+	case lvl == l4g.TRACE:
+		return "trace"
+	case lvl == l4g.INFO:
+		return "info"
+	case lvl == l4g.WARNING:
+		return "warning"
+	case lvl == l4g.ERROR:
+		return "error"
+	}
+	return "critical"
+}
+
+// postBatch posts body to url as contentType with the given headers, gzipping
+// it first if zip is set, and reads at most 1 KiB of the response.  Failed
+// requests and throttled (429), server error (5xx) and retry responses are
+// retryable.  Errors are prefixed with name, the client's type.
+func postBatch(client *http.Client, name, url, contentType string, header map[string]string, body []byte, zip bool, retry ...int) error {
+	if zip {
+		var zbody bytes.Buffer
+		zw := gzip.NewWriter(&zbody)
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = zbody.Bytes()
+	}
+
+	hreq, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		hreq.Header.Set(k, v)
+	}
+	hreq.Header.Set("Content-Type", contentType)
+	if zip {
+		hreq.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := client.Do(hreq)
+	if err != nil {
+		return &RetryableError{err}
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	err = fmt.Errorf("%s: %s: %s", name, resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5 {
+		return &RetryableError{err}
+	}
+	for _, status := range retry {
+		if resp.StatusCode == status {
+			return &RetryableError{err}
+		}
+	}
+	return err
+}
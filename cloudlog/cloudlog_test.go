@@ -0,0 +1,525 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package cloudlog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	l4g "github.com/blackbeans/log4go"
+)
+
+type fakeClient struct {
+	GoogleClient
+
+	mu       sync.Mutex
+	batches  [][]Entry
+	failures int
+	wrap     bool // Wrap the RetryableError of failures
+}
+
+func (c *fakeClient) WriteEntries(entries []Entry) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures > 0 {
+		c.failures--
+		if c.wrap {
+			return fmt.Errorf("fakeClient: %w", &RetryableError{errors.New("throttled")})
+		}
+		return &RetryableError{errors.New("throttled")}
+	}
+	c.batches = append(c.batches, entries)
+	return nil
+}
+
+func (c *fakeClient) Batches() [][]Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.batches
+}
+
+func newRecord(lvl l4g.Level, msg string) *l4g.LogRecord {
+	return &l4g.LogRecord{Level: lvl, Created: time.Now(), Source: "source", Message: msg}
+}
+
+func TestBatchWriter(t *testing.T) {
+	client := &fakeClient{}
+	w := NewBatchWriter(client, Config{BatchSize: 3, FlushInterval: time.Hour})
+
+	for i := 0; i < 7; i++ {
+		w.LogWrite(newRecord(l4g.INFO, fmt.Sprint("message ", i)))
+	}
+	w.Flush()
+
+	var sizes []int
+	for _, batch := range client.Batches() {
+		sizes = append(sizes, len(batch))
+	}
+	if fmt.Sprint(sizes) != "[3 3 1]" {
+		t.Errorf("BatchWriter: got batches of %v, want [3 3 1]", sizes)
+	}
+	if got := client.Batches()[2][0].Payload["message"]; got != "message 6" {
+		t.Errorf("BatchWriter: last batch holds %v", got)
+	}
+
+	w.LogWrite(newRecord(l4g.ERROR, "on close"))
+	w.Close()
+	if n := len(client.Batches()); n != 4 {
+		t.Errorf("BatchWriter: Close sent %d batches, want 4", n)
+	}
+}
+
+func TestBatchWriterRetry(t *testing.T) {
+	client := &fakeClient{failures: 2}
+	w := NewBatchWriter(client, Config{MaxRetries: 2, RetryBackoff: time.Millisecond})
+	w.LogWrite(newRecord(l4g.INFO, "retried"))
+	w.Flush()
+	if len(client.Batches()) != 1 || w.Dropped() != 0 {
+		t.Errorf("BatchWriter: throttled batch was not retried")
+	}
+
+	client.mu.Lock()
+	client.failures = 3
+	client.mu.Unlock()
+	w.LogWrite(newRecord(l4g.INFO, "dropped"))
+	w.Close()
+	if len(client.Batches()) != 1 || w.Dropped() != 1 {
+		t.Errorf("BatchWriter: got %d dropped after too many retries, want 1", w.Dropped())
+	}
+}
+
+func TestBatchWriterRetryWrapped(t *testing.T) {
+	client := &fakeClient{failures: 2, wrap: true}
+	w := NewBatchWriter(client, Config{MaxRetries: 2, RetryBackoff: time.Millisecond})
+	w.LogWrite(newRecord(l4g.INFO, "retried"))
+	w.Close()
+	if len(client.Batches()) != 1 || w.Dropped() != 0 {
+		t.Errorf("BatchWriter: batch failing with a wrapped RetryableError was not retried")
+	}
+}
+
+func TestBatchWriterMaxBuffered(t *testing.T) {
+	client := &fakeClient{}
+	w := NewBatchWriter(client, Config{BatchSize: 1, MaxBuffered: 2})
+
+	// While the client is stuck, at most one record is being sent and two
+	// more wait; the rest are dropped without blocking
+	client.mu.Lock()
+	for i := 0; i < 5; i++ {
+		w.LogWrite(newRecord(l4g.INFO, fmt.Sprint("message ", i)))
+	}
+	client.mu.Unlock()
+	w.Close()
+
+	sent := len(client.Batches())
+	if dropped := int(w.Dropped()); sent+dropped != 5 || dropped < 2 {
+		t.Errorf("BatchWriter: sent %d and dropped %d of 5, want at least 2 dropped", sent, dropped)
+	}
+}
+
+func TestGoogleSeverity(t *testing.T) {
+	tests := map[l4g.Level]string{
+		l4g.FINEST:    "DEBUG",
+		l4g.FINE:      "DEBUG",
+		l4g.DEBUG:     "DEBUG",
+		l4g.TRACE:     "DEBUG",
+		l4g.INFO:      "INFO",
+		l4g.WARNING:   "WARNING",
+		l4g.ERROR:     "ERROR",
+		l4g.CRITICAL:  "CRITICAL",
+		l4g.Level(42): "DEFAULT",
+	}
+	c := NewGoogleClient(GoogleConfig{})
+	for lvl, want := range tests {
+		if got := c.Severity(lvl); got != want {
+			t.Errorf("Severity(%d) = %q, want %q", lvl, got, want)
+		}
+	}
+}
+
+func TestGoogleClient(t *testing.T) {
+	var got googleRequest
+	status := http.StatusTooManyRequests
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("GoogleClient: Authorization %q", auth)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		rw.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	c := NewGoogleClient(GoogleConfig{
+		ProjectID: "project",
+		LogID:     "service",
+		Token:     func() (string, error) { return "token", nil },
+		Endpoint:  srv.URL,
+	})
+	entries := []Entry{{Severity: "ERROR", Timestamp: time.Unix(1234567890, 0), Payload: map[string]interface{}{"message": "boom"}}}
+
+	if _, ok := c.WriteEntries(entries).(*RetryableError); !ok {
+		t.Errorf("GoogleClient: throttled response is not retryable")
+	}
+	status = http.StatusOK
+	if err := c.WriteEntries(entries); err != nil {
+		t.Fatalf("GoogleClient: %s", err)
+	}
+	if got.LogName != "projects/project/logs/service" || got.Resource.Type != "global" {
+		t.Errorf("GoogleClient: sent to %q (%q)", got.LogName, got.Resource.Type)
+	}
+	if len(got.Entries) != 1 || got.Entries[0].Severity != "ERROR" || got.Entries[0].JSONPayload["message"] != "boom" ||
+		got.Entries[0].Timestamp != "2009-02-13T23:31:30Z" {
+		t.Errorf("GoogleClient: sent entries %+v", got.Entries)
+	}
+}
+
+type fakeUploader struct {
+	mu      sync.Mutex
+	keys    []string
+	objects [][]byte
+}
+
+func (u *fakeUploader) Upload(key string, body []byte) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.keys = append(u.keys, key)
+	u.objects = append(u.objects, body)
+	return nil
+}
+
+// lines gunzips the i'th object and returns its records.
+func (u *fakeUploader) lines(t *testing.T, i int) []map[string]interface{} {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	zr, err := gzip.NewReader(bytes.NewReader(u.objects[i]))
+	if err != nil {
+		t.Fatalf("object %d is not gzipped: %s", i, err)
+	}
+	var lines []map[string]interface{}
+	dec := json.NewDecoder(zr)
+	for dec.More() {
+		var line map[string]interface{}
+		if err := dec.Decode(&line); err != nil {
+			t.Fatalf("object %d: %s", i, err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestObjectStoreLogWriter(t *testing.T) {
+	uploader := &fakeUploader{}
+	w := NewObjectStoreLogWriter(ObjectStoreConfig{Uploader: uploader, Prefix: "logs/"},
+		Config{BatchSize: 3, FlushInterval: time.Hour})
+
+	for i := 0; i < 7; i++ {
+		w.LogWrite(newRecord(l4g.WARNING, fmt.Sprint("message ", i)))
+	}
+	w.Close()
+
+	if len(uploader.keys) != 3 {
+		t.Fatalf("ObjectStoreLogWriter: uploaded %d objects, want 3", len(uploader.keys))
+	}
+	for i, want := range []int{3, 3, 1} {
+		lines := uploader.lines(t, i)
+		if len(lines) != want {
+			t.Errorf("ObjectStoreLogWriter: object %d has %d records, want %d", i, len(lines), want)
+			continue
+		}
+		if got := lines[0]["message"]; got != fmt.Sprint("message ", 3*i) {
+			t.Errorf("ObjectStoreLogWriter: object %d starts with %v", i, got)
+		}
+		if got := lines[0]["severity"]; got != "WARN" {
+			t.Errorf("ObjectStoreLogWriter: severity %v, want WARN", got)
+		}
+	}
+	for i, key := range uploader.keys {
+		if !strings.HasPrefix(key, "logs/") || !strings.HasSuffix(key, fmt.Sprintf("-%06d.ndjson.gz", i+1)) {
+			t.Errorf("ObjectStoreLogWriter: unexpected key %q", key)
+		}
+	}
+}
+
+func TestObjectStoreBatchBytes(t *testing.T) {
+	uploader := &fakeUploader{}
+	w := NewObjectStoreLogWriter(ObjectStoreConfig{Uploader: uploader},
+		Config{BatchBytes: 20, FlushInterval: time.Hour})
+
+	// Two 10-byte messages fill a batch
+	for i := 0; i < 5; i++ {
+		w.LogWrite(newRecord(l4g.INFO, fmt.Sprintf("message %02d", i)))
+	}
+	w.Close()
+
+	var sizes []int
+	for i := range uploader.keys {
+		sizes = append(sizes, len(uploader.lines(t, i)))
+	}
+	if fmt.Sprint(sizes) != "[2 2 1]" {
+		t.Errorf("ObjectStoreLogWriter: got objects of %v records, want [2 2 1]", sizes)
+	}
+}
+
+func TestLokiLogWriter(t *testing.T) {
+	var mu sync.Mutex
+	var pushes []lokiRequest
+	statuses := []int{http.StatusServiceUnavailable, http.StatusNoContent}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if enc := r.Header.Get("Content-Encoding"); enc != "gzip" {
+			t.Errorf("LokiClient: Content-Encoding %q", enc)
+		}
+		if tenant := r.Header.Get("X-Scope-OrgID"); tenant != "team" {
+			t.Errorf("LokiClient: X-Scope-OrgID %q", tenant)
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("LokiClient: body is not gzipped: %s", err)
+			return
+		}
+		var req lokiRequest
+		json.NewDecoder(zr).Decode(&req)
+		pushes = append(pushes, req)
+		rw.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	defer srv.Close()
+
+	w := NewLokiLogWriter(LokiConfig{
+		URL:      srv.URL,
+		Labels:   map[string]string{"app": "billing"},
+		Format:   "[%L] %M",
+		Gzip:     true,
+		TenantID: "team",
+	}, Config{FlushInterval: time.Hour, RetryBackoff: time.Millisecond})
+
+	at := time.Unix(1234567890, 0)
+	for _, rec := range []*l4g.LogRecord{
+		{Level: l4g.INFO, Created: at, Message: "first"},
+		{Level: l4g.ERROR, Created: at.Add(time.Second), Message: "failed"},
+		{Level: l4g.INFO, Created: at.Add(2 * time.Second), Message: "second"},
+	} {
+		w.LogWrite(rec)
+	}
+	w.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(pushes) != 2 || w.Dropped() != 0 {
+		t.Fatalf("LokiClient: got %d pushes and %d dropped, want the push retried once", len(pushes), w.Dropped())
+	}
+	want := []lokiStream{
+		{
+			Stream: map[string]string{"app": "billing", "level": "error"},
+			Values: [][2]string{{"1234567891000000000", "[EROR] failed"}},
+		},
+		{
+			Stream: map[string]string{"app": "billing", "level": "info"},
+			Values: [][2]string{{"1234567890000000000", "[INFO] first"}, {"1234567892000000000", "[INFO] second"}},
+		},
+	}
+	if got := pushes[1].Streams; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("LokiClient: pushed streams %v, want %v", got, want)
+	}
+}
+
+func TestLokiClientError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Error(rw, "entry out of order", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	c := NewLokiClient(LokiConfig{URL: srv.URL})
+	err := c.WriteEntries([]Entry{{Severity: "info", Timestamp: time.Now(), Payload: map[string]interface{}{"message": "late"}}})
+	if err == nil || !strings.Contains(err.Error(), "entry out of order") {
+		t.Errorf("LokiClient: got %v for a rejected push", err)
+	}
+	if _, ok := err.(*RetryableError); ok {
+		t.Errorf("LokiClient: rejected push is retryable")
+	}
+}
+
+func TestSplunkHECLogWriter(t *testing.T) {
+	var mu sync.Mutex
+	var posts [][]splunkEvent
+	statuses := []int{http.StatusServiceUnavailable, http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if auth := r.Header.Get("Authorization"); auth != "Splunk secret" {
+			t.Errorf("SplunkClient: Authorization %q", auth)
+		}
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Errorf("SplunkClient: body is not gzipped: %s", err)
+			return
+		}
+		var events []splunkEvent
+		for dec := json.NewDecoder(zr); dec.More(); {
+			var e splunkEvent
+			if err := dec.Decode(&e); err != nil {
+				t.Errorf("SplunkClient: %s", err)
+				return
+			}
+			events = append(events, e)
+		}
+		posts = append(posts, events)
+		rw.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	defer srv.Close()
+
+	w := NewSplunkHECLogWriter(SplunkConfig{
+		URL:        srv.URL,
+		Token:      "secret",
+		Index:      "main",
+		SourceType: "_json",
+		Gzip:       true,
+	}, Config{FlushInterval: time.Hour, RetryBackoff: time.Millisecond})
+
+	at := time.Unix(1234567890, 123456789)
+	w.LogWrite(&l4g.LogRecord{Level: l4g.INFO, Created: at, Source: "main.main:12", Message: "first"})
+	w.LogWrite(&l4g.LogRecord{Level: l4g.ERROR, Created: at, Message: "failed", Category: "db"})
+	w.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posts) != 2 || w.Dropped() != 0 {
+		t.Fatalf("SplunkClient: got %d posts and %d dropped, want the post retried once", len(posts), w.Dropped())
+	}
+	want := []splunkEvent{
+		{Time: "1234567890.123", SourceType: "_json", Index: "main", Event: map[string]interface{}{"severity": "info", "source": "main.main:12", "message": "first"}},
+		{Time: "1234567890.123", SourceType: "_json", Index: "main", Event: map[string]interface{}{"severity": "error", "category": "db", "message": "failed"}},
+	}
+	if got := posts[1]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("SplunkClient: posted events %v, want %v", got, want)
+	}
+
+}
+
+func TestSplunkClientError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusForbidden)
+		fmt.Fprint(rw, `{"text":"Invalid token","code":4}`)
+	}))
+	defer srv.Close()
+
+	c := NewSplunkClient(SplunkConfig{URL: srv.URL, Token: "wrong"})
+	err := c.WriteEntries([]Entry{{Severity: "info", Timestamp: time.Now(), Payload: map[string]interface{}{"message": "denied"}}})
+	if err == nil || !strings.Contains(err.Error(), "Invalid token") {
+		t.Errorf("SplunkClient: got %v for a rejected post", err)
+	}
+	if _, ok := err.(*RetryableError); ok {
+		t.Errorf("SplunkClient: rejected post is retryable")
+	}
+}
+
+func TestDatadogLogWriter(t *testing.T) {
+	var mu sync.Mutex
+	var posts [][]map[string]interface{}
+	statuses := []int{http.StatusTooManyRequests, http.StatusAccepted}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if key := r.Header.Get("DD-API-KEY"); key != "key" {
+			t.Errorf("DatadogClient: DD-API-KEY %q", key)
+		}
+		var logs []map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&logs); err != nil {
+			t.Errorf("DatadogClient: %s", err)
+		}
+		posts = append(posts, logs)
+		rw.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	defer srv.Close()
+
+	w := NewDatadogLogWriter(DatadogConfig{
+		APIKey:  "key",
+		URL:     srv.URL,
+		Service: "billing",
+		Env:     "prod",
+		Version: "1.2.3",
+		Tags:    []string{"team:payments"},
+	}, Config{FlushInterval: time.Hour, RetryBackoff: time.Millisecond})
+
+	at := time.Unix(1234567890, 123456789)
+	for _, lvl := range []l4g.Level{l4g.FINE, l4g.INFO, l4g.WARNING, l4g.ERROR, l4g.CRITICAL} {
+		w.LogWrite(&l4g.LogRecord{Level: lvl, Created: at, Message: lvl.String()})
+	}
+	w.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(posts) != 2 || w.Dropped() != 0 {
+		t.Fatalf("DatadogClient: got %d posts and %d dropped, want the post retried once", len(posts), w.Dropped())
+	}
+	var statusesSent []string
+	for _, log := range posts[1] {
+		statusesSent = append(statusesSent, log["status"].(string))
+	}
+	if got, want := strings.Join(statusesSent, " "), "debug info warn error critical"; got != want {
+		t.Errorf("DatadogClient: statuses %q, want %q", got, want)
+	}
+	want := map[string]interface{}{
+		"ddsource":  "go",
+		"ddtags":    "env:prod,version:1.2.3,team:payments",
+		"message":   "INFO",
+		"service":   "billing",
+		"status":    "info",
+		"timestamp": float64(1234567890123),
+	}
+	if got := posts[1][1]; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("DatadogClient: sent %v, want %v", got, want)
+	}
+}
+
+func TestHTTPLogWriter(t *testing.T) {
+	var mu sync.Mutex
+	var posts []string
+	statuses := []int{http.StatusInternalServerError, http.StatusOK}
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ct := r.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+			t.Errorf("HTTPClient: Content-Type %q", ct)
+		}
+		if auth := r.Header.Get("Authorization"); auth != "Bearer token" {
+			t.Errorf("HTTPClient: Authorization %q", auth)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		posts = append(posts, string(body))
+		rw.WriteHeader(statuses[0])
+		statuses = statuses[1:]
+	}))
+	defer srv.Close()
+
+	w := NewHTTPLogWriter(HTTPConfig{
+		URL:     srv.URL,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}, Config{BatchSize: 2, FlushInterval: time.Hour, RetryBackoff: time.Millisecond})
+
+	at := time.Date(2024, time.March, 4, 5, 6, 7, 0, time.UTC)
+	w.LogWrite(&l4g.LogRecord{Level: l4g.INFO, Created: at, Source: "main.main:12", Message: "first"})
+	w.LogWrite(&l4g.LogRecord{Level: l4g.WARNING, Created: at, Message: "second"})
+	w.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := `{"level":"info","message":"first","source":"main.main:12","time":"2024-03-04T05:06:07Z"}` + "\n" +
+		`{"level":"warning","message":"second","time":"2024-03-04T05:06:07Z"}` + "\n"
+	if len(posts) != 2 || posts[0] != want || posts[1] != want || w.Dropped() != 0 {
+		t.Errorf("HTTPClient: posted %q, want %q twice", posts, want)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package cloudlog
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	l4g "github.com/blackbeans/log4go"
+)
+
+// DatadogConfig says where a DatadogClient sends logs and how it tags them.
+type DatadogConfig struct {
+	// The API key, sent as DD-API-KEY
+	APIKey string
+
+	// Optional: the logs intake endpoint (default the US1 site's,
+	// "https://http-intake.logs.datadoghq.com/api/v2/logs")
+	URL string
+
+	// Optional: the service, env and version of every log, which Datadog's
+	// unified service tagging reads from the service field and the env: and
+	// version: tags, more tags such as "team:billing", the hostname, and the
+	// source (default "go")
+	Service  string
+	Env      string
+	Version  string
+	Tags     []string
+	Hostname string
+	Source   string
+
+	// Optional: whether to gzip requests, and the HTTP client to use (default
+	// http.DefaultClient)
+	Gzip       bool
+	HTTPClient *http.Client
+}
+
+// A DatadogClient sends entries to the Datadog logs intake API, each entry's
+// payload being the attributes of a log.  The intake takes at most 1000 logs
+// per request, so a BatchWriter for it should keep Config.BatchSize at or
+// below that.
+type DatadogClient struct {
+	config DatadogConfig
+	tags   string
+}
+
+// NewDatadogClient creates a Client for the Datadog logs intake API.
+func NewDatadogClient(config DatadogConfig) *DatadogClient {
+	if len(config.URL) == 0 {
+		config.URL = "https://http-intake.logs.datadoghq.com/api/v2/logs"
+	}
+	if len(config.Source) == 0 {
+		config.Source = "go"
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+
+	var tags []string
+	if len(config.Env) > 0 {
+		tags = append(tags, "env:"+config.Env)
+	}
+	if len(config.Version) > 0 {
+		tags = append(tags, "version:"+config.Version)
+	}
+	tags = append(tags, config.Tags...)
+	return &DatadogClient{config, strings.Join(tags, ",")}
+}
+
+// NewDatadogLogWriter creates a new CloudLogWriter which sends records to
+// Datadog.
+func NewDatadogLogWriter(datadog DatadogConfig, config Config) *BatchWriter {
+	return NewBatchWriter(NewDatadogClient(datadog), config)
+}
+
+// Severity maps a log4go level to the status of the logs.
+func (c *DatadogClient) Severity(lvl l4g.Level) string {
+	switch {
+	case !lvl.Valid():
+		return "notice"
+	case lvl <= l4g.TRACE:
+		return "debug"
+	case lvl == l4g.INFO:
+		return "info"
+	case lvl == l4g.WARNING:
+		return "warn"
+	case lvl == l4g.ERROR:
+		return "error"
+	}
+	return "critical"
+}
+
+// WriteEntries sends entries to Datadog in one request.  Timed out (408),
+// throttled (429) and server error (5xx) responses are retryable.
+func (c *DatadogClient) WriteEntries(entries []Entry) error {
+	logs := make([]map[string]interface{}, 0, len(entries))
+	for _, e := range entries {
+		log := map[string]interface{}{
+			"ddsource":  c.config.Source,
+			"status":    e.Severity,
+			"timestamp": e.Timestamp.UnixNano() / 1e6,
+		}
+		for k, v := range e.Payload {
+			log[k] = v
+		}
+		if len(c.config.Service) > 0 {
+			log["service"] = c.config.Service
+		}
+		if len(c.tags) > 0 {
+			log["ddtags"] = c.tags
+		}
+		if len(c.config.Hostname) > 0 {
+			log["hostname"] = c.config.Hostname
+		}
+		logs = append(logs, log)
+	}
+	body, err := json.Marshal(logs)
+	if err != nil {
+		return err
+	}
+
+	return postBatch(c.config.HTTPClient, "DatadogClient", c.config.URL, "application/json",
+		map[string]string{"DD-API-KEY": c.config.APIKey}, body, c.config.Gzip, http.StatusRequestTimeout)
+}
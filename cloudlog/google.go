@@ -0,0 +1,137 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package cloudlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+
+	l4g "github.com/blackbeans/log4go"
+)
+
+// GoogleConfig says where a GoogleClient sends entries and how it
+// authenticates.
+type GoogleConfig struct {
+	ProjectID string // The project the log belongs to
+	LogID     string // The name of the log within the project
+
+	// Token returns an OAuth2 access token with the logging.write scope, such
+	// as one from golang.org/x/oauth2/google.
+	Token func() (string, error)
+
+	// Optional: the monitored resource type (default "global"), the API
+	// endpoint, and the HTTP client to use (default http.DefaultClient)
+	ResourceType string
+	Endpoint     string
+	HTTPClient   *http.Client
+}
+
+// A GoogleClient sends entries to Google Cloud Logging with the entries.write
+// REST method.
+type GoogleClient struct {
+	config GoogleConfig
+}
+
+// NewGoogleClient creates a Client for Google Cloud Logging.
+func NewGoogleClient(config GoogleConfig) *GoogleClient {
+	if len(config.ResourceType) == 0 {
+		config.ResourceType = "global"
+	}
+	if len(config.Endpoint) == 0 {
+		config.Endpoint = "https://logging.googleapis.com/v2/entries:write"
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &GoogleClient{config}
+}
+
+// NewGoogleLogWriter creates a new CloudLogWriter which sends records to Google
+// Cloud Logging.
+func NewGoogleLogWriter(google GoogleConfig, config Config) *BatchWriter {
+	return NewBatchWriter(NewGoogleClient(google), config)
+}
+
+// Severity maps a log4go level to a Cloud Logging severity.
+func (c *GoogleClient) Severity(lvl l4g.Level) string {
+	switch {
+	case !lvl.Valid():
+		return "DEFAULT"
+	case lvl <= l4g.TRACE:
+		return "DEBUG"
+	case lvl == l4g.INFO:
+		return "INFO"
+	case lvl == l4g.WARNING:
+		return "WARNING"
+	case lvl == l4g.ERROR:
+		return "ERROR"
+	}
+	return "CRITICAL"
+}
+
+type googleEntry struct {
+	Severity    string                 `json:"severity"`
+	Timestamp   string                 `json:"timestamp"`
+	JSONPayload map[string]interface{} `json:"jsonPayload"`
+}
+
+type googleRequest struct {
+	LogName  string `json:"logName"`
+	Resource struct {
+		Type string `json:"type"`
+	} `json:"resource"`
+	Entries []googleEntry `json:"entries"`
+}
+
+// WriteEntries sends entries to Cloud Logging in one request.  Throttled
+// (429) and unavailable (500, 503) responses are retryable.
+func (c *GoogleClient) WriteEntries(entries []Entry) error {
+	req := googleRequest{
+		LogName: fmt.Sprintf("projects/%s/logs/%s", c.config.ProjectID, url.PathEscape(c.config.LogID)),
+	}
+	req.Resource.Type = c.config.ResourceType
+	for _, e := range entries {
+		req.Entries = append(req.Entries, googleEntry{
+			Severity:    e.Severity,
+			Timestamp:   e.Timestamp.UTC().Format(time.RFC3339Nano),
+			JSONPayload: e.Payload,
+		})
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	token, err := c.config.Token()
+	if err != nil {
+		return &RetryableError{fmt.Errorf("GoogleClient: getting token: %s", err)}
+	}
+
+	hreq, err := http.NewRequest("POST", c.config.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	hreq.Header.Set("Authorization", "Bearer "+token)
+	hreq.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.config.HTTPClient.Do(hreq)
+	if err != nil {
+		return &RetryableError{err}
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusInternalServerError || resp.StatusCode == http.StatusServiceUnavailable:
+		return &RetryableError{fmt.Errorf("GoogleClient: %s: %s", resp.Status, bytes.TrimSpace(msg))}
+	}
+	return fmt.Errorf("GoogleClient: %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
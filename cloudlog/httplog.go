@@ -0,0 +1,95 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package cloudlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	l4g "github.com/blackbeans/log4go"
+)
+
+// HTTPConfig says where an HTTPClient posts entries.
+type HTTPConfig struct {
+	// The endpoint, which receives each batch as newline-delimited JSON
+	URL string
+
+	// Optional: headers of every request, such as Authorization, whether to
+	// gzip requests, and the HTTP client to use (default http.DefaultClient)
+	Headers    map[string]string
+	Gzip       bool
+	HTTPClient *http.Client
+}
+
+// An HTTPClient posts entries to an arbitrary endpoint as newline-delimited
+// JSON (application/x-ndjson), one object per entry holding its payload along
+// with its "level" and its "time" in RFC 3339 format.
+type HTTPClient struct {
+	config HTTPConfig
+}
+
+// NewHTTPClient creates a Client for an endpoint taking newline-delimited JSON.
+func NewHTTPClient(config HTTPConfig) *HTTPClient {
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &HTTPClient{config}
+}
+
+// NewHTTPLogWriter creates a new CloudLogWriter which posts records in batches
+// to an endpoint taking newline-delimited JSON.  Batches are sent when
+// config.BatchSize records or config.BatchBytes bytes are waiting, or every
+// config.FlushInterval, and retried with exponential backoff; config.MaxBuffered
+// caps the records held in memory while the endpoint is slow or down.
+func NewHTTPLogWriter(endpoint HTTPConfig, config Config) *BatchWriter {
+	return NewBatchWriter(NewHTTPClient(endpoint), config)
+}
+
+// Severity maps a log4go level to the level of the entries, the name of the
+// level in lower case.
+func (c *HTTPClient) Severity(lvl l4g.Level) string {
+	switch lvl {
+	case l4g.FINEST:
+		return "finest"
+	case l4g.FINE:
+		return "fine"
+	case l4g.DEBUG:
+		return "debug"
+	case l4g.TRACE:
+		return "trace"
+	case l4g.INFO:
+		return "info"
+	case l4g.WARNING:
+		return "warning"
+	case l4g.ERROR:
+		return "error"
+	case l4g.CRITICAL:
+		return "critical"
+	}
+	return strings.ToLower(lvl.String())
+}
+
+// WriteEntries posts entries in one request.  Timed out (408), throttled
+// (429) and server error (5xx) responses are retryable.
+func (c *HTTPClient) WriteEntries(entries []Entry) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, e := range entries {
+		obj := map[string]interface{}{
+			"level": e.Severity,
+			"time":  e.Timestamp.Format(time.RFC3339Nano),
+		}
+		for k, v := range e.Payload {
+			obj[k] = v
+		}
+		if err := enc.Encode(obj); err != nil {
+			return err
+		}
+	}
+
+	return postBatch(c.config.HTTPClient, "HTTPClient", c.config.URL, "application/x-ndjson",
+		c.config.Headers, body.Bytes(), c.config.Gzip, http.StatusRequestTimeout)
+}
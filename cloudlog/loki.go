@@ -0,0 +1,108 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package cloudlog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	l4g "github.com/blackbeans/log4go"
+)
+
+// LokiConfig says where a LokiClient pushes entries and how it labels them.
+type LokiConfig struct {
+	// The push endpoint, as in "http://loki:3100/loki/api/v1/push"
+	URL string
+
+	// Labels of every stream; each entry also gets a "level" label
+	Labels map[string]string
+
+	// Optional: the logging format of the lines (default l4g.FORMAT_DEFAULT),
+	// whether to gzip requests, the tenant sent as X-Scope-OrgID, and the HTTP
+	// client to use (default http.DefaultClient)
+	Format     string
+	Gzip       bool
+	TenantID   string
+	HTTPClient *http.Client
+}
+
+// A LokiClient pushes entries to Grafana Loki with its push API, grouping them
+// into one stream per level.
+type LokiClient struct {
+	config LokiConfig
+}
+
+// NewLokiClient creates a Client for Grafana Loki.
+func NewLokiClient(config LokiConfig) *LokiClient {
+	if len(config.Format) == 0 {
+		config.Format = l4g.FORMAT_DEFAULT
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &LokiClient{config}
+}
+
+// NewLokiLogWriter creates a new CloudLogWriter which pushes records to Grafana
+// Loki.
+func NewLokiLogWriter(loki LokiConfig, config Config) *BatchWriter {
+	return NewBatchWriter(NewLokiClient(loki), config)
+}
+
+// Severity maps a log4go level to the value of the level label, using the
+// names Grafana recognizes.
+func (c *LokiClient) Severity(lvl l4g.Level) string {
+	return severity(lvl)
+}
+
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type lokiRequest struct {
+	Streams []lokiStream `json:"streams"`
+}
+
+// WriteEntries pushes entries to Loki in one request.  Throttled (429) and
+// server error (5xx) responses are retryable.
+func (c *LokiClient) WriteEntries(entries []Entry) error {
+	streams := make(map[string]*lokiStream)
+	for _, e := range entries {
+		s, ok := streams[e.Severity]
+		if !ok {
+			s = &lokiStream{Stream: map[string]string{"level": e.Severity}}
+			for k, v := range c.config.Labels {
+				s.Stream[k] = v
+			}
+			streams[e.Severity] = s
+		}
+		line := fmt.Sprint(e.Payload["message"])
+		if e.Record != nil {
+			line = strings.TrimSuffix(l4g.FormatLogRecord(c.config.Format, e.Record), "\n")
+		}
+		s.Values = append(s.Values, [2]string{strconv.FormatInt(e.Timestamp.UnixNano(), 10), line})
+	}
+
+	var req lokiRequest
+	for _, s := range streams {
+		req.Streams = append(req.Streams, *s)
+	}
+	sort.Slice(req.Streams, func(i, j int) bool {
+		return req.Streams[i].Stream["level"] < req.Streams[j].Stream["level"]
+	})
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+
+	header := make(map[string]string)
+	if len(c.config.TenantID) > 0 {
+		header["X-Scope-OrgID"] = c.config.TenantID
+	}
+	return postBatch(c.config.HTTPClient, "LokiClient", c.config.URL, "application/json", header, body, c.config.Gzip)
+}
@@ -0,0 +1,91 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package cloudlog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	l4g "github.com/blackbeans/log4go"
+)
+
+// An Uploader stores an object in an object store such as S3.  Wrap the
+// store's SDK in one to use an ObjectStoreClient.
+type Uploader interface {
+	// Upload stores body under key.  If the store is throttling requests or
+	// briefly unavailable, the error should be a *RetryableError so that the
+	// batch is uploaded again.
+	Upload(key string, body []byte) error
+}
+
+// ObjectStoreConfig says where an ObjectStoreClient uploads batches.
+type ObjectStoreConfig struct {
+	Uploader Uploader
+
+	// Prepended to the key of every object, such as "logs/my-service/"
+	Prefix string
+}
+
+// An ObjectStoreClient uploads each batch of entries as an object holding one
+// JSON object per line (NDJSON), compressed with gzip.  Objects are keyed by
+// the time of their first entry, as in
+// "<prefix>2006/01/02/150405.000000000-000001.ndjson.gz", so that listing them
+// returns them in order.
+type ObjectStoreClient struct {
+	config ObjectStoreConfig
+
+	// Numbers the objects, keeping keys unique within the process
+	seq uint64
+}
+
+// NewObjectStoreClient creates a Client for an object store.
+func NewObjectStoreClient(config ObjectStoreConfig) *ObjectStoreClient {
+	return &ObjectStoreClient{config: config}
+}
+
+// NewObjectStoreLogWriter creates a new CloudLogWriter which uploads batches of
+// records to an object store.  Set BatchSize, BatchBytes and FlushInterval in
+// config to choose how large the objects get; Close uploads the last, partial
+// batch.
+func NewObjectStoreLogWriter(store ObjectStoreConfig, config Config) *BatchWriter {
+	return NewBatchWriter(NewObjectStoreClient(store), config)
+}
+
+// Severity returns the name of the level as log4go renders it with %L.
+func (c *ObjectStoreClient) Severity(lvl l4g.Level) string {
+	return lvl.String()
+}
+
+// WriteEntries uploads entries as a single object.
+func (c *ObjectStoreClient) WriteEntries(entries []Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	enc := json.NewEncoder(zw)
+	for _, e := range entries {
+		line := map[string]interface{}{
+			"severity":  e.Severity,
+			"timestamp": e.Timestamp.UTC().Format(time.RFC3339Nano),
+		}
+		for k, v := range e.Payload {
+			line[k] = v
+		}
+		if err := enc.Encode(line); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	key := fmt.Sprintf("%s%s-%06d.ndjson.gz", c.config.Prefix,
+		entries[0].Timestamp.UTC().Format("2006/01/02/150405.000000000"), atomic.AddUint64(&c.seq, 1))
+	return c.config.Uploader.Upload(key, body.Bytes())
+}
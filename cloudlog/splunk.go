@@ -0,0 +1,97 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package cloudlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	l4g "github.com/blackbeans/log4go"
+)
+
+// SplunkConfig says where a SplunkClient sends events and how it tags them.
+type SplunkConfig struct {
+	// The event endpoint of the HTTP Event Collector, as in
+	// "https://splunk:8088/services/collector/event"
+	URL string
+
+	// The HEC token, sent as "Authorization: Splunk <token>"
+	Token string
+
+	// Optional: the index, sourcetype, source and host of every event, which
+	// otherwise take the token's defaults
+	Index      string
+	SourceType string
+	Source     string
+	Host       string
+
+	// Optional: whether to gzip requests, and the HTTP client to use (default
+	// http.DefaultClient)
+	Gzip       bool
+	HTTPClient *http.Client
+}
+
+// A SplunkClient sends entries to a Splunk HTTP Event Collector as JSON
+// events, each entry's payload being an event with its severity added.
+type SplunkClient struct {
+	config SplunkConfig
+}
+
+// NewSplunkClient creates a Client for the Splunk HTTP Event Collector.
+func NewSplunkClient(config SplunkConfig) *SplunkClient {
+	if config.HTTPClient == nil {
+		config.HTTPClient = http.DefaultClient
+	}
+	return &SplunkClient{config}
+}
+
+// NewSplunkHECLogWriter creates a new CloudLogWriter which sends records to a
+// Splunk HTTP Event Collector.
+func NewSplunkHECLogWriter(splunk SplunkConfig, config Config) *BatchWriter {
+	return NewBatchWriter(NewSplunkClient(splunk), config)
+}
+
+// Severity maps a log4go level to the severity field of the events.
+func (c *SplunkClient) Severity(lvl l4g.Level) string {
+	return severity(lvl)
+}
+
+type splunkEvent struct {
+	Time       json.Number            `json:"time"`
+	Host       string                 `json:"host,omitempty"`
+	Source     string                 `json:"source,omitempty"`
+	SourceType string                 `json:"sourcetype,omitempty"`
+	Index      string                 `json:"index,omitempty"`
+	Event      map[string]interface{} `json:"event"`
+}
+
+// WriteEntries sends entries to the collector in one request, as a stream of
+// events.  Throttled (429) and server error (5xx) responses, such as the 503
+// of a busy collector, are retryable.
+func (c *SplunkClient) WriteEntries(entries []Entry) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, e := range entries {
+		event := map[string]interface{}{"severity": e.Severity}
+		for k, v := range e.Payload {
+			event[k] = v
+		}
+		ms := e.Timestamp.UnixNano() / 1e6
+		err := enc.Encode(splunkEvent{
+			Time:       json.Number(fmt.Sprintf("%d.%03d", ms/1000, ms%1000)),
+			Host:       c.config.Host,
+			Source:     c.config.Source,
+			SourceType: c.config.SourceType,
+			Index:      c.config.Index,
+			Event:      event,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return postBatch(c.config.HTTPClient, "SplunkClient", c.config.URL, "application/json",
+		map[string]string{"Authorization": "Splunk " + c.config.Token}, body.Bytes(), c.config.Gzip)
+}
@@ -7,8 +7,10 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type xmlProperty struct {
@@ -24,13 +26,28 @@ type xmlFilter struct {
 	Property []xmlProperty `xml:"property"`
 }
 
+type xmlRoute struct {
+	Levels  string `xml:"levels,attr"`
+	Filters string `xml:",chardata"`
+}
+
 type xmlLoggerConfig struct {
 	Filter []xmlFilter `xml:"filter"`
+	Route  []xmlRoute  `xml:"routing>route"`
 }
 
 // Load XML configuration; see examples/example.xml for documentation
+//
+// Loading a configuration into a logger that is already configured reconciles
+// the two: filters missing from the new configuration are closed and removed,
+// new ones are added, and filters whose writer settings are unchanged keep
+// their writer (and open file), taking on their new level and format.
 func (log Logger) LoadConfiguration(filename string) {
-	log.Close()
+	opts := log.options()
+	if opts.config == nil {
+		opts.config = make(map[string]xmlFilter)
+	}
+	seen := make(map[string]bool)
 
 	// Open the configuration file
 	fd, err := os.Open(filename)
@@ -51,9 +68,11 @@ func (log Logger) LoadConfiguration(filename string) {
 		os.Exit(1)
 	}
 
+	// Finish the current run of repeated records while its filter is open
+	log.flushDedup()
+
 	for _, xmlfilt := range xc.Filter {
 		var filt LogWriter
-		var lvl level
 		bad, good, enabled := false, true, false
 
 		// Check required children
@@ -76,24 +95,8 @@ func (log Logger) LoadConfiguration(filename string) {
 			bad = true
 		}
 
-		switch xmlfilt.Level {
-		case "FINEST":
-			lvl = FINEST
-		case "FINE":
-			lvl = FINE
-		case "DEBUG":
-			lvl = DEBUG
-		case "TRACE":
-			lvl = TRACE
-		case "INFO":
-			lvl = INFO
-		case "WARNING":
-			lvl = WARNING
-		case "ERROR":
-			lvl = ERROR
-		case "CRITICAL":
-			lvl = CRITICAL
-		default:
+		lvl, err := LevelFromString(xmlfilt.Level)
+		if err != nil && len(xmlfilt.Level) > 0 {
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required child <%s> for filter has unknown value in %s: %s\n", "level", filename, xmlfilt.Level)
 			bad = true
 		}
@@ -103,7 +106,28 @@ func (log Logger) LoadConfiguration(filename string) {
 			os.Exit(1)
 		}
 
-		file := "./logs/"
+		// Keep the writer of a filter which only changed its level or format
+		if old, ok := log[xmlfilt.Tag]; ok && enabled && sameWriterConfig(opts.config[xmlfilt.Tag], xmlfilt) {
+			if flw, ok := old.LogWriter.(*FileLogWriter); ok && xmlfilt.Type == "file" {
+				flw.Reformat(xmlFileFormat(xmlfilt.Property))
+			}
+			if clw, ok := old.LogWriter.(ConsoleLogWriter); ok && xmlfilt.Type == "console" {
+				clw.Reformat(xmlConsoleFormat(xmlfilt.Property))
+			}
+			old.Level = lvl
+			opts.config[xmlfilt.Tag] = xmlfilt
+			seen[xmlfilt.Tag] = true
+			continue
+		}
+
+		// Replace the writer of a filter whose settings changed, closing it
+		// first so that it is done with its file
+		if old, ok := log[xmlfilt.Tag]; ok && enabled {
+			closeWriter(old.LogWriter)
+			delete(log, xmlfilt.Tag)
+		}
+
+		file := ""
 		switch xmlfilt.Type {
 		case "console":
 			filt, good = xmlToConsoleLogWriter(filename, xmlfilt.Property, enabled)
@@ -111,8 +135,14 @@ func (log Logger) LoadConfiguration(filename string) {
 			filt, file, good = xmlToFileLogWriter(filename, xmlfilt.Property, enabled)
 		case "xml":
 			filt, file, good = xmlToXMLLogWriter(filename, xmlfilt.Property, enabled)
+		case "json":
+			filt, file, good = xmlToJSONLogWriter(filename, xmlfilt.Property, enabled)
 		case "socket":
 			filt, good = xmlToSocketLogWriter(filename, xmlfilt.Property, enabled)
+		case "syslog":
+			filt, good = xmlToSyslogLogWriter(filename, xmlfilt.Property, enabled)
+		case "null":
+			filt, good = xmlToNullLogWriter(filename, xmlfilt.Property, enabled)
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not load XML configuration in %s: unknown filter type \"%s\"\n", filename, xmlfilt.Type)
 			os.Exit(1)
@@ -129,13 +159,146 @@ func (log Logger) LoadConfiguration(filename string) {
 		}
 
 		log[xmlfilt.Tag] = &Filter{lvl, file, filt}
+		opts.config[xmlfilt.Tag] = xmlfilt
+		seen[xmlfilt.Tag] = true
+	}
+
+	// Remove the filters that are no longer configured
+	for tag, filt := range log {
+		if !seen[tag] {
+			closeWriter(filt.LogWriter)
+			delete(log, tag)
+			delete(opts.config, tag)
+		}
+	}
+
+	log.SetRoutes(xmlToRoutes(filename, xc)...)
+}
+
+// xmlToRoutes parses the <routing> section, whose routes name their levels as
+// "FINEST-INFO" or "CRITICAL" and list the tags of their filters, separated by
+// commas.  Routes may name disabled filters, which receive nothing.
+func xmlToRoutes(filename string, xc *xmlLoggerConfig) []Route {
+	tags := make(map[string]bool)
+	for _, xmlfilt := range xc.Filter {
+		tags[xmlfilt.Tag] = true
+	}
+
+	var routes []Route
+	bad := false
+	for _, xmlroute := range xc.Route {
+		min, max, err := parseRouteLevels(xmlroute.Levels)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid levels %q for route in %s: %s\n", xmlroute.Levels, filename, err)
+			bad = true
+			continue
+		}
+
+		r := Route{Min: min, Max: max}
+		for _, tag := range strings.Split(xmlroute.Filters, ",") {
+			tag = strings.TrimSpace(tag)
+			if len(tag) == 0 {
+				continue
+			}
+			if !tags[tag] {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Route for %s names unknown filter %q in %s\n", xmlroute.Levels, tag, filename)
+				bad = true
+			}
+			r.Filters = append(r.Filters, tag)
+		}
+		routes = append(routes, r)
 	}
+
+	// Just so all of the bad routes are errored at the same time
+	if bad {
+		os.Exit(1)
+	}
+	return routes
+}
+
+// sameWriterConfig reports whether two configurations of a filter describe the
+// same writer, differing at most in level and format.
+func sameWriterConfig(a, b xmlFilter) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	props := func(f xmlFilter) map[string]string {
+		m := make(map[string]string)
+		for _, prop := range f.Property {
+			if prop.Name != "format" {
+				m[prop.Name] = strings.Trim(prop.Value, " \r\n")
+			}
+		}
+		return m
+	}
+	return reflect.DeepEqual(props(a), props(b))
+}
+
+// xmlFileFormat returns the format property of a file filter.
+func xmlFileFormat(props []xmlProperty) string {
+	format := FORMAT_DEFAULT
+	for _, prop := range props {
+		if prop.Name == "format" {
+			format = strings.Trim(prop.Value, " \r\n")
+		}
+	}
+	return format
+}
+
+// xmlConsoleFormat returns the format property of a console filter, or "" for
+// the console's own layout.
+func xmlConsoleFormat(props []xmlProperty) string {
+	format := ""
+	for _, prop := range props {
+		if prop.Name == "format" {
+			format = strings.Trim(prop.Value, " \r\n")
+		}
+	}
+	return format
+}
+
+// xmlFormatter returns the formatter named by a formatter property: "logfmt"
+// or "json".
+func xmlFormatter(name string) (Formatter, error) {
+	switch name {
+	case "logfmt":
+		return LogfmtFormatter{}, nil
+	case "json":
+		return JSONFormatter{}, nil
+	}
+	return nil, fmt.Errorf("unknown formatter %q", name)
 }
 
 func xmlToConsoleLogWriter(filename string, props []xmlProperty, enabled bool) (ConsoleLogWriter, bool) {
+	var formatter Formatter
+	format := ""
+	target := "stdout"
+	stderrlevel := ""
+
 	// Parse properties
 	for _, prop := range props {
 		switch prop.Name {
+		case "format":
+			format = strings.Trim(prop.Value, " \r\n")
+		case "target":
+			target = strings.Trim(prop.Value, " \r\n")
+			if target != "stdout" && target != "stderr" {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not parse property \"%s\" for console filter in %s: unknown target %q\n", prop.Name, filename, target)
+				return nil, false
+			}
+		case "stderrlevel":
+			stderrlevel = strings.Trim(prop.Value, " \r\n")
+			if _, err := LevelFromString(stderrlevel); err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not parse property \"%s\" for console filter in %s: %s\n", prop.Name, filename, err)
+				return nil, false
+			}
+		case "formatter":
+			f, err := xmlFormatter(strings.Trim(prop.Value, " \r\n"))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not parse property \"%s\" for console filter in %s: %s\n", prop.Name, filename, err)
+				return nil, false
+			}
+			formatter = f
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for console filter in %s\n", prop.Name, filename)
 		}
@@ -146,14 +309,42 @@ func xmlToConsoleLogWriter(filename string, props []xmlProperty, enabled bool) (
 		return nil, true
 	}
 
-	return NewConsoleLogWriter(), true
+	var clw ConsoleLogWriter
+	if target == "stderr" {
+		out := stderr
+		if out == nil {
+			out = os.Stderr
+		}
+		clw = NewConsoleLogWriterTo(out)
+	} else {
+		clw = NewConsoleLogWriter()
+	}
+	if len(stderrlevel) > 0 {
+		lvl, _ := LevelFromString(stderrlevel)
+		clw.SetStderrLevel(lvl)
+	}
+	return clw.SetFormat(format).SetFormatter(formatter), true
+}
+
+// The write error policies of the "writeerror" property of file filters
+var writeErrorPolicies = map[string]WriteErrorPolicy{
+	"stop":   WriteErrorStop,
+	"retry":  WriteErrorRetry,
+	"stderr": WriteErrorStderr,
 }
 
 // Parse a number with K/M/G suffixes based on thousands (1000) or 2^10 (1024)
 func strToNumSuffix(str string, mult int) int {
+	parsed, _ := parseNumSuffix(str, mult)
+	return parsed
+}
+
+// parseNumSuffix is strToNumSuffix, reporting a number that does not parse.
+func parseNumSuffix(str string, mult int) (int, error) {
 	num := 1
-	if len(str) > 1 {
-		switch str[len(str)-1] {
+	digits := str
+	if len(digits) > 1 {
+		switch digits[len(digits)-1] {
 		case 'G', 'g':
 			num *= mult
 			fallthrough
@@ -162,35 +353,132 @@ func strToNumSuffix(str string, mult int) int {
 			fallthrough
 		case 'K', 'k':
 			num *= mult
-			str = str[0 : len(str)-1]
+			digits = digits[0 : len(digits)-1]
+		}
+	}
+	parsed, err := strconv.Atoi(digits)
+	if err != nil {
+		return 0, fmt.Errorf("bad number %q", str)
+	}
+	return parsed * num, nil
+}
+
+// The properties shared by the file, xml and json filters
+type fileProperties struct {
+	daily, rotate         bool
+	maxsize, buffer       int
+	flushinterval, maxage time.Duration
+	schedule              string
+	errpolicy             WriteErrorPolicy
+	syncmode              SyncMode
+	syncinterval          time.Duration
+}
+
+// applyFileProperty parses prop into p if it is one of the properties shared
+// by the file-based filters, reporting whether it is, and the error if its
+// value does not parse.
+func applyFileProperty(p *fileProperties, prop xmlProperty) (bool, error) {
+	value := strings.Trim(prop.Value, " \r\n")
+	switch prop.Name {
+	case "maxsize":
+		p.maxsize = strToNumSuffix(value, 1024)
+	case "daily":
+		p.daily = value != "false"
+	case "rotate":
+		p.rotate = value != "false"
+	case "buffer":
+		p.buffer = strToNumSuffix(value, 1024)
+	case "flushinterval":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return true, err
 		}
+		p.flushinterval = d
+	case "maxage":
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return true, err
+		}
+		p.maxage = d
+	case "sync":
+		switch value {
+		case "never":
+			p.syncmode = SyncNever
+		case "write":
+			p.syncmode = SyncEveryWrite
+		default:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return true, err
+			}
+			p.syncmode, p.syncinterval = SyncInterval, d
+		}
+	case "writeerror":
+		policy, ok := writeErrorPolicies[value]
+		if !ok {
+			return true, fmt.Errorf("unknown policy %q", prop.Value)
+		}
+		p.errpolicy = policy
+	case "schedule":
+		if _, err := ParseSchedule(value); err != nil {
+			return true, err
+		}
+		p.schedule = value
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// setUp configures w with the properties.
+func (p *fileProperties) setUp(w *FileLogWriter) {
+	w.SetRotateSize(p.maxsize)
+	w.SetBufferSize(p.buffer)
+	w.SetFlushInterval(p.flushinterval)
+	w.SetMaxAge(p.maxage)
+	if len(p.schedule) > 0 {
+		w.SetRotateSchedule(p.schedule)
+	}
+	w.SetWriteErrorPolicy(p.errpolicy)
+	if p.syncmode == SyncInterval {
+		w.SetSyncInterval(p.syncinterval)
+	} else {
+		w.SetSync(p.syncmode)
 	}
-	parsed, _ := strconv.Atoi(str)
-	return parsed * num
 }
+
 func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*FileLogWriter, string, bool) {
 	file := ""
 	format := "[%D %T] [%L] (%S) %M"
 	maxlines := 0
-	maxsize := 0
-	daily := false
-	rotate := false
+	var shared fileProperties
+	symlink := ""
+	var formatter Formatter
 
 	// Parse properties
 	for _, prop := range props {
+		if ok, err := applyFileProperty(&shared, prop); err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not parse property \"%s\" for file filter in %s: %s\n", prop.Name, filename, err)
+			return nil, file, false
+		} else if ok {
+			continue
+		}
 		switch prop.Name {
 		case "filename":
 			file = strings.Trim(prop.Value, " \r\n")
 		case "format":
 			format = strings.Trim(prop.Value, " \r\n")
+		case "formatter":
+			f, err := xmlFormatter(strings.Trim(prop.Value, " \r\n"))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not parse property \"%s\" for file filter in %s: %s\n", prop.Name, filename, err)
+				return nil, file, false
+			}
+			formatter = f
 		case "maxlines":
 			maxlines = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1000)
-		case "maxsize":
-			maxsize = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1024)
-		case "daily":
-			daily = strings.Trim(prop.Value, " \r\n") != "false"
-		case "rotate":
-			rotate = strings.Trim(prop.Value, " \r\n") != "false"
+		case "symlink":
+			symlink = strings.Trim(prop.Value, " \r\n")
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for file filter in %s\n", prop.Name, filename)
 		}
@@ -207,33 +495,41 @@ func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*Fi
 		return nil, file, true
 	}
 
-	flw := NewFileLogWriter(file, rotate, daily)
+	// A filename with date codes names a dated file
+	var flw *FileLogWriter
+	if strings.ContainsAny(file, "%{") {
+		flw = NewDatedFileLogWriter(file, shared.rotate)
+	} else {
+		flw = NewFileLogWriter(file, shared.rotate, shared.daily)
+	}
 	flw.SetFormat(format)
+	flw.SetFormatter(formatter)
 	flw.SetRotateLines(maxlines)
-	flw.SetRotateSize(maxsize)
+	shared.setUp(flw)
+	if len(symlink) > 0 {
+		flw.SetSymlink(symlink)
+	}
 	return flw, file, true
 }
 
 func xmlToXMLLogWriter(filename string, props []xmlProperty, enabled bool) (*FileLogWriter, string, bool) {
 	file := ""
 	maxrecords := 0
-	maxsize := 0
-	daily := false
-	rotate := false
+	var shared fileProperties
 
 	// Parse properties
 	for _, prop := range props {
+		if ok, err := applyFileProperty(&shared, prop); err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not parse property \"%s\" for xml filter in %s: %s\n", prop.Name, filename, err)
+			return nil, file, false
+		} else if ok {
+			continue
+		}
 		switch prop.Name {
 		case "filename":
 			file = strings.Trim(prop.Value, " \r\n")
 		case "maxrecords":
 			maxrecords = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1000)
-		case "maxsize":
-			maxsize = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1024)
-		case "daily":
-			daily = strings.Trim(prop.Value, " \r\n") != "false"
-		case "rotate":
-			rotate = strings.Trim(prop.Value, " \r\n") != "false"
 		default:
 			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for xml filter in %s\n", prop.Name, filename)
 		}
@@ -250,12 +546,52 @@ func xmlToXMLLogWriter(filename string, props []xmlProperty, enabled bool) (*Fil
 		return nil, file, true
 	}
 
-	xlw := NewXMLLogWriter(file, rotate, daily)
+	xlw := NewXMLLogWriter(file, shared.rotate, shared.daily)
 	xlw.SetRotateLines(maxrecords)
-	xlw.SetRotateSize(maxsize)
+	shared.setUp(xlw)
 	return xlw, file, true
 }
 
+func xmlToJSONLogWriter(filename string, props []xmlProperty, enabled bool) (*FileLogWriter, string, bool) {
+	file := ""
+	maxlines := 0
+	var shared fileProperties
+
+	// Parse properties
+	for _, prop := range props {
+		if ok, err := applyFileProperty(&shared, prop); err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not parse property \"%s\" for json filter in %s: %s\n", prop.Name, filename, err)
+			return nil, file, false
+		} else if ok {
+			continue
+		}
+		switch prop.Name {
+		case "filename":
+			file = strings.Trim(prop.Value, " \r\n")
+		case "maxlines":
+			maxlines = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1000)
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for json filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if len(file) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for json filter missing in %s\n", "filename", filename)
+		return nil, file, false
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, file, true
+	}
+
+	jlw := NewJSONLogWriter(file, shared.rotate, shared.daily)
+	jlw.SetRotateLines(maxlines)
+	shared.setUp(jlw)
+	return jlw, file, true
+}
+
 func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (SocketLogWriter, bool) {
 	endpoint := ""
 	protocol := "udp"
@@ -285,3 +621,72 @@ func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (S
 
 	return NewSocketLogWriter(protocol, endpoint), true
 }
+
+func xmlToNullLogWriter(filename string, props []xmlProperty, enabled bool) (LogWriter, bool) {
+	// It has no properties
+	for _, prop := range props {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for null filter in %s\n", prop.Name, filename)
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	return NewNullLogWriter(), true
+}
+
+func xmlToSyslogLogWriter(filename string, props []xmlProperty, enabled bool) (LogWriter, bool) {
+	facility := LOG_USER
+	tag := ""
+	format := "%M"
+	endpoint := ""
+	protocol := "tcp"
+	hostname := ""
+
+	// Parse properties
+	for _, prop := range props {
+		switch prop.Name {
+		case "facility":
+			f, err := SyslogFacilityFromString(strings.Trim(prop.Value, " \r\n"))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not parse property \"%s\" for syslog filter in %s: %s\n", prop.Name, filename, err)
+				return nil, false
+			}
+			facility = f
+		case "tag", "appname":
+			tag = strings.Trim(prop.Value, " \r\n")
+		case "format":
+			format = strings.Trim(prop.Value, " \r\n")
+		case "endpoint":
+			endpoint = strings.Trim(prop.Value, " \r\n")
+		case "protocol":
+			protocol = strings.Trim(prop.Value, " \r\n")
+		case "hostname":
+			hostname = strings.Trim(prop.Value, " \r\n")
+		default:
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for syslog filter in %s\n", prop.Name, filename)
+		}
+	}
+
+	// Check properties
+	if protocol != "tcp" && protocol != "tls" {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Property \"%s\" for syslog filter must be tcp or tls in %s\n", "protocol", filename)
+		return nil, false
+	}
+
+	// If it's disabled, we're just checking syntax
+	if !enabled {
+		return nil, true
+	}
+
+	// Without an endpoint, records go to the local daemon
+	if len(endpoint) == 0 {
+		return NewSyslogLogWriter(facility, tag).SetFormat(format), true
+	}
+	slw := NewSyslogNetWriter(protocol, endpoint, facility, tag).SetFormat(format)
+	if len(hostname) > 0 {
+		slw.SetHostname(hostname)
+	}
+	return slw, true
+}
@@ -0,0 +1,104 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"time"
+)
+
+// SetGlobalDedup collapses runs of identical consecutive records (same level,
+// source and message) logged within window of the first record of the run: the
+// first is written, and once the run ends, a record saying how many times it
+// was repeated follows.  It applies to every filter of the logger.  A window of
+// 0 turns deduplication off.  Returns the logger for chaining.
+func (log Logger) SetGlobalDedup(window time.Duration) Logger {
+	opts := log.options()
+	opts.dedupMu.Lock()
+	opts.dedupWindow = window
+	opts.dedupMu.Unlock()
+	if window <= 0 {
+		log.flushDedup()
+	}
+	return log
+}
+
+// dispatch hands rec to the filter l, unless the logger is paused or rec
+// repeats the previous record.
+func (log Logger) dispatch(l *Filter, rec *LogRecord) {
+	opts := log.lookupOptions()
+	if opts == nil {
+		l.LogWrite(rec)
+		return
+	}
+	opts.applySource(rec)
+	if opts.hold(l, rec) {
+		return
+	}
+	opts.deliver(l, rec)
+}
+
+// deliver hands rec to the filter l, unless it repeats the previous record.
+// What to write is decided with dedupMu held, and written once it is released,
+// so that a slow writer holds up only the goroutines logging to it.
+func (opts *loggerOptions) deliver(l *Filter, rec *LogRecord) {
+	opts.dedupMu.Lock()
+	if opts.dedupWindow <= 0 {
+		opts.dedupMu.Unlock()
+		l.LogWrite(rec)
+		return
+	}
+
+	if last := opts.dedupLast; last != nil && l == opts.dedupFilter &&
+		rec.Level == last.Level && rec.Source == last.Source && rec.Message == last.Message &&
+		rec.Created.Sub(last.Created) < opts.dedupWindow {
+		opts.dedupRepeats++
+		opts.dedupMu.Unlock()
+		return
+	}
+
+	repeats, filt := opts.takeRepeats()
+	opts.dedupLast, opts.dedupFilter = rec, l
+	opts.dedupMu.Unlock()
+
+	if repeats != nil {
+		filt.LogWrite(repeats)
+	}
+	l.LogWrite(rec)
+}
+
+// flushDedup writes the repeat count of the current run of records, if any,
+// and forgets the run.  It must be called before the filter of the run may be
+// closed.
+func (log Logger) flushDedup() {
+	opts := log.lookupOptions()
+	if opts == nil {
+		return
+	}
+	opts.dedupMu.Lock()
+	repeats, filt := opts.takeRepeats()
+	opts.dedupLast, opts.dedupFilter = nil, nil
+	opts.dedupMu.Unlock()
+
+	if repeats != nil {
+		filt.LogWrite(repeats)
+	}
+}
+
+// takeRepeats returns a record counting the repeats of the last record, and
+// the filter to write it to, or nil if it was not repeated, and starts the
+// count again.  It must be called with dedupMu held.
+func (opts *loggerOptions) takeRepeats() (*LogRecord, *Filter) {
+	if opts.dedupRepeats == 0 {
+		return nil, nil
+	}
+	last := opts.dedupLast
+	rec := &LogRecord{
+		Level:   last.Level,
+		Created: timeNow(),
+		Source:  last.Source,
+		Message: fmt.Sprintf("last message repeated %d times", opts.dedupRepeats),
+	}
+	opts.dedupRepeats = 0
+	return rec, opts.dedupFilter
+}
@@ -0,0 +1,139 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This log writer writes each record twice: as a formatted line to a text
+// file and as a JSON object to a second file.  Both files are rotated together
+// so that they always cover the same records.
+type DualFormatFileWriter struct {
+	mu   sync.Mutex
+	text *FileLogWriter
+	json *FileLogWriter
+
+	// The logging format of the text file
+	format string
+
+	// Rotate at linecount
+	maxlines          int
+	maxlines_curlines int
+
+	// Rotate at size of the text file
+	maxsize         int
+	maxsize_cursize int
+
+	// Rotate daily
+	daily            bool
+	daily_nextrotate time.Time
+}
+
+// NewDualFormatFileWriter creates a new LogWriter which writes records in the
+// given format to textname and as JSON to jsonname.  Rotation behaves as for
+// NewFileLogWriter, except that the decision to rotate is made once for both
+// files: the files never rotate of their own accord, only when the dual writer
+// rotates them.
+func NewDualFormatFileWriter(textname, jsonname, format string, rotate bool, daily bool) *DualFormatFileWriter {
+	return &DualFormatFileWriter{
+		text:             NewFileLogWriter(textname, false, false).SetRotate(rotate).SetFormat("%M"),
+		json:             NewFileLogWriter(jsonname, false, false).SetRotate(rotate).SetFormat("%M"),
+		format:           format,
+		daily:            daily,
+		daily_nextrotate: nextMidnight(timeNow()),
+	}
+}
+
+// This is the DualFormatFileWriter's output method
+func (w *DualFormatFileWriter) LogWrite(rec *LogRecord) {
+	js, err := json.Marshal(rec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DualFormatFileWriter(%q): %s\n", w.json.filename, err)
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	text := strings.TrimSuffix(FormatLogRecord(w.format, rec), "\n")
+
+	at := rec.Created
+	if at.IsZero() {
+		at = timeNow()
+	}
+	if (w.maxlines > 0 && w.maxlines_curlines >= w.maxlines) ||
+		(w.maxsize > 0 && w.maxsize_cursize >= w.maxsize) ||
+		(w.daily && !at.Before(w.daily_nextrotate)) {
+		w.intRotate()
+	}
+
+	w.text.LogWrite(&LogRecord{Level: rec.Level, Created: rec.Created, Source: rec.Source, Message: text})
+	w.json.LogWrite(&LogRecord{Level: rec.Level, Created: rec.Created, Source: rec.Source, Message: string(js)})
+
+	w.maxlines_curlines++
+	w.maxsize_cursize += len(text) + 1
+}
+
+// Close closes both files.
+func (w *DualFormatFileWriter) Close() {
+	w.CloseErr()
+}
+
+// CloseErr closes both files, waiting for their remaining records to be
+// written, and returns the first error that kept records from either file.
+func (w *DualFormatFileWriter) CloseErr() error {
+	err := closeWriter(w.text)
+	if jerr := closeWriter(w.json); err == nil {
+		err = jerr
+	}
+	return err
+}
+
+// Reformat changes the logging format of the text file, starting with the next
+// record.
+func (w *DualFormatFileWriter) Reformat(format string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.format = format
+}
+
+// Request that both logs rotate
+func (w *DualFormatFileWriter) Rotate() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.intRotate()
+}
+
+// intRotate rotates both files once everything already written to them is
+// out, so the rotation falls between the same two records in each.  It must be
+// called with w.mu held.
+func (w *DualFormatFileWriter) intRotate() {
+	w.text.Flush()
+	w.json.Flush()
+	w.text.Rotate()
+	w.json.Rotate()
+
+	w.maxlines_curlines = 0
+	w.maxsize_cursize = 0
+	w.daily_nextrotate = nextMidnight(timeNow())
+}
+
+// Set rotate at linecount (chainable). Must be called before the first log
+// message is written.
+func (w *DualFormatFileWriter) SetRotateLines(maxlines int) *DualFormatFileWriter {
+	w.maxlines = maxlines
+	return w
+}
+
+// Set rotate at the size of the text file (chainable). Must be called before
+// the first log message is written.
+func (w *DualFormatFileWriter) SetRotateSize(maxsize int) *DualFormatFileWriter {
+	w.maxsize = maxsize
+	return w
+}
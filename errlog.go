@@ -0,0 +1,179 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// LogError logs msg and err at the given level.  The message reads "msg: err"
+// for text output, while the record also carries the message of every error in
+// err's chain of wrapped errors and, if one of them has a StackTrace method (as
+// the errors of github.com/pkg/errors do), the stack trace it captured.  JSON
+// output includes both.
+func (log Logger) LogError(lvl Level, err error, msg string) {
+	countLevel(lvl)
+
+	l, ok := log.getLogger(logName(lvl), lvl)
+	if !ok || lvl < l.Level || !log.sampled(lvl) || !log.withinRate(lvl) {
+		return
+	}
+
+	rec := &LogRecord{
+		Level:   lvl,
+		Created: timeNow(),
+		Seq:     log.nextSeq(),
+		Message: msg,
+	}
+	if err != nil {
+		if len(msg) > 0 {
+			rec.Message = msg + ": " + err.Error()
+		} else {
+			rec.Message = err.Error()
+		}
+		rec.ErrorChain = errorChain(err)
+		rec.Stack = errorStack(err)
+	}
+	if log.wantsSource(lvl) {
+		rec.setCaller(1)
+	}
+
+	// Dispatch the logs
+	log.dispatch(l, rec)
+}
+
+// RecoverAndLog logs a panic in progress as a CRITICAL record and waits for
+// the writer to write it out.  Defer it at the top of a function or goroutine:
+//
+//	defer log.RecoverAndLog(false)
+//
+// The record's message reads "panic: " followed by the panic value, its source
+// is where the panic happened, and it carries the stack of the panicking
+// goroutine (and the error chain, if the value is an error).  If rethrow is
+// set, the panic then continues with the same value; otherwise the function
+// returns normally.  It does nothing if there is no panic.
+func (log Logger) RecoverAndLog(rethrow bool) {
+	if r := recover(); r != nil {
+		log.logPanic(r, rethrow)
+	}
+}
+
+// logPanic logs the recovered value r for RecoverAndLog, which must be its
+// caller, and panics again with it if rethrow is set.
+func (log Logger) logPanic(r interface{}, rethrow bool) {
+	const lvl = CRITICAL
+	countLevel(lvl)
+
+	// Rate limits and sampling are not applied, a panic is always worth a record
+	if l, ok := log.getLogger(logName(lvl), lvl); ok && lvl >= l.Level {
+		rec := &LogRecord{
+			Level:   lvl,
+			Created: timeNow(),
+			Seq:     log.nextSeq(),
+			Message: fmt.Sprintf("panic: %v", r),
+		}
+		if err, ok := r.(error); ok {
+			rec.ErrorChain = errorChain(err)
+		}
+		rec.setPanicStack(3)
+		log.dispatch(l, rec)
+
+		switch w := l.LogWriter.(type) {
+		case Flusher:
+			w.Flush()
+		case Syncer:
+			if err := w.Sync(); err != nil {
+				fmt.Fprintf(os.Stderr, "RecoverAndLog: %s\n", err)
+			}
+		}
+	}
+
+	if rethrow {
+		panic(r)
+	}
+}
+
+// setPanicStack sets the stack of rec to that of the panicking goroutine,
+// leaving out the skip innermost frames and the runtime's own panic handling,
+// and its caller to the function that panicked.
+func (rec *LogRecord) setPanicStack(skip int) {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(skip+1, pcs)])
+	for {
+		frame, more := frames.Next()
+		if len(rec.Stack) > 0 || !strings.HasPrefix(frame.Function, "runtime.") {
+			if len(rec.Stack) == 0 {
+				rec.Func, rec.File, rec.Line = frame.Function, frame.File, frame.Line
+				rec.Source = fmt.Sprintf("%s:%d", trimSourcePrefix(frame.Function), frame.Line)
+			}
+			rec.Stack = append(rec.Stack, fmt.Sprintf("%s %s:%d", frame.Function, frame.File, frame.Line))
+		}
+		if !more {
+			break
+		}
+	}
+}
+
+// errorChain returns the message of each error in err's chain, outermost
+// first.  The text an error repeats from the error it wraps is left out, so
+// each entry only holds what its own layer added.
+func errorChain(err error) []string {
+	var chain []string
+	for err != nil {
+		text := err.Error()
+		inner := errors.Unwrap(err)
+		if inner != nil {
+			text = strings.TrimSuffix(text, ": "+inner.Error())
+		}
+		chain = append(chain, text)
+		err = inner
+	}
+	return chain
+}
+
+// errorStack returns the stack trace of the innermost error in err's chain with
+// a StackTrace method returning program counters, one "func file:line" entry
+// per frame, or nil if there is none.
+func errorStack(err error) []string {
+	var stack []string
+	for ; err != nil; err = errors.Unwrap(err) {
+		if pcs := stackTracePCs(err); pcs != nil {
+			stack = stack[:0]
+			for _, pc := range pcs {
+				// Like the pcs from runtime.Callers, each is just past its call
+				fn := runtime.FuncForPC(pc - 1)
+				if fn == nil {
+					stack = append(stack, "unknown")
+					continue
+				}
+				file, line := fn.FileLine(pc - 1)
+				stack = append(stack, fmt.Sprintf("%s %s:%d", fn.Name(), file, line))
+			}
+		}
+	}
+	return stack
+}
+
+// stackTracePCs calls the StackTrace method of err, if it has one returning a
+// slice of program counters, such as github.com/pkg/errors.StackTrace.
+func stackTracePCs(err error) []uintptr {
+	m := reflect.ValueOf(err).MethodByName("StackTrace")
+	if !m.IsValid() || m.Type().NumIn() != 0 || m.Type().NumOut() != 1 {
+		return nil
+	}
+	if out := m.Type().Out(0); out.Kind() != reflect.Slice || out.Elem().Kind() != reflect.Uintptr {
+		return nil
+	}
+
+	frames := m.Call(nil)[0]
+	pcs := make([]uintptr, frames.Len())
+	for i := range pcs {
+		pcs[i] = uintptr(frames.Index(i).Uint())
+	}
+	return pcs
+}
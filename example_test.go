@@ -0,0 +1,90 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/blackbeans/log4go"
+)
+
+func ExampleLogger_Info() {
+	// Stamp every record with the same time so the output can be checked
+	log4go.SetDeterministic(true)
+	defer log4go.SetDeterministic(false)
+
+	log := make(log4go.Logger)
+	log.AddFilter("stdout", log4go.INFO, log4go.NewConsoleLogWriter())
+	log.Info("The time is now: %s", "noon")
+	log.Debug("Below the level of the filter")
+	log.Warn("%d of %d disks are full", 1, 3)
+
+	// Closing the logger waits for the console writer to catch up
+	log.Close()
+	// Output:
+	// [01/01/00 00:00:00] [INFO] The time is now: noon
+	// [01/01/00 00:00:00] [WARN] 1 of 3 disks are full
+}
+
+func ExampleLogger_LogObject() {
+	log4go.SetDeterministic(true)
+	defer log4go.SetDeterministic(false)
+
+	type login struct {
+		User   string `json:"user"`
+		Remote string `json:"remote"`
+	}
+
+	log := make(log4go.Logger)
+	log.AddWriter("audit", log4go.INFO, os.Stdout, "[%L] %M")
+	log.LogObject(log4go.INFO, "audit", login{User: "ann", Remote: "10.0.0.7"})
+	log.LogCategory("audit", log4go.WARNING, "%d failed logins", 3)
+	// Output:
+	// [INFO] {"user":"ann","remote":"10.0.0.7"}
+	// [WARN] 3 failed logins
+}
+
+func ExampleNewFileLogWriter() {
+	log4go.SetDeterministic(true)
+	defer log4go.SetDeterministic(false)
+
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+
+	log := make(log4go.Logger)
+	log.AddFilter("stdout", log4go.INFO, log4go.NewFileLogWriter(fname, false, false).SetFormat("[%D %T] [%L] %M"))
+	log.Info("opened %s", "app.log")
+	log.Error("disk %d%% full", 91)
+
+	// Closing the logger waits for the file to be written
+	log.Close()
+	contents, _ := ioutil.ReadFile(fname)
+	fmt.Print(string(contents))
+	// Output:
+	// [2000/01/01 00:00:00 UTC] [INFO] opened app.log
+	// [2000/01/01 00:00:00 UTC] [EROR] disk 91% full
+}
+
+func ExampleNewWriterLog() {
+	var buf bytes.Buffer
+
+	log := make(log4go.Logger)
+	log.AddFilter("stdout", log4go.INFO, log4go.NewWriterLog(&buf, "[%L] %M"))
+	log.Info("cache warmed in %dms", 42)
+	log.Warn("cache %d%% full", 97)
+
+	// Each record is in the buffer as soon as it is logged
+	fmt.Print(buf.String())
+	// Output:
+	// [INFO] cache warmed in 42ms
+	// [WARN] cache 97% full
+}
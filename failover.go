@@ -0,0 +1,175 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How often a FailoverLogWriter tries the writers it has failed over from,
+// unless set otherwise
+const failoverProbeInterval = 10 * time.Second
+
+// This log writer writes to a primary writer, such as a SocketLogWriter, and
+// fails over to the next of its secondaries, such as a local file, while the
+// primary is down.
+type FailoverLogWriter struct {
+	mu sync.Mutex
+
+	// The writers in order of preference, the one in use, and those that
+	// panicked the last time they were written to
+	writers []LogWriter
+	active  int
+	failed  []bool
+
+	// When to try the preferred writers again while failed over
+	probeinterval time.Duration
+	probeAt       time.Time
+
+	// Records no writer could take
+	dropped uint64
+}
+
+// NewFailoverLogWriter creates a new LogWriter which hands each record to
+// primary while it is working, and otherwise to the first working one of
+// secondaries.  A writer is down while it reports so, through Good or Err, or
+// once it panics writing a record.  While failed over, the preferred writers
+// are also handed a record every ten seconds, to let them find out whether they
+// work again; the writer goes back to the first that reports it does.  Records
+// that arrive while every writer is down are dropped.
+func NewFailoverLogWriter(primary LogWriter, secondaries ...LogWriter) *FailoverLogWriter {
+	writers := append([]LogWriter{primary}, secondaries...)
+	return &FailoverLogWriter{
+		writers:       writers,
+		failed:        make([]bool, len(writers)),
+		probeinterval: failoverProbeInterval,
+	}
+}
+
+// This is the FailoverLogWriter's output method
+func (w *FailoverLogWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := timeNow()
+	probe := w.active > 0 && !now.Before(w.probeAt)
+	if probe {
+		w.probeAt = now.Add(w.probeinterval)
+	}
+
+	for i, child := range w.writers {
+		if i < w.active && !w.healthy(i) {
+			// Hand a preferred writer that is down the record anyway, now
+			// and then, so that it can recover
+			if probe && w.write(i, rec) {
+				w.failed[i] = false
+			}
+			continue
+		}
+		if !w.healthy(i) || !w.write(i, rec) {
+			continue
+		}
+		if i != w.active {
+			fmt.Fprintf(os.Stderr, "FailoverLogWriter: switching from writer %d (%T) to writer %d (%T)\n", w.active, w.writers[w.active], i, child)
+			w.active = i
+			w.probeAt = now.Add(w.probeinterval)
+		}
+		return
+	}
+	atomic.AddUint64(&w.dropped, 1)
+}
+
+// healthy reports whether the writer at index i is working, as far as it can
+// tell.  It must be called with w.mu held.
+func (w *FailoverLogWriter) healthy(i int) bool {
+	if w.failed[i] {
+		return false
+	}
+	switch child := w.writers[i].(type) {
+	case interface{ Good() bool }:
+		return child.Good()
+	case HealthChecker:
+		return child.Err() == nil
+	}
+	return true
+}
+
+// write hands rec to the writer at index i, reporting whether it took it
+// without panicking.  It must be called with w.mu held.
+func (w *FailoverLogWriter) write(i int, rec *LogRecord) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "FailoverLogWriter: writer %d (%T): panic: %v\n", i, w.writers[i], r)
+			w.failed[i] = true
+			ok = false
+		}
+	}()
+	w.writers[i].LogWrite(rec)
+	return true
+}
+
+// Close closes every writer.
+func (w *FailoverLogWriter) Close() {
+	w.CloseErr()
+}
+
+// CloseErr closes every writer, returning the first error reported by the
+// writers that implement CloserErr.
+func (w *FailoverLogWriter) CloseErr() error {
+	var first error
+	for _, child := range w.writers {
+		if err := closeWriter(child); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Flush waits for the writers that can to write out the records handed to
+// them.
+func (w *FailoverLogWriter) Flush() {
+	for _, child := range w.writers {
+		if f, ok := child.(Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// Active returns the index of the writer in use: 0 for the primary, and 1 on
+// for the secondaries in order.
+func (w *FailoverLogWriter) Active() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.active
+}
+
+// Err returns an error if every writer is down, or nil if one is working.
+func (w *FailoverLogWriter) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i := range w.writers {
+		if w.healthy(i) {
+			return nil
+		}
+	}
+	return errors.New("every writer is down")
+}
+
+// Dropped returns the number of records that arrived while every writer was
+// down.
+func (w *FailoverLogWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// SetProbeInterval sets how often the writers failed over from are handed a
+// record to find out whether they work again (chainable).  The default is ten
+// seconds.  Must be called before the first log message is written.
+func (w *FailoverLogWriter) SetProbeInterval(interval time.Duration) *FailoverLogWriter {
+	w.probeinterval = interval
+	return w
+}
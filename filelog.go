@@ -3,27 +3,124 @@
 package log4go
 
 import (
+	"bufio"
+	"compress/gzip"
+	"encoding/xml"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// syncFile commits a file to stable storage; tests replace it to watch the
+// writers sync.
+var syncFile = (*os.File).Sync
+
+// gzipFile compresses a rotated file; tests replace it to hold compression up.
+var gzipFile = compressFile
+
+// A WriteErrorPolicy says what a FileLogWriter does when it cannot write to
+// its file, as when the disk is full or permission to it is revoked.
+type WriteErrorPolicy int
+
+const (
+	// Stop writing, reporting the error through Err
+	WriteErrorStop WriteErrorPolicy = iota
+
+	// Try the record again, waiting twice as long after each failure, and
+	// drop it once the retries run out
+	WriteErrorRetry
+
+	// Write the record to standard error instead, and try the file again
+	// with the next one
+	WriteErrorStderr
+)
+
+// How many times, and after how long a first wait, a FileLogWriter retries a
+// record with WriteErrorRetry, unless set otherwise
+const (
+	writeRetries      = 5
+	writeRetryBackoff = 100 * time.Millisecond
+)
+
+// A SyncMode says when a FileLogWriter commits its file to stable storage,
+// trading throughput for what a crash or power failure can lose.
+type SyncMode int
+
+const (
+	// Leave it to the operating system, except when the file is closed
+	SyncNever SyncMode = iota
+
+	// Sync after every record, before the next is written
+	SyncEveryWrite
+
+	// Sync at least every interval, as set by SetSyncInterval
+	SyncInterval
+)
+
+// How often a FileLogWriter syncs with SyncInterval, unless set otherwise
+const syncInterval = time.Second
+
 // This log writer sends output to a file
 type FileLogWriter struct {
-	rec chan *LogRecord
-	rot chan bool
+	rec    chan *LogRecord
+	rot    chan bool
+	reopen chan chan error
+	flush  chan flushRequest
+	refmt  chan reformatRequest
+	done   chan struct{}
+
+	// The error that stopped the writer, if any
+	errMu sync.Mutex
+	err   error
 
 	// The opened file
 	filename string
 	file     *os.File
 
-	// The logging format
-	format string
+	// Buffered output, flushed every flushinterval if set
+	buf           *bufio.Writer
+	flushinterval time.Duration
+
+	// Write out records arriving together as one batch, flushed after
+	// batchdelay or once no more records are waiting
+	batching   bool
+	batchdelay time.Duration
+	batchC     <-chan time.Time
+
+	// Write out buffered output once it reaches highwater bytes, or once no
+	// record has come for idle
+	highwater int
+	idle      time.Duration
+	idleTimer *time.Timer
+	idleC     <-chan time.Time
+
+	// How and when to sync the file, and how often with SyncInterval
+	sync         func(*os.File) error
+	syncmode     SyncMode
+	syncinterval time.Duration
+
+	// The logging format, and the formats of levels that use their own
+	format       string
+	levelformats [len(levelStrings)]string
+
+	// Leave out the newline after each record
+	nonewline bool
+
+	// Restart sequence numbers in each file, which began with seqfirst
+	seqrestart bool
+	seqfirst   uint64
 
 	// File header/trailer
 	header, trailer string
 
+	// Mark where each file was opened and closed
+	markers bool
+
 	// Rotate at linecount
 	maxlines          int
 	maxlines_curlines int
@@ -33,11 +130,89 @@ type FileLogWriter struct {
 	maxsize_cursize int
 
 	// Rotate daily
-	daily          bool
-	daily_opendate int
+	daily            bool
+	daily_opendate   int
+	daily_nextrotate time.Time
+
+	// Rotate by the clock for records created further than skew from it,
+	// warning about the first
+	skew       time.Duration
+	skewwarned bool
+
+	// Keep old logfiles (.001, .002, etc), the last numbered for rotatedate
+	rotate     bool
+	rotatenum  int
+	rotatedate string
+
+	// Gzip old logfiles at compresslevel
+	compress      bool
+	compresslevel int
+
+	// Names the file after the time of its records, if set, as last expanded
+	// for the second from pattern_from to pattern_until
+	pattern                     string
+	pattern_from, pattern_until time.Time
+
+	// Kept pointing at the open file, if set
+	symlink string
+
+	// Uploads the rotated files, if set
+	archiver *Archiver
 
-	// Keep old logfiles (.001, .002, etc)
-	rotate bool
+	// Remove rotated files older than maxage, if set
+	maxage time.Duration
+
+	// Called with the old and new names once the log moves to another file
+	onrotate []func(oldname, newname string)
+
+	// Compresses, archives and reports the files the log has moved on from,
+	// off the writer's goroutine
+	moved     chan movedFile
+	movedDone chan struct{}
+	gzip      func(name string, level int) error
+
+	// Names the rotated files, in place of rotatedName
+	namer func(base string, t time.Time, seq int) string
+
+	// Keep a single document per file, resuming it when reopened
+	resume bool
+
+	// Escape the source and message as XML character data
+	xmlescape bool
+
+	// Formats each record in place of the format, if set
+	formatter Formatter
+
+	// What to do when writing fails, and whom to tell, if set
+	errpolicy    WriteErrorPolicy
+	errhandler   func(err error, rec *LogRecord)
+	retries      int
+	retrybackoff time.Duration
+	failing      bool
+
+	// Writes that failed, and records lost to them
+	failed, dropped uint64
+}
+
+// A movedFile is a file the log has moved on from: kept by rotation, to be
+// compressed and archived, or left behind by a dated writer.
+type movedFile struct {
+	base, oldname, newname string
+	kept                   bool
+}
+
+// A flushRequest asks the writer's goroutine to write out the queued records,
+// and to sync the file if sync is set, reporting the outcome on done.
+type flushRequest struct {
+	sync bool
+	done chan error
+}
+
+// A reformatRequest asks the writer's goroutine to write out the queued records
+// and then switch to format, closing done once it has.
+type reformatRequest struct {
+	format string
+	done   chan struct{}
 }
 
 // This is the FileLogWriter's output method
@@ -49,12 +224,35 @@ func (w *FileLogWriter) Close() {
 	close(w.rec)
 }
 
+// CloseErr closes the writer like Close, but waits for the remaining records
+// to be written and the file to be closed, and reports the first error that
+// kept records from reaching the file.
+func (w *FileLogWriter) CloseErr() error {
+	close(w.rec)
+	<-w.done
+	return w.Err()
+}
+
+// Err returns the error that stopped the writer, or nil if it is healthy.
+func (w *FileLogWriter) Err() error {
+	w.errMu.Lock()
+	defer w.errMu.Unlock()
+	return w.err
+}
+
+func (w *FileLogWriter) setErr(err error) {
+	w.errMu.Lock()
+	defer w.errMu.Unlock()
+	w.err = err
+}
+
 // NewFileLogWriter creates a new LogWriter which writes to the given file and
 // has rotation enabled if rotate is true.
 //
 // If rotate is true, any time a new log file is opened, the old one is renamed
-// with a .### extension to preserve it.  The various Set* methods can be used
-// to configure log rotation based on lines, size, and daily.
+// with a .### extension to preserve it, numbered on from the highest number
+// already kept, past .999 as needed.  The various Set* methods can be used to
+// configure log rotation based on lines, size, and daily.
 //
 // The standard log-line format is:
 //   [%D %T] [%L] (%S) %M
@@ -62,10 +260,21 @@ func NewFileLogWriter(fname string, rotate bool, daily bool) *FileLogWriter {
 	w := &FileLogWriter{
 		rec:            make(chan *LogRecord, LogBufferLength),
 		rot:            make(chan bool),
+		reopen:         make(chan chan error),
+		flush:          make(chan flushRequest),
+		refmt:          make(chan reformatRequest),
+		done:           make(chan struct{}),
+		moved:          make(chan movedFile, LogBufferLength),
+		movedDone:      make(chan struct{}),
 		filename:       fname,
-		daily_opendate: time.Now().Day(),
+		sync:           syncFile,
+		gzip:           gzipFile,
+		daily_opendate: timeNow().Day(),
 		format:         "[%D %T] [%L] (%S) %M",
 		rotate:         rotate,
+		compresslevel:  gzip.DefaultCompression,
+		retries:        writeRetries,
+		retrybackoff:   writeRetryBackoff,
 		daily:          daily}
 
 	// open the file for the first time
@@ -74,12 +283,11 @@ func NewFileLogWriter(fname string, rotate bool, daily bool) *FileLogWriter {
 	// 	return nil
 	// }
 
-	fpath := fname[:strings.LastIndex(fname, "/")]
-
-	//check path
-	_, err := os.Lstat(fpath)
-	if nil != err {
-		os.MkdirAll(fpath, os.ModePerm)
+	//check path, creating the directory only if the file name has one
+	if fpath := filepath.Dir(fname); fpath != "." {
+		if _, err := os.Lstat(fpath); nil != err {
+			os.MkdirAll(fpath, os.ModePerm)
+		}
 	}
 
 	// Open the log file
@@ -89,10 +297,11 @@ func NewFileLogWriter(fname string, rotate bool, daily bool) *FileLogWriter {
 	}
 	w.file = fd
 
-	now := time.Now()
+	now := timeNow()
 
 	// Set the daily open date to the current date
 	w.daily_opendate = now.Day()
+	w.daily_nextrotate = nextMidnight(now)
 
 	fi, err := fd.Stat()
 	if nil == err && nil != fi {
@@ -104,12 +313,34 @@ func NewFileLogWriter(fname string, rotate bool, daily bool) *FileLogWriter {
 
 	fmt.Fprint(w.file, FormatLogRecord(w.header, &LogRecord{Created: now}))
 
+	registerFileWriter(w)
+	go w.afterMove()
 	go func() {
 		defer func() {
+			unregisterFileWriter(w)
 			if w.file != nil {
-				fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
-				w.file.Close()
+				err := w.flushBuffer()
+				w.writeMarker("closed", timeNow())
+				fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: timeNow()}))
+				if w.syncmode != SyncNever {
+					if serr := w.sync(w.file); err == nil {
+						err = serr
+					}
+				}
+				if cerr := w.file.Close(); err == nil {
+					err = cerr
+				}
+				if err != nil && w.Err() == nil {
+					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+					w.setErr(err)
+				}
 			}
+			close(w.moved)
+			<-w.movedDone
+			if w.archiver != nil {
+				w.archiver.close()
+			}
+			close(w.done)
 		}()
 
 		for {
@@ -117,42 +348,76 @@ func NewFileLogWriter(fname string, rotate bool, daily bool) *FileLogWriter {
 			case <-w.rot:
 				if err := w.intRotate(); err != nil {
 					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+					w.setErr(err)
+					return
+				}
+			case done := <-w.reopen:
+				// Records handed over before the request go to the old file
+				err := w.drain()
+				if err == nil {
+					err = w.intSwitch(w.filename)
+				}
+				done <- err
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+					w.setErr(err)
+					return
+				}
+			case req := <-w.flush:
+				err := w.drain()
+				if err == nil {
+					err = w.flushBuffer()
+				}
+				if err == nil && req.sync {
+					err = w.sync(w.file)
+				}
+				req.done <- err
+				err = w.flushFailed(err)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+					w.setErr(err)
+					return
+				}
+			case req := <-w.refmt:
+				// Records handed over before the change keep the old format
+				err := w.drain()
+				w.format = req.format
+				close(req.done)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+					w.setErr(err)
+					return
+				}
+			case <-w.batchC:
+				w.batchC = nil
+				if err := w.flushFailed(w.flushBuffer()); err != nil {
+					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+					w.setErr(err)
+					return
+				}
+			case <-w.idleC:
+				w.idleC = nil
+				if err := w.flushFailed(w.flushBuffer()); err != nil {
+					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+					w.setErr(err)
 					return
 				}
 			case rec, ok := <-w.rec:
 				if !ok {
 					return
 				}
-
-				if (w.maxlines > 0 && w.maxlines_curlines >= w.maxlines) ||
-					(w.maxsize > 0 && w.maxsize_cursize >= w.maxsize) {
-					if err := w.intRotate(); err != nil {
-						fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-						return
-					}
+				err := w.writeRec(rec)
+				if err == nil && w.batching {
+					err = w.flushFailed(w.endBatch())
 				}
-
-				now := time.Now()
-				//如果是开启了并且按天滚动，并且已经换了一天需要重建
-				if w.daily {
-					if now.Day() != w.daily_opendate {
-						if err := w.intRotate(); err != nil {
-							fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-							return
-						}
-					}
+				if err == nil && w.highwater > 0 {
+					err = w.flushFailed(w.adaptiveFlush())
 				}
-
-				// Perform the write
-				n, err := fmt.Fprint(w.file, FormatLogRecord(w.format, rec))
 				if err != nil {
 					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+					w.setErr(err)
 					return
 				}
-
-				// Update the counts
-				w.maxlines_curlines++
-				w.maxsize_cursize += n
 			}
 		}
 	}()
@@ -160,74 +425,808 @@ func NewFileLogWriter(fname string, rotate bool, daily bool) *FileLogWriter {
 	return w
 }
 
-// Request that the logs rotate
-func (w *FileLogWriter) Rotate() {
-	w.rot <- true
+// rotationTime returns the time rotation goes by for rec: the time it was
+// created, or the clock's for records without one or, with a skew threshold,
+// created too far from now.
+func (w *FileLogWriter) rotationTime(rec *LogRecord) time.Time {
+	at := rec.Created
+	if at.IsZero() {
+		at = timeNow()
+	} else if w.skew > 0 {
+		if now := timeNow(); w.skewed(at, now) {
+			at = now
+		}
+	}
+	return at
 }
 
-// If this is called in a threaded context, it MUST be synchronized
-func (w *FileLogWriter) intRotate() error {
-	// Close any log file that may be open
+// write rotates the file if needed and writes rec to it.  It must only be
+// called from the writer's goroutine.
+func (w *FileLogWriter) write(rec *LogRecord) error {
+	defer reportPanic("FileLogWriter", w.filename)
+
+	// Move on to the file a dated name gives for the time of the record,
+	// expanding the name at most once a second
+	if len(w.pattern) > 0 {
+		at := w.rotationTime(rec)
+		if at.Before(w.pattern_from) || !at.Before(w.pattern_until) {
+			w.pattern_from = at.Truncate(time.Second)
+			w.pattern_until = w.pattern_from.Add(time.Second)
+			if name := datedFilename(w.pattern, at); name != w.filename {
+				oldname := w.filename
+				if err := w.intSwitch(name); err != nil {
+					return err
+				}
+				w.moveOn(movedFile{oldname: oldname, newname: name})
+			}
+		}
+	}
+
+	if (w.maxlines > 0 && w.maxlines_curlines >= w.maxlines) ||
+		(w.maxsize > 0 && w.maxsize_cursize >= w.maxsize) {
+		if err := w.intRotate(); err != nil {
+			return err
+		}
+	}
+
+	//如果是开启了并且按天滚动，并且已经换了一天需要重建
+	//用记录自带的时间和缓存的下次滚动时间比较，避免每条日志都读一次时钟
+	if w.daily {
+		if !w.rotationTime(rec).Before(w.daily_nextrotate) {
+			if err := w.intRotate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Perform the write
+	var out io.Writer = w.file
+	if w.buf != nil {
+		out = w.buf
+	}
+	n, err := fmt.Fprint(out, w.render(rec))
+	if err != nil {
+		return err
+	}
+
+	// Update the counts
+	w.maxlines_curlines++
+	w.maxsize_cursize += n
+	return nil
+}
+
+// render formats rec as a line of the file, by the formatter if there is one
+// and otherwise by the format for its level.  It must only be called from the
+// writer's goroutine.
+func (w *FileLogWriter) render(rec *LogRecord) string {
+	if w.seqrestart && rec.Seq > 0 {
+		if w.seqfirst == 0 {
+			w.seqfirst = rec.Seq
+		}
+		renumbered := *rec
+		renumbered.Seq = rec.Seq - w.seqfirst + 1
+		rec = &renumbered
+	}
+	if w.xmlescape {
+		escaped := *rec
+		escaped.Source = xmlEscape(rec.Source)
+		escaped.Message = xmlEscape(rec.Message)
+		rec = &escaped
+	}
+
+	var line string
+	if w.formatter != nil {
+		line = w.formatter.Format(rec)
+		if !w.nonewline {
+			line += "\n"
+		}
+	} else {
+		format := w.format
+		if rec.Level.Valid() && len(w.levelformats[rec.Level]) > 0 {
+			format = w.levelformats[rec.Level]
+		}
+		line = formatLogRecord(format, rec, !w.nonewline)
+	}
+	return line
+}
+
+// writeRec writes rec, handling a failure by the write error policy.  It
+// returns an error only if the writer must stop.  It must only be called from
+// the writer's goroutine.
+func (w *FileLogWriter) writeRec(rec *LogRecord) error {
+	err := w.write(rec)
+	backoff := w.retrybackoff
+	for attempt := 0; err != nil; attempt++ {
+		atomic.AddUint64(&w.failed, 1)
+		if w.errhandler != nil {
+			w.errhandler(err, rec)
+		}
+		if w.errpolicy == WriteErrorStop {
+			return err
+		}
+		w.reportFailing(err)
+
+		if w.errpolicy == WriteErrorStderr || attempt >= w.retries {
+			if w.errpolicy == WriteErrorStderr {
+				fmt.Fprint(os.Stderr, w.render(rec))
+			} else {
+				atomic.AddUint64(&w.dropped, 1)
+			}
+			// Ready the file for the next record
+			w.recoverFile()
+			return nil
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		w.recoverFile()
+		err = w.write(rec)
+	}
+	w.failing = false
+
+	if w.syncmode == SyncEveryWrite {
+		err = w.flushBuffer()
+		if err == nil {
+			err = w.sync(w.file)
+		}
+		return w.flushFailed(err)
+	}
+	return nil
+}
+
+// flushFailed handles an error writing out buffered output, which loses the
+// records in the buffer, by the write error policy: it returns err if the
+// writer must stop, and otherwise reopens the file and returns nil.  It must
+// only be called from the writer's goroutine.
+func (w *FileLogWriter) flushFailed(err error) error {
+	if err == nil {
+		return nil
+	}
+	atomic.AddUint64(&w.failed, 1)
+	if w.errhandler != nil {
+		w.errhandler(err, nil)
+	}
+	if w.errpolicy == WriteErrorStop {
+		return err
+	}
+	w.reportFailing(err)
+	w.recoverFile()
+	return nil
+}
+
+// recoverFile readies the file to be written again after a failure.  The
+// output buffer, whose contents are lost, is emptied of the error it keeps.
+// The file is reopened only if its descriptor is no longer usable, as after a
+// failed rotation, and then without a header or markers, so that failures
+// leave nothing in the middle of the log.  It must only be called from the
+// writer's goroutine.
+func (w *FileLogWriter) recoverFile() {
 	if w.file != nil {
-		fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
+		if _, err := w.file.Stat(); err == nil {
+			if w.buf != nil {
+				w.buf.Reset(w.file)
+			}
+			return
+		}
 		w.file.Close()
 	}
 
+	// If this fails, the next failed write tries again
+	fd, err := os.OpenFile(w.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		return
+	}
+	w.file = fd
+	if w.buf != nil {
+		w.buf.Reset(fd)
+	}
+	if fi, err := fd.Stat(); err == nil {
+		w.maxsize_cursize = int(fi.Size())
+	}
+}
+
+// reportFailing reports err on standard error, unless writing has been failing
+// since the last error reported.
+func (w *FileLogWriter) reportFailing(err error) {
+	if !w.failing {
+		fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+		w.failing = true
+	}
+}
+
+// Failed returns the number of times writing to the file failed, counting
+// each retry.
+func (w *FileLogWriter) Failed() uint64 {
+	return atomic.LoadUint64(&w.failed)
+}
+
+// Dropped returns the number of records lost because WriteErrorRetry ran out
+// of retries.
+func (w *FileLogWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// endBatch writes out the current batch once no more records are waiting to
+// join it, or starts the batch delay.  It must only be called from the writer's
+// goroutine.
+func (w *FileLogWriter) endBatch() error {
+	if w.batchdelay > 0 {
+		if w.batchC == nil {
+			w.batchC = time.After(w.batchdelay)
+		}
+		return nil
+	}
+	if len(w.rec) > 0 {
+		return nil
+	}
+	return w.flushBuffer()
+}
+
+// adaptiveFlush writes out the buffered output if it has reached the high-water
+// mark, and otherwise restarts the idle timeout.  It must only be called from
+// the writer's goroutine.
+func (w *FileLogWriter) adaptiveFlush() error {
+	if w.idleTimer == nil {
+		w.idleTimer = time.NewTimer(w.idle)
+		w.idleC = w.idleTimer.C
+	}
+	if w.idleC != nil && !w.idleTimer.Stop() {
+		select {
+		case <-w.idleTimer.C:
+		default:
+		}
+	}
+	w.idleC = nil
+
+	if w.buf.Buffered() >= w.highwater {
+		return w.flushBuffer()
+	}
+	w.idleTimer.Reset(w.idle)
+	w.idleC = w.idleTimer.C
+	return nil
+}
+
+// skewed reports whether a record created at is too far from now to be trusted
+// for daily rotation, warning about the first such record.
+func (w *FileLogWriter) skewed(at, now time.Time) bool {
+	off := at.Sub(now)
+	if off < 0 {
+		off = -off
+	}
+	if off <= w.skew {
+		return false
+	}
+	if !w.skewwarned {
+		w.skewwarned = true
+		fmt.Fprintf(os.Stderr, "FileLogWriter(%q): WARNING: record created at %s is %s off the clock; rotating by the clock for such records\n",
+			w.filename, at.Format(time.RFC3339), off)
+	}
+	return true
+}
+
+// drain writes every record already queued on the writer.  It must only be
+// called from the writer's goroutine.
+func (w *FileLogWriter) drain() error {
+	for {
+		select {
+		case rec, ok := <-w.rec:
+			if !ok {
+				return nil
+			}
+			if err := w.writeRec(rec); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// Flush blocks until every record handed to the writer so far has been
+// written to the file.  It must not be called after Close.
+func (w *FileLogWriter) Flush() {
+	w.intFlush(false)
+}
+
+// Sync blocks until every record handed to the writer so far has been written
+// and committed to stable storage.  It must not be called after Close.
+func (w *FileLogWriter) Sync() error {
+	return w.intFlush(true)
+}
+
+func (w *FileLogWriter) intFlush(sync bool) error {
+	done := make(chan error, 1)
+	select {
+	case w.flush <- flushRequest{sync: sync, done: done}:
+		return <-done
+	case <-w.done:
+		return nil
+	}
+}
+
+// Reformat changes the logging format of a running writer, starting with the
+// next record handed to it.  It blocks until the records handed over before it
+// are written in the old format.
+func (w *FileLogWriter) Reformat(format string) {
+	req := reformatRequest{format: format, done: make(chan struct{})}
+	select {
+	case w.refmt <- req:
+		<-req.done
+	case <-w.done:
+	}
+}
+
+// flushBuffer writes out anything held in the output buffer.  It must only be
+// called from the writer's goroutine.
+func (w *FileLogWriter) flushBuffer() error {
+	if w.buf == nil {
+		return nil
+	}
+	return w.buf.Flush()
+}
+
+// nextMidnight returns the start of the day following t, which is when a
+// daily-rotated file opened at t must be rotated.
+func nextMidnight(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day+1, 0, 0, 0, 0, t.Location())
+}
+
+// Request that the logs rotate.  It does nothing once the writer has stopped.
+func (w *FileLogWriter) Rotate() {
+	select {
+	case w.rot <- true:
+	case <-w.done:
+	}
+}
+
+// Reopen closes the log file and opens the file by its name again, without
+// rotating it, so that writing goes on in a new file once an external tool
+// such as logrotate has moved the old one away.  It blocks until the records
+// handed to the writer before it are written to the old file.  It does nothing
+// once the writer is closed.
+func (w *FileLogWriter) Reopen() error {
+	done := make(chan error, 1)
+	select {
+	case w.reopen <- done:
+		return <-done
+	case <-w.done:
+		return nil
+	}
+}
+
+// If this is called in a threaded context, it MUST be synchronized
+func (w *FileLogWriter) intRotate() error {
+	w.closeFile()
+
+	// The name the old file was kept under, if it was
+	rotated := ""
+
 	// If we are keeping log files, move it to the next available number
 	if w.rotate {
 		_, err := os.Lstat(w.filename)
 		if err == nil { // file exists
-			// Find the next available number
+			at := timeNow()
+			if w.daily && at.Day() != w.daily_opendate {
+				at = at.Add(-24 * time.Hour)
+			}
+			date := ""
+			if w.daily {
+				date = at.Format("2006-01-02")
+			}
+
+			// Find the next available number, carrying on from the last one
+			// used, which is looked up in the directory the first time and
+			// each time the date changes
 			num := 1
+			if w.namer == nil {
+				if w.rotatenum == 0 || w.rotatedate != date {
+					w.rotatenum, w.rotatedate = lastRotatedNum(w.filename, date), date
+				}
+				num = w.rotatenum + 1
+			}
 			fname := w.filename
-			filename := strings.TrimSuffix(w.filename, ".log")
-			for ; err == nil && num <= 999; num++ {
-				if w.daily {
-					if time.Now().Day() != w.daily_opendate {
-						t := time.Now().Add(-24 * time.Hour).Format("2006-01-02")
-						fname = fmt.Sprintf("%s.%s-%03d.log", filename, t, num)
-					} else {
-						t := time.Now().Format("2006-01-02")
-						fname = fmt.Sprintf("%s.%s-%03d.log", filename, t, num)
-					}
+			for ; ; num++ {
+				if w.namer != nil {
+					fname = w.namer(w.filename, at, num)
 				} else {
-					fname = fmt.Sprintf("%s.%03d.log", filename, num)
+					fname = rotatedName(w.filename, date, num)
 				}
 
 				_, err = os.Lstat(fname)
-			}
-			// return error if the last file checked still existed
-			if err == nil {
-				return fmt.Errorf("Rotate: Cannot find free log number to rename %s\n", w.filename)
+				if err != nil {
+					_, err = os.Lstat(fname + ".gz")
+				}
+				if err != nil {
+					break
+				}
 			}
 
-			// Rename the file to its newfound home
-			err = os.Rename(w.filename, fname)
+			// Rename the file to its newfound home, which a namer may put
+			// in a directory of its own
+			if w.namer != nil {
+				os.MkdirAll(filepath.Dir(fname), os.ModePerm)
+			}
+			err = renameLog(w.filename, fname)
 			if err != nil {
 				return fmt.Errorf("Rotate: %s\n", err)
 			}
+			if w.namer == nil {
+				w.rotatenum = num
+			}
+
+			rotated = fname
 		}
 	}
 
-	// Open the log file
+	if err := w.openFile(); err != nil {
+		return err
+	}
+	if len(rotated) > 0 {
+		w.moveOn(movedFile{base: w.filename, oldname: rotated, newname: w.filename, kept: true})
+	}
+	return nil
+}
+
+// moveOn hands a file the log has moved on from to afterMove, if there is
+// anything to do with it.  It must only be called from the writer's
+// goroutine.
+func (w *FileLogWriter) moveOn(m movedFile) {
+	if len(w.onrotate) > 0 || (m.kept && (w.compress || w.archiver != nil || w.maxage > 0)) {
+		w.moved <- m
+	}
+}
+
+// afterMove compresses and archives the files rotation keeps, removes the
+// expired ones and calls the OnRotate hooks, in the order the log moved on,
+// so that a large file or a slow hook does not hold up logging.  It runs on a
+// goroutine of its own until the writer stops.
+func (w *FileLogWriter) afterMove() {
+	defer close(w.movedDone)
+	for m := range w.moved {
+		name := m.oldname
+		if m.kept {
+			// A file that cannot be compressed is kept as it is
+			if w.compress {
+				if err := w.gzip(name, w.compresslevel); err != nil {
+					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", m.base, err)
+				} else {
+					name += ".gz"
+				}
+			}
+			if w.archiver != nil {
+				w.archiver.files <- name
+			}
+			if w.maxage > 0 {
+				w.removeExpired(m.base)
+			}
+		}
+		w.runRotateHooks(name, m.newname)
+	}
+}
+
+// runRotateHooks calls the OnRotate hooks, reporting a panic in one on
+// standard error rather than letting it stop the writer.  It must only be
+// called from afterMove.
+func (w *FileLogWriter) runRotateHooks(oldname, newname string) {
+	for _, hook := range w.onrotate {
+		func() {
+			defer reportPanic("FileLogWriter", newname)
+			hook(oldname, newname)
+		}()
+	}
+}
+
+// intSwitch closes the log file and opens name in its place, appending to it
+// if it exists, as when the name of a dated file moves on to the next day.  It
+// must only be called from the writer's goroutine.
+func (w *FileLogWriter) intSwitch(name string) error {
+	w.closeFile()
+	w.filename = name
+	if fpath := filepath.Dir(name); fpath != "." {
+		os.MkdirAll(fpath, os.ModePerm)
+	}
+	if err := w.openFile(); err != nil {
+		return err
+	}
+
+	// The files rotated from the new name are numbered on their own
+	w.rotatenum, w.rotatedate = 0, ""
+	w.maxlines_curlines = 0
+	if fi, err := w.file.Stat(); err == nil {
+		w.maxsize_cursize = int(fi.Size())
+	}
+	return nil
+}
+
+// closeFile writes out and closes the log file, if one is open, ending it
+// with the closing marker and the trailer.
+func (w *FileLogWriter) closeFile() {
+	if w.file == nil {
+		return
+	}
+	w.flushBuffer()
+	w.writeMarker("closed", timeNow())
+	fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: timeNow()}))
+	if w.syncmode != SyncNever {
+		if err := w.sync(w.file); err != nil {
+			fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+		}
+	}
+	w.file.Close()
+}
+
+// openFile opens the log file for appending, starting it with the header and
+// the opening marker.
+func (w *FileLogWriter) openFile() error {
 	fd, err := os.OpenFile(w.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
 	if err != nil {
 		return err
 	}
 	w.file = fd
+	if w.buf != nil {
+		w.buf.Reset(fd)
+	}
 
-	now := time.Now()
-	fmt.Fprint(w.file, FormatLogRecord(w.header, &LogRecord{Created: now}))
+	// initialize rotation values
+	w.maxlines_curlines = 0
+	w.maxsize_cursize = 0
+	w.seqfirst = 0
+
+	now := timeNow()
+	w.writeHeader(now)
+	w.writeMarker("opened", now)
 
 	// Set the daily open date to the current date
 	w.daily_opendate = now.Day()
+	w.daily_nextrotate = nextMidnight(now)
 
-	// initialize rotation values
-	w.maxlines_curlines = 0
-	w.maxsize_cursize = 0
+	if len(w.symlink) > 0 {
+		w.updateSymlink()
+	}
 	return nil
 }
 
+// updateSymlink points the symlink at the log file, replacing the old link in
+// a single rename so that it is never missing.  A log file in the link's
+// directory is linked by its base name, so that the directory can be moved.
+func (w *FileLogWriter) updateSymlink() {
+	target := w.filename
+	if rel, err := filepath.Rel(filepath.Dir(w.symlink), w.filename); err == nil && !strings.HasPrefix(rel, "..") {
+		target = rel
+	}
+	if cur, err := os.Readlink(w.symlink); err == nil && cur == target {
+		return
+	}
+
+	tmp := w.symlink + ".tmp"
+	os.Remove(tmp)
+	err := os.Symlink(target, tmp)
+	if err == nil {
+		err = os.Rename(tmp, w.symlink)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+	}
+}
+
+// writeHeader starts the newly opened file with the header.  If the writer
+// keeps a single document per file and the file already holds one, the
+// document is resumed instead: its trailer is removed and no header is written.
+func (w *FileLogWriter) writeHeader(now time.Time) {
+	if w.resume {
+		if fi, err := w.file.Stat(); err == nil && fi.Size() > 0 {
+			w.stripTrailer(fi.Size())
+			return
+		}
+	}
+	fmt.Fprint(w.file, FormatLogRecord(w.header, &LogRecord{Created: now}))
+}
+
+// writeMarker writes a record saying the file was opened or closed at now, if
+// lifecycle markers are enabled, rendered as the records are.  The buffer must
+// be empty, as the marker goes straight to the file.
+func (w *FileLogWriter) writeMarker(what string, now time.Time) {
+	if !w.markers {
+		return
+	}
+	n, _ := fmt.Fprint(w.file, w.render(&LogRecord{
+		Level:   INFO,
+		Created: now,
+		Source:  "log4go",
+		Message: fmt.Sprintf("logger %s at %s", what, now.Format(time.RFC3339)),
+	}))
+	w.maxsize_cursize += n
+}
+
+// stripTrailer truncates the trailer (and anything but whitespace after it)
+// from the end of the open file of the given size.
+func (w *FileLogWriter) stripTrailer(size int64) {
+	w.maxsize_cursize = int(size)
+
+	trailer := strings.TrimSpace(FormatLogRecord(w.trailer, &LogRecord{Created: timeNow()}))
+	if len(trailer) == 0 {
+		return
+	}
+
+	fd, err := os.Open(w.filename)
+	if err != nil {
+		return
+	}
+	defer fd.Close()
+
+	// Only the end of the file can hold the trailer
+	off := size - int64(len(trailer)) - 1024
+	if off < 0 {
+		off = 0
+	}
+	tail := make([]byte, size-off)
+	if _, err := fd.ReadAt(tail, off); err != nil {
+		return
+	}
+
+	idx := strings.LastIndex(string(tail), trailer)
+	if idx < 0 || len(strings.TrimSpace(string(tail[idx+len(trailer):]))) > 0 {
+		return
+	}
+	if err := w.file.Truncate(off + int64(idx)); err != nil {
+		fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+		return
+	}
+	w.maxsize_cursize = int(off) + idx
+}
+
+// datedFilename expands the date codes of pattern for t: %Y (2006), %y (06),
+// %m (01), %d (02), %H (15), %M (04), %S (05) and %% (a percent sign), and a Go
+// time layout in braces, as in "app-{20060102}.log".  Other characters, and
+// unknown codes, are kept as they are.
+func datedFilename(pattern string, t time.Time) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '%' && i+1 < len(pattern):
+			i++
+			switch pattern[i] {
+			case 'Y':
+				b.WriteString(t.Format("2006"))
+			case 'y':
+				b.WriteString(t.Format("06"))
+			case 'm':
+				b.WriteString(t.Format("01"))
+			case 'd':
+				b.WriteString(t.Format("02"))
+			case 'H':
+				b.WriteString(t.Format("15"))
+			case 'M':
+				b.WriteString(t.Format("04"))
+			case 'S':
+				b.WriteString(t.Format("05"))
+			case '%':
+				b.WriteByte('%')
+			default:
+				b.WriteByte('%')
+				b.WriteByte(pattern[i])
+			}
+		case c == '{':
+			end := strings.IndexByte(pattern[i:], '}')
+			if end < 0 {
+				b.WriteString(pattern[i:])
+				return b.String()
+			}
+			b.WriteString(t.Format(pattern[i+1 : i+end]))
+			i += end
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// rotatedName returns the name the log file filename is kept under when it is
+// rotated: filename without its .log extension, followed by the date of the
+// file for daily rotation (empty otherwise), a sequence number, and .log.
+func rotatedName(filename, date string, num int) string {
+	base := strings.TrimSuffix(filename, ".log")
+	if len(date) > 0 {
+		return fmt.Sprintf("%s.%s-%03d.log", base, date, num)
+	}
+	return fmt.Sprintf("%s.%03d.log", base, num)
+}
+
+// copyTruncate copies the file from to a new file to and then empties from,
+// for when from cannot be renamed.  A record written to from in between would
+// be lost, so from must be closed.
+func copyTruncate(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Truncate(from, 0)
+}
+
+// lastRotatedNum returns the highest sequence number of the files rotation
+// kept of the log file filename for date (empty without daily rotation), or 0
+// if there are none.
+func lastRotatedNum(filename, date string) int {
+	files, err := rotatedFiles(filename)
+	if err != nil {
+		return 0
+	}
+	last := 0
+	for _, f := range files {
+		if f.date == date && f.num > last {
+			last = f.num
+		}
+	}
+	return last
+}
+
+// removeExpired removes the files rotation kept from the log file base that
+// were last written more than maxage ago.  It must only be called from
+// afterMove.
+func (w *FileLogWriter) removeExpired(base string) {
+	files, err := rotatedFiles(base)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", base, err)
+		return
+	}
+	cutoff := timeNow().Add(-w.maxage)
+	for _, f := range files {
+		if fi, err := os.Lstat(f.name); err != nil || !fi.ModTime().Before(cutoff) {
+			continue
+		}
+		if err := os.Remove(f.name); err != nil {
+			fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", base, err)
+		}
+	}
+}
+
+// compressFile gzips the file name at the given level to name.gz, removing
+// name once the compressed copy is complete.
+func compressFile(name string, level int) error {
+	in, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0660)
+	if err != nil {
+		return err
+	}
+	zw, err := gzip.NewWriterLevel(out, level)
+	if err == nil {
+		_, err = io.Copy(zw, in)
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(name + ".gz")
+		return err
+	}
+	in.Close()
+	return os.Remove(name)
+}
+
 // Set the logging format (chainable).  Must be called before the first log
 // message is written.
 func (w *FileLogWriter) SetFormat(format string) *FileLogWriter {
@@ -235,14 +1234,228 @@ func (w *FileLogWriter) SetFormat(format string) *FileLogWriter {
 	return w
 }
 
+// SetFormatter formats each record with f, such as a LogfmtFormatter, in place
+// of the logging format (chainable).  A nil Formatter goes back to the format.
+// Must be called before the first log message is written.
+func (w *FileLogWriter) SetFormatter(f Formatter) *FileLogWriter {
+	w.formatter = f
+	return w
+}
+
+// Set the logging format of records at the given level (chainable), overriding
+// the format set with SetFormat for that level only.  Must be called before the
+// first log message is written.
+func (w *FileLogWriter) SetLevelFormat(lvl Level, format string) *FileLogWriter {
+	if lvl.Valid() {
+		w.levelformats[lvl] = format
+	}
+	return w
+}
+
+// Set whether sequence numbers restart at 1 in each new file after a rotation
+// rather than continuing from the logger (chainable).  Gaps within a file still
+// show lost records.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetSequenceRestart(restart bool) *FileLogWriter {
+	w.seqrestart = restart
+	return w
+}
+
+// Set whether each record is followed by a newline (chainable).  The default
+// is true; turn it off when the format or the reader of the file handles line
+// termination itself.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetAppendNewline(newline bool) *FileLogWriter {
+	w.nonewline = !newline
+	return w
+}
+
 // Set the logfile header and footer (chainable).  Must be called before the first log
 // message is written.  These are formatted similar to the FormatLogRecord (e.g.
 // you can use %D and %T in your header/footer for date and time).
 func (w *FileLogWriter) SetHeadFoot(head, foot string) *FileLogWriter {
 	w.header, w.trailer = head, foot
 	if w.maxlines_curlines == 0 {
-		fmt.Fprint(w.file, FormatLogRecord(w.header, &LogRecord{Created: time.Now()}))
+		w.writeHeader(timeNow())
+	}
+	return w
+}
+
+// SetLifecycleMarkers sets whether each file begins with a "logger opened at
+// <time>" record and ends with a "logger closed at <time>" one (chainable),
+// written in the logging format inside any header and trailer.  A file without
+// its closing marker was not closed cleanly.  The default is false.  Must be
+// called before the first log message is written, after SetFormat.
+func (w *FileLogWriter) SetLifecycleMarkers(markers bool) *FileLogWriter {
+	w.markers = markers
+	if w.maxlines_curlines == 0 {
+		w.writeMarker("opened", timeNow())
+	}
+	return w
+}
+
+// SetBufferSize buffers up to size bytes of output in memory instead of writing
+// each record to the file as it arrives (chainable).  The buffer is written out
+// when it fills, on Flush, Sync, rotation and Close, and every flush interval
+// if one is set.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetBufferSize(size int) *FileLogWriter {
+	if size > 0 {
+		w.buf = bufio.NewWriterSize(w.file, size)
+	}
+	return w
+}
+
+// SetFlushInterval writes out buffered output at least every interval
+// (chainable), bounding how long a record can sit in memory.  It enables
+// buffering with a default size if SetBufferSize was not called.  Must be
+// called before the first log message is written, and at most once.
+func (w *FileLogWriter) SetFlushInterval(interval time.Duration) *FileLogWriter {
+	if interval <= 0 {
+		return w
+	}
+	if w.buf == nil {
+		w.buf = bufio.NewWriter(w.file)
+	}
+	w.flushinterval = interval
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.Flush()
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// SetAdaptiveFlush writes out buffered output once it reaches highwater bytes,
+// or once no record has come for idle (chainable), in place of a fixed flush
+// interval: a busy writer flushes as soon as it has enough to write, and a
+// quiet one holds back its last few records only until it has been quiet for
+// idle.  It enables buffering with a default size if SetBufferSize was not
+// called; a full buffer is written out regardless.  Must be called before the
+// first log message is written.
+func (w *FileLogWriter) SetAdaptiveFlush(highwater int, idle time.Duration) *FileLogWriter {
+	if highwater <= 0 || idle <= 0 {
+		return w
+	}
+	if w.buf == nil {
+		w.buf = bufio.NewWriter(w.file)
+	}
+	w.highwater = highwater
+	w.idle = idle
+	return w
+}
+
+// SetMicrobatch coalesces records handed to the writer concurrently into a
+// single write to the file of up to size bytes (chainable), saving a system
+// call per record under load.  A batch is written out once it reaches size
+// bytes, or after delay from its first record; with a delay of 0, as soon as no
+// more records are waiting, so a lone record is not held back.  Records keep
+// their order, and Flush, Sync, rotation and Close write out the batch.  Must
+// be called before the first log message is written, in place of
+// SetBufferSize.
+func (w *FileLogWriter) SetMicrobatch(size int, delay time.Duration) *FileLogWriter {
+	if size <= 0 {
+		return w
+	}
+	w.buf = bufio.NewWriterSize(w.file, size)
+	w.batching = true
+	w.batchdelay = delay
+	return w
+}
+
+// SetSkewThreshold makes daily rotation go by the clock rather than by the
+// time of the record for records created more than d before or after now, such
+// as backfilled ones or those from a host with a skewed clock (chainable).  The
+// first such record is reported on standard error.  A threshold of 0, the
+// default, always trusts the record.  Must be called before the first log
+// message is written.
+func (w *FileLogWriter) SetSkewThreshold(d time.Duration) *FileLogWriter {
+	w.skew = d
+	return w
+}
+
+// SetSyncInterval commits the file to stable storage at least every interval
+// (chainable), bounding what a power failure can lose without the cost of
+// syncing every record.  The file is also synced before it is rotated and when
+// the writer is closed.  Must be called before the first log message is
+// written, and at most once.
+func (w *FileLogWriter) SetSyncInterval(interval time.Duration) *FileLogWriter {
+	if interval <= 0 {
+		return w
 	}
+	w.syncmode = SyncInterval
+	w.syncinterval = interval
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.Sync()
+			case <-w.done:
+				return
+			}
+		}
+	}()
+	return w
+}
+
+// SetSync sets when the file is committed to stable storage (chainable).  The
+// default, SyncNever, only syncs when the file is closed.  SyncEveryWrite
+// syncs after each record, writing out any buffered output first, so that a
+// record that has been written survives a crash, at a cost in throughput.
+// SyncInterval syncs every second, as SetSyncInterval(time.Second) does; call
+// SetSyncInterval itself for another interval.  Must be called before the
+// first log message is written, and at most once.
+func (w *FileLogWriter) SetSync(mode SyncMode) *FileLogWriter {
+	switch mode {
+	case SyncInterval:
+		return w.SetSyncInterval(syncInterval)
+	case SyncEveryWrite:
+		w.syncmode = mode
+	}
+	return w
+}
+
+// SetRotateSchedule rotates the log at the times of a schedule as parsed by
+// ParseSchedule, such as "0 0 * * *" or "every 6h" (chainable).  A timer of
+// the writer's own does the rotating, so the log rotates on time even when no
+// records are coming in.  A schedule that does not parse is reported on
+// standard error and ignored.  Must be called before the first log message is
+// written, and at most once.
+func (w *FileLogWriter) SetRotateSchedule(expr string) *FileLogWriter {
+	sched, err := ParseSchedule(expr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+		return w
+	}
+
+	go func() {
+		for {
+			next := sched.Next(timeNow())
+			if next.IsZero() {
+				return
+			}
+			timer := time.NewTimer(next.Sub(timeNow()))
+			select {
+			case <-timer.C:
+			case <-w.done:
+				timer.Stop()
+				return
+			}
+			select {
+			case w.rot <- true:
+			case <-w.done:
+				return
+			}
+		}
+	}()
 	return w
 }
 
@@ -262,6 +1475,59 @@ func (w *FileLogWriter) SetRotateSize(maxsize int) *FileLogWriter {
 	return w
 }
 
+// SetRotateLinesString is SetRotateLines with the count given as a string
+// with an optional K, M or G suffix for thousands, millions or billions, as
+// "500K" (chainable).  A count that does not parse is reported on standard
+// error and ignored.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetRotateLinesString(maxlines string) *FileLogWriter {
+	n, err := parseNumSuffix(strings.TrimSpace(maxlines), 1000)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FileLogWriter(%q): rotate lines: %s\n", w.filename, err)
+		return w
+	}
+	return w.SetRotateLines(n)
+}
+
+// SetRotateSizeString is SetRotateSize with the size given as a string with
+// an optional K, M or G suffix for kilobytes, megabytes or gigabytes of 1024,
+// as "100M" (chainable).  A size that does not parse is reported on standard
+// error and ignored.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetRotateSizeString(maxsize string) *FileLogWriter {
+	n, err := parseNumSuffix(strings.TrimSpace(maxsize), 1024)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "FileLogWriter(%q): rotate size: %s\n", w.filename, err)
+		return w
+	}
+	return w.SetRotateSize(n)
+}
+
+// SetWriteErrorPolicy sets what the writer does when it cannot write to its
+// file (chainable).  The default, WriteErrorStop, stops the writer.  Must be
+// called before the first log message is written.
+func (w *FileLogWriter) SetWriteErrorPolicy(policy WriteErrorPolicy) *FileLogWriter {
+	w.errpolicy = policy
+	return w
+}
+
+// SetWriteRetries sets how many times WriteErrorRetry tries a record again,
+// and how long it waits before the first retry (chainable).  The default is
+// five retries, after 100ms.  Must be called before the first log message is
+// written.
+func (w *FileLogWriter) SetWriteRetries(retries int, backoff time.Duration) *FileLogWriter {
+	w.retries = retries
+	w.retrybackoff = backoff
+	return w
+}
+
+// SetWriteErrorHandler sets a function called, on the writer's goroutine, each
+// time writing to the file fails, whatever the write error policy (chainable).
+// It is given the record that failed, or nil if buffered output could not be
+// written out.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetWriteErrorHandler(handler func(err error, rec *LogRecord)) *FileLogWriter {
+	w.errhandler = handler
+	return w
+}
+
 // Set rotate daily (chainable). Must be called before the first log message is
 // written.
 func (w *FileLogWriter) SetRotateDaily(daily bool) *FileLogWriter {
@@ -280,13 +1546,126 @@ func (w *FileLogWriter) SetRotate(rotate bool) *FileLogWriter {
 	return w
 }
 
+// SetRotateNamer sets the function naming the files kept by rotation
+// (chainable), in place of the numbered names described for NewFileLogWriter.
+// It is given the name of the log file, the time of the rotated file (the day
+// it was for, with daily rotation), and a sequence number starting at 1, which
+// is increased until the returned name is free.  The name may be in another
+// directory, such as one per day, which is created as needed.  Only applies if
+// old logs are kept.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetRotateNamer(namer func(base string, t time.Time, seq int) string) *FileLogWriter {
+	w.namer = namer
+	return w
+}
+
+// SetMaxAge removes the files kept by rotation once they were last written
+// more than maxage ago, checking each time the log rotates (chainable).  Files
+// named by a SetRotateNamer function are not recognized, and so never removed.
+// An age of 0, the default, keeps every file.  Must be called before the first
+// log message is written.
+func (w *FileLogWriter) SetMaxAge(maxage time.Duration) *FileLogWriter {
+	w.maxage = maxage
+	return w
+}
+
+// SetCompress gzips each file as it is rotated, renaming it to .###.log.gz
+// (chainable).  Only applies if old logs are kept.  Compression runs in the
+// background, so logging carries on meanwhile; CloseErr waits for it.  Must be
+// called before the first log message is written.
+func (w *FileLogWriter) SetCompress(compress bool) *FileLogWriter {
+	w.compress = compress
+	return w
+}
+
+// SetSymlink keeps a symbolic link at link pointing at the file being written
+// (chainable), so that "tail -f" on a stable name follows a writer whose file
+// name changes, as a dated one does.  The link is updated each time a file is
+// opened.  It must not be the name of the log file itself.  Must be called
+// before the first log message is written.
+func (w *FileLogWriter) SetSymlink(link string) *FileLogWriter {
+	w.symlink = link
+	w.updateSymlink()
+	return w
+}
+
+// OnRotate adds a function called each time the log moves on to another file
+// (chainable): once a rotated file is kept, with the name it was kept under,
+// after any compression, and the name of the new log file; or once a dated
+// writer moves to a file with another date, with the names of the old and new
+// files.  Hooks are called in the order added, and for each file in the order
+// the log moved on, on a goroutine the writer keeps for them, so a slow hook
+// holds up later hooks but not logging; CloseErr waits for them.  Must be
+// called before the first log message is written.
+func (w *FileLogWriter) OnRotate(hook func(oldname, newname string)) *FileLogWriter {
+	w.onrotate = append(w.onrotate, hook)
+	return w
+}
+
+// SetArchiver hands each file to a as it is rotated, to be compressed and
+// uploaded (chainable).  Only applies if old logs are kept.  The archiver is
+// stopped along with the writer; CloseErr waits for its uploads.  Must be
+// called before the first log message is written.
+func (w *FileLogWriter) SetArchiver(a *Archiver) *FileLogWriter {
+	w.archiver = a
+	return w
+}
+
+// SetCompressLevel sets the gzip level used by SetCompress (chainable), from
+// gzip.BestSpeed to gzip.BestCompression, trading CPU for smaller files.  The
+// default is gzip.DefaultCompression, which an out-of-range level also leaves
+// in place.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetCompressLevel(level int) *FileLogWriter {
+	if level != gzip.DefaultCompression && (level < gzip.BestSpeed || level > gzip.BestCompression) {
+		fmt.Fprintf(os.Stderr, "FileLogWriter(%q): invalid compression level %d\n", w.filename, level)
+		return w
+	}
+	w.compresslevel = level
+	return w
+}
+
+// NewDatedFileLogWriter creates a new FileLogWriter which names its file after
+// the time of its records, by the date codes in pattern: %Y, %y, %m, %d, %H,
+// %M and %S as in strftime, or a Go time layout in braces.  Records go
+// straight into the file for their time, as "app-20240501.log" for the
+// pattern "app-%Y%m%d.log", which is created, or appended to if it exists,
+// once the name changes; no file is renamed.  Rotation by lines or size works
+// as for NewFileLogWriter within each dated file, if rotate is true.
+func NewDatedFileLogWriter(pattern string, rotate bool) *FileLogWriter {
+	w := NewFileLogWriter(datedFilename(pattern, timeNow()), rotate, false)
+	w.pattern = pattern
+	return w
+}
+
 // NewXMLLogWriter is a utility method for creating a FileLogWriter set up to
-// output XML record log messages instead of line-based ones.
+// output XML record log messages instead of line-based ones.  Each file holds a
+// single <log> document, declared as UTF-8, in which sources and messages are
+// escaped and any invalid UTF-8 in them is replaced; reopening an existing
+// file, for example after a restart, continues the document already in it.
 func NewXMLLogWriter(fname string, rotate bool, daily bool) *FileLogWriter {
-	return NewFileLogWriter(fname, rotate, daily).SetFormat(
+	w := NewFileLogWriter(fname, rotate, daily)
+	w.resume = true
+	w.xmlescape = true
+	return w.SetFormat(
 		`	<record level="%L">
 		<timestamp>%D %T</timestamp>
 		<source>%S</source>
 		<message>%M</message>
-	</record>`).SetHeadFoot("<log created=\"%D %T\">", "</log>")
+	</record>`).SetHeadFoot(xml.Header+"<log created=\"%D %T\">", "</log>")
+}
+
+// NewJSONLogWriter is a utility method for creating a FileLogWriter set up to
+// output each record as a JSON object on a line of its own, with level,
+// timestamp, source and message keys, for log shippers which cannot parse
+// formatted lines.  It writes with a JSONFormatter, so the format is not used.
+// Lines can be read back with ParseJSONLogLine.
+func NewJSONLogWriter(fname string, rotate bool, daily bool) *FileLogWriter {
+	return NewFileLogWriter(fname, rotate, daily).SetFormatter(JSONFormatter{})
+}
+
+// xmlEscape escapes s for use as XML character data, replacing invalid UTF-8
+// and characters XML does not allow with U+FFFD.
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
 }
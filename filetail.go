@@ -0,0 +1,123 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// rotatedSuffix matches what rotatedName appends to the base name of a log
+// file: an optional date, a sequence number, and the extension, possibly
+// compressed.
+var rotatedSuffix = regexp.MustCompile(`^\.(?:(\d{4}-\d{2}-\d{2})-)?(\d+)\.log(\.gz)?$`)
+
+// A rotatedFile is a log file kept by rotation.
+type rotatedFile struct {
+	name string
+	date string
+	num  int
+}
+
+// rotatedFiles returns the rotated files of the log file filename, oldest
+// first.
+func rotatedFiles(filename string) ([]rotatedFile, error) {
+	dir, base := filepath.Split(strings.TrimSuffix(filename, ".log"))
+	if len(dir) == 0 {
+		dir = "."
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []rotatedFile
+	for _, fi := range entries {
+		if !strings.HasPrefix(fi.Name(), base) {
+			continue
+		}
+		m := rotatedSuffix.FindStringSubmatch(fi.Name()[len(base):])
+		if m == nil {
+			continue
+		}
+		num, _ := strconv.Atoi(m[2])
+		files = append(files, rotatedFile{filepath.Join(dir, fi.Name()), m[1], num})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].date != files[j].date {
+			return files[i].date < files[j].date
+		}
+		return files[i].num < files[j].num
+	})
+	return files, nil
+}
+
+// TailFile returns the last n lines logged to the log file baseName, reading
+// back through the files kept by rotation (including compressed ones) when
+// the current file holds fewer than n lines.  Lines are returned oldest first.
+func TailFile(baseName string, n int) ([]string, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+
+	files, err := rotatedFiles(baseName)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(files)+1)
+	for _, f := range files {
+		names = append(names, f.name)
+	}
+	if _, err := os.Lstat(baseName); err == nil {
+		names = append(names, baseName)
+	}
+
+	// Read newest first, stopping once there are enough lines
+	var tail []string
+	for i := len(names) - 1; i >= 0 && len(tail) < n; i-- {
+		lines, err := readLines(names[i])
+		if err != nil {
+			return nil, err
+		}
+		if want := n - len(tail); len(lines) > want {
+			lines = lines[len(lines)-want:]
+		}
+		tail = append(lines, tail...)
+	}
+	return tail, nil
+}
+
+// readLines reads the lines of a log file, decompressing it if it is gzipped.
+func readLines(name string) ([]string, error) {
+	fd, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	var in io.Reader = fd
+	if strings.HasSuffix(name, ".gz") {
+		gz, err := gzip.NewReader(fd)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		in = gz
+	}
+
+	var lines []string
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,215 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/blackbeans/log4go/logpb"
+)
+
+// This log writer streams records to a collector serving the LogService of
+// logpb/record.proto over gRPC
+type GRPCLogWriter struct {
+	rec  chan *LogRecord
+	done chan struct{}
+
+	// Where the LogService is, and how to reach it
+	addr, url string
+	client    *http.Client
+
+	// The open stream, if there is one, and how its call ended once it has
+	stream *io.PipeWriter
+	result chan error
+
+	// When to open a stream again after one failed
+	retryinterval time.Duration
+	retryAt       time.Time
+
+	// Records that could not be sent
+	dropped uint64
+}
+
+// NewGRPCLogWriter creates a new LogWriter which streams records to the
+// LogService.Stream method of the collector at addr, as "host:port", over
+// TLS, verifying the collector against the system's roots unless
+// SetTLSConfig says otherwise.  The stream is opened with the first record.
+// If it fails, because the collector cannot be reached or goes away, the
+// error is reported on standard error, records are dropped for a second, and
+// a new stream is opened for the next record.
+//
+// gRPC runs over HTTP/2, which Go's HTTP client speaks over TLS only.  For a
+// collector without TLS, give addr as "http://host:port" and pass an HTTP/2
+// transport that allows it, such as golang.org/x/net/http2's, to
+// SetTransport.
+func NewGRPCLogWriter(addr string) *GRPCLogWriter {
+	w := &GRPCLogWriter{
+		rec:           make(chan *LogRecord, LogBufferLength),
+		done:          make(chan struct{}),
+		addr:          addr,
+		url:           "https://" + addr + "/log4go.LogService/Stream",
+		retryinterval: socketRetryInterval,
+	}
+	if strings.HasPrefix(addr, "http://") || strings.HasPrefix(addr, "https://") {
+		w.url = addr + "/log4go.LogService/Stream"
+	}
+	w.SetTLSConfig(nil)
+
+	go func() {
+		defer close(w.done)
+		for rec := range w.rec {
+			w.send(rec)
+		}
+		w.closeStream()
+	}()
+
+	return w
+}
+
+// send writes rec to the stream, opening one first if needed.  It must only be
+// called from the writer's goroutine.
+func (w *GRPCLogWriter) send(rec *LogRecord) {
+	defer reportPanic("GRPCLogWriter", w.addr)
+
+	// Notice a call the collector ended on its own
+	select {
+	case err := <-w.result:
+		w.failed(err)
+	default:
+	}
+
+	if w.stream == nil {
+		if time.Now().Before(w.retryAt) {
+			atomic.AddUint64(&w.dropped, 1)
+			return
+		}
+		w.open()
+	}
+
+	if err := logpb.WriteGRPCFrame(w.stream, protoRecord(rec)); err != nil {
+		atomic.AddUint64(&w.dropped, 1)
+		w.stream.Close()
+		w.failed(<-w.result)
+	}
+}
+
+// open starts a call to LogService.Stream, whose request body is fed through
+// a pipe.  It must only be called from the writer's goroutine.
+func (w *GRPCLogWriter) open() {
+	pr, pw := io.Pipe()
+	result := make(chan error, 1)
+	w.stream, w.result = pw, result
+
+	req, err := http.NewRequest("POST", w.url, pr)
+	if err != nil {
+		pr.CloseWithError(err)
+		result <- err
+		return
+	}
+	req.Header.Set("Content-Type", "application/grpc+proto")
+	req.Header.Set("TE", "trailers")
+
+	go func() {
+		resp, err := w.client.Do(req)
+		if err == nil {
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+			err = grpcStatus(resp)
+		}
+		if err == nil {
+			err = io.EOF
+		}
+		pr.CloseWithError(err)
+		result <- err
+	}()
+}
+
+// grpcStatus returns the error a finished gRPC call reports, if any.
+func grpcStatus(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s", resp.Status)
+	}
+
+	// Calls that fail at once may send their status with the headers
+	status, msg := resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+	if len(status) == 0 {
+		status, msg = resp.Header.Get("Grpc-Status"), resp.Header.Get("Grpc-Message")
+	}
+	switch status {
+	case "0":
+		return nil
+	case "":
+		return fmt.Errorf("no grpc-status")
+	}
+	return fmt.Errorf("grpc-status %s: %s", status, msg)
+}
+
+// failed forgets the stream whose call ended with err, putting off opening
+// the next one if the call failed.  It must only be called from the writer's
+// goroutine.
+func (w *GRPCLogWriter) failed(err error) {
+	w.stream, w.result = nil, nil
+	if err != io.EOF {
+		fmt.Fprintf(os.Stderr, "GRPCLogWriter(%q): %s\n", w.addr, err)
+		w.retryAt = time.Now().Add(w.retryinterval)
+	}
+}
+
+// closeStream ends the open stream, if any, and waits for the collector to
+// acknowledge it.  It must only be called from the writer's goroutine.
+func (w *GRPCLogWriter) closeStream() {
+	if w.stream == nil {
+		return
+	}
+	w.stream.Close()
+	if err := <-w.result; err != io.EOF {
+		fmt.Fprintf(os.Stderr, "GRPCLogWriter(%q): %s\n", w.addr, err)
+	}
+	w.stream, w.result = nil, nil
+}
+
+// This is the GRPCLogWriter's output method
+func (w *GRPCLogWriter) LogWrite(rec *LogRecord) {
+	w.rec <- rec
+}
+
+// Close ends the stream once the records already handed to the writer are
+// sent, and waits for the collector to acknowledge them.
+func (w *GRPCLogWriter) Close() {
+	close(w.rec)
+	<-w.done
+}
+
+// Dropped returns the number of records that could not be sent.
+func (w *GRPCLogWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// SetTLSConfig sets the TLS configuration used to reach the collector
+// (chainable), as for a client certificate or a private CA; nil means the
+// default.  Must be called before the first log message is written.
+func (w *GRPCLogWriter) SetTLSConfig(config *tls.Config) *GRPCLogWriter {
+	dialer := &net.Dialer{Timeout: SocketDialTimeout}
+	return w.SetTransport(&http.Transport{
+		DialContext:       dialer.DialContext,
+		TLSClientConfig:   config,
+		ForceAttemptHTTP2: true,
+	})
+}
+
+// SetTransport sets the HTTP/2 transport used to reach the collector
+// (chainable), in place of the one SetTLSConfig sets up.  Must be called
+// before the first log message is written.
+func (w *GRPCLogWriter) SetTransport(rt http.RoundTripper) *GRPCLogWriter {
+	w.client = &http.Client{Transport: rt}
+	return w
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// A record as written by a JSON log writer
+type jsonRecord struct {
+	Level     string `json:"level"`
+	Timestamp string `json:"timestamp"`
+	Source    string `json:"source"`
+	Message   string `json:"message"`
+	Category  string `json:"category,omitempty"`
+	Topic     string `json:"topic,omitempty"`
+
+	// Named as in the JSON of a LogRecord
+	Seq        uint64   `json:"seq,omitempty"`
+	Func       string   `json:"caller_func,omitempty"`
+	File       string   `json:"caller_file,omitempty"`
+	Line       int      `json:"caller_line,omitempty"`
+	ErrorChain []string `json:"error_chain,omitempty"`
+	Stack      []string `json:"stack,omitempty"`
+}
+
+// JSONFormatter is a Formatter which writes each record as a JSON object with
+// level, timestamp, source and message keys, and for records that have them,
+// category, topic, seq, caller_func, caller_file, caller_line, error_chain and
+// stack keys, so that ParseJSONLogLine reads the whole record back.
+type JSONFormatter struct{}
+
+func (JSONFormatter) Format(rec *LogRecord) string {
+	level := rec.Level.String()
+	if rec.Level.Valid() {
+		level = levelNames[rec.Level]
+	}
+	// Strings always marshal
+	js, _ := json.Marshal(jsonRecord{
+		Level:     level,
+		Timestamp: rec.Created.Format(time.RFC3339Nano),
+		Source:    rec.Source,
+		Message:   rec.Message,
+		Category:  rec.Category,
+		Topic:     rec.Topic,
+
+		Seq:        rec.Seq,
+		Func:       rec.Func,
+		File:       rec.File,
+		Line:       rec.Line,
+		ErrorChain: rec.ErrorChain,
+		Stack:      rec.Stack,
+	})
+	return string(js)
+}
+
+// ParseJSONLogLine reconstructs a record from a line of JSON written by a
+// writer that logs records as JSON objects, such as a JSONFormatter, the
+// DualFormatFileWriter or the SocketLogWriter, so that tools can read logs
+// back and write them elsewhere.  The level may be given by number or by name,
+// as in "WARNING" or "WARN", and the time, as "Created" or "timestamp", as an
+// RFC 3339 string or in nanoseconds since the epoch.  Fields the record does
+// not have are ignored.
+func ParseJSONLogLine(line []byte) (*LogRecord, error) {
+	rec := new(LogRecord)
+	raw := struct {
+		*LogRecord
+		Level     json.RawMessage
+		Created   json.RawMessage
+		Timestamp json.RawMessage `json:"timestamp"`
+	}{LogRecord: rec}
+	if err := json.Unmarshal(line, &raw); err != nil {
+		return nil, fmt.Errorf("ParseJSONLogLine: %s", err)
+	}
+
+	lvl, err := parseJSONLevel(raw.Level)
+	if err != nil {
+		return nil, fmt.Errorf("ParseJSONLogLine: Level: %s", err)
+	}
+	rec.Level = lvl
+
+	if len(raw.Created) == 0 {
+		raw.Created = raw.Timestamp
+	}
+	if rec.Created, err = parseJSONTime(raw.Created); err != nil {
+		return nil, fmt.Errorf("ParseJSONLogLine: Created: %s", err)
+	}
+	return rec, nil
+}
+
+// parseJSONLevel parses a level given by number or by name.
+func parseJSONLevel(raw json.RawMessage) (Level, error) {
+	if len(raw) == 0 {
+		return 0, fmt.Errorf("missing")
+	}
+	if raw[0] == '"' {
+		var name string
+		if err := json.Unmarshal(raw, &name); err != nil {
+			return 0, err
+		}
+		return LevelFromString(name)
+	}
+	n, err := strconv.Atoi(string(raw))
+	if err != nil {
+		return 0, fmt.Errorf("invalid level %s", raw)
+	}
+	return Level(n), nil
+}
+
+// parseJSONTime parses a time given as an RFC 3339 string or in nanoseconds
+// since the epoch.  A missing or null time is the zero time.
+func parseJSONTime(raw json.RawMessage) (time.Time, error) {
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return time.Time{}, nil
+	}
+	if raw[0] == '"' {
+		var t time.Time
+		err := t.UnmarshalJSON(raw)
+		return t, err
+	}
+	ns, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %s", raw)
+	}
+	return time.Unix(0, ns), nil
+}
@@ -0,0 +1,130 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// This log writer splits the records of a single filter among files by level,
+// such as app.info.log for INFO and WARNING records and app.error.log for
+// ERROR and CRITICAL ones.  Each file is a FileLogWriter of its own, which can
+// be set up, and rotated, apart from the others.
+type LevelSplitFileWriter struct {
+	// The file records of each level go to, nil for levels below the lowest
+	files [len(levelStrings)]*FileLogWriter
+
+	// The files in order of level, and the lowest level of each
+	writers []*FileLogWriter
+	levels  []Level
+}
+
+// NewLevelSplitFileWriter creates a new LogWriter which writes the records of
+// each of levels, and of the levels above it up to the next one given, to a
+// file named after fname with the name of the level put before the extension,
+// as app.error.log for ERROR and app.log.  Records below the lowest of levels
+// are dropped.  With no levels, every level gets a file of its own.  The files
+// are rotated as for NewFileLogWriter if rotate is true; use File to set up
+// each one further.
+func NewLevelSplitFileWriter(fname string, rotate bool, levels ...Level) *LevelSplitFileWriter {
+	if len(levels) == 0 {
+		for lvl := range levelStrings {
+			levels = append(levels, Level(lvl))
+		}
+	}
+	levels = append([]Level(nil), levels...)
+	sort.Slice(levels, func(i, j int) bool { return levels[i] < levels[j] })
+
+	w := &LevelSplitFileWriter{}
+	for _, lvl := range levels {
+		if !lvl.Valid() || (len(w.levels) > 0 && w.levels[len(w.levels)-1] == lvl) {
+			continue
+		}
+		file := NewFileLogWriter(levelSplitName(fname, lvl), rotate, false)
+		for l := lvl; l.Valid(); l++ {
+			w.files[l] = file
+		}
+		w.writers = append(w.writers, file)
+		w.levels = append(w.levels, lvl)
+	}
+	return w
+}
+
+// levelSplitName returns the name of the file for the records from lvl, with
+// the name of the level put before the extension of fname.
+func levelSplitName(fname string, lvl Level) string {
+	ext := filepath.Ext(fname)
+	return strings.TrimSuffix(fname, ext) + "." + strings.ToLower(lvl.longName()) + ext
+}
+
+// This is the LevelSplitFileWriter's output method
+func (w *LevelSplitFileWriter) LogWrite(rec *LogRecord) {
+	if !rec.Level.Valid() || w.files[rec.Level] == nil {
+		return
+	}
+	w.files[rec.Level].LogWrite(rec)
+}
+
+// File returns the writer of the file records at lvl go to, or nil if they are
+// dropped.
+func (w *LevelSplitFileWriter) File(lvl Level) *FileLogWriter {
+	if !lvl.Valid() {
+		return nil
+	}
+	return w.files[lvl]
+}
+
+// Set the logging format of every file (chainable).  Must be called before the
+// first log message is written.
+func (w *LevelSplitFileWriter) SetFormat(format string) *LevelSplitFileWriter {
+	for _, file := range w.writers {
+		file.SetFormat(format)
+	}
+	return w
+}
+
+// Rotate requests that every file rotate.
+func (w *LevelSplitFileWriter) Rotate() {
+	for _, file := range w.writers {
+		file.Rotate()
+	}
+}
+
+// Flush blocks until every record handed to the writer so far has been
+// written to its file.
+func (w *LevelSplitFileWriter) Flush() {
+	for _, file := range w.writers {
+		file.Flush()
+	}
+}
+
+// Close closes every file.
+func (w *LevelSplitFileWriter) Close() {
+	w.CloseErr()
+}
+
+// CloseErr closes every file, waiting for the remaining records to be written,
+// and returns the first error reported.
+func (w *LevelSplitFileWriter) CloseErr() error {
+	var first error
+	for _, file := range w.writers {
+		if err := file.CloseErr(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Err returns the error that stopped the first file to stop, naming the level
+// it is for, or nil if every file is healthy.
+func (w *LevelSplitFileWriter) Err() error {
+	for i, file := range w.writers {
+		if err := file.Err(); err != nil {
+			return fmt.Errorf("%s file: %s", w.levels[i].longName(), err)
+		}
+	}
+	return nil
+}
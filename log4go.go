@@ -25,7 +25,7 @@
 //
 // Usage notes:
 // - The ConsoleLogWriter does not display the source of the message to standard
-//   output, but the FileLogWriter does.
+//   output unless told to with SetShowSource, but the FileLogWriter does.
 // - The utility functions (Info, Debug, Warn, etc) derive their source from the
 //   calling function, and this incurs extra overhead.
 //
@@ -40,18 +40,27 @@
 // - Log file rotation
 // - Logging configuration files ala log4j
 // - Have the ability to remove filters?
-// - Have GetInfoChannel, GetDebugChannel, etc return a chan string that allows
-//   for another method of logging
 // - Add an XML filter type
+//
+// To handle records in your own code, NewChannelLogWriter returns a LogWriter
+// together with the channel it delivers records on.
 package log4go
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"math"
 	"os"
+	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -65,6 +74,10 @@ const (
 
 var (
 	loglevelCounter *prometheus.CounterVec
+
+	// The counter of each defined level, so counting a record neither
+	// allocates nor hashes its label
+	levelCounters [len(levelStrings)]prometheus.Counter
 )
 
 func init() {
@@ -73,8 +86,8 @@ func init() {
 		Help: "Total number of a specified loglevel",
 	}, []string{"level"})
 
-	for _, levelString := range levelStrings {
-		loglevelCounter.WithLabelValues(levelString)
+	for lvl, levelString := range levelStrings {
+		levelCounters[lvl] = loglevelCounter.WithLabelValues(levelString)
 	}
 	err := prometheus.Register(loglevelCounter)
 	if err != nil {
@@ -82,13 +95,22 @@ func init() {
 	}
 }
 
+// countLevel counts a record at lvl in the log_level_total metric.
+func countLevel(lvl Level) {
+	if lvl.Valid() {
+		levelCounters[lvl].Inc()
+		return
+	}
+	loglevelCounter.WithLabelValues(lvl.String()).Inc()
+}
+
 /****** Constants ******/
 
 // These are the integer logging levels used by the logger
-type level int
+type Level int
 
 const (
-	FINEST level = iota
+	FINEST Level = iota
 	FINE
 	DEBUG
 	TRACE
@@ -98,33 +120,194 @@ const (
 	CRITICAL
 )
 
+// OFF is a filter level above every other, so that a filter can be kept but
+// turned off: no record is at or above it.  Records are not logged at OFF.
+const OFF Level = math.MaxInt32
+
 // Logging level strings
 var (
 	levelStrings = [...]string{"FNST", "FINE", "DEBG", "TRAC", "INFO", "WARN", "EROR", "CRIT"}
+	levelNames   = [...]string{"FINEST", "FINE", "DEBUG", "TRACE", "INFO", "WARNING", "ERROR", "CRITICAL"}
 )
 
-func (l level) String() string {
-	if l < 0 || int(l) > len(levelStrings) {
+// String returns the four-character tag of the level, as rendered by %L,
+// "OFF" for OFF, or "UNKNOWN" for a level that is not valid.
+func (l Level) String() string {
+	if l == OFF {
+		return "OFF"
+	}
+	if !l.Valid() {
 		return "UNKNOWN"
 	}
 	return levelStrings[int(l)]
 }
 
+// LevelFromString returns the level with the given name, either in full as in
+// the XML configuration ("WARNING") or as the tag rendered by %L ("WARN"), or
+// OFF for "OFF".  Case is ignored.
+func LevelFromString(name string) (Level, error) {
+	name = strings.ToUpper(strings.TrimSpace(name))
+	if name == "OFF" {
+		return OFF, nil
+	}
+	for lvl := range levelNames {
+		if name == levelNames[lvl] || name == levelStrings[lvl] {
+			return Level(lvl), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown level %q", name)
+}
+
+// Valid reports whether l is one of the defined levels, FINEST to CRITICAL.
+func (l Level) Valid() bool {
+	return l >= 0 && int(l) < len(levelStrings)
+}
+
+// shortName returns the four letter name of the level rendered by %L, or
+// "L<n>" if the level has no name.
+func (l Level) shortName() string {
+	if l == OFF {
+		return "OFF"
+	}
+	if !l.Valid() {
+		return "L" + strconv.Itoa(int(l))
+	}
+	return levelStrings[l]
+}
+
+// longName returns the full name of the level rendered by %N, or "L<n>" if the
+// level has no name.
+func (l Level) longName() string {
+	if l == OFF {
+		return "OFF"
+	}
+	if !l.Valid() {
+		return "L" + strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+// reportPanic recovers from a panic while a writer's goroutine handles a
+// record and reports it on standard error, so one bad record cannot crash the
+// program.  It must be deferred directly.
+func reportPanic(writer, name string) {
+	if r := recover(); r != nil {
+		if len(name) > 0 {
+			fmt.Fprintf(os.Stderr, "%s(%q): panic: %v\n", writer, name, r)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: panic: %v\n", writer, r)
+		}
+	}
+}
+
 /****** Variables ******/
 var (
 	// LogBufferLength specifies how many log messages a particular log4go
-	// logger can buffer at a time before writing them.
-	LogBufferLength = 32
+	// logger can buffer at a time before writing them.  It defaults to 32 and
+	// can be set with the LOG4GO_BUFFER environment variable.
+	LogBufferLength = envBufferLength("LOG4GO_BUFFER", 32)
+
+	// timeNow is the clock used to stamp records and drive rotation; tests
+	// replace it to control the current time.
+	timeNow = time.Now
 )
 
+// deterministicTime is the time of every record in deterministic mode.
+var deterministicTime = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Whether records are stamped with deterministicTime and given no source
+var deterministic int32
+
+// SetDeterministic is for tests only.  It stamps every record with the same
+// fixed time (midnight UTC on 1 January 2000) and leaves out its source, so
+// that output can be compared byte for byte against a golden file or checksum
+// across runs and machines.  Turning it off restores the real clock.  It must
+// not be called while logging.
+func SetDeterministic(enabled bool) {
+	if enabled {
+		atomic.StoreInt32(&deterministic, 1)
+		timeNow = func() time.Time { return deterministicTime }
+	} else {
+		atomic.StoreInt32(&deterministic, 0)
+		timeNow = time.Now
+	}
+}
+
+// envBufferLength reads a buffer length from the named environment variable,
+// warning about and ignoring values that are not a non-negative integer.
+func envBufferLength(name string, def int) int {
+	str := os.Getenv(name)
+	if len(str) == 0 {
+		return def
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(str))
+	if err != nil || n < 0 {
+		fmt.Fprintf(os.Stderr, "log4go: Warning: ignoring invalid %s=%q, using %d\n", name, str, def)
+		return def
+	}
+	return n
+}
+
 /****** LogRecord ******/
 
 // A LogRecord contains all of the pertinent information for each message
 type LogRecord struct {
-	Level   level     // The log level
-	Created time.Time // The time at which the log message was created (nanoseconds)
-	Source  string    // The message source
-	Message string    // The log message
+	Level    Level     // The log level
+	Created  time.Time // The time at which the log message was created (nanoseconds)
+	Source   string    // The message source
+	Message  string    // The log message
+	Topic    string    `json:",omitempty"`    // The topic of a record logged with LogObject
+	Category string    `json:",omitempty"`    // The category of a record logged with LogCategory
+	Seq      uint64    `json:"seq,omitempty"` // The sequence number, if the logger numbers records
+
+	// The call site of the record, which Source combines as func:line
+	Func string `json:"caller_func,omitempty"` // The calling function
+	File string `json:"caller_file,omitempty"` // The file of the call
+	Line int    `json:"caller_line,omitempty"` // The line of the call
+
+	// The error of a record logged with LogError
+	ErrorChain []string `json:"error_chain,omitempty"` // The message of each wrapped error, outermost first
+	Stack      []string `json:"stack,omitempty"`       // The stack trace carried by the error, if any
+}
+
+// setCaller records the call site skip frames above the caller of setCaller as
+// the source of rec.
+func (rec *LogRecord) setCaller(skip int) {
+	if atomic.LoadInt32(&deterministic) != 0 {
+		return
+	}
+	pc, file, lineno, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return
+	}
+	rec.Func = runtime.FuncForPC(pc).Name()
+	rec.File = file
+	rec.Line = lineno
+	rec.Source = fmt.Sprintf("%s:%d", trimSourcePrefix(rec.Func), lineno)
+}
+
+// The prefixes trimmed from the function names in record sources
+var sourceTrimPrefixes atomic.Value // []string
+
+// SetSourceTrimPrefix sets prefixes, such as the module path of the program,
+// to remove from the function names in the sources of records, so that
+// "github.com/org/repo/internal/pkg.Func:12" becomes "internal/pkg.Func:12"
+// with the prefix "github.com/org/repo/".  Only the first prefix that matches
+// is removed.  Calling it with no prefixes keeps sources whole again.  The
+// Func field of records always holds the whole name.
+func SetSourceTrimPrefix(prefixes ...string) {
+	sourceTrimPrefixes.Store(append([]string(nil), prefixes...))
+}
+
+// trimSourcePrefix removes the first matching trim prefix from name.
+func trimSourcePrefix(name string) string {
+	prefixes, _ := sourceTrimPrefixes.Load().([]string)
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return name[len(prefix):]
+		}
+	}
+	return name
 }
 
 /****** LogWriter ******/
@@ -139,12 +322,56 @@ type LogWriter interface {
 	Close()
 }
 
+// A Flusher is a LogWriter that can wait until the records handed to it have
+// been written out.
+type Flusher interface {
+	Flush()
+}
+
+// A Syncer is a LogWriter that can wait until the records handed to it have
+// been committed to stable storage.
+type Syncer interface {
+	Sync() error
+}
+
+// A CloserErr is a LogWriter that can report, when it is closed, that records
+// it had accepted could not be written out.  Logger.Close uses CloseErr in
+// place of Close for writers that implement it.
+type CloserErr interface {
+	CloseErr() error
+}
+
+// A FormatSetter is a LogWriter whose logging format can be changed while it is
+// running.  Logger.SetFormatAll uses Reformat to change the format of its
+// writers.
+type FormatSetter interface {
+	// Reformat sets the logging format, starting with the next record handed
+	// to the writer.
+	Reformat(format string)
+}
+
+// A Formatter turns a record into the line a writer writes for it, without the
+// newline, in place of a logging format.  Writers such as the FileLogWriter
+// take one with SetFormatter.
+type Formatter interface {
+	Format(rec *LogRecord) string
+}
+
+// A HealthChecker is a LogWriter that can report whether it is working.
+// Logger.Healthy uses Err to check the health of its writers.
+type HealthChecker interface {
+	// Err returns the error keeping the writer from writing records, or nil
+	// if it is healthy.
+	Err() error
+}
+
 /****** Logger ******/
 
 // A Filter represents the log level below which no log records are written to
-// the associated LogWriter.
+// the associated LogWriter.  Path names the file the LogWriter writes to, and
+// is empty for writers that do not write to a file.
 type Filter struct {
-	Level level
+	Level Level
 	Path  string
 	LogWriter
 }
@@ -153,6 +380,88 @@ type Filter struct {
 // written.
 type Logger map[string]*Filter
 
+// loggerOptions holds the settings of a Logger that apply across its filters.
+// Since a Logger is a map, these are kept on the side, keyed by the identity
+// of the map, from the first option set until the logger is closed.
+type loggerOptions struct {
+	// The logger the options belong to, held so that its map is not freed,
+	// and its address given to another logger, while they are kept
+	owner Logger
+
+	// Records below sampleLevel are sampled at 1/sampleN
+	sampleLevel int32
+	sampleN     int32
+	sampleCount [len(levelStrings)]uint64
+
+	// Records are numbered from seq when sequence is set
+	seq      uint64
+	sequence int32
+
+	// Records below sourceLevel are not given a source
+	sourceLevel int32
+
+	// Records without a source are given defaultSource, and all records are
+	// given sourceOverride if it is set; both are strings
+	defaultSource  atomic.Value
+	sourceOverride atomic.Value
+
+	// The routing table set with SetRoutes, a []levelRoute
+	routes atomic.Value
+
+	// Records are limited to rate per second by a token bucket, except those
+	// at rateExempt or above if exempting is set
+	rateMu     sync.Mutex
+	rate       float64
+	tokens     float64
+	rateLast   time.Time
+	rateExempt Level
+	exempting  bool
+	dropped    uint64
+
+	// Identical consecutive records within dedupWindow of the first of their
+	// run are collapsed into it, counting the repeats
+	dedupMu      sync.Mutex
+	dedupWindow  time.Duration
+	dedupLast    *LogRecord
+	dedupFilter  *Filter
+	dedupRepeats int
+
+	// While paused is set, records wait in pending for Resume; pauses counts
+	// the calls to Pause, and resumeMu keeps Resumes from overlapping
+	pauseMu      sync.Mutex
+	paused       int32
+	pauses       uint64
+	pending      []pendingRecord
+	resumeMu     sync.Mutex
+	pauseDropped uint64
+
+	// The configuration each filter was last loaded from by LoadConfiguration
+	config map[string]xmlFilter
+}
+
+var loggerOptionsMap sync.Map // map[uintptr]*loggerOptions
+
+// lookupOptions returns the options of the logger, or nil if none were ever
+// set, so that the logging path stays cheap for plain loggers.
+func (log Logger) lookupOptions() *loggerOptions {
+	if opts, ok := loggerOptionsMap.Load(reflect.ValueOf(log).Pointer()); ok {
+		return opts.(*loggerOptions)
+	}
+	return nil
+}
+
+// options returns the options of the logger, creating them if needed.  They
+// hold on to the logger until releaseOptions.
+func (log Logger) options() *loggerOptions {
+	opts, _ := loggerOptionsMap.LoadOrStore(reflect.ValueOf(log).Pointer(), &loggerOptions{owner: log})
+	return opts.(*loggerOptions)
+}
+
+// releaseOptions forgets the options of the logger, letting it be freed.
+func (log Logger) releaseOptions() {
+	loggerOptionsMap.Delete(reflect.ValueOf(log).Pointer())
+}
+
 // Create a new logger.
 //
 // DEPRECATED: Use make(Logger) instead.
@@ -165,89 +474,413 @@ func NewLogger() Logger {
 // or above lvl to standard output.
 //
 // DEPRECATED: use NewDefaultLogger instead.
-func NewConsoleLogger(lvl level) Logger {
+func NewConsoleLogger(lvl Level) Logger {
 	os.Stderr.WriteString("warning: use of deprecated NewConsoleLogger\n")
 	return Logger{
-		"stdout": &Filter{lvl, "./logs/stdout.log", NewConsoleLogWriter()},
+		"stdout": &Filter{lvl, "", NewConsoleLogWriter()},
 	}
 }
 
 // Create a new logger with a "stdout" filter configured to send log messages at
 // or above lvl to standard output.
-func NewDefaultLogger(lvl level) Logger {
+func NewDefaultLogger(lvl Level) Logger {
 	return Logger{
-		"stdout": &Filter{lvl, "./logs/stdout.log", NewConsoleLogWriter()},
+		"stdout": &Filter{lvl, "", NewConsoleLogWriter()},
+	}
+}
+
+// newGlobalLogger creates the default logger of Global, like NewDefaultLogger
+// but without changing how the process handles SIGPIPE, so that importing the
+// package has no such side effect.
+func newGlobalLogger(lvl Level) Logger {
+	return Logger{
+		"stdout": &Filter{lvl, "", newConsoleLogWriter(consoleStdout())},
 	}
 }
 
 // Closes all log writers in preparation for exiting the program or a
 // reconfiguration of logging.  Calling this is not really imperative, unless
 // you want to guarantee that all log messages are written.  Close removes
-// all filters (and thus all LogWriters) from the logger.
-func (log Logger) Close() {
+// all filters (and thus all LogWriters) from the logger, and drops the options
+// set on it, such as sampling and rate limits, which otherwise keep the
+// logger from being garbage collected.  A paused logger is resumed first, so
+// that the records it held are written.  The returned error
+// lists the filters whose writers (implementing CloserErr) failed to write out
+// all of their records.
+func (log Logger) Close() error {
+	var errs []string
+
+	// Write out the records held while paused, then the count of a run of
+	// repeated records
+	log.Resume()
+	log.flushDedup()
+
 	// Close all open loggers
 	for name, filt := range log {
-		filt.Close()
+		if err := closeWriter(filt.LogWriter); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", name, err))
+		}
 		delete(log, name)
 	}
+	log.releaseOptions()
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New("Close: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// closeWriter closes writer, waiting for it to finish and returning its error
+// if it supports that.
+func closeWriter(writer LogWriter) error {
+	if c, ok := writer.(CloserErr); ok {
+		return c.CloseErr()
+	}
+	writer.Close()
+	return nil
+}
+
+// Healthy reports whether all of the logger's writers are working, and for
+// each filter whose writer is not, the error the writer reports.  Writers that
+// are not HealthCheckers are taken to be healthy.  It is safe to call while
+// logging, for example from a readiness probe.
+func (log Logger) Healthy() (bool, map[string]error) {
+	var errs map[string]error
+	for name, filt := range log {
+		if hc, ok := filt.LogWriter.(HealthChecker); ok {
+			if err := hc.Err(); err != nil {
+				if errs == nil {
+					errs = make(map[string]error)
+				}
+				errs[name] = err
+			}
+		}
+	}
+	return len(errs) == 0, errs
+}
+
+// SetFormatAll changes the logging format of every writer of the logger that
+// is a FormatSetter, such as the FileLogWriter, while they are running.
+// Records already handed to a writer keep the old format.  Writers without a
+// format, such as the SocketLogWriter, are left alone.
+func (log Logger) SetFormatAll(format string) {
+	for _, filt := range log {
+		if fs, ok := filt.LogWriter.(FormatSetter); ok {
+			fs.Reformat(format)
+		}
+	}
 }
 
 // Add a new LogWriter to the Logger which will only log messages at lvl or
 // higher.  This function should not be called from multiple goroutines.
 // Returns the logger for chaining.
-func (log Logger) AddFilter(name string, lvl level, writer LogWriter) Logger {
-	log[name] = &Filter{lvl, "./logs/" + name + ".log", writer}
+func (log Logger) AddFilter(name string, lvl Level, writer LogWriter) Logger {
+	log[name] = &Filter{lvl, writerPath(writer), writer}
+	return log
+}
+
+// AddWriter adds a filter which writes records at or above lvl to w in the
+// given format, with no buffering or rotation (chainable).  It is the
+// lightweight way to log to something already open, such as a test buffer or a
+// pipe; closing the logger leaves w open.
+func (log Logger) AddWriter(name string, lvl Level, w io.Writer, format string) Logger {
+	return log.AddFilter(name, lvl, NewWriterLog(w, format))
+}
+
+// writerPath returns the file written by writer, or "" if it does not write to
+// a file.
+func writerPath(writer LogWriter) string {
+	if flw, ok := writer.(*FileLogWriter); ok {
+		return flw.filename
+	}
+	return ""
+}
+
+// SetSampling makes the logger keep only one in every n records below lvl,
+// while records at lvl or above are always logged.  Each level is sampled with
+// its own counter, so the first record of a level is always kept.  An n of 1 or
+// less turns sampling off.  Returns the logger for chaining.
+func (log Logger) SetSampling(lvl Level, n int) Logger {
+	opts := log.options()
+	atomic.StoreInt32(&opts.sampleLevel, int32(lvl))
+	atomic.StoreInt32(&opts.sampleN, int32(n))
+	return log
+}
+
+// sampled reports whether a record at lvl survives sampling.
+func (log Logger) sampled(lvl Level) bool {
+	opts := log.lookupOptions()
+	if opts == nil {
+		return true
+	}
+	n := uint64(atomic.LoadInt32(&opts.sampleN))
+	if n <= 1 || int32(lvl) >= atomic.LoadInt32(&opts.sampleLevel) || !lvl.Valid() {
+		return true
+	}
+	return (atomic.AddUint64(&opts.sampleCount[lvl], 1)-1)%n == 0
+}
+
+// SetRateLimit caps the records the logger passes on to its filters at
+// perSecond per second, allowing bursts of up to a second's worth; records over
+// the limit are dropped and counted in TotalDropped.  A limit of 0 or less
+// turns limiting off.  Returns the logger for chaining.
+func (log Logger) SetRateLimit(perSecond int) Logger {
+	opts := log.options()
+	opts.rateMu.Lock()
+	defer opts.rateMu.Unlock()
+	opts.rate = float64(perSecond)
+	opts.tokens = opts.rate
+	opts.rateLast = timeNow()
+	return log
+}
+
+// SetRateLimitExempt lets records at lvl or above through regardless of the
+// rate limit, so that warnings and errors are never lost to it.  Returns the
+// logger for chaining.
+func (log Logger) SetRateLimitExempt(lvl Level) Logger {
+	opts := log.options()
+	opts.rateMu.Lock()
+	defer opts.rateMu.Unlock()
+	opts.rateExempt = lvl
+	opts.exempting = true
+	return log
+}
+
+// withinRate reports whether a record at lvl is within the rate limit, using up
+// a token if so.
+func (log Logger) withinRate(lvl Level) bool {
+	opts := log.lookupOptions()
+	if opts == nil {
+		return true
+	}
+	opts.rateMu.Lock()
+	defer opts.rateMu.Unlock()
+	if opts.rate <= 0 || (opts.exempting && lvl >= opts.rateExempt) {
+		return true
+	}
+
+	// Refill the bucket for the time since the last record
+	now := timeNow()
+	if elapsed := now.Sub(opts.rateLast); elapsed > 0 {
+		opts.tokens += elapsed.Seconds() * opts.rate
+		if opts.tokens > opts.rate {
+			opts.tokens = opts.rate
+		}
+	}
+	opts.rateLast = now
+
+	if opts.tokens < 1 {
+		opts.dropped++
+		return false
+	}
+	opts.tokens--
+	return true
+}
+
+// TotalDropped returns the number of records lost by the logger: those over
+// its rate limit or beyond what it holds while paused, and those its writers
+// report dropping through a Dropped method, such as a ChannelLogWriter with a
+// full buffer.
+func (log Logger) TotalDropped() uint64 {
+	var total uint64
+	if opts := log.lookupOptions(); opts != nil {
+		opts.rateMu.Lock()
+		total = opts.dropped
+		opts.rateMu.Unlock()
+		opts.pauseMu.Lock()
+		total += opts.pauseDropped
+		opts.pauseMu.Unlock()
+	}
+	for _, filt := range log {
+		if d, ok := filt.LogWriter.(interface{ Dropped() uint64 }); ok {
+			total += d.Dropped()
+		}
+	}
+	return total
+}
+
+// SetSequence numbers the records of the logger, so that records lost or
+// reordered on their way to the output show up as gaps.  Numbers start at 1 and
+// are shared by all of the logger's filters; the %q format code renders them.
+// Returns the logger for chaining.
+func (log Logger) SetSequence(enabled bool) Logger {
+	var sequence int32
+	if enabled {
+		sequence = 1
+	}
+	atomic.StoreInt32(&log.options().sequence, sequence)
 	return log
 }
 
+// nextSeq returns the sequence number of the next record, or 0 if records are
+// not numbered.
+func (log Logger) nextSeq() uint64 {
+	opts := log.lookupOptions()
+	if opts == nil || atomic.LoadInt32(&opts.sequence) == 0 {
+		return 0
+	}
+	return atomic.AddUint64(&opts.seq, 1)
+}
+
+// SetSourceMinLevel limits looking up the source of records, which costs a
+// walk of the stack, to records at lvl or above.  Records below it are logged
+// with empty Source and caller fields.  The default, FINEST, looks up the
+// source of every record.  Returns the logger for chaining.
+func (log Logger) SetSourceMinLevel(lvl Level) Logger {
+	atomic.StoreInt32(&log.options().sourceLevel, int32(lvl))
+	return log
+}
+
+// SetDefaultSource sets the source of records logged without one, because
+// looking it up is disabled with SetSourceMinLevel or SetDeterministic or
+// failed, such as "worker-pool" for records from a pool's goroutines.  An empty
+// source removes the default.  Returns the logger for chaining.
+func (log Logger) SetDefaultSource(source string) Logger {
+	log.options().defaultSource.Store(source)
+	return log
+}
+
+// SetSourceOverride sets the source of every record, replacing the one looked
+// up from the caller or given to the logging call.  An empty source removes the
+// override.  Returns the logger for chaining.
+func (log Logger) SetSourceOverride(source string) Logger {
+	log.options().sourceOverride.Store(source)
+	return log
+}
+
+// applySource gives rec the overriding or default source, if set.
+func (opts *loggerOptions) applySource(rec *LogRecord) {
+	if source, _ := opts.sourceOverride.Load().(string); len(source) > 0 {
+		rec.Source = source
+	} else if len(rec.Source) == 0 {
+		rec.Source, _ = opts.defaultSource.Load().(string)
+	}
+}
+
+// wantsSource reports whether records at lvl are given a source.
+func (log Logger) wantsSource(lvl Level) bool {
+	opts := log.lookupOptions()
+	return opts == nil || lvl >= Level(atomic.LoadInt32(&opts.sourceLevel))
+}
+
 /******* Logging *******/
 // Send a formatted log message internally
-func (log Logger) intLogf(lvl level, format string, args ...interface{}) {
+func (log Logger) intLogf(lvl Level, format string, args ...interface{}) {
 	log.intLogNamef(logName(lvl), lvl, format, args...)
 }
 
 // Send a closure log message internally
-func (log Logger) intLogc(lvl level, closure func() string) {
+func (log Logger) intLogc(lvl Level, closure func() string) {
 
 	log.intLogNamec(logName(lvl), lvl, closure)
 }
 
-func logName(lvl level) string {
+func logName(lvl Level) string {
 	return "stdout"
 }
 
 // Send a log message with manual level, source, and message.
-func (log Logger) Log(lvl level, source, message string) {
+func (log Logger) Log(lvl Level, source, message string) {
 	log.intLogNamef(logName(lvl), lvl, message)
 }
 
-func (log Logger) getLogger(logname string, lvl level) (*Filter, bool) {
-	l, ok := log[logname]
-	if !ok {
-		//use stdout
-		l, ok = log["stdout"]
+// LogAt logs a message with manual level, source, and message like Log, but
+// created at t rather than now, so that the formats render the time of the
+// original event.  Use it to replay or import records from elsewhere.
+func (log Logger) LogAt(t time.Time, lvl Level, source, message string) {
+	countLevel(lvl)
+
+	l, ok := log.getLogger(logName(lvl), lvl)
+	if !ok || lvl < l.Level || !log.sampled(lvl) || !log.withinRate(lvl) {
+		return
+	}
+
+	log.dispatch(l, &LogRecord{
+		Level:   lvl,
+		Created: t,
+		Seq:     log.nextSeq(),
+		Source:  source,
+		Message: message,
+	})
+}
+
+// LogSync logs a message with manual level, source, and message like Log, then
+// blocks until the filter's writer has written it out, syncing it to stable
+// storage if the writer supports that.  Use it for the occasional message that
+// must be durable before the program carries on.
+func (log Logger) LogSync(lvl Level, source, message string) {
+	countLevel(lvl)
+
+	l, ok := log.getLogger(logName(lvl), lvl)
+	if !ok || lvl < l.Level {
+		return
+	}
+
+	log.dispatch(l, &LogRecord{
+		Level:   lvl,
+		Created: timeNow(),
+		Seq:     log.nextSeq(),
+		Source:  source,
+		Message: message,
+	})
+
+	switch w := l.LogWriter.(type) {
+	case Syncer:
+		if err := w.Sync(); err != nil {
+			fmt.Fprintf(os.Stderr, "LogSync: %s\n", err)
+		}
+	case Flusher:
+		w.Flush()
+	}
+}
+
+// getLogger finds the filter for logname.  Names are hierarchical, so a record
+// for "events.orders" goes to the "events" filter if there is no filter of its
+// own, and to "stdout" if neither exists.
+func (log Logger) getLogger(logname string, lvl Level) (*Filter, bool) {
+	if lvl >= OFF {
+		return nil, false
+	}
+	if opts := log.lookupOptions(); opts != nil {
+		if l := opts.route(lvl); l != nil {
+			return l, true
+		}
+	}
+
+	// A lone stdout filter is where every name ends up
+	if len(log) == 1 {
+		l, ok := log["stdout"]
+		if ok {
+			return l, ok
+		}
 	}
+	for {
+		if l, ok := log[logname]; ok {
+			return l, ok
+		}
+		dot := strings.LastIndex(logname, ".")
+		if dot < 0 {
+			break
+		}
+		logname = logname[:dot]
+	}
+	//use stdout
+	l, ok := log["stdout"]
 	return l, ok
 }
 
 // Send a formatted log message internally
-func (log Logger) intLogNamef(logname string, lvl level, format string, args ...interface{}) {
+func (log Logger) intLogNamef(logname string, lvl Level, format string, args ...interface{}) {
 
-	loglevelCounter.WithLabelValues(lvl.String()).Inc()
+	countLevel(lvl)
 
 	l, ok := log.getLogger(logname, lvl)
 	//log level less than  filter level ignored
-	if !ok || lvl < l.Level {
+	if !ok || lvl < l.Level || !log.sampled(lvl) || !log.withinRate(lvl) {
 		return
 	}
 
-	// Determine caller func
-	pc, _, lineno, ok := runtime.Caller(2)
-	src := ""
-	if ok {
-		src = fmt.Sprintf("%s:%d", runtime.FuncForPC(pc).Name(), lineno)
-	}
-
 	msg := format
 	if len(args) > 0 {
 		msg = fmt.Sprintf(format, args...)
@@ -256,120 +889,118 @@ func (log Logger) intLogNamef(logname string, lvl level, format string, args ...
 	// Make the log record
 	rec := &LogRecord{
 		Level:   lvl,
-		Created: time.Now(),
-		Source:  src,
+		Created: timeNow(),
+		Seq:     log.nextSeq(),
 		Message: msg,
 	}
+	if log.wantsSource(lvl) {
+		rec.setCaller(2)
+	}
 
 	// Dispatch the logs
-	l.LogWrite(rec)
+	log.dispatch(l, rec)
 }
 
 // Send a closure log message internally
-func (log Logger) intLogNamec(logname string, lvl level, closure func() string) {
+func (log Logger) intLogNamec(logname string, lvl Level, closure func() string) {
 	l, ok := log.getLogger(logname, lvl)
 
 	//log level less than  filter level ignored
-	if !ok || lvl < l.Level {
+	if !ok || lvl < l.Level || !log.sampled(lvl) || !log.withinRate(lvl) {
 		return
 	}
 
-	// Determine caller func
-	pc, _, lineno, ok := runtime.Caller(2)
-	src := ""
-	if ok {
-		src = fmt.Sprintf("%s:%d", runtime.FuncForPC(pc).Name(), lineno)
-	}
-
 	// Make the log record
 	rec := &LogRecord{
 		Level:   lvl,
-		Created: time.Now(),
-		Source:  src,
+		Created: timeNow(),
+		Seq:     log.nextSeq(),
 		Message: closure(),
 	}
+	if log.wantsSource(lvl) {
+		rec.setCaller(2)
+	}
 
 	// Dispatch the logs
-	l.LogWrite(rec)
+	log.dispatch(l, rec)
 }
 
-// Logf logs a formatted log message at the given log level, using the caller as
-// its source.
-func (log Logger) Logf(lvl level, format string, args ...interface{}) {
-	log.intLogf(lvl, format, args...)
-}
+// LogObject marshals obj to JSON (honoring its json tags) and logs the result
+// at the given level to the filter for topic, falling back like the other
+// named logging calls.  The record carries the topic, so a single filter such
+// as a TopicRoutingWriter can handle many topics.  If obj cannot be marshaled,
+// the error is reported on standard error and nothing is logged.
+func (log Logger) LogObject(lvl Level, topic string, obj interface{}) {
+	countLevel(lvl)
 
-// Logc logs a string returned by the closure at the given log level, using the caller as
-// its source.  If no log message would be written, the closure is never called.
-func (log Logger) Logc(lvl level, closure func() string) {
-	log.intLogc(lvl, closure)
-}
+	l, ok := log.getLogger(topic, lvl)
+	if !ok || lvl < l.Level || !log.sampled(lvl) || !log.withinRate(lvl) {
+		return
+	}
 
-// Finest logs a message at the finest log level.
-// See Debug for an explanation of the arguments.
-func (log Logger) Finest(arg0 interface{}, args ...interface{}) {
-	const (
-		lvl = FINEST
-	)
-	switch first := arg0.(type) {
-	case string:
-		// Use the string as a format string
-		log.intLogf(lvl, first, args...)
-	case func() string:
-		// Log the closure (no other arguments used)
-		log.intLogc(lvl, first)
-	default:
-		// Build a format string so that it will be similar to Sprint
-		log.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+	js, err := json.Marshal(obj)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LogObject(%q): %s\n", topic, err)
+		return
 	}
-}
 
-// Fine logs a message at the fine log level.
-// See Debug for an explanation of the arguments.
-func (log Logger) Fine(arg0 interface{}, args ...interface{}) {
-	const (
-		lvl = FINE
-	)
-	switch first := arg0.(type) {
-	case string:
-		// Use the string as a format string
-		log.intLogf(lvl, first, args...)
-	case func() string:
-		// Log the closure (no other arguments used)
-		log.intLogc(lvl, first)
-	default:
-		// Build a format string so that it will be similar to Sprint
-		log.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+	rec := &LogRecord{
+		Level:   lvl,
+		Created: timeNow(),
+		Seq:     log.nextSeq(),
+		Message: string(js),
+		Topic:   topic,
 	}
+	if log.wantsSource(lvl) {
+		rec.setCaller(1)
+	}
+
+	// Dispatch the logs
+	log.dispatch(l, rec)
 }
 
-// Debug is a utility method for debug log messages.
-// The behavior of Debug depends on the first argument:
-// - arg0 is a string
-//   When given a string as the first argument, this behaves like Logf but with
-//   the DEBUG log level: the first argument is interpreted as a format for the
-//   latter arguments.
-// - arg0 is a func()string
-//   When given a closure of type func()string, this logs the string returned by
-//   the closure iff it will be logged.  The closure runs at most one time.
-// - arg0 is interface{}
-//   When given anything else, the log message will be each of the arguments
-//   formatted with %v and separated by spaces (ala Sprint).
-func (log Logger) Debug(arg0 interface{}, args ...interface{}) {
-	const (
-		lvl = DEBUG
-	)
-	switch first := arg0.(type) {
-	case string:
-		// Use the string as a format string
-		log.intLogf(lvl, first, args...)
-	case func() string:
-		// Log the closure (no other arguments used)
-		log.intLogc(lvl, first)
-	default:
-		// Build a format string so that it will be similar to Sprint
-		log.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
+// LogCategory logs a formatted message at the given level under a logical
+// category, such as "billing" or "auth", which records carry apart from their
+// source and which the %C format code shows.  The record goes to the filter
+// for category, falling back like the other named logging calls.
+func (log Logger) LogCategory(category string, lvl Level, format string, args ...interface{}) {
+	countLevel(lvl)
+
+	l, ok := log.getLogger(category, lvl)
+	if !ok || lvl < l.Level || !log.sampled(lvl) || !log.withinRate(lvl) {
+		return
+	}
+
+	msg := format
+	if len(args) > 0 {
+		msg = fmt.Sprintf(format, args...)
 	}
+
+	rec := &LogRecord{
+		Level:    lvl,
+		Created:  timeNow(),
+		Seq:      log.nextSeq(),
+		Message:  msg,
+		Category: category,
+	}
+	if log.wantsSource(lvl) {
+		rec.setCaller(1)
+	}
+
+	// Dispatch the logs
+	log.dispatch(l, rec)
+}
+
+// Logf logs a formatted log message at the given log level, using the caller as
+// its source.
+func (log Logger) Logf(lvl Level, format string, args ...interface{}) {
+	log.intLogf(lvl, format, args...)
+}
+
+// Logc logs a string returned by the closure at the given log level, using the caller as
+// its source.  If no log message would be written, the closure is never called.
+func (log Logger) Logc(lvl Level, closure func() string) {
+	log.intLogc(lvl, closure)
 }
 
 // Trace logs a message at the trace log level.
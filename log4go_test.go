@@ -3,22 +3,42 @@
 package log4go
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"crypto/md5"
+	"crypto/tls"
 	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/blackbeans/log4go/logpb"
 )
 
 const testLogFile = "_logtest.log"
 
 var now time.Time = time.Unix(0, 1234567890123456789).In(time.UTC)
 
-func newLogRecord(lvl level, src string, msg string) *LogRecord {
+func newLogRecord(lvl Level, src string, msg string) *LogRecord {
 	return &LogRecord{
 		Level:   lvl,
 		Source:  src,
@@ -27,6 +47,27 @@ func newLogRecord(lvl level, src string, msg string) *LogRecord {
 	}
 }
 
+// recordingLogWriter keeps every record it is handed so tests can inspect
+// exactly what was dispatched.
+type recordingLogWriter struct {
+	mu   sync.Mutex
+	recs []*LogRecord
+}
+
+func (w *recordingLogWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.recs = append(w.recs, rec)
+}
+
+func (w *recordingLogWriter) Close() {}
+
+func (w *recordingLogWriter) Records() []*LogRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*LogRecord(nil), w.recs...)
+}
+
 func TestELog(t *testing.T) {
 	fmt.Printf("Testing %s\n", L4G_VERSION)
 	lr := newLogRecord(CRITICAL, "source", "message")
@@ -76,6 +117,117 @@ func TestFormatLogRecord(t *testing.T) {
 	}
 }
 
+func TestFormatLevels(t *testing.T) {
+	tests := []struct {
+		Level       Level
+		Short, Long string
+	}{
+		{FINEST, "FNST", "FINEST"},
+		{FINE, "FINE", "FINE"},
+		{DEBUG, "DEBG", "DEBUG"},
+		{TRACE, "TRAC", "TRACE"},
+		{INFO, "INFO", "INFO"},
+		{WARNING, "WARN", "WARNING"},
+		{ERROR, "EROR", "ERROR"},
+		{CRITICAL, "CRIT", "CRITICAL"},
+	}
+	for _, test := range tests {
+		rec := newLogRecord(test.Level, "source", "message")
+		if got, want := FormatLogRecord("%L", rec), test.Short+"\n"; got != want {
+			t.Errorf("%%L for level %d: got %q, want %q", test.Level, got, want)
+		}
+		if got, want := FormatLogRecord("[%N] %M", rec), "["+test.Long+"] message\n"; got != want {
+			t.Errorf("%%N for level %d: got %q, want %q", test.Level, got, want)
+		}
+	}
+}
+
+func TestFormatCacheZones(t *testing.T) {
+	defer SetFormatCache(true)
+
+	at := time.Date(2009, time.February, 13, 23, 31, 30, 0, time.UTC)
+	zones := []*time.Location{time.UTC, time.FixedZone("EST", -5*60*60)}
+	want := []string{"2009/02/13 23:31:30 UTC\n", "2009/02/13 18:31:30 EST\n"}
+
+	for _, enabled := range []bool{true, false} {
+		SetFormatCache(enabled)
+
+		var wg sync.WaitGroup
+		for i, zone := range zones {
+			wg.Add(1)
+			go func(zone *time.Location, want string) {
+				defer wg.Done()
+				rec := &LogRecord{Level: INFO, Created: at.In(zone), Message: "message"}
+				for j := 0; j < 100; j++ {
+					if got := FormatLogRecord("%D %T", rec); got != want {
+						t.Errorf("cache %v: got %q, want %q", enabled, got, want)
+						return
+					}
+				}
+			}(zone, want[i])
+		}
+		wg.Wait()
+	}
+}
+
+// panickyWriter panics on its first write, then writes to w
+type panickyWriter struct {
+	w        io.Writer
+	panicked bool
+}
+
+func (p *panickyWriter) Write(b []byte) (int, error) {
+	if !p.panicked {
+		p.panicked = true
+		panic("first write")
+	}
+	return p.w.Write(b)
+}
+
+func TestFormatUnnamedLevel(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	in := bufio.NewReader(pr)
+
+	w := NewFormatLogWriter(&panickyWriter{w: pw}, "[%L|%N] %M")
+	defer w.Close()
+
+	// The panic in the writer's goroutine is reported, and the writer goes on
+	w.LogWrite(newLogRecord(INFO, "source", "lost"))
+	w.LogWrite(newLogRecord(Level(12), "source", "custom"))
+
+	line, err := in.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading formatted record: %s", err)
+	}
+	if want := "[L12|L12] custom\n"; line != want {
+		t.Errorf("unnamed level: got %q, want %q", line, want)
+	}
+}
+
+func TestLevelString(t *testing.T) {
+	tests := []struct {
+		Level Level
+		Valid bool
+		Str   string
+	}{
+		{FINEST, true, "FNST"},
+		{DEBUG, true, "DEBG"},
+		{CRITICAL, true, "CRIT"},
+		{Level(-1), false, "UNKNOWN"},
+		{CRITICAL + 1, false, "UNKNOWN"},
+		{Level(42), false, "UNKNOWN"},
+	}
+	for _, test := range tests {
+		if got := test.Level.Valid(); got != test.Valid {
+			t.Errorf("Level(%d).Valid() = %v, want %v", int(test.Level), got, test.Valid)
+		}
+		if got := test.Level.String(); got != test.Str {
+			t.Errorf("Level(%d).String() = %q, want %q", int(test.Level), got, test.Str)
+		}
+	}
+}
+
 var logRecordWriteTests = []struct {
 	Test    string
 	Record  *LogRecord
@@ -97,7 +249,7 @@ func TestConsoleLogWriter(t *testing.T) {
 	console := make(ConsoleLogWriter)
 
 	r, w := io.Pipe()
-	go console.run(w)
+	go console.run(console.options(), w)
 	defer console.Close()
 
 	buf := make([]byte, 1024)
@@ -115,6 +267,200 @@ func TestConsoleLogWriter(t *testing.T) {
 	}
 }
 
+func TestConsoleLogWriterMaxWidth(t *testing.T) {
+	console := make(ConsoleLogWriter)
+	console.SetMaxWidth(10)
+
+	r, w := io.Pipe()
+	go console.run(console.options(), w)
+	defer console.Close()
+
+	buf := make([]byte, 1024)
+	for _, test := range logRecordWriteTests {
+		console.LogWrite(test.Record)
+		n, _ := r.Read(buf)
+
+		if got, want := string(buf[:n]), test.Console; got != want {
+			t.Errorf("%s: non-terminal output was truncated: got %q, want %q", test.Test, got, want)
+		}
+	}
+
+	if got, want := truncateLine("0123456789abc", 10), "012345678…"; got != want {
+		t.Errorf("truncateLine: got %q, want %q", got, want)
+	}
+	if got, want := truncateLine("short", 10), "short"; got != want {
+		t.Errorf("truncateLine: got %q, want %q", got, want)
+	}
+
+	// Wide characters take up two columns, combining marks none
+	for _, test := range []struct {
+		line  string
+		width int
+		want  string
+	}{
+		{"日本語のテキスト", 9, "日本語の…"},
+		{"日本語です", 10, "日本語です"},
+		{"日本語です", 9, "日本語で…"},
+		{"🙂🙂🙂🙂🙂🙂", 7, "🙂🙂🙂…"},
+		{"cafe\u0301 au lait", 10, "cafe\u0301 au l…"},
+	} {
+		if got := truncateLine(test.line, test.width); got != test.want {
+			t.Errorf("truncateLine(%q, %d): got %q, want %q", test.line, test.width, got, test.want)
+		}
+	}
+}
+
+func TestConsoleLogWriterShowSource(t *testing.T) {
+	rec := &LogRecord{
+		Level:   INFO,
+		Created: time.Unix(1234567890, 0).UTC(),
+		Source:  "main.main:12",
+		Message: "message",
+	}
+	tests := []struct {
+		show bool
+		want string
+	}{
+		{false, "[02/13/09 23:31:30] [INFO] message\n"},
+		{true, "[02/13/09 23:31:30] [INFO] (main.main:12) message\n"},
+	}
+	for _, test := range tests {
+		console := make(ConsoleLogWriter).SetShowSource(test.show)
+		r, w := io.Pipe()
+		go console.run(console.options(), w)
+
+		console.LogWrite(rec)
+		buf := make([]byte, 1024)
+		n, _ := r.Read(buf)
+		console.Close()
+
+		if got := string(buf[:n]); got != test.want {
+			t.Errorf("SetShowSource(%v): got %q, want %q", test.show, got, test.want)
+		}
+	}
+}
+
+func TestConsoleLogWriterTarget(t *testing.T) {
+	defer func(out io.Writer) {
+		stderr = out
+	}(stderr)
+	var out, errout bytes.Buffer
+	stderr = &errout
+
+	console := NewConsoleLogWriterTo(&out).SetStderrLevel(ERROR)
+	console.LogWrite(newLogRecord(INFO, "source", "fine"))
+	console.LogWrite(newLogRecord(ERROR, "source", "broken"))
+	console.LogWrite(newLogRecord(CRITICAL, "source", "down"))
+	if err := console.CloseErr(); err != nil {
+		t.Fatalf("CloseErr: %s", err)
+	}
+
+	if got := out.String(); !strings.HasSuffix(got, "[INFO] fine\n") || strings.Count(got, "\n") != 1 {
+		t.Errorf("NewConsoleLogWriterTo: target got %q, want the INFO record", got)
+	}
+	if got := errout.String(); !strings.Contains(got, "[EROR] broken\n") || !strings.Contains(got, "[CRIT] down\n") || strings.Count(got, "\n") != 2 {
+		t.Errorf("SetStderrLevel: standard error got %q, want the ERROR and CRITICAL records", got)
+	}
+}
+
+func TestConsoleLogWriterFormat(t *testing.T) {
+	var buf bytes.Buffer
+	console := NewConsoleLogWriterTo(&buf).SetFormat("[%L] (%S) %M")
+	console.LogWrite(newLogRecord(INFO, "main.main:12", "first"))
+	console.Reformat("%L %M")
+	console.LogWrite(newLogRecord(ERROR, "main.main:13", "second"))
+	console.Reformat("")
+	console.LogWrite(&LogRecord{Level: WARNING, Created: time.Unix(1234567890, 0).UTC(), Message: "third"})
+	if err := console.CloseErr(); err != nil {
+		t.Fatalf("CloseErr: %s", err)
+	}
+
+	want := "[INFO] (main.main:12) first\nEROR second\n[02/13/09 23:31:30] [WARN] third\n"
+	if got := buf.String(); got != want {
+		t.Errorf("SetFormat: got %q, want %q", got, want)
+	}
+}
+
+func TestConsoleLogWriterBrokenPipe(t *testing.T) {
+	// In the child, log to a standard output nobody reads
+	if os.Getenv("LOG4GO_BROKEN_STDOUT") == "1" {
+		w := NewConsoleLogWriter()
+		for i := 0; i < 100 && w.Err() == nil; i++ {
+			w.LogWrite(newLogRecord(INFO, "source", "nobody reads this"))
+			time.Sleep(10 * time.Millisecond)
+		}
+		if w.Err() == nil {
+			fmt.Fprintln(os.Stderr, "writer did not notice the broken pipe")
+			os.Exit(1)
+		}
+		w.LogWrite(newLogRecord(INFO, "source", "discarded"))
+		w.Close()
+		os.Exit(0)
+	}
+
+	r, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %s", err)
+	}
+	r.Close()
+	defer pw.Close()
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0], "-test.run=^TestConsoleLogWriterBrokenPipe$")
+	cmd.Env = append(os.Environ(), "LOG4GO_BROKEN_STDOUT=1")
+	cmd.Stdout = pw
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("ConsoleLogWriter: logging to a broken pipe: %s\n%s", err, stderr.Bytes())
+	}
+	if !strings.Contains(stderr.String(), "ConsoleLogWriter: ") {
+		t.Errorf("ConsoleLogWriter: broken pipe was not reported: %q", stderr.Bytes())
+	}
+}
+
+func TestConsoleLogWriterSIGPIPENotInherited(t *testing.T) {
+	if _, err := os.Stat("/proc/self/status"); err != nil {
+		t.Skip("no /proc/self/status to read the signal dispositions from")
+	}
+	w := NewConsoleLogWriterTo(os.Stdout)
+	defer w.Close()
+
+	// SIGPIPE is signal 13, the 13th bit of the mask of ignored signals
+	out, err := exec.Command("grep", "^SigIgn:", "/proc/self/status").Output()
+	if err != nil {
+		t.Fatalf("grep: %s", err)
+	}
+	mask, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(string(out), "SigIgn:")), 16, 64)
+	if err != nil {
+		t.Fatalf("SigIgn: %s", err)
+	}
+	if mask&(1<<(13-1)) != 0 {
+		t.Errorf("child process inherited SIGPIPE ignored: SigIgn %016x", mask)
+	}
+}
+
+func TestBufferLengthFromEnv(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	defer os.Unsetenv("LOG4GO_BUFFER")
+
+	os.Setenv("LOG4GO_BUFFER", "128")
+	LogBufferLength = envBufferLength("LOG4GO_BUFFER", 32)
+	w := NewConsoleLogWriter()
+	defer w.Close()
+	if got, want := cap(w), 128; got != want {
+		t.Errorf("LOG4GO_BUFFER=128: got buffer of %d, want %d", got, want)
+	}
+
+	for _, bad := range []string{"lots", "-1"} {
+		os.Setenv("LOG4GO_BUFFER", bad)
+		if got, want := envBufferLength("LOG4GO_BUFFER", 32), 32; got != want {
+			t.Errorf("LOG4GO_BUFFER=%s: got %d, want %d", bad, got, want)
+		}
+	}
+}
+
 func TestFileLogWriter(t *testing.T) {
 	defer func(buflen int) {
 		LogBufferLength = buflen
@@ -138,6 +484,129 @@ func TestFileLogWriter(t *testing.T) {
 	}
 }
 
+func TestFileLogWriterLevelFormat(t *testing.T) {
+	defer os.Remove(testLogFile)
+	os.Remove(testLogFile)
+
+	w := NewFileLogWriter(testLogFile, false, false).
+		SetFormat("[%L] %M").
+		SetLevelFormat(ERROR, "[%N] (%S) %M")
+	w.LogWrite(newLogRecord(INFO, "source", "terse"))
+	w.LogWrite(newLogRecord(ERROR, "source", "detailed"))
+	w.Close()
+
+	if got, want := string(readLogFile(t, testLogFile, 2)), "[INFO] terse\n[ERROR] (source) detailed\n"; got != want {
+		t.Errorf("SetLevelFormat: got %q, want %q", got, want)
+	}
+}
+
+func TestShardedFileLogWriter(t *testing.T) {
+	const base = "_logtest_shard.log"
+	defer func() {
+		names, _ := filepath.Glob(base + ".*")
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}()
+
+	w := NewShardedFileLogWriter(base, 3)
+	start := time.Unix(1234567890, 0)
+	for i := 0; i < 10; i++ {
+		w.LogWrite(&LogRecord{Level: INFO, Created: start.Add(time.Duration(i) * time.Millisecond), Source: "source", Message: fmt.Sprint("message ", i)})
+	}
+	w.Flush()
+	w.Close()
+
+	for i := 0; i < 3; i++ {
+		if _, err := os.Stat(fmt.Sprintf("%s.%d", base, i)); err != nil {
+			t.Errorf("shard %d: %s", i, err)
+		}
+	}
+
+	recs, err := MergeShards(base)
+	if err != nil {
+		t.Fatalf("MergeShards: %s", err)
+	}
+	if len(recs) != 10 {
+		t.Fatalf("MergeShards: got %d records, want 10", len(recs))
+	}
+	for i, rec := range recs {
+		if want := fmt.Sprint("message ", i); rec.Message != want || !rec.Created.Equal(start.Add(time.Duration(i)*time.Millisecond)) {
+			t.Errorf("record %d: got %q at %s, want %q", i, rec.Message, rec.Created, want)
+		}
+	}
+}
+
+func TestShardedFileLogWriterKey(t *testing.T) {
+	base := filepath.Join(t.TempDir(), "shard.log")
+	w := NewShardedFileLogWriter(base, 4).SetShardKey(func(rec *LogRecord) string { return rec.Category })
+
+	// The clock does not move, so only the sequence numbers give the order
+	at := time.Unix(1234567890, 0)
+	var seq uint64
+	for i := 0; i < 4; i++ {
+		for _, category := range []string{"db", "http", "auth"} {
+			seq++
+			w.LogWrite(&LogRecord{Level: INFO, Created: at, Category: category, Seq: seq, Message: fmt.Sprint(category, " ", i)})
+		}
+	}
+	w.Flush()
+	w.Close()
+
+	// Each category is kept whole, in order, in a single shard
+	for i := 0; i < 4; i++ {
+		contents, err := ioutil.ReadFile(fmt.Sprintf("%s.%d", base, i))
+		if err != nil {
+			t.Fatalf("shard %d: %s", i, err)
+		}
+		for _, category := range []string{"db", "http", "auth"} {
+			if n := bytes.Count(contents, []byte(`"Category":"`+category+`"`)); n != 0 && n != 4 {
+				t.Errorf("shard %d: holds %d of the 4 %s records", i, n, category)
+			}
+		}
+	}
+
+	recs, err := MergeShards(base)
+	if err != nil {
+		t.Fatalf("MergeShards: %s", err)
+	}
+	if len(recs) != 12 {
+		t.Fatalf("MergeShards: got %d records, want 12", len(recs))
+	}
+	for i, rec := range recs {
+		if rec.Seq != uint64(i+1) {
+			t.Errorf("record %d: got seq %d (%q), want %d", i, rec.Seq, rec.Message, i+1)
+		}
+	}
+}
+
+func TestFileLogWriterNoNewline(t *testing.T) {
+	rotated := rotatedName(testLogFile, "", 1)
+	defer os.Remove(testLogFile)
+	defer os.Remove(rotated)
+	os.Remove(testLogFile)
+	os.Remove(rotated)
+
+	// Each record is "<n>;", 2 bytes, so the size limit rotates after 3 records
+	w := NewFileLogWriter(testLogFile, true, false).SetFormat("%M;").SetAppendNewline(false).SetRotateSize(6)
+	for i := 1; i <= 5; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprint(i)))
+	}
+	if err := w.CloseErr(); err != nil {
+		t.Fatalf("CloseErr: %s", err)
+	}
+
+	if got, _ := ioutil.ReadFile(rotated); string(got) != "1;2;3;" {
+		t.Errorf("SetAppendNewline(false): rotated file has %q, want %q", got, "1;2;3;")
+	}
+	if got, _ := ioutil.ReadFile(testLogFile); string(got) != "4;5;" {
+		t.Errorf("SetAppendNewline(false): log file has %q, want %q", got, "4;5;")
+	}
+	if got := FormatLogRecordNoNewline("%M", newLogRecord(INFO, "source", "raw")); got != "raw" {
+		t.Errorf("FormatLogRecordNoNewline: got %q", got)
+	}
+}
+
 func TestXMLLogWriter(t *testing.T) {
 	defer func(buflen int) {
 		LogBufferLength = buflen
@@ -156,105 +625,3233 @@ func TestXMLLogWriter(t *testing.T) {
 
 	if contents, err := ioutil.ReadFile(testLogFile); err != nil {
 		t.Errorf("read(%q): %s", testLogFile, err)
-	} else if len(contents) != 185 {
+	} else if len(contents) != 224 {
 		t.Errorf("malformed xmllog: %q (%d bytes)", string(contents), len(contents))
 	}
 }
 
-func TestLogger(t *testing.T) {
-	sl := NewDefaultLogger(WARNING)
-	if sl == nil {
-		t.Fatalf("NewDefaultLogger should never return nil")
+// readLogFile waits for the asynchronous writer of fname to flush lines lines
+// and returns the file's contents.
+func readLogFile(t *testing.T, fname string, lines int) []byte {
+	var contents []byte
+	for i := 0; i < 100; i++ {
+		contents, _ = ioutil.ReadFile(fname)
+		if bytes.Count(contents, []byte{'\n'}) >= lines {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
 	}
-	if lw, exist := sl["stdout"]; lw == nil || exist != true {
-		t.Fatalf("NewDefaultLogger produced invalid logger (DNE or nil)")
+	return contents
+}
+
+func TestPrefixLogWriter(t *testing.T) {
+	inner := &recordingLogWriter{}
+	w := NewPrefixLogWriter(inner, "[app] ", " ;").SetFormat("%L %M")
+	w.LogWrite(newLogRecord(INFO, "source", "one line"))
+	w.LogWrite(newLogRecord(ERROR, "source", "first\nsecond"))
+
+	recs := inner.Records()
+	if len(recs) != 2 {
+		t.Fatalf("PrefixLogWriter: got %d records, want 2", len(recs))
 	}
-	if sl["stdout"].Level != WARNING {
-		t.Fatalf("NewDefaultLogger produced invalid logger (incorrect level)")
+	for i, want := range []string{
+		"[app] INFO one line ;",
+		"[app] EROR first ;\n[app] second ;",
+	} {
+		if recs[i].Message != want {
+			t.Errorf("PrefixLogWriter: record %d is %q, want %q", i, recs[i].Message, want)
+		}
 	}
-	if len(sl) != 1 {
-		t.Fatalf("NewDefaultLogger produced invalid logger (incorrect map count)")
+
+	// Size rotation counts the wrapped bytes, newline included
+	fname := filepath.Join(t.TempDir(), "prefix.log")
+	fw := NewFileLogWriter(fname, false, false).SetFormat("%M")
+	pw := NewPrefixLogWriter(fw, ">> ", "").SetFormat("%M")
+	pw.LogWrite(newLogRecord(INFO, "source", "hello"))
+	pw.Flush()
+	if got, want := fw.maxsize_cursize, len(">> hello\n"); got != want {
+		t.Errorf("PrefixLogWriter: file writer counted %d bytes, want %d", got, want)
 	}
+	pw.Close()
+}
 
-	//func (l *Logger) AddFilter(name string, level int, writer LogWriter) {}
-	l := make(Logger)
-	l.AddFilter("stdout", DEBUG, NewConsoleLogWriter())
-	if lw, exist := l["stdout"]; lw == nil || exist != true {
-		t.Fatalf("AddFilter produced invalid logger (DNE or nil)")
+func TestMultiLogWriter(t *testing.T) {
+	defer func(dial func(string, string, time.Duration) (net.Conn, error)) {
+		dialTimeout = dial
+	}(dialTimeout)
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return nil, errors.New("connection refused")
 	}
-	if l["stdout"].Level != DEBUG {
-		t.Fatalf("AddFilter produced invalid logger (incorrect level)")
+
+	first, second := &recordingLogWriter{}, &recordingLogWriter{}
+	w := NewMultiLogWriter(first, NewWriterLog(&panickyWriter{w: ioutil.Discard}, "%M"), second)
+	w.LogWrite(newLogRecord(INFO, "source", "one"))
+	w.LogWrite(newLogRecord(ERROR, "source", "two"))
+
+	// The panic on the first write reaches neither of the other writers
+	for i, child := range []*recordingLogWriter{first, second} {
+		if recs := child.Records(); len(recs) != 2 || recs[0].Message != "one" || recs[1].Message != "two" {
+			t.Errorf("MultiLogWriter: writer %d got %d records, want both", i, len(recs))
+		}
 	}
-	if len(l) != 1 {
-		t.Fatalf("AddFilter produced invalid logger (incorrect map count)")
+	if err := w.Err(); err != nil {
+		t.Errorf("MultiLogWriter: Err() = %v with working writers", err)
 	}
+	w.Close()
 
-	//func (l *Logger) Warn(format string, args ...interface{}) error {}
-	if err := l.Warn("%s %d %#v", "Warning:", 1, []int{}); err.Error() != "Warning: 1 []int{}" {
-		t.Errorf("Warn returned invalid error: %s", err)
+	broken := NewMultiLogWriter(&recordingLogWriter{}, NewSocketLogWriter("tcp", "collector:12124"))
+	defer broken.Close()
+	if err := broken.Err(); err == nil || !strings.Contains(err.Error(), "writer 1") {
+		t.Errorf("MultiLogWriter: Err() = %v, want the socket writer's error", err)
 	}
+}
 
-	//func (l *Logger) Error(format string, args ...interface{}) error {}
-	if err := l.Error("%s %d %#v", "Error:", 10, []string{}); err.Error() != "Error: 10 []string{}" {
-		t.Errorf("Error returned invalid error: %s", err)
+// flakyLogWriter records what it is handed, reporting itself good after a
+// write while up is set, like a writer that reconnects when it has to send.
+type flakyLogWriter struct {
+	recordingLogWriter
+	up, good bool
+}
+
+func (w *flakyLogWriter) LogWrite(rec *LogRecord) {
+	w.recordingLogWriter.LogWrite(rec)
+	w.good = w.up
+}
+
+func (w *flakyLogWriter) Good() bool { return w.good }
+
+func TestFailoverLogWriter(t *testing.T) {
+	at := now
+	defer func(clock func() time.Time) { timeNow = clock }(timeNow)
+	timeNow = func() time.Time { return at }
+
+	primary := &flakyLogWriter{up: true, good: true}
+	secondary := &recordingLogWriter{}
+	w := NewFailoverLogWriter(primary, secondary)
+	defer w.Close()
+
+	w.LogWrite(newLogRecord(INFO, "source", "one"))
+	primary.up, primary.good = false, false
+	w.LogWrite(newLogRecord(INFO, "source", "two"))
+	if w.Active() != 1 {
+		t.Errorf("FailoverLogWriter: Active() = %d with the primary down, want 1", w.Active())
 	}
 
-	//func (l *Logger) Critical(format string, args ...interface{}) error {}
-	if err := l.Critical("%s %d %#v", "Critical:", 100, []int64{}); err.Error() != "Critical: 100 []int64{}" {
-		t.Errorf("Critical returned invalid error: %s", err)
+	// The primary is back, but it does not know until it is handed a record
+	primary.up = true
+	w.LogWrite(newLogRecord(INFO, "source", "three"))
+	at = at.Add(failoverProbeInterval)
+	w.LogWrite(newLogRecord(INFO, "source", "four"))
+	w.LogWrite(newLogRecord(INFO, "source", "five"))
+	if w.Active() != 0 {
+		t.Errorf("FailoverLogWriter: Active() = %d with the primary back, want 0", w.Active())
 	}
 
-	// Already tested or basically untestable
-	//func (l *Logger) Log(level int, source, message string) {}
-	//func (l *Logger) Logf(level int, format string, args ...interface{}) {}
-	//func (l *Logger) intLogf(level int, format string, args ...interface{}) string {}
-	//func (l *Logger) Finest(format string, args ...interface{}) {}
-	//func (l *Logger) Fine(format string, args ...interface{}) {}
-	//func (l *Logger) Debug(format string, args ...interface{}) {}
-	//func (l *Logger) Trace(format string, args ...interface{}) {}
-	//func (l *Logger) Info(format string, args ...interface{}) {}
+	messages := func(recs []*LogRecord) (msgs []string) {
+		for _, rec := range recs {
+			msgs = append(msgs, rec.Message)
+		}
+		return msgs
+	}
+	if got, want := messages(primary.Records()), []string{"one", "four", "five"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FailoverLogWriter: primary got %q, want %q", got, want)
+	}
+	if got, want := messages(secondary.Records()), []string{"two", "three", "four"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("FailoverLogWriter: secondary got %q, want %q", got, want)
+	}
+	if w.Dropped() != 0 || w.Err() != nil {
+		t.Errorf("FailoverLogWriter: Dropped() = %d, Err() = %v", w.Dropped(), w.Err())
+	}
 }
 
-func TestLogOutput(t *testing.T) {
-	const (
-		expected = "fdf3e51e444da56b4cb400f30bc47424"
-	)
+// gatedLogWriter records what it is handed, each record only once release is
+// closed, signalling started as it begins on each.
+type gatedLogWriter struct {
+	recordingLogWriter
+	started chan struct{}
+	release chan struct{}
+}
 
-	// Unbuffered output
-	defer func(buflen int) {
-		LogBufferLength = buflen
-	}(LogBufferLength)
-	LogBufferLength = 0
+func (w *gatedLogWriter) LogWrite(rec *LogRecord) {
+	w.started <- struct{}{}
+	<-w.release
+	w.recordingLogWriter.LogWrite(rec)
+}
+
+func TestWrapAsync(t *testing.T) {
+	for _, overflow := range []Policy{OverflowDrop, OverflowBlock} {
+		inner := &gatedLogWriter{started: make(chan struct{}, 10), release: make(chan struct{})}
+		w := WrapAsync(inner, 2, overflow)
+
+		// The first record holds up the goroutine, and two more fill the queue
+		w.LogWrite(newLogRecord(INFO, "source", "0"))
+		<-inner.started
+		w.LogWrite(newLogRecord(INFO, "source", "1"))
+		w.LogWrite(newLogRecord(INFO, "source", "2"))
+
+		logged := make(chan struct{})
+		go func() {
+			w.LogWrite(newLogRecord(INFO, "source", "3"))
+			close(logged)
+		}()
+		select {
+		case <-logged:
+			if overflow == OverflowBlock {
+				t.Fatalf("WrapAsync(%d): LogWrite did not wait for room in the queue", overflow)
+			}
+		case <-time.After(50 * time.Millisecond):
+			if overflow == OverflowDrop {
+				t.Fatalf("WrapAsync(%d): LogWrite waited for room in the queue", overflow)
+			}
+		}
+
+		close(inner.release)
+		<-logged
+		w.Flush()
+		want := 4
+		if overflow == OverflowDrop {
+			want = 3
+			if w.Dropped() != 1 {
+				t.Errorf("WrapAsync(%d): Dropped() = %d, want 1", overflow, w.Dropped())
+			}
+		}
+		if got := len(inner.Records()); got != want {
+			t.Errorf("WrapAsync(%d): inner writer got %d records, want %d", overflow, got, want)
+		}
+		if err := w.CloseErr(); err != nil {
+			t.Errorf("WrapAsync(%d): CloseErr: %s", overflow, err)
+		}
+	}
+}
+
+func TestRingLogWriter(t *testing.T) {
+	w := NewRingLogWriter(3).SetFormat("[%L] %M")
+	defer w.Close()
+
+	var buf bytes.Buffer
+	w.Dump(&buf)
+	if buf.Len() != 0 {
+		t.Errorf("RingLogWriter: empty ring dumped %q", buf.String())
+	}
+
+	for i, lvl := range []Level{FINE, DEBUG, INFO, WARNING, ERROR} {
+		w.LogWrite(newLogRecord(lvl, "source", fmt.Sprintf("record %d", i)))
+	}
+	if recs := w.Records(); len(recs) != 3 || recs[0].Message != "record 2" || recs[2].Message != "record 4" {
+		t.Errorf("RingLogWriter: Records() = %d records, want records 2 to 4", len(recs))
+	}
+
+	if err := w.Dump(&buf); err != nil {
+		t.Fatalf("RingLogWriter: Dump: %s", err)
+	}
+	if got, want := buf.String(), "[INFO] record 2\n[WARN] record 3\n[EROR] record 4\n"; got != want {
+		t.Errorf("RingLogWriter: Dump wrote %q, want %q", got, want)
+	}
+
+	w.Reset()
+	if recs := w.Records(); len(recs) != 0 {
+		t.Errorf("RingLogWriter: %d records after Reset", len(recs))
+	}
+}
+
+func TestSetFormatAll(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "all.log")
+	inner := &recordingLogWriter{}
+	skipped := &recordingLogWriter{}
+	buf := new(bytes.Buffer)
+
+	log := make(Logger)
+	log.AddFilter("file", DEBUG, NewFileLogWriter(fname, false, false).SetFormat("old %M"))
+	log.AddFilter("prefix", DEBUG, NewPrefixLogWriter(inner, "", "").SetFormat("old %M"))
+	log.AddFilter("topics", DEBUG, NewTopicRoutingWriter(dir, "%s.log", 0).SetFormat("old %M"))
+	log.AddFilter("records", DEBUG, skipped)
+	log.AddWriter("buffer", DEBUG, buf, "old %M")
+
+	// Each record goes to a single filter, so hand it to every writer
+	logAll := func(msg string) {
+		for _, filt := range log {
+			filt.LogWrite(newLogRecord(INFO, "source", msg))
+		}
+	}
+	logAll("before")
+	log.SetFormatAll("new [%L] %M")
+	logAll("after")
+	log.Close()
+
+	want := "old before\nnew [INFO] after\n"
+	if got := string(readLogFile(t, fname, 2)); got != want {
+		t.Errorf("SetFormatAll: file holds %q, want %q", got, want)
+	}
+	if got := string(readLogFile(t, filepath.Join(dir, "default.log"), 2)); got != want {
+		t.Errorf("SetFormatAll: topic file holds %q, want %q", got, want)
+	}
+	if got := buf.String(); got != want {
+		t.Errorf("SetFormatAll: buffer holds %q, want %q", got, want)
+	}
+	if recs := inner.Records(); len(recs) != 2 || recs[0].Message != "old before" || recs[1].Message != "new [INFO] after" {
+		t.Errorf("SetFormatAll: got %d prefixed records", len(recs))
+	}
+	if recs := skipped.Records(); len(recs) != 2 || recs[1].Message != "after" {
+		t.Errorf("SetFormatAll: writer without a format got %v", recs)
+	}
+}
+
+func TestAuditLogWriter(t *testing.T) {
+	key := []byte("secret")
+	defer os.Remove(testLogFile)
+
+	w := NewAuditLogWriter(testLogFile, key, false, false)
+	w.LogWrite(newLogRecord(INFO, "source", "user 1 logged in"))
+	w.LogWrite(newLogRecord(WARNING, "source", "user 1 changed\npassword"))
+	w.LogWrite(newLogRecord(INFO, "source", "user 1 logged out"))
+	w.LogWrite(newLogRecord(INFO, "source", "user 1 sent a CRLF line\r\nending in CR\r"))
+	w.Close()
+
+	contents := readLogFile(t, testLogFile, 4)
+	lines := bytes.SplitAfter(contents, []byte{'\n'})[:4]
+
+	if ok, err := VerifyAuditLog(bytes.NewReader(contents), key); !ok || err != nil {
+		t.Fatalf("intact audit log failed verification: %v, %v\n%s", ok, err, contents)
+	}
+	if ok, _ := VerifyAuditLog(bytes.NewReader(contents), []byte("wrong")); ok {
+		t.Errorf("audit log verified with the wrong key")
+	}
+
+	tampered := bytes.Replace(contents, []byte("user 1 logged out"), []byte("user 2 logged out"), 1)
+	if ok, err := VerifyAuditLog(bytes.NewReader(tampered), key); ok || err == nil {
+		t.Errorf("modified audit log passed verification")
+	}
+
+	deleted := bytes.Join([][]byte{lines[0], lines[2]}, nil)
+	if ok, err := VerifyAuditLog(bytes.NewReader(deleted), key); ok || err == nil {
+		t.Errorf("audit log with a deleted line passed verification")
+	}
+
+	// Reopening resumes the chain
+	w = NewAuditLogWriter(testLogFile, key, false, false)
+	w.LogWrite(newLogRecord(INFO, "source", "user 2 logged in"))
+	w.Close()
+
+	contents = readLogFile(t, testLogFile, 5)
+	if ok, err := VerifyAuditLog(bytes.NewReader(contents), key); !ok || err != nil {
+		t.Errorf("resumed audit log failed verification: %v, %v\n%s", ok, err, contents)
+	}
+}
+
+func TestChannelLogWriter(t *testing.T) {
+	w, records := NewChannelLogWriter(2)
+
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, w)
+	l.Info("first")
+	l.Warn("second")
+	l.Error("third")
+
+	if got, want := w.(*ChannelLogWriter).Dropped(), uint64(1); got != want {
+		t.Errorf("ChannelLogWriter: got %d dropped, want %d", got, want)
+	}
+
+	l.Close()
+	var got []string
+	for rec := range records {
+		got = append(got, rec.Level.String()+" "+rec.Message)
+	}
+	if want := []string{"INFO first", "WARN second"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("ChannelLogWriter: got %q, want %q", got, want)
+	}
+}
+
+func TestXMLLogWriterAppend(t *testing.T) {
+	defer os.Remove(testLogFile)
+	os.Remove(testLogFile)
+
+	w := NewXMLLogWriter(testLogFile, false, false)
+	w.LogWrite(newLogRecord(CRITICAL, "source", "first run"))
+	w.Close()
+	readLogFile(t, testLogFile, 7)
+
+	w = NewXMLLogWriter(testLogFile, false, false)
+	w.LogWrite(newLogRecord(INFO, "source", "second run"))
+	w.Close()
+	contents := readLogFile(t, testLogFile, 12)
+
+	var doc struct {
+		XMLName xml.Name `xml:"log"`
+		Records []struct {
+			Level   string `xml:"level,attr"`
+			Message string `xml:"message"`
+		} `xml:"record"`
+	}
+	if err := xml.Unmarshal(contents, &doc); err != nil {
+		t.Fatalf("appended xml log is not a valid document: %s\n%s", err, contents)
+	}
+	if len(doc.Records) != 2 || doc.Records[0].Message != "first run" || doc.Records[1].Message != "second run" {
+		t.Errorf("appended xml log has wrong records: %+v", doc.Records)
+	}
+	if n := bytes.Count(contents, []byte("<log ")); n != 1 {
+		t.Errorf("appended xml log has %d headers, want 1", n)
+	}
+	if n := bytes.Count(contents, []byte("</log>")); n != 1 {
+		t.Errorf("appended xml log has %d trailers, want 1", n)
+	}
+}
+
+func TestXMLLogWriterStrict(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "strict.xml")
+	w := NewXMLLogWriter(fname, true, false)
+	w.LogWrite(newLogRecord(INFO, "a<b>", "x < y && z > \"w\""))
+	w.Flush()
+	w.Rotate()
+	w.LogWrite(newLogRecord(INFO, "source", "héllo 世界 \xff"))
+	if err := w.CloseErr(); err != nil {
+		t.Fatalf("XMLLogWriter: %s", err)
+	}
+
+	for name, want := range map[string]string{
+		rotatedName(fname, "", 1): "x < y && z > \"w\"",
+		fname:                     "héllo 世界 \uFFFD",
+	} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("XMLLogWriter: %s", err)
+		}
+		if !bytes.HasPrefix(contents, []byte(`<?xml version="1.0" encoding="UTF-8"?>`+"\n")) {
+			t.Errorf("XMLLogWriter: %s does not start with an XML declaration: %q", name, contents)
+		}
+
+		var doc struct {
+			Records []struct {
+				Message string `xml:"message"`
+			} `xml:"record"`
+		}
+		dec := xml.NewDecoder(bytes.NewReader(contents))
+		dec.Strict = true
+		if err := dec.Decode(&doc); err != nil {
+			t.Fatalf("XMLLogWriter: %s is not strictly valid XML: %s\n%s", name, err, contents)
+		}
+		if len(doc.Records) != 1 || doc.Records[0].Message != want {
+			t.Errorf("XMLLogWriter: %s holds %+v, want the message %q", name, doc.Records, want)
+		}
+	}
+}
+
+func TestFileWrappersCloseErr(t *testing.T) {
+	const base = "_logtest_closeerr"
+	defer func() {
+		names, _ := filepath.Glob(base + "*")
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}()
+
+	// CloseErr returns once every record is in the files
+	for _, test := range []struct {
+		name  string
+		w     CloserErr
+		files []string
+	}{
+		{"DualFormatFileWriter", NewDualFormatFileWriter(base+"_text.log", base+"_json.log", "%M", false, false), []string{base + "_text.log", base + "_json.log"}},
+		{"AuditLogWriter", NewAuditLogWriter(base+"_audit.log", []byte("secret"), false, false), []string{base + "_audit.log"}},
+		{"ShardedFileLogWriter", NewShardedFileLogWriter(base+"_shard.log", 1), []string{base + "_shard.log.0"}},
+	} {
+		test.w.(LogWriter).LogWrite(newLogRecord(INFO, "source", "closing"))
+		if err := test.w.CloseErr(); err != nil {
+			t.Errorf("%s: CloseErr: %s", test.name, err)
+		}
+		for _, fname := range test.files {
+			if contents, _ := ioutil.ReadFile(fname); !bytes.Contains(contents, []byte("closing")) {
+				t.Errorf("%s: %s holds %q after CloseErr", test.name, fname, contents)
+			}
+		}
+	}
+
+	// and reports a record that could not be written
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+	w := NewAuditLogWriter("/dev/full", []byte("secret"), false, false)
+	w.LogWrite(newLogRecord(INFO, "source", "lost"))
+	if err := w.CloseErr(); err == nil {
+		t.Errorf("AuditLogWriter: CloseErr on a full disk returned nil")
+	}
+}
+
+func TestDualFormatFileWriter(t *testing.T) {
+	const (
+		textFile = "_logtest_text.log"
+		jsonFile = "_logtest_json.log"
+	)
+	cleanup := func() {
+		for _, pattern := range []string{"_logtest_text*.log", "_logtest_json*.log"} {
+			names, _ := filepath.Glob(pattern)
+			for _, name := range names {
+				os.Remove(name)
+			}
+		}
+	}
+	cleanup()
+	defer cleanup()
+
+	w := NewDualFormatFileWriter(textFile, jsonFile, "[%L] %M", true, false).SetRotateLines(2)
+	for i := 0; i < 5; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("message %d", i)))
+	}
+	w.Close()
+	for i := 0; i < 100; i++ {
+		text, _ := ioutil.ReadFile(textFile)
+		js, _ := ioutil.ReadFile(jsonFile)
+		if bytes.Contains(text, []byte("message 4")) && bytes.Contains(js, []byte("message 4")) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, files := range [][2]string{
+		{"_logtest_text.001.log", "_logtest_json.001.log"},
+		{"_logtest_text.002.log", "_logtest_json.002.log"},
+		{textFile, jsonFile},
+	} {
+		text, err := ioutil.ReadFile(files[0])
+		if err != nil {
+			t.Fatalf("read(%q): %s", files[0], err)
+		}
+		js, err := ioutil.ReadFile(files[1])
+		if err != nil {
+			t.Fatalf("read(%q): %s", files[1], err)
+		}
+
+		textLines := strings.Split(strings.TrimSpace(string(text)), "\n")
+		jsonLines := strings.Split(strings.TrimSpace(string(js)), "\n")
+		if len(textLines) != len(jsonLines) {
+			t.Fatalf("%s has %d lines but %s has %d", files[0], len(textLines), files[1], len(jsonLines))
+		}
+		for i := range textLines {
+			var rec LogRecord
+			if err := json.Unmarshal([]byte(jsonLines[i]), &rec); err != nil {
+				t.Fatalf("%s: bad JSON line %q: %s", files[1], jsonLines[i], err)
+			}
+			if want := "[INFO] " + rec.Message; textLines[i] != want {
+				t.Errorf("%s: line %d is %q, but %s has %q", files[0], i, textLines[i], files[1], want)
+			}
+		}
+	}
+}
+
+func TestDualFormatFileWriterDaily(t *testing.T) {
+	at := time.Date(2024, 3, 4, 23, 0, 0, 0, time.Local)
+	defer func(clock func() time.Time) { timeNow = clock }(timeNow)
+	timeNow = func() time.Time { return at }
+
+	dir := t.TempDir()
+	textFile, jsonFile := filepath.Join(dir, "text.log"), filepath.Join(dir, "json.log")
+	w := NewDualFormatFileWriter(textFile, jsonFile, "%M", true, true)
+	if w.text.daily || w.json.daily {
+		t.Errorf("inner writers rotate daily of their own accord")
+	}
+
+	rec := newLogRecord(INFO, "source", "monday")
+	rec.Created = at
+	w.LogWrite(rec)
+	at = at.Add(2 * time.Hour)
+	rec = newLogRecord(INFO, "source", "tuesday")
+	rec.Created = at
+	w.LogWrite(rec)
+	w.Close()
+	<-w.text.done
+	<-w.json.done
+
+	for _, base := range []string{"text", "json"} {
+		kept, _ := filepath.Glob(filepath.Join(dir, base+".*.log"))
+		if len(kept) != 1 {
+			t.Fatalf("%s: kept %q, want one file", base, kept)
+		}
+		if old, _ := ioutil.ReadFile(kept[0]); !bytes.Contains(old, []byte("monday")) || bytes.Contains(old, []byte("tuesday")) {
+			t.Errorf("%s: got %q", kept[0], old)
+		}
+	}
+	if got, _ := ioutil.ReadFile(textFile); string(got) != "tuesday\n" {
+		t.Errorf("%s: got %q, want %q", textFile, got, "tuesday\n")
+	}
+}
+
+func TestTailFile(t *testing.T) {
+	const base = "_logtest_tail.log"
+	cleanup := func() {
+		names, _ := filepath.Glob("_logtest_tail*")
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}
+	defer cleanup()
+	cleanup()
+
+	write := func(name string, lines ...string) {
+		if err := ioutil.WriteFile(name, []byte(strings.Join(lines, "\n")+"\n"), 0660); err != nil {
+			t.Fatalf("seeding %s: %s", name, err)
+		}
+	}
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	io.WriteString(zw, "line 1\nline 2\n")
+	zw.Close()
+	if err := ioutil.WriteFile(rotatedName(base, "", 1)+".gz", gz.Bytes(), 0660); err != nil {
+		t.Fatalf("seeding compressed log: %s", err)
+	}
+	write(rotatedName(base, "", 2), "line 3", "line 4")
+	write(rotatedName(base, "", 10), "line 5", "line 6")
+	write(base, "line 7")
+	write("_logtest_tail.other.log", "unrelated")
+
+	tests := []struct {
+		n    int
+		want []string
+	}{
+		{0, nil},
+		{1, []string{"line 7"}},
+		{4, []string{"line 4", "line 5", "line 6", "line 7"}},
+		{20, []string{"line 1", "line 2", "line 3", "line 4", "line 5", "line 6", "line 7"}},
+	}
+	for _, test := range tests {
+		got, err := TailFile(base, test.n)
+		if err != nil {
+			t.Fatalf("TailFile(%d): %s", test.n, err)
+		}
+		if strings.Join(got, "|") != strings.Join(test.want, "|") {
+			t.Errorf("TailFile(%d) = %q, want %q", test.n, got, test.want)
+		}
+	}
+}
+
+func TestFileLogWriterSyncInterval(t *testing.T) {
+	defer func(sync func(*os.File) error) { syncFile = sync }(syncFile)
+	var syncs int32
+	syncFile = func(f *os.File) error {
+		atomic.AddInt32(&syncs, 1)
+		return f.Sync()
+	}
+
+	const interval = 20 * time.Millisecond
+	fname := filepath.Join(t.TempDir(), "sync.log")
+	w := NewFileLogWriter(fname, true, false).SetSyncInterval(interval)
+	w.LogWrite(newLogRecord(INFO, "source", "message"))
+
+	time.Sleep(10 * interval)
+	w.Close()
+	if got := atomic.LoadInt32(&syncs); got < 3 || got > 12 {
+		t.Errorf("SetSyncInterval: %d syncs in %s, want about 10", got, 10*interval)
+	}
+
+	// Rotating and closing sync the file even between ticks
+	w = NewFileLogWriter(fname, true, false).SetSyncInterval(time.Hour)
+	w.LogWrite(newLogRecord(INFO, "source", "message"))
+	for _, step := range []struct {
+		name string
+		do   func()
+	}{
+		{"Rotate", func() { w.Rotate(); w.Flush() }},
+		{"Close", func() { w.CloseErr() }},
+	} {
+		before := atomic.LoadInt32(&syncs)
+		step.do()
+		if got := atomic.LoadInt32(&syncs); got <= before {
+			t.Errorf("SetSyncInterval: %s did not sync the file", step.name)
+		}
+	}
+}
+
+func TestFileLogWriterSync(t *testing.T) {
+	defer func(sync func(*os.File) error) { syncFile = sync }(syncFile)
+	var syncs int32
+	syncFile = func(f *os.File) error {
+		atomic.AddInt32(&syncs, 1)
+		return f.Sync()
+	}
+
+	for _, test := range []struct {
+		mode  SyncMode
+		syncs int32
+	}{
+		{SyncNever, 0},
+		{SyncEveryWrite, 3},
+	} {
+		atomic.StoreInt32(&syncs, 0)
+		fname := filepath.Join(t.TempDir(), "sync.log")
+		w := NewFileLogWriter(fname, false, false).SetFormat("%M").SetBufferSize(4096).SetSync(test.mode)
+		for i := 0; i < 3; i++ {
+			w.LogWrite(newLogRecord(INFO, "source", "message"))
+		}
+		w.Flush()
+
+		if got := atomic.LoadInt32(&syncs); got != test.syncs {
+			t.Errorf("SetSync(%d): %d syncs for 3 records, want %d", test.mode, got, test.syncs)
+		}
+		if test.mode == SyncEveryWrite {
+			if got, _ := ioutil.ReadFile(fname); strings.Count(string(got), "message") != 3 {
+				t.Errorf("SetSync(%d): file holds %q, want every record", test.mode, got)
+			}
+		}
+		w.Close()
+	}
+}
+
+func TestFileLogWriterMicrobatch(t *testing.T) {
+	const writers, each = 8, 500
+	pad := strings.Repeat("x", 40)
+	fname := filepath.Join(t.TempDir(), "batch.log")
+	w := NewFileLogWriter(fname, false, false).SetFormat("%M").SetMicrobatch(512, 0)
+
+	var wg sync.WaitGroup
+	for g := 0; g < writers; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("writer %d record %d %s", g, i, pad)))
+			}
+		}(g)
+	}
+	wg.Wait()
+	if err := w.CloseErr(); err != nil {
+		t.Fatalf("SetMicrobatch: %s", err)
+	}
+
+	// Every line is whole, and each writer's lines are in order
+	contents, _ := ioutil.ReadFile(fname)
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if len(lines) != writers*each {
+		t.Fatalf("SetMicrobatch: got %d lines, want %d", len(lines), writers*each)
+	}
+	next := make([]int, writers)
+	for _, line := range lines {
+		var g, i int
+		var rest string
+		if n, _ := fmt.Sscanf(line, "writer %d record %d %s", &g, &i, &rest); n != 3 || rest != pad || g < 0 || g >= writers || i != next[g] {
+			t.Fatalf("SetMicrobatch: malformed or misordered line %q", line)
+		}
+		next[g]++
+	}
+
+	// With a delay, a lone record waits for the rest of its batch
+	fname = filepath.Join(t.TempDir(), "delayed.log")
+	w = NewFileLogWriter(fname, false, false).SetFormat("%M").SetMicrobatch(4096, time.Hour)
+	defer w.CloseErr()
+	w.LogWrite(newLogRecord(INFO, "source", "held"))
+	time.Sleep(20 * time.Millisecond)
+	if contents, _ := ioutil.ReadFile(fname); len(contents) != 0 {
+		t.Errorf("SetMicrobatch: batch written before its delay: %q", contents)
+	}
+	w.Flush()
+	if contents, _ := ioutil.ReadFile(fname); string(contents) != "held\n" {
+		t.Errorf("SetMicrobatch: file holds %q after Flush, want %q", contents, "held\n")
+	}
+}
+
+func TestFileLogWriterAdaptiveFlush(t *testing.T) {
+	const idle = 100 * time.Millisecond
+	fname := filepath.Join(t.TempDir(), "adaptive.log")
+	w := NewFileLogWriter(fname, false, false).SetFormat("%M").SetAdaptiveFlush(64, idle)
+	defer w.CloseErr()
+	size := func() int {
+		contents, _ := ioutil.ReadFile(fname)
+		return len(contents)
+	}
+
+	// A burst past the high-water mark is written out without waiting
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", "a burst of records"))
+	}
+	for size() == 0 && time.Since(start) < idle/2 {
+		time.Sleep(time.Millisecond)
+	}
+	if size() == 0 {
+		t.Fatalf("SetAdaptiveFlush: burst not written before the idle timeout")
+	}
+	w.Flush()
+	burst := size()
+
+	// A trickle below it waits until the writer has been idle
+	for i := 0; i < 3; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", "trickle"))
+		time.Sleep(idle / 5)
+		if size() != burst {
+			t.Fatalf("SetAdaptiveFlush: trickle written after %d records, before the writer was idle", i+1)
+		}
+	}
+	time.Sleep(2 * idle)
+	if got, want := size(), burst+3*len("trickle\n"); got != want {
+		t.Errorf("SetAdaptiveFlush: %d bytes written once idle, want %d", got, want)
+	}
+}
+
+func TestFileLogWriterSkewThreshold(t *testing.T) {
+	defer func(clock func() time.Time) {
+		timeNow = clock
+	}(timeNow)
+	now := time.Date(2020, time.March, 1, 12, 0, 0, 0, time.Local)
+	timeNow = func() time.Time { return now }
+
+	fname := filepath.Join(t.TempDir(), "skew.log")
+	w := NewFileLogWriter(fname, true, true).SetFormat("%M").SetSkewThreshold(time.Hour)
+
+	// A record from far in the future must not rotate today's file
+	w.LogWrite(&LogRecord{Level: INFO, Created: now.AddDate(10, 0, 0), Message: "future"})
+	w.LogWrite(&LogRecord{Level: INFO, Created: now, Message: "present"})
+	w.Flush()
+	if names, _ := filepath.Glob(filepath.Join(filepath.Dir(fname), "skew.*-*.log")); len(names) != 0 {
+		t.Errorf("SetSkewThreshold: skewed record rotated the file: %q", names)
+	}
+	if !w.skewwarned {
+		t.Errorf("SetSkewThreshold: skewed record was not reported")
+	}
+
+	// Records within the threshold still rotate at midnight
+	now = nextMidnight(now).Add(time.Second)
+	w.LogWrite(&LogRecord{Level: INFO, Created: now, Message: "tomorrow"})
+	w.Flush()
+	if names, _ := filepath.Glob(filepath.Join(filepath.Dir(fname), "skew.*-*.log")); len(names) != 1 {
+		t.Errorf("SetSkewThreshold: got rotated files %q, want one", names)
+	}
+	w.CloseErr()
+}
+
+func TestFileLogWriterLifecycleMarkers(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "markers.log")
+	w := NewFileLogWriter(fname, false, false).SetFormat("[%L] %M").SetLifecycleMarkers(true)
+	w.LogWrite(newLogRecord(WARNING, "source", "in between"))
+	if err := w.CloseErr(); err != nil {
+		t.Fatalf("CloseErr: %s", err)
+	}
+
+	contents, err := ioutil.ReadFile(fname)
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("SetLifecycleMarkers: got %d lines, want 3: %q", len(lines), contents)
+	}
+	if !strings.HasPrefix(lines[0], "[INFO] logger opened at ") {
+		t.Errorf("SetLifecycleMarkers: first line %q is not the opening marker", lines[0])
+	}
+	if lines[1] != "[WARN] in between" {
+		t.Errorf("SetLifecycleMarkers: record %q, want it between the markers", lines[1])
+	}
+	if !strings.HasPrefix(lines[2], "[INFO] logger closed at ") {
+		t.Errorf("SetLifecycleMarkers: last line %q is not the closing marker", lines[2])
+	}
+
+	// The markers of a JSON file are JSON too
+	fname = filepath.Join(t.TempDir(), "markers.json")
+	w = NewJSONLogWriter(fname, false, false).SetLifecycleMarkers(true)
+	w.LogWrite(newLogRecord(WARNING, "source", "in between"))
+	if err := w.CloseErr(); err != nil {
+		t.Fatalf("CloseErr: %s", err)
+	}
+	contents, _ = ioutil.ReadFile(fname)
+	lines = strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("SetLifecycleMarkers: got %d JSON lines, want 3: %q", len(lines), contents)
+	}
+	for _, line := range lines {
+		if _, err := ParseJSONLogLine([]byte(line)); err != nil {
+			t.Errorf("SetLifecycleMarkers: %s", err)
+		}
+	}
+}
+
+func TestFileLogWriterRotateNamer(t *testing.T) {
+	defer func(clock func() time.Time) {
+		timeNow = clock
+	}(timeNow)
+	now := time.Date(2024, time.January, 15, 12, 0, 0, 0, time.Local)
+	timeNow = func() time.Time { return now }
+
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "app.log")
+	w := NewFileLogWriter(fname, true, false).SetFormat("%M").SetRotateNamer(func(base string, t time.Time, seq int) string {
+		return filepath.Join(filepath.Dir(base), t.Format("2006/01/02"), fmt.Sprintf("%s.%d", filepath.Base(base), seq))
+	})
+	for _, msg := range []string{"first", "second"} {
+		w.LogWrite(newLogRecord(INFO, "source", msg))
+		w.Flush()
+		w.Rotate()
+		w.Flush()
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "current"))
+	if err := w.CloseErr(); err != nil {
+		t.Fatalf("SetRotateNamer: %s", err)
+	}
+
+	for name, want := range map[string]string{
+		"2024/01/15/app.log.1": "first\n",
+		"2024/01/15/app.log.2": "second\n",
+		"app.log":              "current\n",
+	} {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("SetRotateNamer: %s", err)
+		} else if string(contents) != want {
+			t.Errorf("SetRotateNamer: %s holds %q, want %q", name, contents, want)
+		}
+	}
+}
+
+func TestJSONLogWriter(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "app.json")
+	w := NewJSONLogWriter(fname, true, false).SetRotateLines(2)
+	w.LogWrite(newLogRecord(INFO, "main.main:12", "first"))
+	w.LogWrite(newLogRecord(WARNING, "main.main:13", `a "quoted" line`+"\nand another"))
+	rec := newLogRecord(ERROR, "main.main:14", "third")
+	rec.Category = "db"
+	w.LogWrite(rec)
+	if err := w.CloseErr(); err != nil {
+		t.Fatalf("NewJSONLogWriter: %s", err)
+	}
+
+	// The first two records were rotated away together
+	rotated, _ := filepath.Glob(fname + ".*")
+	if len(rotated) != 1 {
+		t.Fatalf("NewJSONLogWriter: rotated files %q, want 1", rotated)
+	}
+	var lines []string
+	for _, name := range []string{rotated[0], fname} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("NewJSONLogWriter: %s", err)
+		}
+		lines = append(lines, strings.SplitAfter(string(contents), "\n")...)
+	}
+
+	created := now.Format(time.RFC3339Nano)
+	want := []string{
+		`{"level":"INFO","timestamp":"` + created + `","source":"main.main:12","message":"first"}` + "\n",
+		`{"level":"WARNING","timestamp":"` + created + `","source":"main.main:13","message":"a \"quoted\" line\nand another"}` + "\n",
+		"",
+		`{"level":"ERROR","timestamp":"` + created + `","source":"main.main:14","message":"third","category":"db"}` + "\n",
+		"",
+	}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("NewJSONLogWriter: got\n%q\nwant\n%q", lines, want)
+	}
+
+	// The lines can be read back
+	got, err := ParseJSONLogLine([]byte(lines[3]))
+	if err != nil {
+		t.Fatalf("ParseJSONLogLine: %s", err)
+	}
+	if got.Level != ERROR || !got.Created.Equal(now) || got.Source != "main.main:14" || got.Message != "third" || got.Category != "db" {
+		t.Errorf("ParseJSONLogLine: got %+v", got)
+	}
+}
+
+func TestLogfmtFormatter(t *testing.T) {
+	created := time.Date(2024, time.March, 4, 5, 6, 7, 0, time.UTC)
+	categorized := &LogRecord{Level: ERROR, Created: created, Message: "failed", Category: "db", Topic: "orders"}
+	for _, test := range []struct {
+		rec  *LogRecord
+		want string
+	}{
+		{&LogRecord{Level: INFO, Created: created, Source: "main.main:12", Message: "started"},
+			`time=2024-03-04T05:06:07Z level=info source=main.main:12 msg=started`},
+		{&LogRecord{Level: WARNING, Message: `disk "sda" at 91%, a=b`},
+			`level=warning msg="disk \"sda\" at 91%, a=b"`},
+		{&LogRecord{Level: DEBUG, Message: "two\nlines\x00"},
+			`level=debug msg="two\nlines\x00"`},
+		{&LogRecord{Level: CRITICAL},
+			`level=critical msg=""`},
+		{categorized,
+			`time=2024-03-04T05:06:07Z level=error msg=failed category=db topic=orders`},
+	} {
+		if got := (LogfmtFormatter{}).Format(test.rec); got != test.want {
+			t.Errorf("LogfmtFormatter: got %s, want %s", got, test.want)
+		}
+	}
+
+	fname := filepath.Join(t.TempDir(), "app.log")
+	w := NewFileLogWriter(fname, false, false).SetFormatter(LogfmtFormatter{})
+	w.LogWrite(categorized)
+	if err := w.CloseErr(); err != nil {
+		t.Fatalf("SetFormatter: %s", err)
+	}
+	want := "time=2024-03-04T05:06:07Z level=error msg=failed category=db topic=orders\n"
+	if got, _ := ioutil.ReadFile(fname); string(got) != want {
+		t.Errorf("SetFormatter: got %q, want %q", got, want)
+	}
+}
+
+func TestFileLogWriterCompressLevel(t *testing.T) {
+	cleanup := func() {
+		names, _ := filepath.Glob("_logtest_gz*")
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}
+	defer cleanup()
+	cleanup()
+
+	rotated := func(level int) []byte {
+		fname := fmt.Sprintf("_logtest_gz%d.log", level)
+		w := NewFileLogWriter(fname, true, false).SetFormat("%M").SetCompress(true).SetCompressLevel(level)
+		for i := 0; i < 500; i++ {
+			w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("compressible line %d", i%7)))
+		}
+		w.Flush()
+		w.Rotate()
+		if err := w.CloseErr(); err != nil {
+			t.Fatalf("level %d: %s", level, err)
+		}
+
+		if _, err := os.Stat(rotatedName(fname, "", 1)); !os.IsNotExist(err) {
+			t.Errorf("level %d: uncompressed rotated file left behind (%v)", level, err)
+		}
+		fd, err := os.Open(rotatedName(fname, "", 1) + ".gz")
+		if err != nil {
+			t.Fatalf("level %d: %s", level, err)
+		}
+		defer fd.Close()
+		zr, err := gzip.NewReader(fd)
+		if err != nil {
+			t.Fatalf("level %d: %s", level, err)
+		}
+		contents, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("level %d: %s", level, err)
+		}
+		return contents
+	}
+
+	fast, best := rotated(gzip.BestSpeed), rotated(gzip.BestCompression)
+	if len(fast) == 0 {
+		t.Fatalf("no records in the compressed file")
+	}
+	if !bytes.Equal(fast, best) {
+		t.Errorf("BestSpeed and BestCompression files differ:\n%q\n%q", fast, best)
+	}
+
+	if w := NewFileLogWriter("_logtest_gzbad.log", true, false).SetCompressLevel(42); w.compresslevel != gzip.DefaultCompression {
+		t.Errorf("SetCompressLevel(42) = %d, want the default", w.compresslevel)
+	} else {
+		w.Close()
+	}
+}
+
+func TestFileLogWriterCompressInBackground(t *testing.T) {
+	started, release := make(chan string, 2), make(chan struct{})
+	defer func(gz func(string, int) error) { gzipFile = gz }(gzipFile)
+	gzipFile = func(name string, level int) error {
+		started <- name
+		<-release
+		return compressFile(name, level)
+	}
+
+	fname := filepath.Join(t.TempDir(), "app.log")
+	w := NewFileLogWriter(fname, true, false).SetFormat("%M").SetRotateLines(1).SetCompress(true)
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	w.LogWrite(newLogRecord(INFO, "source", "second"))
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("rotated file never compressed")
+	}
+
+	// Logging, and rotating again, carry on while the first file is compressed
+	done := make(chan struct{})
+	go func() {
+		w.LogWrite(newLogRecord(INFO, "source", "third"))
+		w.Flush()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatalf("logging blocked on compression")
+	}
+	if got, _ := ioutil.ReadFile(fname); string(got) != "third\n" {
+		t.Errorf("log file: got %q, want %q", got, "third\n")
+	}
+
+	close(release)
+	if err := w.CloseErr(); err != nil {
+		t.Fatalf("CloseErr: %s", err)
+	}
+	for num, want := range []string{"first\n", "second\n"} {
+		rotated := rotatedName(fname, "", num+1)
+		if _, err := os.Stat(rotated); !os.IsNotExist(err) {
+			t.Errorf("%s: uncompressed rotated file left behind (%v)", rotated, err)
+		}
+		fd, err := os.Open(rotated + ".gz")
+		if err != nil {
+			t.Fatalf("%s", err)
+		}
+		zr, err := gzip.NewReader(fd)
+		if err != nil {
+			fd.Close()
+			t.Fatalf("%s: %s", rotated, err)
+		}
+		got, _ := ioutil.ReadAll(zr)
+		fd.Close()
+		if string(got) != want {
+			t.Errorf("%s: got %q, want %q", rotated, got, want)
+		}
+	}
+}
+
+func TestFileLogWriterRotateStrings(t *testing.T) {
+	w := NewFileLogWriter(filepath.Join(t.TempDir(), "app.log"), false, false)
+	defer w.Close()
+
+	w.SetRotateSizeString("100M").SetRotateLinesString(" 500k ")
+	if want := 100 * 1024 * 1024; w.maxsize != want {
+		t.Errorf("SetRotateSizeString: maxsize = %d, want %d", w.maxsize, want)
+	}
+	if want := 500 * 1000; w.maxlines != want {
+		t.Errorf("SetRotateLinesString: maxlines = %d, want %d", w.maxlines, want)
+	}
+
+	// Bad counts leave the limits alone
+	w.SetRotateSizeString("lots").SetRotateLinesString("5X")
+	if want := 100 * 1024 * 1024; w.maxsize != want {
+		t.Errorf("SetRotateSizeString(bad): maxsize = %d, want %d", w.maxsize, want)
+	}
+	if want := 500 * 1000; w.maxlines != want {
+		t.Errorf("SetRotateLinesString(bad): maxlines = %d, want %d", w.maxlines, want)
+	}
+}
+
+func TestReopenAll(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "app.log")
+	w := NewFileLogWriter(fname, false, false).SetFormat("%M")
+
+	w.LogWrite(newLogRecord(INFO, "source", "before"))
+	// logrotate moves the file away, and the writer follows on its signal
+	w.Flush()
+	if err := os.Rename(fname, fname+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ReopenAll(); err != nil {
+		t.Fatalf("ReopenAll: %s", err)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "after"))
+	if err := w.CloseErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := ioutil.ReadFile(fname + ".1"); string(got) != "before\n" {
+		t.Errorf("ReopenAll: moved file holds %q, want %q", got, "before\n")
+	}
+	if got, _ := ioutil.ReadFile(fname); string(got) != "after\n" {
+		t.Errorf("ReopenAll: reopened file holds %q, want %q", got, "after\n")
+	}
+
+	// Closed writers are left alone
+	if err := w.Reopen(); err != nil {
+		t.Errorf("Reopen after Close: %s", err)
+	}
+	fileWriters.Lock()
+	_, ok := fileWriters.m[w]
+	fileWriters.Unlock()
+	if ok {
+		t.Errorf("ReopenAll: closed writer still registered")
+	}
+}
+
+func TestFileLogWriterWriteErrorPolicy(t *testing.T) {
+	// Every write to /dev/full fails as on a full disk
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+
+	for _, test := range []struct {
+		policy          WriteErrorPolicy
+		failed, dropped uint64
+		handled         int
+		stopped         bool
+	}{
+		{WriteErrorStop, 1, 0, 1, true},
+		{WriteErrorRetry, 6, 2, 6, false},
+		{WriteErrorStderr, 2, 0, 2, false},
+	} {
+		handled := 0
+		w := NewFileLogWriter("/dev/full", false, false).
+			SetWriteErrorPolicy(test.policy).
+			SetWriteRetries(2, time.Millisecond).
+			SetWriteErrorHandler(func(err error, rec *LogRecord) {
+				if rec == nil || rec.Message != "full" {
+					t.Errorf("policy %d: handler given %v", test.policy, rec)
+				}
+				handled++
+			})
+		w.LogWrite(newLogRecord(INFO, "source", "full"))
+		w.LogWrite(newLogRecord(INFO, "source", "full"))
+		err := w.CloseErr()
+
+		if got := w.Failed(); got != test.failed {
+			t.Errorf("policy %d: Failed() = %d, want %d", test.policy, got, test.failed)
+		}
+		if got := w.Dropped(); got != test.dropped {
+			t.Errorf("policy %d: Dropped() = %d, want %d", test.policy, got, test.dropped)
+		}
+		if handled != test.handled {
+			t.Errorf("policy %d: handler called %d times, want %d", test.policy, handled, test.handled)
+		}
+		if stopped := err != nil; stopped != test.stopped {
+			t.Errorf("policy %d: CloseErr() = %v, want stopped %v", test.policy, err, test.stopped)
+		}
+	}
+}
+
+func TestFileLogWriterWriteErrorStderr(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full")
+	}
+	r, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %s", err)
+	}
+	defer func(f *os.File) { os.Stderr = f }(os.Stderr)
+	os.Stderr = pw
+
+	// The record falls back to standard error as the file would have had it
+	w := NewFileLogWriter("/dev/full", false, false).SetFormatter(JSONFormatter{}).SetWriteErrorPolicy(WriteErrorStderr)
+	w.LogWrite(newLogRecord(INFO, "source", "full"))
+	w.CloseErr()
+	pw.Close()
+	out, _ := ioutil.ReadAll(r)
+	r.Close()
+
+	found := false
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		rec, err := ParseJSONLogLine([]byte(line))
+		if err != nil {
+			t.Errorf("WriteErrorStderr: %s", err)
+		} else if rec.Message == "full" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("WriteErrorStderr: no JSON record on standard error: %q", out)
+	}
+}
+
+func TestLevelSplitFileWriter(t *testing.T) {
+	dir := t.TempDir()
+	w := NewLevelSplitFileWriter(filepath.Join(dir, "app.log"), true, ERROR, INFO).SetFormat("%L %M")
+	if w.File(DEBUG) != nil || w.File(INFO) != w.File(WARNING) || w.File(ERROR) != w.File(CRITICAL) || w.File(INFO) == w.File(ERROR) {
+		t.Errorf("NewLevelSplitFileWriter: levels not split at INFO and ERROR")
+	}
+	w.File(ERROR).SetRotateLines(1)
+
+	for _, lvl := range []Level{DEBUG, INFO, WARNING, ERROR, CRITICAL} {
+		w.LogWrite(newLogRecord(lvl, "source", "message"))
+	}
+	if err := w.CloseErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"app.info.log":                      "INFO message\nWARN message\n",
+		"app.error.log":                     "CRIT message\n",
+		rotatedName("app.error.log", "", 1): "EROR message\n",
+	} {
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(got) != want {
+			t.Errorf("LevelSplitFileWriter: %s holds %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app.debug.log")); err == nil {
+		t.Errorf("LevelSplitFileWriter: wrote a file for DEBUG")
+	}
+}
+
+func TestFileLogWriterOnRotate(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "app.log")
+
+	var rotations []string
+	hook := func(oldname, newname string) {
+		rotations = append(rotations, filepath.Base(oldname)+" -> "+filepath.Base(newname))
+	}
+	w := NewFileLogWriter(fname, true, false).SetRotateLines(1).SetCompress(true).
+		OnRotate(hook).
+		OnRotate(func(oldname, newname string) { panic("hook") })
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	w.LogWrite(newLogRecord(INFO, "source", "second"))
+	if err := w.CloseErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	dated := NewDatedFileLogWriter(filepath.Join(dir, "app-%Y%m%d.log"), false).OnRotate(hook)
+	for _, day := range []int{1, 1, 2} {
+		rec := newLogRecord(INFO, "source", "dated")
+		rec.Created = time.Date(2024, 5, day, 12, 0, 0, 0, time.Local)
+		dated.LogWrite(rec)
+	}
+	if err := dated.CloseErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	today := datedFilename("app-%Y%m%d.log", time.Now())
+	want := []string{
+		filepath.Base(rotatedName(fname, "", 1)) + ".gz -> app.log",
+		today + " -> app-20240501.log",
+		"app-20240501.log -> app-20240502.log",
+	}
+	if !reflect.DeepEqual(rotations, want) {
+		t.Errorf("OnRotate: hooks called with %q, want %q", rotations, want)
+	}
+}
+
+func TestFileLogWriterRotateNumbering(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "app.log")
+
+	// Numbering carries on from the highest number kept, gaps and all, and
+	// goes past 999
+	for _, num := range []int{1, 998} {
+		if err := ioutil.WriteFile(rotatedName(fname, "", num), nil, 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := NewFileLogWriter(fname, true, false).SetFormat("%M").SetRotateLines(1)
+	for _, msg := range []string{"a", "b", "c", "d"} {
+		w.LogWrite(newLogRecord(INFO, "source", msg))
+	}
+	if err := w.CloseErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		rotatedName(fname, "", 999):  "a\n",
+		rotatedName(fname, "", 1000): "b\n",
+		rotatedName(fname, "", 1001): "c\n",
+		fname:                        "d\n",
+	} {
+		if got, err := ioutil.ReadFile(name); err != nil || string(got) != want {
+			t.Errorf("rotation: %s holds %q (%v), want %q", filepath.Base(name), got, err, want)
+		}
+	}
+	if _, err := os.Stat(rotatedName(fname, "", 2)); err == nil {
+		t.Errorf("rotation: filled in the gap at 2")
+	}
+}
+
+func TestCopyTruncate(t *testing.T) {
+	dir := t.TempDir()
+	from, to := filepath.Join(dir, "app.log"), filepath.Join(dir, "app.001.log")
+	if err := ioutil.WriteFile(from, []byte("records\n"), 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := copyTruncate(from, to); err != nil {
+		t.Fatalf("copyTruncate: %s", err)
+	}
+	if got, _ := ioutil.ReadFile(to); string(got) != "records\n" {
+		t.Errorf("copyTruncate: copy holds %q", got)
+	}
+	if fi, err := os.Stat(from); err != nil || fi.Size() != 0 {
+		t.Errorf("copyTruncate: original not emptied (%v)", err)
+	}
+
+	// An existing file is never overwritten
+	if err := copyTruncate(from, to); err == nil {
+		t.Errorf("copyTruncate: overwrote %s", filepath.Base(to))
+	}
+	if got, _ := ioutil.ReadFile(to); string(got) != "records\n" {
+		t.Errorf("copyTruncate: failed copy left %q", got)
+	}
+}
+
+func TestFileLogWriterWriteErrorRecovery(t *testing.T) {
+	for _, policy := range []WriteErrorPolicy{WriteErrorRetry, WriteErrorStderr} {
+		fname := filepath.Join(t.TempDir(), "app.log")
+		w := NewFileLogWriter(fname, false, false).SetFormat("%M").
+			SetHeadFoot("HEAD", "FOOT").SetLifecycleMarkers(true).
+			SetWriteErrorPolicy(policy).SetWriteRetries(2, time.Millisecond)
+		w.LogWrite(newLogRecord(INFO, "source", "first"))
+		w.Flush()
+
+		// Break the descriptor, as a failed rotation leaves it; Flush and
+		// LogWrite order this with the writer's goroutine
+		good := w.file
+		bad, err := os.Open(fname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bad.Close()
+		w.file = bad
+		w.LogWrite(newLogRecord(INFO, "source", "second"))
+		w.LogWrite(newLogRecord(INFO, "source", "third"))
+		if err := w.CloseErr(); err != nil {
+			t.Fatal(err)
+		}
+		good.Close()
+
+		got, _ := ioutil.ReadFile(fname)
+		lines := strings.Split(strings.TrimSpace(string(got)), "\n")
+		want := []string{"first", "second", "third"}
+		if policy == WriteErrorStderr {
+			// The failed record went to standard error
+			want = []string{"first", "third"}
+		}
+		if len(lines) < 4 || lines[0] != "HEAD" || !strings.Contains(lines[1], "logger opened") ||
+			!reflect.DeepEqual(lines[2:len(lines)-2], want) ||
+			!strings.Contains(lines[len(lines)-2], "logger closed") || lines[len(lines)-1] != "FOOT" {
+			t.Errorf("policy %d: failed write left the log as %q", policy, lines)
+		}
+		if w.Failed() != 1 {
+			t.Errorf("policy %d: Failed() = %d, want 1", policy, w.Failed())
+		}
+	}
+}
+
+func TestFileLogWriterRotateAfterClose(t *testing.T) {
+	w := NewFileLogWriter(filepath.Join(t.TempDir(), "app.log"), true, false)
+	w.CloseErr()
+
+	done := make(chan struct{})
+	go func() {
+		w.Rotate()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Rotate: blocked after Close")
+	}
+}
+
+func TestFileLogWriterMaxAge(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "app.log")
+	old := time.Now().Add(-48 * time.Hour)
+	for name, mtime := range map[string]time.Time{
+		"app.001.log":    old,
+		"app.002.log.gz": old,
+		"app.003.log":    time.Now(),
+		"app.notes":      old,
+	} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0660); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := NewFileLogWriter(fname, true, false).SetMaxAge(24 * time.Hour)
+	w.LogWrite(newLogRecord(INFO, "source", "rotated out"))
+	w.Flush()
+	w.Rotate()
+	if err := w.CloseErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, kept := range map[string]bool{
+		"app.001.log":    false,
+		"app.002.log.gz": false,
+		"app.003.log":    true,
+		"app.004.log":    true,
+		"app.notes":      true,
+	} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != kept {
+			t.Errorf("SetMaxAge: %s kept = %v, want %v", name, err == nil, kept)
+		}
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	// A Wednesday
+	from := time.Date(2024, 5, 1, 10, 17, 30, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"0 0 * * *", time.Date(2024, 5, 2, 0, 0, 0, 0, time.UTC)},
+		{"@hourly", time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)},
+		{"5/15 * * * *", time.Date(2024, 5, 1, 10, 20, 0, 0, time.UTC)},
+		{"30 9-17 * * 1-5", time.Date(2024, 5, 1, 10, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2024, 5, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 5", time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", time.Time{}},
+		{"every 6h", time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, test := range tests {
+		sched, err := ParseSchedule(test.expr)
+		if err != nil {
+			t.Errorf("ParseSchedule(%q): %s", test.expr, err)
+			continue
+		}
+		if got := sched.Next(from); !got.Equal(test.want) {
+			t.Errorf("ParseSchedule(%q).Next = %s, want %s", test.expr, got, test.want)
+		}
+	}
+
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "every", "every -1h", "every soon"} {
+		if _, err := ParseSchedule(expr); err == nil {
+			t.Errorf("ParseSchedule(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestFileLogWriterRotateSchedule(t *testing.T) {
+	dir := t.TempDir()
+	fname := filepath.Join(dir, "sched.log")
+	w := NewFileLogWriter(fname, true, false).SetFormat("%M").SetRotateSchedule("every 50ms")
+	w.LogWrite(newLogRecord(INFO, "source", "before"))
+	w.Flush()
+
+	// The log rotates without another record to trigger it
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := os.Stat(rotatedName(fname, "", 1)); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("SetRotateSchedule: the log was not rotated")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := w.CloseErr(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readLogFile(t, rotatedName(fname, "", 1), 1); string(got) != "before\n" {
+		t.Errorf("SetRotateSchedule: rotated file holds %q", got)
+	}
+}
+
+func TestDatedFilename(t *testing.T) {
+	at := time.Date(2024, 5, 1, 9, 7, 3, 0, time.UTC)
+	for pattern, want := range map[string]string{
+		"app-%Y%m%d.log":          "app-20240501.log",
+		"logs/%y/%m/%d/%H%M%S":    "logs/24/05/01/090703",
+		"app-{2006010215}.log":    "app-2024050109.log",
+		"100%%-%Y.log":            "100%-2024.log",
+		"odd-%q-{2006.log":        "odd-%q-{2006.log",
+		"plain.log":               "plain.log",
+		"{2006}/{Jan}/app-%d.log": "2024/May/app-01.log",
+	} {
+		if got := datedFilename(pattern, at); got != want {
+			t.Errorf("datedFilename(%q) = %q, want %q", pattern, got, want)
+		}
+	}
+}
+
+func TestDatedFileLogWriter(t *testing.T) {
+	dir := t.TempDir()
+	w := NewDatedFileLogWriter(filepath.Join(dir, "app-%Y%m%d.log"), false).SetFormat("%M")
+
+	day := time.Date(2024, 5, 1, 23, 59, 59, 0, time.Local)
+	for i, at := range []time.Time{day, day, day.Add(time.Second), day} {
+		rec := newLogRecord(INFO, "source", fmt.Sprintf("record %d", i))
+		rec.Created = at
+		w.LogWrite(rec)
+	}
+	if err := w.CloseErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]string{
+		"app-20240501.log": "record 0\nrecord 1\nrecord 3\n",
+		"app-20240502.log": "record 2\n",
+	} {
+		if got, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(got) != want {
+			t.Errorf("NewDatedFileLogWriter: %s holds %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestDatedFileLogWriterRotate(t *testing.T) {
+	dir := t.TempDir()
+	w := NewDatedFileLogWriter(filepath.Join(dir, "app-%Y%m%d.log"), true).SetFormat("%M").SetRotateLines(1)
+
+	day := time.Date(2024, 5, 1, 12, 0, 0, 0, time.Local)
+	for i, at := range []time.Time{day, day, day, day.Add(24 * time.Hour), day.Add(24 * time.Hour)} {
+		rec := newLogRecord(INFO, "source", fmt.Sprintf("record %d", i))
+		rec.Created = at
+		w.LogWrite(rec)
+	}
+	if err := w.CloseErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second day's file is numbered from .001 again
+	for name, want := range map[string]string{
+		"app-20240501.001.log": "record 0\n",
+		"app-20240501.002.log": "record 1\n",
+		"app-20240501.log":     "record 2\n",
+		"app-20240502.001.log": "record 3\n",
+		"app-20240502.log":     "record 4\n",
+	} {
+		if got, err := ioutil.ReadFile(filepath.Join(dir, name)); string(got) != want {
+			t.Errorf("%s holds %q, want %q (%v)", name, got, want, err)
+		}
+	}
+}
+
+func TestFileLogWriterSymlink(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "app.log")
+	w := NewDatedFileLogWriter(filepath.Join(dir, "app-%Y%m%d.log"), false).SetFormat("%M").SetSymlink(link)
+
+	if target, err := os.Readlink(link); err != nil || target != datedFilename("app-%Y%m%d.log", time.Now()) {
+		t.Errorf("SetSymlink: link points at %q (%v), want today's file", target, err)
+	}
+
+	rec := newLogRecord(INFO, "source", "next day")
+	rec.Created = time.Date(2024, 5, 2, 0, 0, 0, 0, time.Local)
+	w.LogWrite(rec)
+	if err := w.CloseErr(); err != nil {
+		t.Fatal(err)
+	}
+
+	if target, err := os.Readlink(link); err != nil || target != "app-20240502.log" {
+		t.Errorf("SetSymlink: link points at %q (%v), want %q", target, err, "app-20240502.log")
+	}
+	if got, _ := ioutil.ReadFile(link); string(got) != "next day\n" {
+		t.Errorf("SetSymlink: reading the link gives %q", got)
+	}
+}
+
+// memoryBlobStore keeps what is put in it, by key.
+type memoryBlobStore map[string][]byte
+
+func (m memoryBlobStore) Put(key string, body io.Reader, size int64) error {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != size {
+		return fmt.Errorf("read %d bytes, want %d", len(data), size)
+	}
+	m[key] = data
+	return nil
+}
+
+func TestArchiver(t *testing.T) {
+	cleanup := func() {
+		names, _ := filepath.Glob("_logtest_archive*")
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}
+	defer cleanup()
+	cleanup()
+
+	for _, compress := range []bool{false, true} {
+		fname := fmt.Sprintf("_logtest_archive_%v.log", compress)
+		store := memoryBlobStore{}
+		a := NewArchiver(store, "logs/").SetDeleteLocal(!compress)
+		w := NewFileLogWriter(fname, true, false).SetFormat("%M").SetCompress(compress).SetArchiver(a)
+		w.LogWrite(newLogRecord(INFO, "source", "first file"))
+		w.Flush()
+		w.Rotate()
+		w.LogWrite(newLogRecord(INFO, "source", "second file"))
+		if err := w.CloseErr(); err != nil {
+			t.Fatalf("compress %v: %s", compress, err)
+		}
+
+		key := "logs/" + rotatedName(fname, "", 1) + ".gz"
+		data, ok := store[key]
+		if !ok || len(store) != 1 {
+			t.Fatalf("compress %v: store holds %d objects, want %q", compress, len(store), key)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("compress %v: %s", compress, err)
+		}
+		if contents, _ := ioutil.ReadAll(zr); string(contents) != "first file\n" {
+			t.Errorf("compress %v: uploaded %q, want %q", compress, contents, "first file\n")
+		}
+
+		_, err = os.Stat(rotatedName(fname, "", 1) + ".gz")
+		if compress && err != nil {
+			t.Errorf("compress %v: local copy removed (%v)", compress, err)
+		} else if !compress && !os.IsNotExist(err) {
+			t.Errorf("compress %v: local copy kept (%v)", compress, err)
+		}
+		if _, err := os.Stat(rotatedName(fname, "", 1)); !os.IsNotExist(err) {
+			t.Errorf("compress %v: uncompressed rotated file left behind (%v)", compress, err)
+		}
+		if a.Failed() != 0 {
+			t.Errorf("compress %v: Failed() = %d", compress, a.Failed())
+		}
+	}
+}
+
+func TestSocketLogWriterTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer ln.Close()
+
+	// Accept connections but never read from them
+	var conns []net.Conn
+	var mu sync.Mutex
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, c)
+			mu.Unlock()
+		}
+	}()
+
+	w := NewSocketLogWriter("tcp", ln.Addr().String())
+	if w == nil {
+		t.Fatalf("NewSocketLogWriter returned nil")
+	}
+	w.SetWriteTimeout(50 * time.Millisecond)
+	defer w.Close()
+
+	big := newLogRecord(INFO, "source", strings.Repeat("x", 1<<20))
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 64; i++ {
+			w.LogWrite(big)
+		}
+		done <- true
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("LogWrite blocked on a receiver that never reads")
+	}
+	for i := 0; i < 100 && w.Dropped() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w.Dropped() == 0 {
+		t.Errorf("SocketLogWriter: expected records to be dropped after the write timeout")
+	}
+}
+
+func TestSocketLogWriterUnreachable(t *testing.T) {
+	defer func(d time.Duration, dial func(string, string, time.Duration) (net.Conn, error)) {
+		SocketDialTimeout, dialTimeout = d, dial
+	}(SocketDialTimeout, dialTimeout)
+	SocketDialTimeout = 100 * time.Millisecond
+
+	// Simulate a collector that never answers
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		time.Sleep(timeout)
+		return nil, errors.New("i/o timeout")
+	}
+
+	start := time.Now()
+	w := NewSocketLogWriter("tcp", "10.255.255.1:12124")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("NewSocketLogWriter took %s on an unreachable collector", elapsed)
+	}
+	if w == nil {
+		t.Fatalf("NewSocketLogWriter returned nil")
+	}
+	defer w.Close()
+	if w.Good() {
+		t.Errorf("Good: reports true without a connection")
+	}
+
+	w.LogWrite(newLogRecord(INFO, "source", "message"))
+	for i := 0; i < 100 && w.Dropped() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if w.Dropped() != 1 {
+		t.Errorf("Dropped: got %d, want 1", w.Dropped())
+	}
+}
+
+func TestSocketLogWriterRetryQueue(t *testing.T) {
+	defer func(dial func(string, string, time.Duration) (net.Conn, error), retry time.Duration) {
+		dialTimeout, socketRetryInterval = dial, retry
+	}(dialTimeout, socketRetryInterval)
+	socketRetryInterval = 20 * time.Millisecond
+
+	// A collector that can be taken down and brought back, handing the writer
+	// a new pipe each time it connects
+	var down int32
+	conns := make(chan net.Conn, 2)
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		if atomic.LoadInt32(&down) != 0 {
+			return nil, errors.New("connection refused")
+		}
+		client, server := net.Pipe()
+		conns <- server
+		return client, nil
+	}
+	var server net.Conn
+	collector := func() *json.Decoder {
+		select {
+		case server = <-conns:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the writer did not connect")
+		}
+		server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return json.NewDecoder(server)
+	}
+	read := func(dec *json.Decoder, n int) []string {
+		var msgs []string
+		for i := 0; i < n; i++ {
+			var rec LogRecord
+			if err := dec.Decode(&rec); err != nil {
+				t.Fatalf("reading record %d: %s", i, err)
+			}
+			msgs = append(msgs, rec.Message)
+		}
+		return msgs
+	}
+
+	w := NewSocketLogWriter("tcp", "collector:12124").SetRetryQueue(3)
+	defer w.Close()
+
+	w.LogWrite(newLogRecord(INFO, "source", "1"))
+	if got := read(collector(), 1); got[0] != "1" {
+		t.Fatalf("before the outage: got %q", got)
+	}
+
+	// Take the collector down; the records logged meanwhile are queued, and
+	// the oldest is dropped as only three fit
+	atomic.StoreInt32(&down, 1)
+	server.Close()
+	for _, msg := range []string{"2", "3", "4", "5"} {
+		w.LogWrite(newLogRecord(INFO, "source", msg))
+	}
+	for i := 0; i < 100 && w.Dropped() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Bring it back; the next record goes out after the queued ones
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(2 * socketRetryInterval)
+	w.LogWrite(newLogRecord(INFO, "source", "6"))
+
+	if got, want := strings.Join(read(collector(), 4), " "), "3 4 5 6"; got != want {
+		t.Errorf("after the outage: got %q, want %q", got, want)
+	}
+	if got := w.Dropped(); got != 1 {
+		t.Errorf("Dropped: got %d, want 1", got)
+	}
+}
+
+func TestSocketLogWriterProto(t *testing.T) {
+	defer func(dial func(string, string, time.Duration) (net.Conn, error)) {
+		dialTimeout = dial
+	}(dialTimeout)
+
+	// Hand the writer one end of a pipe and read the frames off the other
+	client, server := net.Pipe()
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return client, nil
+	}
+
+	w := NewSocketLogWriter("tcp", "collector:12124").SetEncoding(EncodingProto)
+	defer w.Close()
+
+	created := time.Unix(1234567890, 123456789)
+	w.LogWrite(&LogRecord{Level: WARNING, Created: created, Source: "main.main:12", Message: "first", Topic: "orders", Seq: 7})
+	w.LogWrite(&LogRecord{Level: ERROR, Created: created, Source: "main.main:13", Message: "second"})
+
+	rd := bufio.NewReader(server)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	first, err := logpb.ReadDelimited(rd)
+	if err != nil {
+		t.Fatalf("reading the first frame: %s", err)
+	}
+	want := &logpb.Record{
+		Level:   int32(WARNING),
+		Ts:      created.UnixNano(),
+		Source:  "main.main:12",
+		Message: "first",
+		Fields:  map[string]string{"Topic": "orders", "seq": "7"},
+	}
+	if !reflect.DeepEqual(first, want) {
+		t.Errorf("first frame: got %+v, want %+v", first, want)
+	}
+
+	second, err := logpb.ReadDelimited(rd)
+	if err != nil {
+		t.Fatalf("reading the second frame: %s", err)
+	}
+	if second.Level != int32(ERROR) || second.Message != "second" || second.Fields != nil {
+		t.Errorf("second frame: got %+v", second)
+	}
+}
+
+func TestSocketLogWriterUnixgram(t *testing.T) {
+	sockname := filepath.Join(t.TempDir(), "collector.sock")
+	listen := func() *net.UnixConn {
+		c, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sockname, Net: "unixgram"})
+		if err != nil {
+			t.Skipf("Could not listen on %s: %s", sockname, err)
+		}
+		c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		return c
+	}
+	receive := func(c *net.UnixConn) string {
+		buf := make([]byte, 1024)
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("Unixgram: %s", err)
+		}
+		var rec LogRecord
+		json.Unmarshal(buf[:n], &rec)
+		return rec.Message
+	}
+
+	collector := listen()
+	w := NewSocketLogWriter("unixgram", sockname)
+	defer w.Close()
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	if got := receive(collector); got != "first" {
+		t.Errorf("Unixgram: received %q, want %q", got, "first")
+	}
+
+	// The collector restarts, recreating its socket
+	collector.Close()
+	os.Remove(sockname)
+	collector = listen()
+	defer collector.Close()
+	w.LogWrite(newLogRecord(INFO, "source", "second"))
+	if got := receive(collector); got != "second" {
+		t.Errorf("Unixgram: received %q after the collector restarted, want %q", got, "second")
+	}
+	if w.Dropped() != 0 || !w.Good() {
+		t.Errorf("Unixgram: dropped %d, good %v after reconnecting", w.Dropped(), w.Good())
+	}
+}
+
+func TestSummaryLogWriter(t *testing.T) {
+	const interval = 200 * time.Millisecond
+
+	inner := &recordingLogWriter{}
+	w := NewSummaryLogWriter(inner, WARNING, interval).SetPassThrough(WARNING)
+	w.LogWrite(newLogRecord(INFO, "source", "info"))
+	w.LogWrite(newLogRecord(INFO, "source", "info"))
+	w.LogWrite(newLogRecord(INFO, "source", "info"))
+	w.LogWrite(newLogRecord(WARNING, "source", "warning"))
+	w.LogWrite(newLogRecord(ERROR, "source", "error"))
+
+	// The warning passes through, and the error is above the summarized levels
+	recs := inner.Records()
+	if len(recs) != 2 || recs[0].Message != "warning" || recs[1].Message != "error" {
+		t.Fatalf("SummaryLogWriter: records written at once: %v", recs)
+	}
+
+	for i := 0; i < 100 && len(inner.Records()) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	recs = inner.Records()
+	if len(recs) != 3 {
+		t.Fatalf("SummaryLogWriter: no summary after the interval")
+	}
+	if rec := recs[2]; rec.Level != WARNING || !strings.HasSuffix(rec.Message, ": 3 INFO, 1 WARNING") {
+		t.Errorf("SummaryLogWriter: got summary %q at %v", rec.Message, rec.Level)
+	}
+
+	// Intervals with nothing to summarize write nothing
+	time.Sleep(2 * interval)
+	if got := len(inner.Records()); got != 3 {
+		t.Errorf("SummaryLogWriter: got %d records after empty intervals, want 3", got)
+	}
+
+	w.LogWrite(newLogRecord(DEBUG, "source", "debug"))
+	w.Close()
+	recs = inner.Records()
+	if len(recs) != 4 || !strings.HasSuffix(recs[3].Message, ": 1 DEBUG") {
+		t.Errorf("SummaryLogWriter: Close did not write a final summary: %v", recs)
+	}
+}
+
+func TestLogger(t *testing.T) {
+	sl := NewDefaultLogger(WARNING)
+	if sl == nil {
+		t.Fatalf("NewDefaultLogger should never return nil")
+	}
+	if lw, exist := sl["stdout"]; lw == nil || exist != true {
+		t.Fatalf("NewDefaultLogger produced invalid logger (DNE or nil)")
+	}
+	if sl["stdout"].Level != WARNING {
+		t.Fatalf("NewDefaultLogger produced invalid logger (incorrect level)")
+	}
+	if len(sl) != 1 {
+		t.Fatalf("NewDefaultLogger produced invalid logger (incorrect map count)")
+	}
+
+	//func (l *Logger) AddFilter(name string, level int, writer LogWriter) {}
+	l := make(Logger)
+	l.AddFilter("stdout", DEBUG, NewConsoleLogWriter())
+	if lw, exist := l["stdout"]; lw == nil || exist != true {
+		t.Fatalf("AddFilter produced invalid logger (DNE or nil)")
+	}
+	if l["stdout"].Level != DEBUG {
+		t.Fatalf("AddFilter produced invalid logger (incorrect level)")
+	}
+	if len(l) != 1 {
+		t.Fatalf("AddFilter produced invalid logger (incorrect map count)")
+	}
+
+	//func (l *Logger) Warn(format string, args ...interface{}) error {}
+	if err := l.Warn("%s %d %#v", "Warning:", 1, []int{}); err.Error() != "Warning: 1 []int{}" {
+		t.Errorf("Warn returned invalid error: %s", err)
+	}
+
+	//func (l *Logger) Error(format string, args ...interface{}) error {}
+	if err := l.Error("%s %d %#v", "Error:", 10, []string{}); err.Error() != "Error: 10 []string{}" {
+		t.Errorf("Error returned invalid error: %s", err)
+	}
+
+	//func (l *Logger) Critical(format string, args ...interface{}) error {}
+	if err := l.Critical("%s %d %#v", "Critical:", 100, []int64{}); err.Error() != "Critical: 100 []int64{}" {
+		t.Errorf("Critical returned invalid error: %s", err)
+	}
+
+	// Already tested or basically untestable
+	//func (l *Logger) Log(level int, source, message string) {}
+	//func (l *Logger) Logf(level int, format string, args ...interface{}) {}
+	//func (l *Logger) intLogf(level int, format string, args ...interface{}) string {}
+	//func (l *Logger) Finest(format string, args ...interface{}) {}
+	//func (l *Logger) Fine(format string, args ...interface{}) {}
+	//func (l *Logger) Debug(format string, args ...interface{}) {}
+	//func (l *Logger) Trace(format string, args ...interface{}) {}
+	//func (l *Logger) Info(format string, args ...interface{}) {}
+}
+
+func TestConsoleOnlyCreatesNoFiles(t *testing.T) {
+	defer func(out io.Writer) {
+		stdout = out
+	}(stdout)
+	stdout = ioutil.Discard
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Getwd: %s", err)
+	}
+	defer os.Chdir(wd)
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Chdir: %s", err)
+	}
+
+	l := NewDefaultLogger(DEBUG)
+	l.AddFilter("other", INFO, NewConsoleLogWriter())
+	l.Info("This message only goes to the console")
+	l.Close()
+
+	for name, filt := range Global {
+		if filt.Path != "" {
+			t.Errorf("Global filter %q has file path %q", name, filt.Path)
+		}
+	}
+	if _, err := os.Lstat("logs"); !os.IsNotExist(err) {
+		t.Errorf("console logging created ./logs/ (err = %v)", err)
+	}
+}
+
+func TestResetGlobalLeaky(t *testing.T) {
+	defer ResetGlobal()
+
+	// A filter left behind by a test that does not clean up after itself
+	AddFilter("leaky", INFO, &recordingLogWriter{})
+	Global.SetRateLimit(1)
+}
+
+func TestResetGlobalIsolated(t *testing.T) {
+	if _, ok := Global["leaky"]; ok {
+		t.Errorf("ResetGlobal: filter of the previous test is still in Global")
+	}
+	if len(Global) != 1 || Global["stdout"] == nil {
+		t.Errorf("ResetGlobal: Global has %d filters, want the default one", len(Global))
+	}
+	if opts := Global.lookupOptions(); opts != nil {
+		t.Errorf("ResetGlobal: options of the previous test are still set")
+	}
+}
+
+func TestResetGlobalConcurrent(t *testing.T) {
+	defer ResetGlobal()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					Logf(FINEST, "below the level of the default logger")
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		ResetGlobal()
+		AddFilter("stdout", ERROR, &recordingLogWriter{})
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestLogOutput(t *testing.T) {
+	if !debugLogging {
+		t.Skip("DEBUG logging is compiled out")
+	}
+
+	const (
+		expected = "fdf3e51e444da56b4cb400f30bc47424"
+	)
+
+	// Unbuffered output
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+
+	l := make(Logger)
+
+	// Delete and open the output log without a timestamp (for a constant md5sum);
+	// records of every level go to the "stdout" filter
+	l.AddFilter("stdout", FINEST, NewFileLogWriter(testLogFile, false, true).SetFormat("[%L] %M"))
+	defer os.Remove(testLogFile)
+
+	// Send some log messages
+	l.Log(CRITICAL, "testsrc1", fmt.Sprintf("This message is level %d", int(CRITICAL)))
+	l.Logf(ERROR, "This message is level %v", ERROR)
+	l.Logf(WARNING, "This message is level %s", WARNING)
+	l.Logc(INFO, func() string { return "This message is level INFO" })
+	l.Trace("This message is level %d", int(TRACE))
+	l.Debug("This message is level %s", DEBUG)
+	l.Fine(func() string { return fmt.Sprintf("This message is level %v", FINE) })
+	l.Finest("This message is level %v", FINEST)
+	l.Finest(FINEST, "is also this message's level")
+
+	l.Close()
+
+	contents, err := ioutil.ReadFile(testLogFile)
+	if err != nil {
+		t.Fatalf("Could not read output log: %s", err)
+	}
+
+	sum := md5.New()
+	sum.Write(contents)
+	if sumstr := hex.EncodeToString(sum.Sum(nil)); sumstr != expected {
+		t.Errorf("--- Log Contents:\n%s---", string(contents))
+		t.Fatalf("Checksum does not match: %s (expecting %s)", sumstr, expected)
+	}
+}
+
+func TestSetDeterministic(t *testing.T) {
+	defer SetDeterministic(false)
+	SetDeterministic(true)
+
+	run := func() string {
+		var buf bytes.Buffer
+		l := make(Logger).AddWriter("stdout", FINEST, &buf, FORMAT_DEFAULT)
+		l.Logf(INFO, "The time is now: %s", timeNow().Format("15:04:05"))
+		l.Warn("This message is level %s", WARNING)
+		l.LogObject(ERROR, "topic", map[string]int{"n": 1})
+		return buf.String()
+	}
+
+	first := run()
+	time.Sleep(1100 * time.Millisecond)
+	if second := run(); second != first {
+		t.Errorf("SetDeterministic: output differs between runs:\n%s---\n%s", first, second)
+	}
+	if want := "[2000/01/01 00:00:00 UTC] [INFO] () The time is now: 00:00:00\n"; !strings.HasPrefix(first, want) {
+		t.Errorf("SetDeterministic: got %q, want it to start with %q", first, want)
+	}
+}
+
+func TestNotLoggedAllocs(t *testing.T) {
+	for _, filters := range []int{1, 2} {
+		sl := make(Logger)
+		sl.AddFilter("stdout", INFO, &recordingLogWriter{})
+		if filters > 1 {
+			sl.AddFilter("audit", INFO, &recordingLogWriter{})
+		}
+		for name, log := range map[string]func(){
+			"Log":   func() { sl.Log(DEBUG, "here", "message") },
+			"Debug": func() { sl.Debug("message") },
+			"named": func() { sl.intLogNamef("app.db.query", DEBUG, "message") },
+		} {
+			if allocs := testing.AllocsPerRun(100, log); allocs != 0 {
+				t.Errorf("%s with %d filters: %v allocations for a record not logged, want 0", name, filters, allocs)
+			}
+		}
+	}
+}
+
+func TestLogObject(t *testing.T) {
+	type event struct {
+		UserID  int    `json:"user_id"`
+		Action  string `json:"action"`
+		private string
+	}
+
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("audit", INFO, w)
+
+	l.LogObject(INFO, "audit", event{UserID: 42, Action: "login", private: "x"})
+	l.LogObject(INFO, "audit", make(chan int))
+	l.LogObject(DEBUG, "audit", event{UserID: 7})
+
+	recs := w.Records()
+	if len(recs) != 1 {
+		t.Fatalf("LogObject: expected 1 record, got %d", len(recs))
+	}
+	if got, want := recs[0].Message, `{"user_id":42,"action":"login"}`; got != want {
+		t.Errorf("LogObject: got %q, want %q", got, want)
+	}
+	if recs[0].Level != INFO {
+		t.Errorf("LogObject: got level %v, want %v", recs[0].Level, INFO)
+	}
+}
+
+func TestLogCategory(t *testing.T) {
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, w)
+
+	l.LogCategory("billing", INFO, "charged %d cents", 250)
+	l.LogCategory("billing", DEBUG, "not logged")
+
+	recs := w.Records()
+	if len(recs) != 1 {
+		t.Fatalf("LogCategory: expected 1 record, got %d", len(recs))
+	}
+	rec := recs[0]
+	if rec.Category != "billing" || rec.Message != "charged 250 cents" {
+		t.Errorf("LogCategory: got category %q and message %q", rec.Category, rec.Message)
+	}
+	if !strings.HasPrefix(rec.Source, "github.com/blackbeans/log4go.TestLogCategory:") {
+		t.Errorf("LogCategory: got source %q, want the caller", rec.Source)
+	}
+	if got, want := FormatLogRecordNoNewline("[%C] (%S) %M", rec), "[billing] ("+rec.Source+") charged 250 cents"; got != want {
+		t.Errorf("LogCategory: formatted as %q, want %q", got, want)
+	}
+}
+
+func TestLogRecordCaller(t *testing.T) {
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, w)
+
+	_, file, line, _ := runtime.Caller(0)
+	l.LogObject(INFO, "caller", "here")
+
+	recs := w.Records()
+	if len(recs) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(recs))
+	}
+	rec := recs[0]
+	if want := "github.com/blackbeans/log4go.TestLogRecordCaller"; rec.Func != want {
+		t.Errorf("Func = %q, want %q", rec.Func, want)
+	}
+	if rec.File != file {
+		t.Errorf("File = %q, want %q", rec.File, file)
+	}
+	if rec.Line != line+1 {
+		t.Errorf("Line = %d, want %d", rec.Line, line+1)
+	}
+	if want := fmt.Sprintf("%s:%d", rec.Func, rec.Line); rec.Source != want {
+		t.Errorf("Source = %q, want %q", rec.Source, want)
+	}
+
+	js, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	var fields map[string]interface{}
+	json.Unmarshal(js, &fields)
+	for _, key := range []string{"caller_func", "caller_file", "caller_line"} {
+		if _, ok := fields[key]; !ok {
+			t.Errorf("JSON record is missing %q: %s", key, js)
+		}
+	}
+}
+
+func TestParseJSONLogLine(t *testing.T) {
+	rec := &LogRecord{
+		Level:      ERROR,
+		Created:    time.Date(2009, time.February, 13, 23, 31, 30, 123456789, time.UTC),
+		Source:     "main.main:12",
+		Message:    "failed",
+		Topic:      "orders",
+		Category:   "billing",
+		Seq:        7,
+		Func:       "main.main",
+		File:       "main.go",
+		Line:       12,
+		ErrorChain: []string{"charge: declined", "declined"},
+		Stack:      []string{"main.main", "runtime.main"},
+	}
+
+	// As written by the DualFormatFileWriter and the SocketLogWriter
+	js, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	got, err := ParseJSONLogLine(js)
+	if err != nil {
+		t.Fatalf("ParseJSONLogLine(%s): %s", js, err)
+	}
+	if !got.Created.Equal(rec.Created) {
+		t.Errorf("ParseJSONLogLine: Created = %v, want %v", got.Created, rec.Created)
+	}
+	got.Created = rec.Created
+	if !reflect.DeepEqual(got, rec) {
+		t.Errorf("ParseJSONLogLine: got %+v, want %+v", got, rec)
+	}
+
+	// As written by a JSONFormatter
+	line := JSONFormatter{}.Format(rec)
+	if got, err = ParseJSONLogLine([]byte(line)); err != nil {
+		t.Fatalf("ParseJSONLogLine(%s): %s", line, err)
+	}
+	got.Created = rec.Created
+	if !reflect.DeepEqual(got, rec) {
+		t.Errorf("ParseJSONLogLine(%s): got %+v, want %+v", line, got, rec)
+	}
+
+	// Levels by name and times in nanoseconds since the epoch
+	for _, line := range []string{
+		`{"Level":"ERROR","Created":1234567890123456789,"Message":"failed"}`,
+		`{"Level":"eror","Created":"2009-02-13T23:31:30.123456789Z","Message":"failed"}`,
+	} {
+		got, err := ParseJSONLogLine([]byte(line))
+		if err != nil {
+			t.Errorf("ParseJSONLogLine(%s): %s", line, err)
+			continue
+		}
+		if got.Level != ERROR || !got.Created.Equal(time.Unix(0, 1234567890123456789)) || got.Message != "failed" {
+			t.Errorf("ParseJSONLogLine(%s): got %+v", line, got)
+		}
+	}
+
+	for _, bad := range []string{
+		`not json`,
+		`{"Message":"no level"}`,
+		`{"Level":"LOUD"}`,
+		`{"Level":4,"Created":"yesterday"}`,
+	} {
+		if _, err := ParseJSONLogLine([]byte(bad)); err == nil {
+			t.Errorf("ParseJSONLogLine(%s): no error", bad)
+		}
+	}
+}
+
+func TestSetDefaultSource(t *testing.T) {
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, w)
+	l.SetSourceMinLevel(ERROR).SetDefaultSource("worker-pool")
+
+	l.Log(INFO, "", "lookup disabled")
+	l.LogAt(now, INFO, "explicit", "source given")
+	l.Log(ERROR, "", "lookup enabled")
+	l.SetSourceOverride("pool-7")
+	l.Log(INFO, "", "overridden")
+	l.Log(ERROR, "", "overridden")
+	l.SetSourceOverride("")
+	l.Log(INFO, "", "override removed")
+
+	recs := w.Records()
+	if len(recs) != 6 {
+		t.Fatalf("SetDefaultSource: expected 6 records, got %d", len(recs))
+	}
+	for i, want := range []string{"worker-pool", "explicit", "", "pool-7", "pool-7", "worker-pool"} {
+		if i == 2 {
+			if !strings.HasPrefix(recs[i].Source, "github.com/blackbeans/log4go.") {
+				t.Errorf("SetDefaultSource: record %d has source %q, want the caller", i, recs[i].Source)
+			}
+			continue
+		}
+		if recs[i].Source != want {
+			t.Errorf("SetDefaultSource: record %d has source %q, want %q", i, recs[i].Source, want)
+		}
+	}
+}
+
+func TestSetSourceMinLevel(t *testing.T) {
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, w)
+	l.SetSourceMinLevel(WARNING)
+
+	l.Log(INFO, "", "below the threshold")
+	l.Log(WARNING, "", "at the threshold")
+	l.LogObject(ERROR, "topic", "above the threshold")
+
+	recs := w.Records()
+	if len(recs) != 3 {
+		t.Fatalf("SetSourceMinLevel: got %d records, want 3", len(recs))
+	}
+	if rec := recs[0]; rec.Source != "" || rec.Func != "" || rec.Line != 0 {
+		t.Errorf("SetSourceMinLevel: INFO record has source %q (%s:%d)", rec.Source, rec.Func, rec.Line)
+	}
+	for _, rec := range recs[1:] {
+		if !strings.HasPrefix(rec.Source, "github.com/blackbeans/log4go.TestSetSourceMinLevel:") {
+			t.Errorf("SetSourceMinLevel: %s record has source %q", rec.Level, rec.Source)
+		}
+	}
+}
+
+// stackError carries a stack trace the way github.com/pkg/errors does
+type stackError struct {
+	msg    string
+	frames []uintptr
+}
+
+type stackFrame uintptr
+
+func newStackError(msg string) error {
+	pcs := make([]uintptr, 8)
+	return &stackError{msg, pcs[:runtime.Callers(2, pcs)]}
+}
+
+func (e *stackError) Error() string { return e.msg }
+
+func (e *stackError) StackTrace() []stackFrame {
+	frames := make([]stackFrame, len(e.frames))
+	for i, pc := range e.frames {
+		frames[i] = stackFrame(pc)
+	}
+	return frames
+}
+
+func TestLogError(t *testing.T) {
+	errNotFound := errors.New("not found")
+
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, w)
+
+	l.LogError(ERROR, fmt.Errorf("load config: %w", fmt.Errorf("open file: %w", errNotFound)), "startup failed")
+	l.LogError(ERROR, fmt.Errorf("query: %w", newStackError("connection reset")), "")
+	l.LogError(DEBUG, errNotFound, "hidden")
+
+	recs := w.Records()
+	if len(recs) != 2 {
+		t.Fatalf("LogError: got %d records, want 2", len(recs))
+	}
+
+	rec := recs[0]
+	if got, want := rec.Message, "startup failed: load config: open file: not found"; got != want {
+		t.Errorf("LogError: message %q, want %q", got, want)
+	}
+	if got, want := strings.Join(rec.ErrorChain, "|"), "load config|open file|not found"; got != want {
+		t.Errorf("LogError: chain %q, want %q", got, want)
+	}
+	if rec.Stack != nil {
+		t.Errorf("LogError: unexpected stack %q", rec.Stack)
+	}
+
+	rec = recs[1]
+	if got, want := rec.Message, "query: connection reset"; got != want {
+		t.Errorf("LogError: message %q, want %q", got, want)
+	}
+	if len(rec.Stack) == 0 || !strings.HasPrefix(rec.Stack[0], "github.com/blackbeans/log4go.TestLogError ") {
+		t.Errorf("LogError: stack does not start at the test: %q", rec.Stack)
+	}
+
+	js, err := json.Marshal(rec)
+	if err != nil {
+		t.Fatalf("marshal: %s", err)
+	}
+	if !bytes.Contains(js, []byte(`"error_chain":["query","connection reset"]`)) {
+		t.Errorf("LogError: JSON record lacks the error chain: %s", js)
+	}
+}
+
+func TestRecoverAndLog(t *testing.T) {
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, w)
+
+	errBroken := errors.New("broken")
+	func() {
+		defer l.RecoverAndLog(false)
+		panic(fmt.Errorf("handler: %w", errBroken))
+	}()
+
+	recs := w.Records()
+	if len(recs) != 1 {
+		t.Fatalf("RecoverAndLog: got %d records, want 1", len(recs))
+	}
+	rec := recs[0]
+	if rec.Level != CRITICAL {
+		t.Errorf("RecoverAndLog: level %s, want CRITICAL", rec.Level)
+	}
+	if got, want := rec.Message, "panic: handler: broken"; got != want {
+		t.Errorf("RecoverAndLog: message %q, want %q", got, want)
+	}
+	if got, want := strings.Join(rec.ErrorChain, "|"), "handler|broken"; got != want {
+		t.Errorf("RecoverAndLog: chain %q, want %q", got, want)
+	}
+	if !strings.HasPrefix(rec.Source, "github.com/blackbeans/log4go.TestRecoverAndLog.func") {
+		t.Errorf("RecoverAndLog: source %q is not where the panic happened", rec.Source)
+	}
+	if len(rec.Stack) < 2 || !strings.HasPrefix(rec.Stack[1], "github.com/blackbeans/log4go.TestRecoverAndLog ") {
+		t.Errorf("RecoverAndLog: stack does not lead back to the test: %q", rec.Stack)
+	}
+
+	// Rethrowing keeps the panic going with the same value
+	defer func() {
+		if r := recover(); r != "again" {
+			t.Errorf("RecoverAndLog(true): recovered %v, want the original value", r)
+		}
+		if got := len(w.Records()); got != 2 {
+			t.Errorf("RecoverAndLog(true): got %d records, want 2", got)
+		}
+	}()
+	defer l.RecoverAndLog(true)
+	panic("again")
+}
+
+func TestSetSourceTrimPrefix(t *testing.T) {
+	defer SetSourceTrimPrefix()
+	SetSourceTrimPrefix("example.com/other/", "github.com/blackbeans/")
+
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, w)
+
+	_, _, line, _ := runtime.Caller(0)
+	l.LogObject(INFO, "trim", "here")
+
+	recs := w.Records()
+	if len(recs) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(recs))
+	}
+	if want := fmt.Sprintf("log4go.TestSetSourceTrimPrefix:%d", line+1); recs[0].Source != want {
+		t.Errorf("Source = %q, want %q", recs[0].Source, want)
+	}
+	if want := "github.com/blackbeans/log4go.TestSetSourceTrimPrefix"; recs[0].Func != want {
+		t.Errorf("Func = %q, want %q", recs[0].Func, want)
+	}
+}
+
+func TestLogAt(t *testing.T) {
+	var buf bytes.Buffer
+	l := make(Logger).AddWriter("stdout", INFO, &buf, "[%D %T] [%L] (%S) %M")
+
+	at := time.Date(2009, time.February, 13, 23, 31, 30, 0, time.UTC)
+	l.LogAt(at, WARNING, "importer", "replayed")
+
+	if got, want := buf.String(), "[2009/02/13 23:31:30 UTC] [WARN] (importer) replayed\n"; got != want {
+		t.Errorf("LogAt: got %q, want %q", got, want)
+	}
+}
+
+func TestLogAccess(t *testing.T) {
+	defer func(clock func() time.Time) {
+		timeNow = clock
+	}(timeNow)
+	timeNow = func() time.Time {
+		return time.Date(2000, time.October, 10, 13, 55, 36, 0, time.FixedZone("", -7*60*60))
+	}
+
+	r, err := http.NewRequest("GET", "http://www.example.com/apache_pb.gif?q=1", nil)
+	if err != nil {
+		t.Fatalf("NewRequest: %s", err)
+	}
+	r.RemoteAddr = "127.0.0.1:51234"
+	r.RequestURI = "/apache_pb.gif?q=1"
+	r.Proto = "HTTP/1.0"
+	r.SetBasicAuth("frank", "secret")
+	r.Header.Set("Referer", "http://www.example.com/start.html")
+	r.Header.Set("User-Agent", `Mozilla/4.08 [en] (Win98; I ;Nav) "quoted"`)
+
+	buf := new(bytes.Buffer)
+	l := make(Logger)
+	l.AddWriter("access", INFO, buf, FORMAT_APACHE_COMBINED)
+	l.LogAccess(NewAccessLogRecord(r, 200, 2326))
+
+	want := `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif?q=1 HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav) \"quoted\""` + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("LogAccess: got  %s", got)
+		t.Errorf("LogAccess: want %s", want)
+	}
+
+	// The pattern log analyzers use for the Combined Log Format
+	combined := regexp.MustCompile(`^(\S+) (\S+) (\S+) \[([^\]]+)\] "(\S+) (\S+) (\S+)" (\d{3}) (\d+|-) "((?:[^"\\]|\\.)*)" "((?:[^"\\]|\\.)*)"\n$`)
+	m := combined.FindStringSubmatch(buf.String())
+	if m == nil {
+		t.Fatalf("LogAccess: line does not parse as Combined Log Format: %q", buf.String())
+	}
+	if m[1] != "127.0.0.1" || m[3] != "frank" || m[6] != "/apache_pb.gif?q=1" || m[8] != "200" || m[9] != "2326" {
+		t.Errorf("LogAccess: parsed fields %q", m[1:])
+	}
+}
+
+func TestSetSampling(t *testing.T) {
+	if !debugLogging {
+		t.Skip("DEBUG logging is compiled out")
+	}
+
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", FINEST, w)
+	l.SetSampling(WARNING, 10)
+
+	for i := 0; i < 1000; i++ {
+		l.Debug("debug %d", i)
+		if i%10 == 0 {
+			l.Error("error %d", i)
+		}
+	}
+
+	counts := map[Level]int{}
+	for _, rec := range w.Records() {
+		counts[rec.Level]++
+	}
+	if got, want := counts[DEBUG], 100; got != want {
+		t.Errorf("SetSampling: got %d DEBUG records, want %d", got, want)
+	}
+	if got, want := counts[ERROR], 100; got != want {
+		t.Errorf("SetSampling: got %d ERROR records, want %d", got, want)
+	}
+
+	l.SetSampling(WARNING, 1)
+	l.Debug("unsampled")
+	l.Debug("unsampled")
+	if got, want := len(w.Records()), 202; got != want {
+		t.Errorf("SetSampling(1): got %d records, want %d", got, want)
+	}
+}
+
+func TestDebugLogging(t *testing.T) {
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", FINEST, w)
+
+	l.Finest("finest")
+	l.Fine("fine")
+	l.Debug("debug")
+	l.Info("info")
+
+	want := 4
+	if !debugLogging {
+		// Built with -tags nodebuglog: only the INFO record is logged
+		want = 1
+	}
+	if got := len(w.Records()); got != want {
+		t.Errorf("debugLogging=%v: got %d records, want %d", debugLogging, got, want)
+	}
+}
+
+func TestLoggerOptionsLifetime(t *testing.T) {
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, &recordingLogWriter{})
+	l.SetRateLimit(1)
+	if l.lookupOptions() == nil || l.lookupOptions().owner == nil {
+		t.Fatalf("SetRateLimit: options not kept with their logger")
+	}
+
+	// Closing drops the options, so that the logger can be freed
+	l.Close()
+	if l.lookupOptions() != nil {
+		t.Errorf("Close: options still kept")
+	}
+
+	// A logger with no options of its own never picks up another's
+	for i := 0; i < 100; i++ {
+		old := make(Logger)
+		old.SetRateLimit(1)
+		if make(Logger).lookupOptions() != nil {
+			t.Fatalf("make(Logger): new logger has options")
+		}
+		old.Close()
+	}
+}
+
+func TestSetRateLimit(t *testing.T) {
+	defer func(clock func() time.Time) {
+		timeNow = clock
+	}(timeNow)
+	now := time.Unix(1234567890, 0)
+	timeNow = func() time.Time { return now }
+
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, w)
+	l.SetRateLimit(100).SetRateLimitExempt(WARNING)
+
+	flood := func() {
+		for i := 0; i < 1000; i++ {
+			l.Info("flood %d", i)
+		}
+	}
+
+	flood()
+	if got, want := len(w.Records()), 100; got != want {
+		t.Errorf("SetRateLimit: burst let %d records through, want %d", got, want)
+	}
+	if got, want := l.TotalDropped(), uint64(900); got != want {
+		t.Errorf("TotalDropped: got %d, want %d", got, want)
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	flood()
+	if got, want := len(w.Records()), 150; got != want {
+		t.Errorf("SetRateLimit: half a second later %d records were let through, want %d", got, want)
+	}
+	if got, want := l.TotalDropped(), uint64(1850); got != want {
+		t.Errorf("TotalDropped: got %d, want %d", got, want)
+	}
+
+	l.Warn("exempt")
+	if got, want := len(w.Records()), 151; got != want {
+		t.Errorf("SetRateLimitExempt: warning was dropped")
+	}
+}
+
+func TestSetGlobalDedup(t *testing.T) {
+	defer func(clock func() time.Time) {
+		timeNow = clock
+	}(timeNow)
+	now := time.Unix(1234567890, 0)
+	timeNow = func() time.Time { return now }
+
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, w)
+	l.SetGlobalDedup(time.Second)
+
+	for i := 0; i < 50; i++ {
+		l.Log(ERROR, "source", "disk full")
+	}
+	l.Log(INFO, "source", "recovered")
+
+	// Runs end when the window is over too; records from the same call site
+	// have the same source
+	for i := 0; i < 4; i++ {
+		if i == 2 {
+			now = now.Add(2 * time.Second)
+		}
+		l.Log(INFO, "source", "tick")
+	}
+	l.Close()
+
+	var got []string
+	for _, rec := range w.Records() {
+		got = append(got, strings.TrimSuffix(FormatLogRecord("%N %M", rec), "\n"))
+	}
+	want := []string{
+		"ERROR disk full",
+		"ERROR last message repeated 49 times",
+		"INFO recovered",
+		"INFO tick",
+		"INFO last message repeated 1 times",
+		"INFO tick",
+		"INFO last message repeated 1 times",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("SetGlobalDedup: got %q, want %q", got, want)
+	}
+}
+
+func TestSetGlobalDedupSlowWriter(t *testing.T) {
+	slow := &gatedLogWriter{started: make(chan struct{}, 10), release: make(chan struct{})}
+	fast := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("slow", INFO, slow)
+	l.AddFilter("fast", INFO, fast)
+	l.SetGlobalDedup(time.Second)
+	opts := l.lookupOptions()
+
+	go opts.deliver(l["slow"], newLogRecord(INFO, "source", "held up"))
+	<-slow.started
+
+	// A writer that blocks holds up only the goroutines logging to it
+	done := make(chan struct{})
+	go func() {
+		opts.deliver(l["fast"], newLogRecord(INFO, "source", "not held up"))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("SetGlobalDedup: a blocked writer held up another filter")
+	}
+	close(slow.release)
+}
+
+func TestSetGlobalDedupReload(t *testing.T) {
+	dir := t.TempDir()
+	configfile := filepath.Join(dir, "reload.xml")
+	config := `<logging>
+  <filter enabled="true">
+    <tag>events</tag>
+    <type>file</type>
+    <level>INFO</level>
+    <property name="filename">` + filepath.Join(dir, "events.log") + `</property>
+  </filter>
+</logging>
+`
+	if err := ioutil.WriteFile(configfile, []byte(config), 0660); err != nil {
+		t.Fatal(err)
+	}
+
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, w)
+	l.SetGlobalDedup(time.Minute)
+	for i := 0; i < 3; i++ {
+		l.Log(ERROR, "source", "disk full")
+	}
+
+	// The run ends before its filter is removed, and nothing is written to
+	// it afterwards
+	l.LoadConfiguration(configfile)
+	l.Log(ERROR, "source", "recovered")
+	l.Close()
+
+	var got []string
+	for _, rec := range w.Records() {
+		got = append(got, rec.Message)
+	}
+	if want := "disk full|last message repeated 2 times"; strings.Join(got, "|") != want {
+		t.Errorf("SetGlobalDedup: removed filter got %q, want %q", strings.Join(got, "|"), want)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	defer func(n int) {
+		LogPauseBufferLength = n
+	}(LogPauseBufferLength)
+	LogPauseBufferLength = 3
+
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, w)
+
+	l.Info("before")
+	l.Pause()
+	for i := 1; i <= 5; i++ {
+		l.Info("paused %d", i)
+	}
+	if got := len(w.Records()); got != 1 {
+		t.Errorf("Pause: %d records written while paused, want 1", got)
+	}
+
+	l.Resume()
+	l.Info("after")
+
+	var got []string
+	for _, rec := range w.Records() {
+		got = append(got, rec.Message)
+	}
+	if want := "before|paused 1|paused 2|paused 3|after"; strings.Join(got, "|") != want {
+		t.Errorf("Resume: got %q, want %q", strings.Join(got, "|"), want)
+	}
+	if got := l.TotalDropped(); got != 2 {
+		t.Errorf("TotalDropped: got %d, want 2", got)
+	}
+}
+
+func TestPauseClose(t *testing.T) {
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, w)
+
+	l.Pause()
+	l.Info("held")
+	l.Info("held")
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	var got []string
+	for _, rec := range w.Records() {
+		got = append(got, rec.Message)
+	}
+	if want := "held|held"; strings.Join(got, "|") != want {
+		t.Errorf("Close: got %q, want %q", strings.Join(got, "|"), want)
+	}
+}
+
+func TestResumeSlowWriter(t *testing.T) {
+	slow := &gatedLogWriter{started: make(chan struct{}, 10), release: make(chan struct{})}
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, slow)
+
+	l.Pause()
+	l.Info("held")
+	resumed := make(chan struct{})
+	go func() {
+		l.Resume()
+		close(resumed)
+	}()
+	<-slow.started
+
+	// Logging goes on while Resume writes out the held records, and what is
+	// logged meanwhile follows them
+	logged := make(chan struct{})
+	go func() {
+		l.Info("meanwhile")
+		close(logged)
+	}()
+	select {
+	case <-logged:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Resume: logging held up while writing out held records")
+	}
+	close(slow.release)
+	<-resumed
+
+	var got []string
+	for _, rec := range slow.Records() {
+		got = append(got, rec.Message)
+	}
+	if want := "held|meanwhile"; strings.Join(got, "|") != want {
+		t.Errorf("Resume: got %q, want %q", strings.Join(got, "|"), want)
+	}
+}
+
+func TestSetSequence(t *testing.T) {
+	const goroutines, each = 8, 100
+
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, w)
+	l.SetSequence(true)
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				l.Info("%d", g)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	recs := w.Records()
+	if len(recs) != goroutines*each {
+		t.Fatalf("SetSequence: got %d records, want %d", len(recs), goroutines*each)
+	}
+	last := map[string]uint64{}
+	seen := map[uint64]bool{}
+	for _, rec := range recs {
+		if rec.Seq <= last[rec.Message] {
+			t.Errorf("SetSequence: goroutine %s logged %d after %d", rec.Message, rec.Seq, last[rec.Message])
+		}
+		last[rec.Message] = rec.Seq
+		seen[rec.Seq] = true
+	}
+	for seq := uint64(1); seq <= goroutines*each; seq++ {
+		if !seen[seq] {
+			t.Errorf("SetSequence: sequence number %d is missing", seq)
+		}
+	}
+
+	rec := recs[0]
+	if got, want := FormatLogRecord("#%q %M", rec), fmt.Sprintf("#%d %s\n", rec.Seq, rec.Message); got != want {
+		t.Errorf("%%q: got %q, want %q", got, want)
+	}
+}
+
+func TestSequenceRestart(t *testing.T) {
+	rotated := rotatedName(testLogFile, "", 1)
+	defer os.Remove(testLogFile)
+	defer os.Remove(rotated)
+	os.Remove(testLogFile)
+	os.Remove(rotated)
+
+	w := NewFileLogWriter(testLogFile, true, false).SetFormat("%q %M").SetRotateLines(2).SetSequenceRestart(true)
+	for seq := uint64(5); seq < 9; seq++ {
+		rec := newLogRecord(INFO, "source", fmt.Sprint("message ", seq))
+		rec.Seq = seq
+		w.LogWrite(rec)
+	}
+	w.Close()
+
+	if got, want := string(readLogFile(t, testLogFile, 2)), "1 message 7\n2 message 8\n"; got != want {
+		t.Errorf("SetSequenceRestart: got %q, want %q", got, want)
+	}
+	if got, want := string(readLogFile(t, rotated, 2)), "1 message 5\n2 message 6\n"; got != want {
+		t.Errorf("SetSequenceRestart: rotated file has %q, want %q", got, want)
+	}
+}
+
+func TestLogSync(t *testing.T) {
+	defer os.Remove(testLogFile)
+	os.Remove(testLogFile)
+
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, NewFileLogWriter(testLogFile, false, false).SetFormat("[%L] (%S) %M"))
+	defer l.Close()
+
+	for i := 0; i < 10; i++ {
+		l.Info("queued %d", i)
+	}
+	l.LogSync(CRITICAL, "source", "must be on disk")
+
+	contents, err := ioutil.ReadFile(testLogFile)
+	if err != nil {
+		t.Fatalf("read(%q): %s", testLogFile, err)
+	}
+	if !bytes.HasSuffix(contents, []byte("[CRIT] (source) must be on disk\n")) {
+		t.Errorf("LogSync returned before the message was written: %q", contents)
+	}
+	if got, want := bytes.Count(contents, []byte{'\n'}), 11; got != want {
+		t.Errorf("LogSync: got %d lines, want %d", got, want)
+	}
+}
+
+func TestTopicRoutingWriter(t *testing.T) {
+	dir := t.TempDir()
+
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, &recordingLogWriter{})
+	l.AddFilter("events", INFO, NewTopicRoutingWriter(dir, "%s.log", 2).SetFormat("%M"))
+
+	topics := []string{"events.orders", "events.payments", "events.users"}
+	for i := 0; i < 3; i++ {
+		for _, topic := range topics {
+			l.LogObject(INFO, topic, map[string]int{"n": i})
+		}
+	}
+	l.Close()
+
+	for _, topic := range topics {
+		contents, err := ioutil.ReadFile(filepath.Join(dir, topic+".log"))
+		if err != nil {
+			t.Fatalf("TopicRoutingWriter: %s", err)
+		}
+		if got, want := string(contents), "{\"n\":0}\n{\"n\":1}\n{\"n\":2}\n"; got != want {
+			t.Errorf("TopicRoutingWriter: %s has %q, want %q", topic, got, want)
+		}
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*")); len(names) != len(topics) {
+		t.Errorf("TopicRoutingWriter: got files %q, want one per topic", names)
+	}
+}
+
+func TestTopicRoutingWriterUnsafeTopics(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "topics")
+	if err := os.MkdirAll(filepath.Join(dir, "busy"), 0770); err != nil {
+		t.Fatal(err)
+	}
+	w := NewTopicRoutingWriter(dir, "%s", 0).SetFormat("%M")
+
+	for _, topic := range []string{"../escape", "..", "a/b", `c\d`, "e\x00f", "busy"} {
+		// A topic naming a directory cannot be opened, and must not panic
+		w.LogWrite(&LogRecord{Topic: topic, Message: topic})
+	}
+	w.Close()
+
+	if names, _ := filepath.Glob(filepath.Join(parent, "*")); len(names) != 1 {
+		t.Errorf("TopicRoutingWriter: wrote outside of its directory: %q", names)
+	}
+	for name, want := range map[string]string{
+		"___escape": "../escape\n",
+		"__":        "..\n",
+		"a_b":       "a/b\n",
+		"c_d":       "c\\d\n",
+		"e_f":       "e\x00f\n",
+	} {
+		if got, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+			t.Errorf("TopicRoutingWriter: %s holds %q (%v), want %q", name, got, err, want)
+		}
+	}
+}
+
+func TestTopicRoutingWriterSlowTopic(t *testing.T) {
+	dir := t.TempDir()
+	w := NewTopicRoutingWriter(dir, "%s.log", 0).SetFormat("%M")
+	defer w.Close()
+	w.LogWrite(&LogRecord{Topic: "slow", Message: "first"})
+
+	// Hold the slow topic's file as a long write or close would
+	openLogFiles.mu.Lock()
+	slow := w.open["slow"].Value.(*topicFile)
+	openLogFiles.mu.Unlock()
+	slow.mu.Lock()
+	defer slow.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		w.LogWrite(&LogRecord{Topic: "fast", Message: "not held up"})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("TopicRoutingWriter: a slow topic held up another")
+	}
+}
+
+func TestSetMaxOpenLogFiles(t *testing.T) {
+	dir := t.TempDir()
+	SetMaxOpenLogFiles(3)
+	defer SetMaxOpenLogFiles(0)
+
+	// Open file descriptors, where the system lists them
+	openFDs := func() int {
+		names, err := ioutil.ReadDir("/proc/self/fd")
+		if err != nil {
+			return -1
+		}
+		return len(names)
+	}
+	before := openFDs()
+
+	// Two writers without limits of their own share the global one
+	a := NewTopicRoutingWriter(dir, "a-%s.log", 0).SetFormat("%M")
+	b := NewTopicRoutingWriter(dir, "b-%s.log", 0).SetFormat("%M")
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 10; i++ {
+			topic := fmt.Sprintf("t%d", i)
+			a.LogWrite(&LogRecord{Topic: topic, Message: fmt.Sprintf("%d", round)})
+			b.LogWrite(&LogRecord{Topic: topic, Message: fmt.Sprintf("%d", round)})
+
+			openLogFiles.mu.Lock()
+			open := openLogFiles.lru.Len()
+			openLogFiles.mu.Unlock()
+			if open > 3 {
+				t.Fatalf("SetMaxOpenLogFiles: %d files open, want at most 3", open)
+			}
+			if before >= 0 {
+				if fds := openFDs(); fds > before+3 {
+					t.Fatalf("SetMaxOpenLogFiles: %d file descriptors open, had %d before", fds, before)
+				}
+			}
+		}
+	}
+	a.Close()
+	b.Close()
+
+	for _, prefix := range []string{"a", "b"} {
+		for i := 0; i < 10; i++ {
+			fname := filepath.Join(dir, fmt.Sprintf("%s-t%d.log", prefix, i))
+			contents, err := ioutil.ReadFile(fname)
+			if err != nil {
+				t.Fatalf("SetMaxOpenLogFiles: %s", err)
+			}
+			if got, want := string(contents), "0\n1\n2\n"; got != want {
+				t.Errorf("SetMaxOpenLogFiles: %s has %q, want %q", fname, got, want)
+			}
+		}
+	}
+}
+
+// failingCloseWriter is a LogWriter whose final flush fails.
+type failingCloseWriter struct {
+	recordingLogWriter
+}
+
+func (w *failingCloseWriter) CloseErr() error {
+	return errors.New("disk full")
+}
+
+func TestLoggerCloseErr(t *testing.T) {
+	defer os.Remove(testLogFile)
+
+	l := make(Logger)
+	l.AddFilter("stdout", INFO, &recordingLogWriter{})
+	l.AddFilter("file", INFO, NewFileLogWriter(testLogFile, false, false))
+	l.AddFilter("failing", INFO, &failingCloseWriter{})
+
+	err := l.Close()
+	if err == nil {
+		t.Fatalf("Close: expected an error from the failing writer")
+	}
+	if got, want := err.Error(), "Close: failing: disk full"; got != want {
+		t.Errorf("Close: got %q, want %q", got, want)
+	}
+	if len(l) != 0 {
+		t.Errorf("Close: %d filters left, want 0", len(l))
+	}
+
+	l.AddFilter("file", INFO, NewFileLogWriter(testLogFile, false, false))
+	if err := l.Close(); err != nil {
+		t.Errorf("Close: unexpected error %s", err)
+	}
+}
+
+type closeRecordingBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeRecordingBuffer) Close() error {
+	b.closed = true
+	return nil
+}
 
+func TestAddWriter(t *testing.T) {
+	buf := &closeRecordingBuffer{}
 	l := make(Logger)
+	l.AddWriter("stdout", INFO, buf, "[%L] %M")
 
-	// Delete and open the output log without a timestamp (for a constant md5sum)
-	l.AddFilter("file", FINEST, NewFileLogWriter(testLogFile, false, true).SetFormat("[%L] %M"))
-	defer os.Remove(testLogFile)
+	l.Debug("hidden")
+	l.Info("shown %d", 1)
+	l.Error("shown %d", 2)
 
-	// Send some log messages
-	l.Log(CRITICAL, "testsrc1", fmt.Sprintf("This message is level %d", int(CRITICAL)))
-	l.Logf(ERROR, "This message is level %v", ERROR)
-	l.Logf(WARNING, "This message is level %s", WARNING)
-	l.Logc(INFO, func() string { return "This message is level INFO" })
-	l.Trace("This message is level %d", int(TRACE))
-	l.Debug("This message is level %s", DEBUG)
-	l.Fine(func() string { return fmt.Sprintf("This message is level %v", FINE) })
-	l.Finest("This message is level %v", FINEST)
-	l.Finest(FINEST, "is also this message's level")
+	if got, want := buf.String(), "[INFO] shown 1\n[EROR] shown 2\n"; got != want {
+		t.Errorf("AddWriter: got %q, want %q", got, want)
+	}
 
-	l.Close()
+	if err := l.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+	if buf.closed {
+		t.Errorf("Close closed a writer the logger did not open")
+	}
+}
 
-	contents, err := ioutil.ReadFile(testLogFile)
-	if err != nil {
-		t.Fatalf("Could not read output log: %s", err)
+func TestHealthy(t *testing.T) {
+	defer func(dial func(string, string, time.Duration) (net.Conn, error)) {
+		dialTimeout = dial
+	}(dialTimeout)
+	dialTimeout = func(network, address string, timeout time.Duration) (net.Conn, error) {
+		return nil, errors.New("connection refused")
 	}
+	defer os.Remove(testLogFile)
 
-	sum := md5.New()
-	sum.Write(contents)
-	if sumstr := hex.EncodeToString(sum.Sum(nil)); sumstr != expected {
-		t.Errorf("--- Log Contents:\n%s---", string(contents))
-		t.Fatalf("Checksum does not match: %s (expecting %s)", sumstr, expected)
+	l := make(Logger)
+	l.AddFilter("file", INFO, NewFileLogWriter(testLogFile, false, false))
+	defer l.Close()
+
+	if ok, errs := l.Healthy(); !ok || errs != nil {
+		t.Errorf("Healthy: got %v, %v with a working file writer", ok, errs)
+	}
+
+	l.AddFilter("network", INFO, NewSocketLogWriter("tcp", "collector:12124"))
+	ok, errs := l.Healthy()
+	if ok {
+		t.Errorf("Healthy: reports healthy with a failed socket writer")
+	}
+	if len(errs) != 1 || errs["network"] == nil {
+		t.Errorf("Healthy: got errors %v, want one for \"network\"", errs)
 	}
 }
 
@@ -317,12 +3914,19 @@ func TestXMLConfig(t *testing.T) {
 	fmt.Fprintln(fd, "    <type>console</type>")
 	fmt.Fprintln(fd, "    <!-- level is (:?FINEST|FINE|DEBUG|TRACE|INFO|WARNING|ERROR) -->")
 	fmt.Fprintln(fd, "    <level>DEBUG</level>")
+	fmt.Fprintln(fd, "    <!-- optional: <property name=\"target\">stderr</property> writes to stderr in place of stdout, -->")
+	fmt.Fprintln(fd, "    <!-- and <property name=\"stderrlevel\">ERROR</property> sends ERROR and above to stderr -->")
+	fmt.Fprint(fd, "    <!-- <property name=\"format\">[%D %T] [%L] (%S) %M</property> replaces the console's own layout -->\n")
 	fmt.Fprintln(fd, "  </filter>")
 	fmt.Fprintln(fd, "  <filter enabled=\"true\">")
 	fmt.Fprintln(fd, "    <tag>file</tag>")
 	fmt.Fprintln(fd, "    <type>file</type>")
 	fmt.Fprintln(fd, "    <level>FINEST</level>")
 	fmt.Fprintln(fd, "    <property name=\"filename\">test.log</property>")
+	fmt.Fprint(fd, "    <!-- A filename with date codes, as app-%Y%m%d.log or app-{2006010215}.log, writes straight into dated files -->\n")
+	fmt.Fprintln(fd, "    <!-- and <property name=\"symlink\">app.log</property> keeps a link to the current one -->")
+	fmt.Fprintln(fd, "    <!-- <property name=\"writeerror\">retry</property> retries failed writes; stderr writes them there; stop, the default, stops -->")
+	fmt.Fprintln(fd, "    <!-- <property name=\"sync\">write</property> syncs the file after every record; a duration such as 1s syncs that often; never is the default -->")
 	fmt.Fprintln(fd, "    <!--")
 	fmt.Fprintln(fd, "       %T - Time (15:04:05 MST)")
 	fmt.Fprintln(fd, "       %t - Time (15:04)")
@@ -348,6 +3952,8 @@ func TestXMLConfig(t *testing.T) {
 	fmt.Fprintln(fd, "    <property name=\"rotate\">true</property> <!-- true enables log rotation, otherwise append -->")
 	fmt.Fprintln(fd, "    <property name=\"maxsize\">100M</property> <!-- \\d+[KMG]? Suffixes are in terms of 2**10 -->")
 	fmt.Fprintln(fd, "    <property name=\"maxrecords\">6K</property> <!-- \\d+[KMG]? Suffixes are in terms of thousands -->")
+	fmt.Fprintln(fd, "    <property name=\"maxage\">168h</property> <!-- Removes rotated files last written longer ago; 0 keeps them all -->")
+	fmt.Fprintln(fd, "    <!-- <property name=\"schedule\">0 0 * * *</property> rotates on a cron schedule, or \"every 6h\" -->")
 	fmt.Fprintln(fd, "    <property name=\"daily\">false</property> <!-- Automatically rotates when a log message is written after midnight -->")
 	fmt.Fprintln(fd, "  </filter>")
 	fmt.Fprintln(fd, "  <filter enabled=\"false\"><!-- enabled=false means this logger won't actually be created -->")
@@ -418,6 +4024,77 @@ func TestXMLConfig(t *testing.T) {
 	os.Rename(configfile, "examples/"+configfile) // Keep this so that an example with the documentation is available
 }
 
+func TestXMLConfigBuffered(t *testing.T) {
+	const (
+		configfile = "_logtest_buffered.xml"
+		logfile    = "_logtest_buffered.log"
+	)
+	defer os.Remove(configfile)
+	defer os.Remove(logfile)
+
+	config := `<logging>
+  <filter enabled="true">
+    <tag>stdout</tag>
+    <type>file</type>
+    <level>INFO</level>
+    <property name="filename">` + logfile + `</property>
+    <property name="format">[%L] %M</property>
+    <property name="buffer">64K</property>
+    <property name="flushinterval">50ms</property>
+  </filter>
+</logging>
+`
+	if err := ioutil.WriteFile(configfile, []byte(config), 0660); err != nil {
+		t.Fatalf("Could not write %s: %s", configfile, err)
+	}
+
+	log := make(Logger)
+	log.LoadConfiguration(configfile)
+	defer log.Close()
+
+	flw, ok := log["stdout"].LogWriter.(*FileLogWriter)
+	if !ok {
+		t.Fatalf("XMLConfig: Expected stdout to be *FileLogWriter, found %T", log["stdout"].LogWriter)
+	}
+	if flw.buf == nil || flw.buf.Size() != 64*1024 {
+		t.Fatalf("XMLConfig: Expected a 64K buffer")
+	}
+	if flw.flushinterval != 50*time.Millisecond {
+		t.Errorf("XMLConfig: Expected a flush interval of 50ms, found %s", flw.flushinterval)
+	}
+
+	log.Info("buffered message")
+	if got := string(readLogFile(t, logfile, 1)); got != "[INFO] buffered message\n" {
+		t.Errorf("XMLConfig: buffered message was not flushed on schedule: %q", got)
+	}
+}
+
+func TestXMLConfigNull(t *testing.T) {
+	const configfile = "_logtest_null.xml"
+	defer os.Remove(configfile)
+
+	config := `<logging>
+  <filter enabled="true">
+    <tag>stdout</tag>
+    <type>null</type>
+    <level>FINEST</level>
+  </filter>
+</logging>
+`
+	if err := ioutil.WriteFile(configfile, []byte(config), 0660); err != nil {
+		t.Fatalf("Could not write %s: %s", configfile, err)
+	}
+
+	log := make(Logger)
+	log.LoadConfiguration(configfile)
+	defer log.Close()
+
+	if _, ok := log["stdout"].LogWriter.(NullLogWriter); !ok {
+		t.Fatalf("XMLConfig: Expected stdout to be NullLogWriter, found %T", log["stdout"].LogWriter)
+	}
+	log.Critical("discarded")
+}
+
 func BenchmarkFormatLogRecord(b *testing.B) {
 	const updateEvery = 1
 	rec := &LogRecord{
@@ -454,6 +4131,25 @@ func BenchmarkConsoleLog(b *testing.B) {
 	}
 }
 
+func BenchmarkNullLog(b *testing.B) {
+	sl := make(Logger)
+	sl.AddFilter("stdout", FINEST, NewNullLogWriter())
+	for i := 0; i < b.N; i++ {
+		sl.Log(WARNING, "here", "This is a log message")
+	}
+}
+
+func BenchmarkSourceMinLevel(b *testing.B) {
+	for _, lvl := range []Level{FINEST, WARNING} {
+		b.Run(lvl.String(), func(b *testing.B) {
+			sl := make(Logger).AddWriter("stdout", INFO, ioutil.Discard, "%L %M").SetSourceMinLevel(lvl)
+			for i := 0; i < b.N; i++ {
+				sl.Log(INFO, "here", "This is a log message")
+			}
+		})
+	}
+}
+
 func BenchmarkConsoleNotLogged(b *testing.B) {
 	sl := NewDefaultLogger(INFO)
 	for i := 0; i < b.N; i++ {
@@ -461,6 +4157,24 @@ func BenchmarkConsoleNotLogged(b *testing.B) {
 	}
 }
 
+// Compares a lone stdout filter, which every name reaches at once, with a
+// second filter, which makes a dotted name look for its closest filter
+func BenchmarkNamedNotLogged(b *testing.B) {
+	for _, filters := range []int{1, 2} {
+		b.Run(fmt.Sprint("filters=", filters), func(b *testing.B) {
+			sl := make(Logger)
+			sl.AddFilter("stdout", INFO, &recordingLogWriter{})
+			if filters > 1 {
+				sl.AddFilter("audit", INFO, &recordingLogWriter{})
+			}
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				sl.intLogNamef("app.db.query", DEBUG, "This is a log message")
+			}
+		})
+	}
+}
+
 func BenchmarkConsoleUtilLog(b *testing.B) {
 	sl := NewDefaultLogger(INFO)
 	for i := 0; i < b.N; i++ {
@@ -487,6 +4201,51 @@ func BenchmarkFileLog(b *testing.B) {
 	os.Remove("benchlog.log")
 }
 
+// Compares a single shard, which is as good as one file, with one shard per CPU
+func BenchmarkShardedFileLogParallel(b *testing.B) {
+	defer func() {
+		names, _ := filepath.Glob("benchlog.log.*")
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}()
+	for _, shards := range []int{1, runtime.GOMAXPROCS(0)} {
+		b.Run(fmt.Sprint("shards=", shards), func(b *testing.B) {
+			w := NewShardedFileLogWriter("benchlog.log", shards)
+			defer w.Close()
+
+			// Each producer logs from a source of its own, which picks its shard
+			var producers int32
+			b.RunParallel(func(pb *testing.PB) {
+				rec := newLogRecord(WARNING, fmt.Sprint("producer ", atomic.AddInt32(&producers, 1)), "This is a log message")
+				for pb.Next() {
+					w.LogWrite(rec)
+				}
+			})
+			w.Flush()
+		})
+	}
+}
+
+// Compares writing each record as it arrives with coalescing concurrent records
+func BenchmarkFileLogMicrobatchParallel(b *testing.B) {
+	defer os.Remove("benchlog.log")
+	rec := newLogRecord(WARNING, "here", "This is a log message")
+
+	for _, batch := range []int{0, 64 * 1024} {
+		b.Run(fmt.Sprint("batch=", batch), func(b *testing.B) {
+			w := NewFileLogWriter("benchlog.log", false, false).SetMicrobatch(batch, 0)
+			defer w.Close()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					w.LogWrite(rec)
+				}
+			})
+			w.Flush()
+		})
+	}
+}
+
 func BenchmarkFileNotLogged(b *testing.B) {
 	sl := make(Logger)
 	b.StopTimer()
@@ -523,6 +4282,32 @@ func BenchmarkFileUtilNotLog(b *testing.B) {
 	os.Remove("benchlog.log")
 }
 
+func BenchmarkFileDailyLog(b *testing.B) {
+	defer func(clock func() time.Time) {
+		timeNow = clock
+	}(timeNow)
+	var calls int64
+	timeNow = func() time.Time {
+		atomic.AddInt64(&calls, 1)
+		return time.Now()
+	}
+
+	b.StopTimer()
+	w := NewFileLogWriter("benchlog.log", false, true)
+	rec := newLogRecord(WARNING, "here", "This is a log message")
+	rec.Created = time.Now()
+	atomic.StoreInt64(&calls, 0)
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		w.LogWrite(rec)
+	}
+	b.StopTimer()
+	w.Close()
+	time.Sleep(10 * time.Millisecond)
+	b.ReportMetric(float64(atomic.LoadInt64(&calls))/float64(b.N), "clockcalls/op")
+	os.Remove("benchlog.log")
+}
+
 // Benchmark results (darwin amd64 6g)
 //elog.BenchmarkConsoleLog           100000       22819 ns/op
 //elog.BenchmarkConsoleNotLogged    2000000         879 ns/op
@@ -532,3 +4317,641 @@ func BenchmarkFileUtilNotLog(b *testing.B) {
 //elog.BenchmarkFileNotLogged       2000000         821 ns/op
 //elog.BenchmarkFileUtilLog           50000       33945 ns/op
 //elog.BenchmarkFileUtilNotLog      1000000        1258 ns/op
+
+func TestLevelOff(t *testing.T) {
+	w := &recordingLogWriter{}
+	l := make(Logger)
+	l.AddFilter("stdout", OFF, w)
+
+	for lvl := FINEST; lvl <= CRITICAL; lvl++ {
+		l.Log(lvl, "source", "message")
+	}
+	l.Critical("critical")
+	l.LogError(CRITICAL, errors.New("failed"), "error")
+	l.Log(OFF, "source", "at the OFF level itself")
+	if recs := w.Records(); len(recs) != 0 {
+		t.Errorf("OFF filter received %d records", len(recs))
+	}
+	if _, ok := l["stdout"]; !ok {
+		t.Errorf("OFF filter was removed")
+	}
+
+	for _, test := range []struct {
+		name string
+		want Level
+	}{
+		{"OFF", OFF},
+		{"off", OFF},
+		{"WARNING", WARNING},
+		{"WARN", WARNING},
+		{"critical", CRITICAL},
+	} {
+		if got, err := LevelFromString(test.name); err != nil || got != test.want {
+			t.Errorf("LevelFromString(%q) = %v, %v, want %v", test.name, got, err, test.want)
+		}
+	}
+	if _, err := LevelFromString("LOUD"); err == nil {
+		t.Errorf("LevelFromString(%q): expected an error", "LOUD")
+	}
+
+	configfile := filepath.Join(t.TempDir(), "off.xml")
+	config := `<logging>
+  <filter enabled="true">
+    <tag>stdout</tag>
+    <type>console</type>
+    <level>OFF</level>
+  </filter>
+</logging>
+`
+	if err := ioutil.WriteFile(configfile, []byte(config), 0660); err != nil {
+		t.Fatalf("Could not write %s: %s", configfile, err)
+	}
+	xl := make(Logger)
+	xl.LoadConfiguration(configfile)
+	defer xl.Close()
+	if filt, ok := xl["stdout"]; !ok || filt.Level != OFF {
+		t.Errorf("LoadConfiguration: level OFF not loaded: %+v", filt)
+	}
+}
+
+func TestXMLConfigReload(t *testing.T) {
+	const (
+		configfile = "_logtest_reload.xml"
+		keepfile   = "_logtest_keep.log"
+		dropfile   = "_logtest_drop.log"
+		addfile    = "_logtest_add.log"
+	)
+	for _, name := range []string{configfile, keepfile, dropfile, addfile} {
+		os.Remove(name)
+		defer os.Remove(name)
+	}
+
+	filter := func(tag, level, fname, format string) string {
+		return `  <filter enabled="true">
+    <tag>` + tag + `</tag>
+    <type>file</type>
+    <level>` + level + `</level>
+    <property name="filename">` + fname + `</property>
+    <property name="format">` + format + `</property>
+  </filter>
+`
+	}
+	load := func(log Logger, filters ...string) {
+		config := "<logging>\n" + strings.Join(filters, "") + "</logging>\n"
+		if err := ioutil.WriteFile(configfile, []byte(config), 0660); err != nil {
+			t.Fatalf("Could not write %s: %s", configfile, err)
+		}
+		log.LoadConfiguration(configfile)
+	}
+
+	log := make(Logger)
+	load(log,
+		filter("stdout", "WARNING", keepfile, "A %M"),
+		filter("audit", "INFO", dropfile, "%M"))
+	defer log.Close()
+
+	keep := log["stdout"].LogWriter.(*FileLogWriter)
+	keepfd := keep.file
+	drop := log["audit"].LogWriter.(*FileLogWriter)
+	log.Warn("before")
+	log.Info("hidden")
+
+	load(log,
+		filter("stdout", "INFO", keepfile, "B %M"),
+		filter("events", "INFO", addfile, "%M"))
+
+	if len(log) != 2 || log["audit"] != nil || log["events"] == nil {
+		t.Fatalf("Reload: wrong filters after reload: %v", log)
+	}
+	select {
+	case <-drop.done:
+	default:
+		t.Errorf("Reload: removed filter was not closed")
+	}
+	if log["stdout"].LogWriter != keep || keep.file != keepfd {
+		t.Errorf("Reload: unchanged filter was reopened")
+	}
+	if log["stdout"].Level != INFO {
+		t.Errorf("Reload: level not updated: %v", log["stdout"].Level)
+	}
+
+	log.Info("after")
+	if got, want := string(readLogFile(t, keepfile, 2)), "A before\nB after\n"; got != want {
+		t.Errorf("Reload: got %q, want %q", got, want)
+	}
+}
+
+func TestXMLConfigRouting(t *testing.T) {
+	dir := t.TempDir()
+	configfile := filepath.Join(dir, "routing.xml")
+	filter := func(tag, level string) string {
+		return `  <filter enabled="true">
+    <tag>` + tag + `</tag>
+    <type>file</type>
+    <level>` + level + `</level>
+    <property name="filename">` + filepath.Join(dir, tag+".log") + `</property>
+    <property name="format">%N %M</property>
+  </filter>
+`
+	}
+	load := func(log Logger, routing string) {
+		config := "<logging>\n" + filter("debug", "ERROR") + filter("app", "INFO") + filter("pager", "FINEST") + routing + "</logging>\n"
+		if err := ioutil.WriteFile(configfile, []byte(config), 0660); err != nil {
+			t.Fatalf("Could not write %s: %s", configfile, err)
+		}
+		log.LoadConfiguration(configfile)
+	}
+
+	log := make(Logger)
+	load(log, `  <routing>
+    <route levels="FINEST-INFO">debug</route>
+    <route levels="WARNING-ERROR">app</route>
+    <route levels="CRITICAL">app, pager</route>
+  </routing>
+`)
+	defer log.Close()
+
+	// The routes decide, whatever the levels of the filters
+	for _, lvl := range []Level{DEBUG, INFO, WARNING, ERROR, CRITICAL} {
+		log.Log(lvl, "source", "message")
+	}
+	for tag, want := range map[string]string{
+		"debug": "DEBUG message\nINFO message\n",
+		"app":   "WARNING message\nERROR message\nCRITICAL message\n",
+		"pager": "CRITICAL message\n",
+	} {
+		log[tag].LogWriter.(*FileLogWriter).Flush()
+		if got := string(readLogFile(t, filepath.Join(dir, tag+".log"), 0)); got != want {
+			t.Errorf("Routing: %s got %q, want %q", tag, got, want)
+		}
+	}
+
+	// Reloading without a routing section goes back to the filters' names
+	load(log, "")
+	if l, ok := log.getLogger("app", INFO); !ok || l != log["app"] {
+		t.Errorf("Routing: routes kept after reloading without them")
+	}
+}
+
+// syncingLogWriter counts the times it is synced.
+type syncingLogWriter struct {
+	recordingLogWriter
+	syncs int
+}
+
+func (w *syncingLogWriter) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.syncs++
+	return nil
+}
+
+func TestLogSyncRouted(t *testing.T) {
+	audit, pager := &syncingLogWriter{}, &syncingLogWriter{}
+	log := make(Logger)
+	log.AddFilter("audit", INFO, audit)
+	log.AddFilter("pager", INFO, pager)
+	log.SetRoutes(Route{Min: CRITICAL, Max: CRITICAL, Filters: []string{"audit", "pager"}})
+	defer log.Close()
+
+	// LogSync syncs every filter the route sends the record to
+	log.LogSync(CRITICAL, "source", "must be on disk")
+	for tag, w := range map[string]*syncingLogWriter{"audit": audit, "pager": pager} {
+		if got := len(w.Records()); got != 1 {
+			t.Errorf("LogSync: %s got %d records, want 1", tag, got)
+		}
+		if w.syncs != 1 {
+			t.Errorf("LogSync: %s synced %d times, want 1", tag, w.syncs)
+		}
+	}
+}
+
+func TestSyslogLogWriter(t *testing.T) {
+	dir := t.TempDir()
+	sockname := filepath.Join(dir, "log")
+	daemon, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: sockname, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("Could not listen on %s: %s", sockname, err)
+	}
+	defer daemon.Close()
+	defer func(paths []string) { syslogPaths = paths }(syslogPaths)
+	syslogPaths = []string{filepath.Join(dir, "missing"), sockname}
+
+	configfile := filepath.Join(dir, "syslog.xml")
+	config := `<logging>
+  <filter enabled="true">
+    <tag>stdout</tag>
+    <type>syslog</type>
+    <level>INFO</level>
+    <property name="facility">local0</property>
+    <property name="tag">myapp</property>
+    <property name="format">%L %M</property>
+  </filter>
+</logging>
+`
+	if err := ioutil.WriteFile(configfile, []byte(config), 0660); err != nil {
+		t.Fatalf("Could not write %s: %s", configfile, err)
+	}
+	log := make(Logger)
+	log.LoadConfiguration(configfile)
+	defer log.Close()
+
+	log.Debug("hidden")
+	log.Info("started")
+	log.Warn("disk full")
+	log.Critical("gone")
+
+	suffix := fmt.Sprintf(" myapp[%d]: ", os.Getpid())
+	daemon.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	for _, want := range []struct{ pri, msg string }{
+		{"<134>", "INFO started"},
+		{"<132>", "WARN disk full"},
+		{"<130>", "CRIT gone"},
+	} {
+		n, err := daemon.Read(buf)
+		if err != nil {
+			t.Fatalf("Syslog: %s", err)
+		}
+		got := string(buf[:n])
+		if !strings.HasPrefix(got, want.pri) || !strings.HasSuffix(got, suffix+want.msg+"\n") {
+			t.Errorf("Syslog: got %q, want %q...%q", got, want.pri, suffix+want.msg+"\n")
+		}
+	}
+
+	if _, err := SyslogFacilityFromString("nope"); err == nil {
+		t.Errorf("SyslogFacilityFromString: no error for an unknown facility")
+	}
+}
+
+func TestSyslogNetWriter(t *testing.T) {
+	created := time.Date(2003, 10, 11, 22, 14, 15, 3000, time.UTC)
+
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	clientconfig := srv.Client().Transport.(*http.Transport).TLSClientConfig
+
+	for _, network := range []string{"tcp", "tls"} {
+		var l net.Listener
+		var err error
+		if network == "tls" {
+			l, err = tls.Listen("tcp", "127.0.0.1:0", srv.TLS)
+		} else {
+			l, err = net.Listen("tcp", "127.0.0.1:0")
+		}
+		if err != nil {
+			t.Fatalf("Could not listen: %s", err)
+		}
+		defer l.Close()
+
+		w := NewSyslogNetWriter(network, l.Addr().String(), LOG_LOCAL4, "").
+			SetTLSConfig(clientconfig).
+			SetHostname("mymachine.example.com").
+			SetAppName("su")
+		w.LogWrite(&LogRecord{Level: CRITICAL, Created: created, Source: "main.main:12", Message: "'su root' failed for lonvick on /dev/pts/8"})
+		w.LogWrite(&LogRecord{Level: INFO, Created: created, Category: "ID47", Topic: `a"b]c\d`, Message: "structured"})
+		w.Close()
+
+		conn, err := l.Accept()
+		if err != nil {
+			t.Fatalf("%s: Accept: %s", network, err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		r := bufio.NewReader(conn)
+		for _, want := range []string{
+			`<162>1 2003-10-11T22:14:15.000003Z mymachine.example.com su %d - [log4go@32473 level="CRIT" source="main.main:12"] 'su root' failed for lonvick on /dev/pts/8`,
+			`<166>1 2003-10-11T22:14:15.000003Z mymachine.example.com su %d ID47 [log4go@32473 level="INFO" topic="a\"b\]c\\d"] structured`,
+		} {
+			want = fmt.Sprintf(want, os.Getpid())
+			var n int
+			if _, err := fmt.Fscanf(r, "%d ", &n); err != nil {
+				t.Fatalf("%s: reading frame length: %s", network, err)
+			}
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				t.Fatalf("%s: reading frame: %s", network, err)
+			}
+			if got := string(msg); got != want {
+				t.Errorf("%s:\n got %q\nwant %q", network, got, want)
+			}
+		}
+		conn.Close()
+	}
+}
+
+func TestWebhookLogWriter(t *testing.T) {
+	defer func(clock func() time.Time) { timeNow = clock }(timeNow)
+	clock := time.Date(2024, time.March, 4, 5, 6, 7, 0, time.UTC)
+	timeNow = func() time.Time { return clock }
+
+	var mu sync.Mutex
+	var posts []string
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if ct := r.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("WebhookLogWriter: Content-Type %q", ct)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		posts = append(posts, string(body))
+	}))
+	defer srv.Close()
+
+	w := NewWebhookLogWriter(srv.URL, WARNING).SetRateLimit(2)
+	for _, rec := range []*LogRecord{
+		{Level: INFO, Created: clock, Source: "main.main:10", Message: "below the threshold"},
+		{Level: ERROR, Created: clock, Source: "main.main:11", Message: `disk "sda" failed`},
+		{Level: CRITICAL, Created: clock, Source: "main.main:12", Message: "second"},
+		{Level: CRITICAL, Created: clock, Source: "main.main:13", Message: "over the limit"},
+	} {
+		w.LogWrite(rec)
+	}
+
+	// Half a minute later, another record may be posted
+	clock = clock.Add(30 * time.Second)
+	w.LogWrite(&LogRecord{Level: WARNING, Created: clock, Source: "main.main:14", Message: "refilled"})
+	w.Close()
+
+	want := []string{
+		`{"text": "[EROR] (main.main:11) disk \"sda\" failed"}`,
+		`{"text": "[CRIT] (main.main:12) second"}`,
+		`{"text": "[WARN] (main.main:14) refilled"}`,
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(posts, want) {
+		t.Errorf("WebhookLogWriter: posted\n%q\nwant\n%q", posts, want)
+	}
+	if got := w.Dropped(); got != 1 {
+		t.Errorf("WebhookLogWriter: dropped %d, want 1", got)
+	}
+
+	// A template of one's own
+	posts = nil
+	mu.Unlock()
+	w = NewWebhookLogWriter(srv.URL, FINEST).SetTemplate(`{"level": {{json .Level}}, "at": {{json .Time}}, "msg": {{json .Message}}}`)
+	w.LogWrite(&LogRecord{Level: INFO, Created: clock, Message: "custom"})
+	w.Close()
+	mu.Lock()
+	if want := []string{`{"level": "INFO", "at": "2024-03-04T05:06:37Z", "msg": "custom"}`}; !reflect.DeepEqual(posts, want) {
+		t.Errorf("SetTemplate: posted %q, want %q", posts, want)
+	}
+}
+
+func TestGRPCLogWriter(t *testing.T) {
+	received := make(chan *logpb.Record, 10)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 || r.URL.Path != "/log4go.LogService/Stream" || r.Header.Get("Content-Type") != "application/grpc+proto" {
+			t.Errorf("GRPCLogWriter: got %s %s as %q", r.Proto, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		rw.Header().Set("Content-Type", "application/grpc")
+		rw.Header().Set("Trailer", "Grpc-Status")
+		rw.WriteHeader(http.StatusOK)
+		rw.(http.Flusher).Flush()
+		for {
+			rec, err := logpb.ReadGRPCFrame(r.Body)
+			if err != nil {
+				break
+			}
+			received <- rec
+		}
+		rw.Header().Set("Grpc-Status", "0")
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	w := NewGRPCLogWriter(strings.TrimPrefix(srv.URL, "https://")).
+		SetTLSConfig(srv.Client().Transport.(*http.Transport).TLSClientConfig)
+	w.LogWrite(&LogRecord{Level: INFO, Created: now, Source: "main.main:12", Message: "first"})
+	w.LogWrite(&LogRecord{Level: ERROR, Created: now, Message: "second", Topic: "orders"})
+	w.Close()
+	close(received)
+
+	var got []string
+	for rec := range received {
+		got = append(got, fmt.Sprintf("%d %d %s %s %v", rec.Level, rec.Ts, rec.Source, rec.Message, rec.Fields))
+	}
+	want := []string{
+		fmt.Sprintf("%d %d main.main:12 first map[]", INFO, now.UnixNano()),
+		fmt.Sprintf("%d %d  second map[Topic:orders]", ERROR, now.UnixNano()),
+	}
+	if !reflect.DeepEqual(got, want) || w.Dropped() != 0 {
+		t.Errorf("GRPCLogWriter: received %q, dropped %d, want %q", got, w.Dropped(), want)
+	}
+
+	// Without a collector, records are dropped while the writer waits to
+	// try again
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	w = NewGRPCLogWriter(addr)
+	w.LogWrite(newLogRecord(INFO, "source", "refused"))
+	w.LogWrite(newLogRecord(INFO, "source", "waiting"))
+	w.Close()
+	if got := w.Dropped(); got != 2 {
+		t.Errorf("GRPCLogWriter: dropped %d records without a collector, want 2", got)
+	}
+}
+
+// fakeRedis accepts connections and replies to each command with reply,
+// sending the commands it receives to cmds.  A connection is closed instead
+// of replying to a command for which reply returns nothing.
+func fakeRedis(t *testing.T, cmds chan<- []string, reply func(cmd []string) string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					var n int
+					if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+						return
+					}
+					cmd := make([]string, n)
+					for i := range cmd {
+						var size int
+						fmt.Fscanf(r, "$%d\r\n", &size)
+						arg := make([]byte, size+2)
+						io.ReadFull(r, arg)
+						cmd[i] = string(arg[:size])
+					}
+					cmds <- cmd
+					rep := reply(cmd)
+					if len(rep) == 0 {
+						return
+					}
+					io.WriteString(conn, rep)
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestRedisLogWriter(t *testing.T) {
+	cmds := make(chan []string, 20)
+	var fail int32 = 1
+	l := fakeRedis(t, cmds, func(cmd []string) string {
+		switch {
+		case cmd[0] == "AUTH" && cmd[1] != "secret":
+			return "-WRONGPASS invalid password\r\n"
+		case cmd[0] == "XADD" && cmd[len(cmd)-1] == "hang up":
+			return ""
+		case cmd[0] == "XADD" && atomic.CompareAndSwapInt32(&fail, 1, 0):
+			return "-ERR simulated\r\n"
+		case cmd[0] == "XADD":
+			return "$15\r\n1526919030474-0\r\n"
+		case cmd[0] == "RPUSH":
+			return ":1\r\n"
+		}
+		return "+OK\r\n"
+	})
+	defer l.Close()
+
+	w := NewRedisLogWriter(l.Addr().String(), "logs").SetMaxLen(1000).SetAuth("secret", 2)
+	w.retryinterval = 0
+	rec := newLogRecord(WARNING, "main.main:12", "rejected")
+	w.LogWrite(rec)
+	rec = newLogRecord(WARNING, "main.main:12", "hang up")
+	w.LogWrite(rec)
+	rec = newLogRecord(ERROR, "main.main:13", "added")
+	rec.Category = "db"
+	w.LogWrite(rec)
+	w.Close()
+
+	created := now.Format(time.RFC3339Nano)
+	xadd := func(msg string, extra ...string) []string {
+		return append([]string{"XADD", "logs", "MAXLEN", "~", "1000", "*", "level", "WARN", "time", created, "source", "main.main:12", "message", msg}, extra...)
+	}
+	added := []string{"XADD", "logs", "MAXLEN", "~", "1000", "*", "level", "EROR", "time", created, "source", "main.main:13", "message", "added", "category", "db"}
+	want := [][]string{
+		{"AUTH", "secret"}, {"SELECT", "2"}, xadd("rejected"), xadd("hang up"),
+		// After the connection is lost, the writer connects again
+		{"AUTH", "secret"}, {"SELECT", "2"}, added,
+	}
+	for i, want := range want {
+		select {
+		case got := <-cmds:
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("RedisLogWriter: command %d is %q, want %q", i, got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("RedisLogWriter: command %d %q not received", i, want)
+		}
+	}
+	if got := w.Dropped(); got != 2 {
+		t.Errorf("RedisLogWriter: dropped %d, want 2", got)
+	}
+
+	// Lists get JSON, trimmed exactly
+	w = NewRedisLogWriter(l.Addr().String(), "loglist").SetCommand(RedisRPush).SetMaxLen(10)
+	w.LogWrite(newLogRecord(INFO, "main.main:14", "pushed"))
+	w.Close()
+	for _, want := range [][]string{
+		{"RPUSH", "loglist", `{"level":"INFO","timestamp":"` + created + `","source":"main.main:14","message":"pushed"}`},
+		{"LTRIM", "loglist", "-10", "-1"},
+	} {
+		select {
+		case got := <-cmds:
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("RedisLogWriter: got %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("RedisLogWriter: %q not received", want)
+		}
+	}
+}
+
+func TestMQTTLogWriter(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer l.Close()
+
+	// The broker hangs up on the first publish instead of acknowledging it
+	type publish struct {
+		flags          byte
+		topic, payload string
+	}
+	packets := make(chan interface{}, 10)
+	go func() {
+		hungup := false
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			r := bufio.NewReader(conn)
+			for {
+				typ, err := r.ReadByte()
+				if err != nil {
+					break
+				}
+				n, _ := readMQTTLength(r)
+				body := make([]byte, n)
+				io.ReadFull(r, body)
+				switch typ >> 4 {
+				case 1:
+					packets <- fmt.Sprintf("% x", body)
+					conn.Write([]byte{mqttConnack, 2, 0, 0})
+					continue
+				case 3:
+					tlen := int(body[0])<<8 | int(body[1])
+					packets <- publish{typ & 0x0f, string(body[2 : 2+tlen]), string(body[4+tlen:])}
+					if !hungup {
+						hungup = true
+						break
+					}
+					conn.Write([]byte{mqttPuback, 2, body[2+tlen], body[3+tlen]})
+					continue
+				case 14:
+				}
+				break
+			}
+			conn.Close()
+		}
+	}()
+
+	w := NewMQTTLogWriter(l.Addr().String(), "devices/7/log").SetQoS(1).SetClientID("dev7").SetAuth("user", "pw").SetFormat("[%L] %M")
+	w.LogWrite(newLogRecord(WARNING, "source", "overheating"))
+	w.LogWrite(newLogRecord(INFO, "source", "cooled"))
+	w.Close()
+
+	// CONNECT: "MQTT", level 4, clean session with user name and password,
+	// no keep alive, then the client id, user name and password
+	wantConnect := "00 04 4d 51 54 54 04 c2 00 00 00 04 64 65 76 37 00 04 75 73 65 72 00 02 70 77"
+	for _, want := range []interface{}{
+		wantConnect,
+		publish{0x02, "devices/7/log", "[WARN] overheating"},
+		// The writer reconnects and publishes the record again, as a duplicate
+		wantConnect,
+		publish{0x0a, "devices/7/log", "[WARN] overheating"},
+		publish{0x02, "devices/7/log", "[INFO] cooled"},
+	} {
+		var got interface{}
+		select {
+		case got = <-packets:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("MQTTLogWriter: %v not received", want)
+		}
+		if got != want {
+			t.Errorf("MQTTLogWriter: got %v, want %v", got, want)
+		}
+	}
+	if got := w.Dropped(); got != 0 {
+		t.Errorf("MQTTLogWriter: dropped %d, want 0", got)
+	}
+}
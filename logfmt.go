@@ -0,0 +1,65 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// LogfmtFormatter is a Formatter which writes each record as logfmt key=value
+// pairs, as read by Grafana Loki and Heroku-style tooling:
+//
+//	time=2006-01-02T15:04:05Z level=info source=main.main:12 msg="the message"
+//
+// The category and topic of records that have them follow as category= and
+// topic=.  Values with spaces, quotes, equals signs or control characters are
+// quoted, with Go escapes.
+type LogfmtFormatter struct{}
+
+func (LogfmtFormatter) Format(rec *LogRecord) string {
+	var b strings.Builder
+	pair := func(key, value string) {
+		if b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(value))
+	}
+
+	if !rec.Created.IsZero() {
+		pair("time", rec.Created.Format(time.RFC3339Nano))
+	}
+	level := rec.Level.String()
+	if rec.Level.Valid() {
+		level = levelNames[rec.Level]
+	}
+	pair("level", strings.ToLower(level))
+	if len(rec.Source) > 0 {
+		pair("source", rec.Source)
+	}
+	pair("msg", rec.Message)
+	if len(rec.Category) > 0 {
+		pair("category", rec.Category)
+	}
+	if len(rec.Topic) > 0 {
+		pair("topic", rec.Topic)
+	}
+	return b.String()
+}
+
+// logfmtValue quotes v if it would not read back as a single value.
+func logfmtValue(v string) string {
+	if len(v) == 0 {
+		return `""`
+	}
+	for _, r := range v {
+		if r <= ' ' || r == '=' || r == '"' || r == utf8.RuneError || r == 0x7f {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
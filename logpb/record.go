@@ -0,0 +1,243 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+// Package logpb holds the protobuf form of log4go records described in
+// record.proto, as sent by a SocketLogWriter using EncodingProto and by a
+// GRPCLogWriter.  The message is small enough that it is encoded by hand here,
+// keeping log4go free of a protobuf runtime; any protobuf implementation can
+// decode what it writes.
+package logpb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A Record is a log record.
+type Record struct {
+	Level int32
+
+	// Nanoseconds since the Unix epoch
+	Ts int64
+
+	Source  string
+	Message string
+	Fields  map[string]string
+}
+
+// Field numbers and wire types of record.proto
+const (
+	fieldLevel   = 1
+	fieldTs      = 2
+	fieldSource  = 3
+	fieldMessage = 4
+	fieldFields  = 5
+
+	wireVarint = 0
+	wireBytes  = 2
+)
+
+// Marshal returns the protobuf encoding of r.  Fields are written in order of
+// their keys, so the same record always encodes the same way.
+func (r *Record) Marshal() []byte {
+	var b []byte
+	if r.Level != 0 {
+		b = appendTag(b, fieldLevel, wireVarint)
+		b = appendVarint(b, uint64(r.Level))
+	}
+	if r.Ts != 0 {
+		b = appendTag(b, fieldTs, wireVarint)
+		b = appendVarint(b, uint64(r.Ts))
+	}
+	b = appendString(b, fieldSource, r.Source)
+	b = appendString(b, fieldMessage, r.Message)
+
+	keys := make([]string, 0, len(r.Fields))
+	for k := range r.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		var entry []byte
+		entry = appendString(entry, 1, k)
+		entry = appendString(entry, 2, r.Fields[k])
+		b = appendTag(b, fieldFields, wireBytes)
+		b = appendVarint(b, uint64(len(entry)))
+		b = append(b, entry...)
+	}
+	return b
+}
+
+// Unmarshal decodes the protobuf encoding of a record into r, skipping fields
+// it does not know.
+func (r *Record) Unmarshal(b []byte) error {
+	*r = Record{}
+	for len(b) > 0 {
+		num, typ, val, rest, err := nextField(b)
+		if err != nil {
+			return err
+		}
+		b = rest
+
+		switch {
+		case num == fieldLevel && typ == wireVarint:
+			r.Level = int32(val.(uint64))
+		case num == fieldTs && typ == wireVarint:
+			r.Ts = int64(val.(uint64))
+		case num == fieldSource && typ == wireBytes:
+			r.Source = string(val.([]byte))
+		case num == fieldMessage && typ == wireBytes:
+			r.Message = string(val.([]byte))
+		case num == fieldFields && typ == wireBytes:
+			k, v, err := unmarshalEntry(val.([]byte))
+			if err != nil {
+				return err
+			}
+			if r.Fields == nil {
+				r.Fields = make(map[string]string)
+			}
+			r.Fields[k] = v
+		}
+	}
+	return nil
+}
+
+// unmarshalEntry decodes an entry of the fields map.
+func unmarshalEntry(b []byte) (k, v string, err error) {
+	for len(b) > 0 {
+		num, typ, val, rest, err := nextField(b)
+		if err != nil {
+			return "", "", err
+		}
+		b = rest
+		if typ != wireBytes {
+			continue
+		}
+		switch num {
+		case 1:
+			k = string(val.([]byte))
+		case 2:
+			v = string(val.([]byte))
+		}
+	}
+	return k, v, nil
+}
+
+// WriteDelimited writes the encoding of r to w, preceded by its length as a
+// varint.
+func WriteDelimited(w io.Writer, r *Record) error {
+	msg := r.Marshal()
+	_, err := w.Write(append(appendVarint(nil, uint64(len(msg))), msg...))
+	return err
+}
+
+// ReadDelimited reads a record written by WriteDelimited.  It returns io.EOF if
+// there are no more records.
+func ReadDelimited(rd *bufio.Reader) (*Record, error) {
+	n, err := binary.ReadUvarint(rd)
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(rd, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	r := new(Record)
+	return r, r.Unmarshal(msg)
+}
+
+// WriteGRPCFrame writes the encoding of r to w as a gRPC message: an
+// uncompressed flag byte, the length as four big-endian bytes, and the
+// message.
+func WriteGRPCFrame(w io.Writer, r *Record) error {
+	msg := r.Marshal()
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// ReadGRPCFrame reads a record written by WriteGRPCFrame, as a LogService
+// receives it.  It returns io.EOF if there are no more records.
+func ReadGRPCFrame(rd io.Reader) (*Record, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(rd, hdr[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errTruncated
+		}
+		return nil, err
+	}
+	if hdr[0] != 0 {
+		return nil, fmt.Errorf("logpb: compressed gRPC messages are not supported")
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(hdr[1:]))
+	if _, err := io.ReadFull(rd, msg); err != nil {
+		return nil, errTruncated
+	}
+	r := new(Record)
+	return r, r.Unmarshal(msg)
+}
+
+var errTruncated = errors.New("logpb: truncated record")
+
+// nextField decodes the field at the start of b, returning its value as a
+// uint64 for varints and a []byte for length-delimited fields, and what is left
+// of b.
+func nextField(b []byte) (num int, typ int, val interface{}, rest []byte, err error) {
+	tag, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, 0, nil, nil, errTruncated
+	}
+	b = b[n:]
+	num, typ = int(tag>>3), int(tag&7)
+
+	switch typ {
+	case wireVarint:
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			return 0, 0, nil, nil, errTruncated
+		}
+		return num, typ, v, b[n:], nil
+	case wireBytes:
+		l, n := binary.Uvarint(b)
+		if n <= 0 || uint64(len(b)-n) < l {
+			return 0, 0, nil, nil, errTruncated
+		}
+		return num, typ, b[n : n+int(l)], b[n+int(l):], nil
+	case 1: // 64-bit
+		if len(b) < 8 {
+			return 0, 0, nil, nil, errTruncated
+		}
+		return num, typ, nil, b[8:], nil
+	case 5: // 32-bit
+		if len(b) < 4 {
+			return 0, 0, nil, nil, errTruncated
+		}
+		return num, typ, nil, b[4:], nil
+	}
+	return 0, 0, nil, nil, fmt.Errorf("logpb: unsupported wire type %d", typ)
+}
+
+func appendTag(b []byte, num, typ int) []byte {
+	return appendVarint(b, uint64(num)<<3|uint64(typ))
+}
+
+func appendVarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendString(b []byte, num int, s string) []byte {
+	if len(s) == 0 {
+		return b
+	}
+	b = appendTag(b, num, wireBytes)
+	b = appendVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
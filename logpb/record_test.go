@@ -0,0 +1,86 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package logpb
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestRecordRoundTrip(t *testing.T) {
+	recs := []*Record{
+		{Level: 7, Ts: 1234567890123456789, Source: "main.main:12", Message: "hello", Fields: map[string]string{"topic": "orders", "seq": "3"}},
+		{Level: -1, Message: "negative level"},
+		{},
+	}
+
+	var buf bytes.Buffer
+	for _, r := range recs {
+		if err := WriteDelimited(&buf, r); err != nil {
+			t.Fatalf("WriteDelimited: %s", err)
+		}
+	}
+
+	rd := bufio.NewReader(&buf)
+	for i, want := range recs {
+		got, err := ReadDelimited(rd)
+		if err != nil {
+			t.Fatalf("ReadDelimited(%d): %s", i, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ReadDelimited(%d) = %+v, want %+v", i, got, want)
+		}
+	}
+	if _, err := ReadDelimited(rd); err != io.EOF {
+		t.Errorf("ReadDelimited at the end: %v, want io.EOF", err)
+	}
+}
+
+func TestRecordWireFormat(t *testing.T) {
+	// The protobuf encoding of Record{level: 2, source: "s", fields: {"k": "v"}}
+	want := []byte{0x08, 0x02, 0x1a, 0x01, 's', 0x2a, 0x06, 0x0a, 0x01, 'k', 0x12, 0x01, 'v'}
+	r := &Record{Level: 2, Source: "s", Fields: map[string]string{"k": "v"}}
+	if got := r.Marshal(); !bytes.Equal(got, want) {
+		t.Errorf("Marshal = % x, want % x", got, want)
+	}
+
+	// Unknown fields are skipped
+	var got Record
+	if err := got.Unmarshal(append([]byte{0x30, 0x05, 0x3a, 0x01, 'x'}, want...)); err != nil {
+		t.Fatalf("Unmarshal: %s", err)
+	}
+	if !reflect.DeepEqual(&got, r) {
+		t.Errorf("Unmarshal = %+v, want %+v", got, r)
+	}
+}
+
+func TestGRPCFrame(t *testing.T) {
+	r := &Record{Level: 2, Source: "s", Fields: map[string]string{"k": "v"}}
+	var buf bytes.Buffer
+	if err := WriteGRPCFrame(&buf, r); err != nil {
+		t.Fatalf("WriteGRPCFrame: %s", err)
+	}
+	if got, want := buf.Bytes()[:5], []byte{0, 0, 0, 0, 13}; !bytes.Equal(got, want) {
+		t.Errorf("WriteGRPCFrame: prefix % x, want % x", got, want)
+	}
+	WriteGRPCFrame(&buf, &Record{})
+
+	for i, want := range []*Record{r, {}} {
+		got, err := ReadGRPCFrame(&buf)
+		if err != nil {
+			t.Fatalf("ReadGRPCFrame(%d): %s", i, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ReadGRPCFrame(%d) = %+v, want %+v", i, got, want)
+		}
+	}
+	if _, err := ReadGRPCFrame(&buf); err != io.EOF {
+		t.Errorf("ReadGRPCFrame at the end: %v, want io.EOF", err)
+	}
+	if _, err := ReadGRPCFrame(bytes.NewReader([]byte{0, 0, 0, 0, 9, 1})); err != errTruncated {
+		t.Errorf("ReadGRPCFrame of a truncated frame: %v", err)
+	}
+}
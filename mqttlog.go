@@ -0,0 +1,359 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types, shifted into the first byte
+const (
+	mqttConnect    = 1 << 4
+	mqttConnack    = 2 << 4
+	mqttPublish    = 3 << 4
+	mqttPuback     = 4 << 4
+	mqttPubrec     = 5 << 4
+	mqttPubrel     = 6<<4 | 2
+	mqttPubcomp    = 7 << 4
+	mqttDisconnect = 14 << 4
+)
+
+// This log writer publishes records to an MQTT broker
+type MQTTLogWriter struct {
+	rec chan *LogRecord
+
+	// Where to publish, and the connection if there is one
+	addr, topic string
+	sock        net.Conn
+	reader      *bufio.Reader
+
+	// How to identify to the broker
+	clientid           string
+	username, password string
+
+	// How to publish: the quality of service, and the identifier of the last
+	// packet that needed one
+	qos      byte
+	packetid uint16
+
+	// The logging format of the payload, if not JSON
+	format string
+
+	// How to connect, and when to try again after a failed attempt
+	dialtimeout   time.Duration
+	retryinterval time.Duration
+	retryAt       time.Time
+
+	// Records that could not be published
+	dropped uint64
+}
+
+// NewMQTTLogWriter creates a new LogWriter which publishes each record, as a
+// JSON object with level, timestamp, source and message keys, to topic on the
+// MQTT broker at addr, as "host:1883", speaking MQTT 3.1.1 with a clean
+// session and at QoS 0 unless SetQoS says otherwise.  If the broker cannot be
+// reached, records are dropped, and connecting is tried again a second later.
+// If the connection is lost while publishing at QoS 1 or 2, the writer
+// reconnects at once and publishes the record again.
+func NewMQTTLogWriter(addr, topic string) *MQTTLogWriter {
+	hostname, _ := os.Hostname()
+	w := &MQTTLogWriter{
+		rec:           make(chan *LogRecord, LogBufferLength),
+		addr:          addr,
+		topic:         topic,
+		clientid:      fmt.Sprintf("log4go-%s-%d", hostname, os.Getpid()),
+		dialtimeout:   SocketDialTimeout,
+		retryinterval: socketRetryInterval,
+	}
+
+	go func() {
+		defer func() {
+			if w.sock != nil {
+				w.sock.Write([]byte{mqttDisconnect, 0})
+				w.sock.Close()
+			}
+		}()
+
+		for rec := range w.rec {
+			w.send(rec)
+		}
+	}()
+
+	return w
+}
+
+// connect connects to the broker, putting off the next attempt if it fails.
+// It must only be called from the writer's goroutine.
+func (w *MQTTLogWriter) connect() error {
+	err := w.dial()
+	if err != nil {
+		if w.sock != nil {
+			w.disconnect()
+		}
+		w.retryAt = time.Now().Add(w.retryinterval)
+	}
+	return err
+}
+
+// dial opens a connection and sends CONNECT, waiting for the broker to accept
+// it.
+func (w *MQTTLogWriter) dial() error {
+	sock, err := net.DialTimeout("tcp", w.addr, w.dialtimeout)
+	if err != nil {
+		return err
+	}
+	w.sock, w.reader = sock, bufio.NewReader(sock)
+
+	// Protocol name and level, flags, and no keep alive, so that an idle
+	// writer is not disconnected
+	flags := byte(0x02)
+	if len(w.username) > 0 {
+		flags |= 0x80
+	}
+	if len(w.password) > 0 {
+		flags |= 0x40
+	}
+	body := appendMQTTString(nil, "MQTT")
+	body = append(body, 4, flags, 0, 0)
+	body = appendMQTTString(body, w.clientid)
+	if len(w.username) > 0 {
+		body = appendMQTTString(body, w.username)
+	}
+	if len(w.password) > 0 {
+		body = appendMQTTString(body, w.password)
+	}
+	if err := w.write(mqttConnect, body); err != nil {
+		return err
+	}
+
+	typ, ack, err := w.read()
+	if err != nil {
+		return err
+	}
+	if typ != mqttConnack || len(ack) != 2 {
+		return fmt.Errorf("unexpected packet %#x for CONNECT", typ)
+	}
+	if ack[1] != 0 {
+		return fmt.Errorf("connection refused (code %d)", ack[1])
+	}
+	return nil
+}
+
+// disconnect closes the connection, to reconnect for the next record.
+func (w *MQTTLogWriter) disconnect() {
+	w.sock.Close()
+	w.sock, w.reader = nil, nil
+}
+
+// send publishes rec, connecting first if needed.  It must only be called
+// from the writer's goroutine.
+func (w *MQTTLogWriter) send(rec *LogRecord) {
+	defer reportPanic("MQTTLogWriter", w.addr)
+
+	var payload string
+	if len(w.format) > 0 {
+		payload = strings.TrimSuffix(FormatLogRecord(w.format, rec), "\n")
+	} else {
+		payload = JSONFormatter{}.Format(rec)
+	}
+
+	if w.qos > 0 {
+		w.packetid++
+		if w.packetid == 0 {
+			w.packetid = 1
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		if w.sock == nil {
+			if time.Now().Before(w.retryAt) {
+				atomic.AddUint64(&w.dropped, 1)
+				return
+			}
+			if err := w.connect(); err != nil {
+				fmt.Fprintf(os.Stderr, "MQTTLogWriter(%q): %s\n", w.addr, err)
+				atomic.AddUint64(&w.dropped, 1)
+				return
+			}
+		}
+
+		err := w.publish(payload, attempt > 0)
+		if err == nil {
+			return
+		}
+		fmt.Fprintf(os.Stderr, "MQTTLogWriter(%q): %s\n", w.addr, err)
+		w.disconnect()
+		if w.qos == 0 || attempt > 0 {
+			atomic.AddUint64(&w.dropped, 1)
+			return
+		}
+	}
+}
+
+// publish sends PUBLISH, waiting for the acknowledgements its QoS calls for.
+func (w *MQTTLogWriter) publish(payload string, dup bool) error {
+	flags := w.qos << 1
+	if dup {
+		flags |= 0x08
+	}
+	body := appendMQTTString(nil, w.topic)
+	if w.qos > 0 {
+		body = append(body, byte(w.packetid>>8), byte(w.packetid))
+	}
+	body = append(body, payload...)
+	if err := w.write(mqttPublish|flags, body); err != nil {
+		return err
+	}
+
+	switch w.qos {
+	case 1:
+		return w.expect(mqttPuback)
+	case 2:
+		if err := w.expect(mqttPubrec); err != nil {
+			return err
+		}
+		if err := w.write(mqttPubrel, []byte{byte(w.packetid >> 8), byte(w.packetid)}); err != nil {
+			return err
+		}
+		return w.expect(mqttPubcomp)
+	}
+	return nil
+}
+
+// expect reads the acknowledgement typ of the packet being published.
+func (w *MQTTLogWriter) expect(typ byte) error {
+	got, body, err := w.read()
+	if err != nil {
+		return err
+	}
+	if got != typ || len(body) != 2 || binary.BigEndian.Uint16(body) != w.packetid {
+		return fmt.Errorf("unexpected packet %#x waiting for %#x", got, typ)
+	}
+	return nil
+}
+
+// write sends a packet.
+func (w *MQTTLogWriter) write(typ byte, body []byte) error {
+	packet := append([]byte{typ}, appendMQTTLength(nil, len(body))...)
+	packet = append(packet, body...)
+
+	// Give up on a broker that stops answering as on one that cannot be reached
+	if w.dialtimeout > 0 {
+		w.sock.SetDeadline(time.Now().Add(w.dialtimeout))
+	}
+	_, err := w.sock.Write(packet)
+	return err
+}
+
+// read reads a packet, returning its first byte and its body.
+func (w *MQTTLogWriter) read() (byte, []byte, error) {
+	typ, err := w.reader.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := readMQTTLength(w.reader)
+	if err != nil {
+		return 0, nil, err
+	}
+	body := make([]byte, n)
+	_, err = io.ReadFull(w.reader, body)
+	return typ, body, err
+}
+
+// appendMQTTString appends s preceded by its length as two bytes.
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// appendMQTTLength appends the remaining length of a packet, seven bits at a
+// time.
+func appendMQTTLength(b []byte, n int) []byte {
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			return b
+		}
+	}
+}
+
+// readMQTTLength reads the remaining length of a packet.
+func readMQTTLength(r io.ByteReader) (int, error) {
+	n, shift := 0, uint(0)
+	for i := 0; i < 4; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		n |= int(digit&0x7f) << shift
+		if digit&0x80 == 0 {
+			return n, nil
+		}
+		shift += 7
+	}
+	return 0, errors.New("malformed remaining length")
+}
+
+// This is the MQTTLogWriter's output method
+func (w *MQTTLogWriter) LogWrite(rec *LogRecord) {
+	w.rec <- rec
+}
+
+// Close disconnects from the broker once the records already sent to the
+// writer are published.
+func (w *MQTTLogWriter) Close() {
+	close(w.rec)
+}
+
+// Dropped returns the number of records that could not be published.
+func (w *MQTTLogWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// SetQoS sets the quality of service records are published at (chainable): 0,
+// the default, sends each record once, 1 waits for the broker to acknowledge
+// it, and 2 completes the exactly-once handshake.  Levels above 2 are taken as
+// 2.  Must be called before the first log message is written.
+func (w *MQTTLogWriter) SetQoS(qos byte) *MQTTLogWriter {
+	if qos > 2 {
+		qos = 2
+	}
+	w.qos = qos
+	return w
+}
+
+// SetClientID sets the client identifier sent to the broker (chainable),
+// which defaults to "log4go-<hostname>-<pid>".  Must be called before the
+// first log message is written.
+func (w *MQTTLogWriter) SetClientID(clientid string) *MQTTLogWriter {
+	w.clientid = clientid
+	return w
+}
+
+// SetAuth sets the user name and password sent to the broker (chainable).
+// Must be called before the first log message is written.
+func (w *MQTTLogWriter) SetAuth(username, password string) *MQTTLogWriter {
+	w.username = username
+	w.password = password
+	return w
+}
+
+// Set the logging format of the payload (chainable), in place of JSON.  Must
+// be called before the first log message is written.
+func (w *MQTTLogWriter) SetFormat(format string) *MQTTLogWriter {
+	w.format = format
+	return w
+}
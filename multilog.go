@@ -0,0 +1,75 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+)
+
+// This log writer hands each record to several others, so that one filter,
+// with one level, can log to the console, a file and a socket at once.  Each
+// child is handled on its own: one that panics or fails does not keep the
+// record from the rest.
+type MultiLogWriter struct {
+	writers []LogWriter
+}
+
+// NewMultiLogWriter creates a new LogWriter which hands each record to every
+// one of writers, in order.
+func NewMultiLogWriter(writers ...LogWriter) *MultiLogWriter {
+	return &MultiLogWriter{writers: writers}
+}
+
+// This is the MultiLogWriter's output method
+func (w *MultiLogWriter) LogWrite(rec *LogRecord) {
+	for i, child := range w.writers {
+		w.write(i, child, rec)
+	}
+}
+
+// write hands rec to the child at index i, reporting a panic on standard
+// error rather than letting it reach the other children.
+func (w *MultiLogWriter) write(i int, child LogWriter, rec *LogRecord) {
+	defer reportPanic("MultiLogWriter", fmt.Sprintf("%d: %T", i, child))
+	child.LogWrite(rec)
+}
+
+// Close closes every child.
+func (w *MultiLogWriter) Close() {
+	w.CloseErr()
+}
+
+// CloseErr closes every child, returning the first error reported by the
+// children that implement CloserErr.
+func (w *MultiLogWriter) CloseErr() error {
+	var first error
+	for _, child := range w.writers {
+		if err := closeWriter(child); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Flush waits for the children that can to write out the records handed to
+// them.
+func (w *MultiLogWriter) Flush() {
+	for _, child := range w.writers {
+		if f, ok := child.(Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// Err returns the error of the first child that implements HealthChecker and
+// is not working, naming which child it is, or nil if they all are.
+func (w *MultiLogWriter) Err() error {
+	for i, child := range w.writers {
+		if hc, ok := child.(HealthChecker); ok {
+			if err := hc.Err(); err != nil {
+				return fmt.Errorf("writer %d (%T): %s", i, child, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+// This log writer discards every record, for turning off an output without
+// removing its filter, or for measuring the cost of dispatching records.
+type NullLogWriter struct{}
+
+// NewNullLogWriter creates a new LogWriter which discards every record.
+func NewNullLogWriter() NullLogWriter {
+	return NullLogWriter{}
+}
+
+// This is the NullLogWriter's output method.  It does nothing.
+func (w NullLogWriter) LogWrite(rec *LogRecord) {}
+
+// Close does nothing.
+func (w NullLogWriter) Close() {}
@@ -6,6 +6,10 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -16,11 +20,46 @@ const (
 
 type formatCacheType struct {
 	LastUpdateSeconds    int64
+	zone                 string
+	offset               int
 	shortTime, shortDate string
 	longTime, longDate   string
 }
 
-var formatCache = &formatCacheType{}
+// The time components formatted for the last record, shared by all writers.
+// They are only reused for records created in the same second and zone.
+var (
+	formatCache         atomic.Value // *formatCacheType
+	formatCacheDisabled int32
+)
+
+// SetFormatCache turns the sharing of formatted times between records on or
+// off.  It is on by default, which saves formatting the time of every record
+// when many are logged each second; turn it off to always format each record's
+// time afresh.
+func SetFormatCache(enabled bool) {
+	var disabled int32
+	if !enabled {
+		disabled = 1
+	}
+	atomic.StoreInt32(&formatCacheDisabled, disabled)
+}
+
+// newFormatCache formats the time components of t.
+func newFormatCache(t time.Time) *formatCacheType {
+	month, day, year := t.Month(), t.Day(), t.Year()
+	hour, minute, second := t.Hour(), t.Minute(), t.Second()
+	zone, offset := t.Zone()
+	return &formatCacheType{
+		LastUpdateSeconds: t.UnixNano() / 1e9,
+		zone:              zone,
+		offset:            offset,
+		shortTime:         fmt.Sprintf("%02d:%02d", hour, minute),
+		shortDate:         fmt.Sprintf("%02d/%02d/%02d", month, day, year%100),
+		longTime:          fmt.Sprintf("%02d:%02d:%02d %s", hour, minute, second, zone),
+		longDate:          fmt.Sprintf("%04d/%02d/%02d", year, month, day),
+	}
+}
 
 // Known format codes:
 // %T - Time (15:04:05 MST)
@@ -28,11 +67,24 @@ var formatCache = &formatCacheType{}
 // %D - Date (2006/01/02)
 // %d - Date (01/02/06)
 // %L - Level (FNST, FINE, DEBG, TRAC, WARN, EROR, CRIT)
+// %N - Level name (FINEST, FINE, DEBUG, TRACE, INFO, WARNING, ERROR, CRITICAL)
 // %S - Source
+// %C - Category (see Logger.LogCategory)
 // %M - Message
+// %q - Sequence number (see Logger.SetSequence)
 // Ignores unknown formats
 // Recommended: "[%D %T] [%L] (%S) %M"
 func FormatLogRecord(format string, rec *LogRecord) string {
+	return formatLogRecord(format, rec, true)
+}
+
+// FormatLogRecordNoNewline formats rec like FormatLogRecord, but without the
+// trailing newline.
+func FormatLogRecordNoNewline(format string, rec *LogRecord) string {
+	return formatLogRecord(format, rec, false)
+}
+
+func formatLogRecord(format string, rec *LogRecord, newline bool) string {
 	if rec == nil {
 		return "<nil>"
 	}
@@ -42,21 +94,17 @@ func FormatLogRecord(format string, rec *LogRecord) string {
 
 	out := bytes.NewBuffer(make([]byte, 0, 64))
 	secs := rec.Created.UnixNano() / 1e9
-
-	cache := *formatCache
-	if cache.LastUpdateSeconds != secs {
-		month, day, year := rec.Created.Month(), rec.Created.Day(), rec.Created.Year()
-		hour, minute, second := rec.Created.Hour(), rec.Created.Minute(), rec.Created.Second()
-		zone, _ := rec.Created.Zone()
-		updated := &formatCacheType{
-			LastUpdateSeconds: secs,
-			shortTime:         fmt.Sprintf("%02d:%02d", hour, minute),
-			shortDate:         fmt.Sprintf("%02d/%02d/%02d", month, day, year%100),
-			longTime:          fmt.Sprintf("%02d:%02d:%02d %s", hour, minute, second, zone),
-			longDate:          fmt.Sprintf("%04d/%02d/%02d", year, month, day),
+	zone, offset := rec.Created.Zone()
+
+	var cache *formatCacheType
+	if atomic.LoadInt32(&formatCacheDisabled) == 0 {
+		cache, _ = formatCache.Load().(*formatCacheType)
+		if cache == nil || cache.LastUpdateSeconds != secs || cache.zone != zone || cache.offset != offset {
+			cache = newFormatCache(rec.Created)
+			formatCache.Store(cache)
 		}
-		cache = *updated
-		formatCache = updated
+	} else {
+		cache = newFormatCache(rec.Created)
 	}
 
 	// Split the string into pieces by % signs
@@ -75,11 +123,17 @@ func FormatLogRecord(format string, rec *LogRecord) string {
 			case 'd':
 				out.WriteString(cache.shortDate)
 			case 'L':
-				out.WriteString(levelStrings[rec.Level])
+				out.WriteString(rec.Level.shortName())
+			case 'N':
+				out.WriteString(rec.Level.longName())
 			case 'S':
 				out.WriteString(rec.Source)
+			case 'C':
+				out.WriteString(rec.Category)
 			case 'M':
 				out.WriteString(rec.Message)
+			case 'q':
+				out.WriteString(strconv.FormatUint(rec.Seq, 10))
 			}
 			if len(piece) > 1 {
 				out.Write(piece[1:])
@@ -88,7 +142,9 @@ func FormatLogRecord(format string, rec *LogRecord) string {
 			out.Write(piece)
 		}
 	}
-	out.WriteByte('\n')
+	if newline {
+		out.WriteByte('\n')
+	}
 
 	return out.String()
 }
@@ -105,10 +161,15 @@ func NewFormatLogWriter(out io.Writer, format string) FormatLogWriter {
 
 func (w FormatLogWriter) run(out io.Writer, format string) {
 	for rec := range w {
-		fmt.Fprint(out, FormatLogRecord(format, rec))
+		w.write(out, format, rec)
 	}
 }
 
+func (w FormatLogWriter) write(out io.Writer, format string, rec *LogRecord) {
+	defer reportPanic("FormatLogWriter", "")
+	fmt.Fprint(out, FormatLogRecord(format, rec))
+}
+
 // This is the FormatLogWriter's output method.  This will block if the output
 // buffer is full.
 func (w FormatLogWriter) LogWrite(rec *LogRecord) {
@@ -120,3 +181,38 @@ func (w FormatLogWriter) LogWrite(rec *LogRecord) {
 func (w FormatLogWriter) Close() {
 	close(w)
 }
+
+// This writer formats each record and writes it straight to an io.Writer it
+// does not own, as set up by NewWriterLog and Logger.AddWriter.
+type ioLogWriter struct {
+	mu     sync.Mutex
+	out    io.Writer
+	format string
+}
+
+// NewWriterLog creates a new LogWriter which writes each record to out in the
+// given format, with no buffering, before LogWrite returns.  Any io.Writer will
+// do, such as a bytes.Buffer, a pipe or a sink of the caller's own; writes are
+// serialized, so it need not be safe for concurrent use.  Closing the writer
+// leaves out open.
+func NewWriterLog(out io.Writer, format string) LogWriter {
+	return &ioLogWriter{out: out, format: format}
+}
+
+// This is the ioLogWriter's output method.  The record is written before it
+// returns.
+func (w *ioLogWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	io.WriteString(w.out, FormatLogRecord(w.format, rec))
+}
+
+// Reformat changes the logging format, starting with the next record.
+func (w *ioLogWriter) Reformat(format string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.format = format
+}
+
+// Close does nothing: the io.Writer belongs to the caller.
+func (w *ioLogWriter) Close() {}
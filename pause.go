@@ -0,0 +1,87 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"sync/atomic"
+)
+
+// LogPauseBufferLength is the number of records a paused logger holds; records
+// beyond it are dropped and counted in TotalDropped.
+var LogPauseBufferLength = 1024
+
+// A record held by a paused logger, with the filter it is for
+type pendingRecord struct {
+	filt *Filter
+	rec  *LogRecord
+}
+
+// Pause holds back the records of the logger, up to LogPauseBufferLength of
+// them, until Resume is called.  Use it to keep log output out of the way
+// while the program has the terminal to itself, for example.
+func (log Logger) Pause() {
+	opts := log.options()
+	opts.pauseMu.Lock()
+	defer opts.pauseMu.Unlock()
+	opts.pauses++
+	atomic.StoreInt32(&opts.paused, 1)
+}
+
+// Resume writes out the records held since Pause, in the order they were
+// logged, and goes back to writing records as they come.
+func (log Logger) Resume() {
+	opts := log.lookupOptions()
+	if opts == nil {
+		return
+	}
+
+	opts.resumeMu.Lock()
+	defer opts.resumeMu.Unlock()
+	opts.pauseMu.Lock()
+	pauses := opts.pauses
+	opts.pauseMu.Unlock()
+
+	// The held records are written without the lock, so that logging goes
+	// on meanwhile; records logged meanwhile are still held, so that they
+	// follow, until none are left
+	for {
+		opts.pauseMu.Lock()
+		if opts.pauses != pauses {
+			// Paused again: the rest waits for the next Resume
+			opts.pauseMu.Unlock()
+			return
+		}
+		held := opts.pending
+		opts.pending = nil
+		if len(held) == 0 {
+			atomic.StoreInt32(&opts.paused, 0)
+			opts.pauseMu.Unlock()
+			return
+		}
+		opts.pauseMu.Unlock()
+
+		for _, p := range held {
+			opts.deliver(p.filt, p.rec)
+		}
+	}
+}
+
+// hold keeps rec for Resume if the logger is paused, and reports whether it
+// did (or dropped it for lack of room).
+func (opts *loggerOptions) hold(l *Filter, rec *LogRecord) bool {
+	if atomic.LoadInt32(&opts.paused) == 0 {
+		return false
+	}
+
+	opts.pauseMu.Lock()
+	defer opts.pauseMu.Unlock()
+	if atomic.LoadInt32(&opts.paused) == 0 {
+		return false
+	}
+	if len(opts.pending) >= LogPauseBufferLength {
+		opts.pauseDropped++
+	} else {
+		opts.pending = append(opts.pending, pendingRecord{l, rec})
+	}
+	return true
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"strings"
+	"sync"
+)
+
+// This log writer wraps another, adding a fixed prefix and suffix to every
+// line of each formatted record, for example the marker a log collector keys
+// on.  Records reach the inner writer with the whole wrapped text as their
+// message, so it should write just the message: a FileLogWriter with the
+// format "%M", for instance.
+type PrefixLogWriter struct {
+	inner LogWriter
+
+	// The logging format, guarded by mu as it may change while running
+	mu     sync.Mutex
+	format string
+
+	// What to add around every line
+	prefix, suffix string
+}
+
+// NewPrefixLogWriter creates a new LogWriter which formats each record and
+// hands it to inner with prefix before and suffix after each of its lines.
+// The line ending stays with the inner writer, after the suffix.
+func NewPrefixLogWriter(inner LogWriter, prefix, suffix string) *PrefixLogWriter {
+	return &PrefixLogWriter{
+		inner:  inner,
+		format: FORMAT_DEFAULT,
+		prefix: prefix,
+		suffix: suffix,
+	}
+}
+
+// This is the PrefixLogWriter's output method
+func (w *PrefixLogWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	format := w.format
+	w.mu.Unlock()
+
+	text := strings.TrimSuffix(FormatLogRecord(format, rec), "\n")
+	if len(w.prefix) > 0 || len(w.suffix) > 0 {
+		text = w.prefix + strings.Replace(text, "\n", w.suffix+"\n"+w.prefix, -1) + w.suffix
+	}
+
+	wrapped := *rec
+	wrapped.Message = text
+	w.inner.LogWrite(&wrapped)
+}
+
+// Close closes the inner writer.
+func (w *PrefixLogWriter) Close() {
+	w.inner.Close()
+}
+
+// Flush waits for the inner writer to write out the records handed to it, if
+// it can.
+func (w *PrefixLogWriter) Flush() {
+	if f, ok := w.inner.(Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Reformat changes the logging format, starting with the next record.
+func (w *PrefixLogWriter) Reformat(format string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.format = format
+}
+
+// Set the logging format (chainable).  Must be called before the first log
+// message is written.
+func (w *PrefixLogWriter) SetFormat(format string) *PrefixLogWriter {
+	w.format = format
+	return w
+}
@@ -0,0 +1,273 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// A RedisCommand is how a RedisLogWriter adds records to its key.
+type RedisCommand int
+
+const (
+	// XADD each record to a stream, with its fields as the entry's fields
+	RedisXAdd RedisCommand = iota
+
+	// RPUSH each record to a list, as a JSON object
+	RedisRPush
+)
+
+// This log writer adds records to a Redis stream or list
+type RedisLogWriter struct {
+	rec chan *LogRecord
+
+	// Where to add the records, and the connection if there is one
+	addr, key string
+	sock      net.Conn
+	reader    *bufio.Reader
+
+	// How to add them, and how many to keep (0 keeps all)
+	command RedisCommand
+	maxlen  int
+
+	// Sent after connecting, if set
+	password string
+	db       int
+
+	// How to connect, and when to try again after a failed attempt
+	dialtimeout   time.Duration
+	retryinterval time.Duration
+	retryAt       time.Time
+
+	// Records that could not be added
+	dropped uint64
+}
+
+// NewRedisLogWriter creates a new LogWriter which adds records to the Redis
+// stream key at addr with XADD, each entry holding the level, time, source and
+// message of a record, and its category and topic if it has them.  If Redis
+// cannot be reached, or rejects a record, the record is dropped and the
+// connection is reestablished for the next record, after a second if
+// connecting failed.
+func NewRedisLogWriter(addr, key string) *RedisLogWriter {
+	w := &RedisLogWriter{
+		rec:           make(chan *LogRecord, LogBufferLength),
+		addr:          addr,
+		key:           key,
+		dialtimeout:   SocketDialTimeout,
+		retryinterval: socketRetryInterval,
+	}
+
+	go func() {
+		defer func() {
+			if w.sock != nil {
+				w.sock.Close()
+			}
+		}()
+
+		for rec := range w.rec {
+			w.send(rec)
+		}
+	}()
+
+	return w
+}
+
+// connect connects to Redis, authenticating and selecting the database if
+// needed, and puts off the next attempt if it fails.  It must only be called
+// from the writer's goroutine.
+func (w *RedisLogWriter) connect() error {
+	sock, err := net.DialTimeout("tcp", w.addr, w.dialtimeout)
+	if err != nil {
+		w.retryAt = time.Now().Add(w.retryinterval)
+		return err
+	}
+	w.sock, w.reader = sock, bufio.NewReader(sock)
+
+	if len(w.password) > 0 {
+		err = w.do("AUTH", w.password)
+	}
+	if err == nil && w.db != 0 {
+		err = w.do("SELECT", strconv.Itoa(w.db))
+	}
+	if err != nil {
+		w.disconnect()
+		w.retryAt = time.Now().Add(w.retryinterval)
+	}
+	return err
+}
+
+// disconnect closes the connection, to reconnect for the next record.
+func (w *RedisLogWriter) disconnect() {
+	w.sock.Close()
+	w.sock, w.reader = nil, nil
+}
+
+// send adds rec to the key, connecting first if needed.  It must only be
+// called from the writer's goroutine.
+func (w *RedisLogWriter) send(rec *LogRecord) {
+	defer reportPanic("RedisLogWriter", w.addr)
+
+	if w.sock == nil {
+		if time.Now().Before(w.retryAt) {
+			atomic.AddUint64(&w.dropped, 1)
+			return
+		}
+		if err := w.connect(); err != nil {
+			fmt.Fprintf(os.Stderr, "RedisLogWriter(%q): %s\n", w.addr, err)
+			atomic.AddUint64(&w.dropped, 1)
+			return
+		}
+	}
+
+	var err error
+	switch w.command {
+	case RedisRPush:
+		err = w.do("RPUSH", w.key, JSONFormatter{}.Format(rec))
+		if err == nil && w.maxlen > 0 {
+			err = w.do("LTRIM", w.key, strconv.Itoa(-w.maxlen), "-1")
+		}
+	default:
+		args := []string{"XADD", w.key}
+		if w.maxlen > 0 {
+			args = append(args, "MAXLEN", "~", strconv.Itoa(w.maxlen))
+		}
+		args = append(args, "*",
+			"level", rec.Level.String(),
+			"time", rec.Created.Format(time.RFC3339Nano),
+			"source", rec.Source,
+			"message", rec.Message)
+		if len(rec.Category) > 0 {
+			args = append(args, "category", rec.Category)
+		}
+		if len(rec.Topic) > 0 {
+			args = append(args, "topic", rec.Topic)
+		}
+		err = w.do(args...)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "RedisLogWriter(%q): %s\n", w.addr, err)
+		atomic.AddUint64(&w.dropped, 1)
+		if _, ok := err.(redisError); !ok {
+			w.disconnect()
+		}
+	}
+}
+
+// A redisError is an error reply, after which the connection is still good.
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// do sends a command and reads its reply, returning an error reply as a
+// redisError.
+func (w *RedisLogWriter) do(args ...string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	// Give up on a Redis that stops answering as on one that cannot be reached
+	if w.dialtimeout > 0 {
+		w.sock.SetDeadline(time.Now().Add(w.dialtimeout))
+	}
+	if _, err := w.sock.Write(buf); err != nil {
+		return err
+	}
+	return readRedisReply(w.reader)
+}
+
+// readRedisReply reads a reply, skipping over its contents.
+func readRedisReply(r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return errors.New("malformed reply")
+	}
+	line = line[:len(line)-2]
+
+	switch line[0] {
+	case '+', ':':
+		return nil
+	case '-':
+		return redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return errors.New("malformed reply")
+		}
+		if n >= 0 {
+			_, err = io.CopyN(ioutil.Discard, r, int64(n)+2)
+		}
+		return err
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return errors.New("malformed reply")
+		}
+		for i := 0; i < n; i++ {
+			if err := readRedisReply(r); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unexpected reply %q", line)
+}
+
+// This is the RedisLogWriter's output method
+func (w *RedisLogWriter) LogWrite(rec *LogRecord) {
+	w.rec <- rec
+}
+
+// Close stops the writer once the records already sent to it are added.
+func (w *RedisLogWriter) Close() {
+	close(w.rec)
+}
+
+// Dropped returns the number of records that could not be added.
+func (w *RedisLogWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// SetCommand sets how records are added (chainable): XADD to a stream, the
+// default, or RPUSH to a list, as JSON objects.  Must be called before the
+// first log message is written.
+func (w *RedisLogWriter) SetCommand(command RedisCommand) *RedisLogWriter {
+	w.command = command
+	return w
+}
+
+// SetMaxLen trims the key to about maxlen records (chainable): streams are
+// trimmed with MAXLEN ~, which lets Redis keep a few more where that is
+// cheaper, and lists exactly, with LTRIM.  A length of 0, the default, keeps
+// every record.  Must be called before the first log message is written.
+func (w *RedisLogWriter) SetMaxLen(maxlen int) *RedisLogWriter {
+	w.maxlen = maxlen
+	return w
+}
+
+// SetAuth sets the password sent with AUTH and the database selected after
+// each connect (chainable).  Must be called before the first log message is
+// written.
+func (w *RedisLogWriter) SetAuth(password string, db int) *RedisLogWriter {
+	w.password = password
+	w.db = db
+	return w
+}
@@ -0,0 +1,16 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build !windows
+// +build !windows
+
+package log4go
+
+import (
+	"os"
+)
+
+// renameLog moves the closed log file from to to.  Other processes that have
+// it open, such as a tail -f, keep reading the moved file.
+func renameLog(from, to string) error {
+	return os.Rename(from, to)
+}
@@ -0,0 +1,39 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build windows
+// +build windows
+
+package log4go
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// How many times, and how far apart, renameLog tries to rename a log file that
+// another process has open
+const (
+	renameRetries    = 5
+	renameRetryDelay = 100 * time.Millisecond
+)
+
+// renameLog moves the closed log file from to to.  Windows will not rename a
+// file another process has open, as a virus scanner or an indexer does for a
+// moment and a tail -f for longer, so the rename is retried a few times, and
+// then the file is copied and truncated instead.  That can fail too, as when
+// the other process opened the file without sharing writes, and then both
+// errors are returned.
+func renameLog(from, to string) error {
+	var err error
+	for i := 0; i < renameRetries; i++ {
+		if err = os.Rename(from, to); err == nil {
+			return nil
+		}
+		time.Sleep(renameRetryDelay)
+	}
+	if cerr := copyTruncate(from, to); cerr != nil {
+		return fmt.Errorf("%w; copy and truncate: %s", err, cerr)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"os"
+	"os/signal"
+	"sync"
+)
+
+// The FileLogWriters still running, for ReopenAll
+var fileWriters = struct {
+	sync.Mutex
+	m map[*FileLogWriter]struct{}
+}{m: make(map[*FileLogWriter]struct{})}
+
+func registerFileWriter(w *FileLogWriter) {
+	fileWriters.Lock()
+	defer fileWriters.Unlock()
+	fileWriters.m[w] = struct{}{}
+}
+
+func unregisterFileWriter(w *FileLogWriter) {
+	fileWriters.Lock()
+	defer fileWriters.Unlock()
+	delete(fileWriters.m, w)
+}
+
+// ReopenAll has every FileLogWriter that is not closed close its file and
+// reopen it by name, as Reopen does, so that logs moved away by an external
+// tool such as logrotate are followed by new ones.  It returns the first error
+// reported.
+func ReopenAll() error {
+	fileWriters.Lock()
+	writers := make([]*FileLogWriter, 0, len(fileWriters.m))
+	for w := range fileWriters.m {
+		writers = append(writers, w)
+	}
+	fileWriters.Unlock()
+
+	var first error
+	for _, w := range writers {
+		if err := w.Reopen(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ReopenOnSignal calls ReopenAll each time the process receives one of sigs,
+// or SIGHUP if none are given, as logrotate sends after moving the logs with
+// its postrotate script.  Calling the returned function stops it.  Where there
+// is no SIGHUP, ReopenOnSignal without signals does nothing.
+func ReopenOnSignal(sigs ...os.Signal) (stop func()) {
+	if len(sigs) == 0 {
+		sigs = hangupSignals
+	}
+	if len(sigs) == 0 {
+		return func() {}
+	}
+
+	c := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(c, sigs...)
+	go func() {
+		for {
+			select {
+			case <-c:
+				ReopenAll()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(c)
+			close(done)
+		})
+	}
+}
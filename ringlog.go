@@ -0,0 +1,99 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"io"
+	"sync"
+)
+
+// This log writer keeps the most recent records in memory, so that detail not
+// worth persisting, such as FINE and DEBUG records, can be written out after
+// something goes wrong.
+type RingLogWriter struct {
+	mu sync.Mutex
+
+	// The records, oldest at next once the ring is full
+	recs []*LogRecord
+	next int
+	full bool
+
+	// The logging format of Dump
+	format string
+}
+
+// NewRingLogWriter creates a new LogWriter which keeps the last size records
+// handed to it, dropping the oldest to make room.  A size below 1 is taken as 1.
+func NewRingLogWriter(size int) *RingLogWriter {
+	if size < 1 {
+		size = 1
+	}
+	return &RingLogWriter{
+		recs:   make([]*LogRecord, size),
+		format: FORMAT_DEFAULT,
+	}
+}
+
+// This is the RingLogWriter's output method
+func (w *RingLogWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.recs[w.next] = rec
+	w.next++
+	if w.next == len(w.recs) {
+		w.next = 0
+		w.full = true
+	}
+}
+
+// Records returns the records kept, oldest first.
+func (w *RingLogWriter) Records() []*LogRecord {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.full {
+		return append([]*LogRecord(nil), w.recs[:w.next]...)
+	}
+	recs := append([]*LogRecord(nil), w.recs[w.next:]...)
+	return append(recs, w.recs[:w.next]...)
+}
+
+// Dump writes the records kept to out in the writer's logging format, oldest
+// first, leaving them in the ring.
+func (w *RingLogWriter) Dump(out io.Writer) error {
+	w.mu.Lock()
+	format := w.format
+	w.mu.Unlock()
+
+	for _, rec := range w.Records() {
+		if _, err := io.WriteString(out, FormatLogRecord(format, rec)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset forgets the records kept.
+func (w *RingLogWriter) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i := range w.recs {
+		w.recs[i] = nil
+	}
+	w.next, w.full = 0, false
+}
+
+// Close does nothing: the records stay available to Records and Dump.
+func (w *RingLogWriter) Close() {}
+
+// Reformat changes the logging format of Dump.
+func (w *RingLogWriter) Reformat(format string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.format = format
+}
+
+// Set the logging format of Dump (chainable).  The default is FORMAT_DEFAULT.
+func (w *RingLogWriter) SetFormat(format string) *RingLogWriter {
+	w.Reformat(format)
+	return w
+}
@@ -0,0 +1,118 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"strings"
+)
+
+// A Route sends the records from level Min to Max, inclusive, to each of the
+// filters named in Filters, whatever the levels of those filters.
+type Route struct {
+	Min, Max Level
+	Filters  []string
+}
+
+// A route in use, with the filter standing in for its filters during dispatch
+type levelRoute struct {
+	min, max Level
+	filter   *Filter
+}
+
+// SetRoutes replaces the routing table of the logger (chainable).  A record at
+// a level covered by a route goes to the filters of that route, in place of
+// the filter its name picks, and regardless of their levels; the first route
+// covering the level wins.  Records at other levels are dispatched as usual.
+// Filters are looked up by name as records are written, so a route may name
+// filters that are added later.  Calling SetRoutes with no routes removes the
+// table.
+func (log Logger) SetRoutes(routes ...Route) Logger {
+	var table []levelRoute
+	for _, r := range routes {
+		table = append(table, levelRoute{
+			min: r.Min,
+			max: r.Max,
+			filter: &Filter{
+				Level:     r.Min,
+				LogWriter: routeWriter{log: log, tags: append([]string(nil), r.Filters...)},
+			},
+		})
+	}
+	log.options().routes.Store(table)
+	return log
+}
+
+// route returns the filter standing in for the route covering lvl, or nil if
+// no route does.
+func (opts *loggerOptions) route(lvl Level) *Filter {
+	table, _ := opts.routes.Load().([]levelRoute)
+	for _, r := range table {
+		if lvl >= r.min && lvl <= r.max {
+			return r.filter
+		}
+	}
+	return nil
+}
+
+// A routeWriter hands each record to the filters of a route.  The filters
+// belong to the logger, which closes them.
+type routeWriter struct {
+	log  Logger
+	tags []string
+}
+
+func (w routeWriter) LogWrite(rec *LogRecord) {
+	for _, tag := range w.tags {
+		if filt, ok := w.log[tag]; ok {
+			filt.LogWrite(rec)
+		}
+	}
+}
+
+func (w routeWriter) Close() {}
+
+// Flush waits for the filters of the route that can to write out the records
+// handed to them.
+func (w routeWriter) Flush() {
+	for _, tag := range w.tags {
+		if filt, ok := w.log[tag]; ok {
+			if f, ok := filt.LogWriter.(Flusher); ok {
+				f.Flush()
+			}
+		}
+	}
+}
+
+// Sync waits for the filters of the route to write out the records handed to
+// them, syncing those that can to stable storage, and returns the first error
+// a filter reports.
+func (w routeWriter) Sync() error {
+	var first error
+	for _, tag := range w.tags {
+		if filt, ok := w.log[tag]; ok {
+			switch fw := filt.LogWriter.(type) {
+			case Syncer:
+				if err := fw.Sync(); err != nil && first == nil {
+					first = err
+				}
+			case Flusher:
+				fw.Flush()
+			}
+		}
+	}
+	return first
+}
+
+// parseRouteLevels parses a level range such as "WARNING-ERROR", or a single
+// level such as "CRITICAL".
+func parseRouteLevels(levels string) (min, max Level, err error) {
+	lo, hi := levels, levels
+	if dash := strings.Index(levels, "-"); dash >= 0 {
+		lo, hi = levels[:dash], levels[dash+1:]
+	}
+	if min, err = LevelFromString(lo); err != nil {
+		return
+	}
+	max, err = LevelFromString(hi)
+	return
+}
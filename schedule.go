@@ -0,0 +1,177 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Schedule says when something recurring, such as a scheduled rotation,
+// happens next.
+type Schedule interface {
+	// Next returns the first time after t on the schedule, or the zero time
+	// if there is none.
+	Next(t time.Time) time.Time
+}
+
+// Shorthands for common cron expressions
+var scheduleShorthands = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+}
+
+// ParseSchedule parses a schedule, either "every " followed by a duration, as
+// "every 6h", or a cron expression of five fields: minute, hour, day of month,
+// month and day of week (0 or 7 for Sunday).  Each field is "*", a number, a
+// range such as "1-5", or a list of them such as "0,30", any of which may be
+// followed by a step such as "/15".  As in cron, when both the day of month
+// and the day of week are restricted, a day matching either is on the
+// schedule.  The shorthands @hourly, @daily, @midnight, @weekly, @monthly,
+// @yearly and @annually are accepted as well.
+//
+// "every" schedules fall on multiples of the duration since the zero time, as
+// for time.Truncate, so "every 6h" falls at 00:00, 06:00, 12:00 and 18:00 UTC.
+// Cron schedules follow the local time of the time given to Next.
+func ParseSchedule(expr string) (Schedule, error) {
+	expr = strings.TrimSpace(expr)
+	if short, ok := scheduleShorthands[expr]; ok {
+		expr = short
+	}
+
+	if strings.HasPrefix(expr, "every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(expr[len("every "):]))
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("schedule %q: interval must be positive", expr)
+		}
+		return everySchedule(d), nil
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("schedule %q: want 5 fields, found %d", expr, len(fields))
+	}
+	var c cronSchedule
+	var err error
+	for i, f := range []struct {
+		bits     *uint64
+		min, max int
+	}{
+		{&c.minute, 0, 59},
+		{&c.hour, 0, 23},
+		{&c.dom, 1, 31},
+		{&c.month, 1, 12},
+		{&c.dow, 0, 7},
+	} {
+		if *f.bits, err = parseCronField(fields[i], f.min, f.max); err != nil {
+			return nil, fmt.Errorf("schedule %q: %s", expr, err)
+		}
+	}
+	// Sunday may be given as 7
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domStar = fields[2] == "*"
+	c.dowStar = fields[4] == "*"
+	return &c, nil
+}
+
+// parseCronField returns the values a cron field allows between min and max,
+// as a set of bits.
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("bad step in %q", part)
+			}
+			rng, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			if i := strings.Index(rng, "-"); i >= 0 {
+				lo, err = strconv.Atoi(rng[:i])
+				if err == nil {
+					hi, err = strconv.Atoi(rng[i+1:])
+				}
+			} else {
+				lo, err = strconv.Atoi(rng)
+				hi = lo
+				// A single value with a step, as "5/15", runs to the end
+				if step > 1 {
+					hi = max
+				}
+			}
+			if err != nil {
+				return 0, fmt.Errorf("bad value in %q", part)
+			}
+			if lo < min || hi > max || lo > hi {
+				return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// An everySchedule falls on every multiple of its duration.
+type everySchedule time.Duration
+
+func (d everySchedule) Next(t time.Time) time.Time {
+	return t.Truncate(time.Duration(d)).Add(time.Duration(d))
+}
+
+// A cronSchedule falls on the minutes whose fields are all in its sets.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// Whether the day fields were "*", which decides how they combine
+	domStar, dowStar bool
+}
+
+func (c *cronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// Give up on schedules that never come, such as February 30
+	for limit := t.AddDate(5, 0, 0); t.Before(limit); {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+// dayMatches reports whether the day of t is on the schedule.
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domStar || c.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+)
+
+// This log writer spreads records across several files by a hash of a key of
+// each record, so that busy producers do not all queue up behind a single
+// writer, while the records sharing a key stay in order in one file.  Each
+// file holds one JSON record per line; use MergeShards to put them back
+// together.
+type ShardedFileLogWriter struct {
+	shards []*FileLogWriter
+
+	// Picks the shard of each record
+	key func(rec *LogRecord) string
+}
+
+// NewShardedFileLogWriter creates a new LogWriter which writes to the files
+// fname.0 through fname.N-1, where N is the number of shards.  Records are
+// spread by their source unless SetShardKey gives another key.
+func NewShardedFileLogWriter(fname string, shards int) *ShardedFileLogWriter {
+	if shards < 1 {
+		shards = 1
+	}
+	w := &ShardedFileLogWriter{key: func(rec *LogRecord) string { return rec.Source }}
+	for i := 0; i < shards; i++ {
+		w.shards = append(w.shards, NewFileLogWriter(fmt.Sprintf("%s.%d", fname, i), false, false).SetFormat("%M"))
+	}
+	return w
+}
+
+// This is the ShardedFileLogWriter's output method
+func (w *ShardedFileLogWriter) LogWrite(rec *LogRecord) {
+	js, err := json.Marshal(rec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ShardedFileLogWriter(%q): %s\n", w.shards[0].filename, err)
+		return
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(w.key(rec)))
+	shard := w.shards[h.Sum32()%uint32(len(w.shards))]
+	shard.LogWrite(&LogRecord{Level: rec.Level, Created: rec.Created, Source: rec.Source, Message: string(js)})
+}
+
+// SetShardKey sets the function giving the key whose hash picks the shard of
+// each record (chainable), such as the category, or a request or goroutine id
+// carried in the message.  Must be called before the first log message is
+// written.
+func (w *ShardedFileLogWriter) SetShardKey(key func(rec *LogRecord) string) *ShardedFileLogWriter {
+	w.key = key
+	return w
+}
+
+// Flush blocks until every record handed to the writer so far has been
+// written to its file.
+func (w *ShardedFileLogWriter) Flush() {
+	for _, shard := range w.shards {
+		shard.Flush()
+	}
+}
+
+// Close closes every shard.
+func (w *ShardedFileLogWriter) Close() {
+	w.CloseErr()
+}
+
+// CloseErr closes every shard, waiting for their remaining records to be
+// written, and returns the first error that kept records from a shard.
+func (w *ShardedFileLogWriter) CloseErr() error {
+	var first error
+	for _, shard := range w.shards {
+		if err := closeWriter(shard); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// MergeShards reads back the records written by a ShardedFileLogWriter to
+// baseName.0, baseName.1 and so on, and returns them in the order they were
+// created, records created at the same time in the order of their sequence
+// numbers, if the logger numbers them.
+func MergeShards(baseName string) ([]*LogRecord, error) {
+	var recs []*LogRecord
+	for i := 0; ; i++ {
+		name := fmt.Sprintf("%s.%d", baseName, i)
+		fd, err := os.Open(name)
+		if os.IsNotExist(err) && i > 0 {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		in := bufio.NewScanner(fd)
+		in.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+		for lineno := 1; in.Scan(); lineno++ {
+			rec := new(LogRecord)
+			if err := json.Unmarshal(in.Bytes(), rec); err != nil {
+				fd.Close()
+				return nil, fmt.Errorf("MergeShards: %s:%d: %s", name, lineno, err)
+			}
+			recs = append(recs, rec)
+		}
+		err = in.Err()
+		fd.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sort.SliceStable(recs, func(i, j int) bool {
+		if !recs[i].Created.Equal(recs[j].Created) {
+			return recs[i].Created.Before(recs[j].Created)
+		}
+		return recs[i].Seq < recs[j].Seq
+	})
+	return recs, nil
+}
@@ -0,0 +1,14 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package log4go
+
+import (
+	"os"
+)
+
+// The signals ReopenOnSignal listens for by default: none, as there is no
+// SIGHUP on this platform
+var hangupSignals []os.Signal
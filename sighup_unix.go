@@ -0,0 +1,14 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package log4go
+
+import (
+	"os"
+	"syscall"
+)
+
+// The signals ReopenOnSignal listens for by default
+var hangupSignals = []os.Signal{syscall.SIGHUP}
@@ -0,0 +1,20 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package log4go
+
+import (
+	"errors"
+	"io"
+)
+
+// notifySIGPIPE does nothing on this platform, where writing to a broken pipe
+// does not raise a signal.
+func notifySIGPIPE() {}
+
+// isBrokenPipe reports whether err comes from writing to a pipe nobody reads.
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, io.ErrClosedPipe)
+}
@@ -0,0 +1,31 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package log4go
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Told of each SIGPIPE, which nobody reads; asking for the signal is what
+// matters
+var sigpipes = make(chan os.Signal, 1)
+
+// notifySIGPIPE keeps a write to standard output or error after the reader of
+// the pipe has gone, such as head or a pager that was quit, from killing the
+// process, so that the write fails with EPIPE instead.  Unlike ignoring the
+// signal, this is not inherited by the processes the program starts.
+func notifySIGPIPE() {
+	signal.Notify(sigpipes, syscall.SIGPIPE)
+}
+
+// isBrokenPipe reports whether err comes from writing to a pipe nobody reads.
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrClosedPipe)
+}
@@ -3,55 +3,339 @@
 package log4go
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/blackbeans/log4go/logpb"
+)
+
+// SocketDialTimeout limits how long connecting to the collector may take, both
+// when a SocketLogWriter is created and when it reconnects.  Each writer keeps
+// the value in effect when it was created.
+var SocketDialTimeout = 3 * time.Second
+
+// dialTimeout connects to the collector; tests replace it to simulate one that
+// cannot be reached.
+var dialTimeout = net.DialTimeout
+
+// After a failed connection attempt, records are dropped (or queued) for this
+// long before connecting is tried again.  Each writer keeps the value in effect
+// when it was created; tests shorten it.
+var socketRetryInterval = time.Second
+
+// A SocketEncoding is how a SocketLogWriter puts records on the wire.
+type SocketEncoding int
+
+const (
+	// Each record as a JSON object
+	EncodingJSON SocketEncoding = iota
+
+	// Each record as a logpb.Record, preceded by its length as a varint
+	EncodingProto
 )
 
 // This log writer sends output to a socket
 type SocketLogWriter chan *LogRecord
 
+// socketOptions holds the settings and state of a SocketLogWriter, which as a
+// channel has no room for them.  They are kept in socketOptionsMap from the
+// writer's creation until it is closed.
+type socketOptions struct {
+	// Where to send the records, and the connection if there is one
+	proto, hostport string
+	sock            net.Conn
+
+	// How to connect, and when to try again after a failed attempt
+	dial          func(network, address string, timeout time.Duration) (net.Conn, error)
+	dialtimeout   time.Duration
+	retryinterval time.Duration
+	retryAt       time.Time
+
+	// Records that could not be sent yet, oldest first, up to queuesize
+	queue     [][]byte
+	queuesize int
+
+	// Give up on a write after this long (0 waits forever)
+	timeout time.Duration
+
+	// How records are put on the wire
+	encoding SocketEncoding
+
+	// Records that could not be sent, and whether the last send succeeded
+	dropped uint64
+	good    int32
+
+	// Why the last send failed
+	errMu sync.Mutex
+	err   error
+}
+
+// The options of each SocketLogWriter, keyed by the writer
+var socketOptionsMap sync.Map
+
+// options returns the options of the writer, or empty ones once it is closed.
+func (w SocketLogWriter) options() *socketOptions {
+	if o, ok := socketOptionsMap.Load(w); ok {
+		return o.(*socketOptions)
+	}
+	return &socketOptions{}
+}
+
 // This is the SocketLogWriter's output method
 func (w SocketLogWriter) LogWrite(rec *LogRecord) {
 	w <- rec
 }
 
+// Close stops the writer once the records handed to it are sent, releasing its
+// options.
 func (w SocketLogWriter) Close() {
+	socketOptionsMap.Delete(w)
 	close(w)
 }
 
+// NewSocketLogWriter creates a new LogWriter which sends each record as JSON to
+// hostport over proto: "tcp" or "udp", or "unix" or "unixgram" with the path
+// of a local collector's socket as hostport.  If the collector cannot be
+// reached within SocketDialTimeout, the writer is returned anyway, with Good
+// reporting false, and connects once the collector is back.  Records that
+// cannot be sent are dropped, unless SetRetryQueue keeps them, and the
+// connection is reestablished for the next record.  Over a Unix socket, a
+// collector that restarted and recreated its socket is reconnected to at
+// once, and the record that found it gone is sent to the new socket.
 func NewSocketLogWriter(proto, hostport string) SocketLogWriter {
-	sock, err := net.Dial(proto, hostport)
-	if err != nil {
+	o := &socketOptions{
+		proto:         proto,
+		hostport:      hostport,
+		dial:          dialTimeout,
+		dialtimeout:   SocketDialTimeout,
+		retryinterval: socketRetryInterval,
+	}
+	if err := o.connect(); err != nil {
 		fmt.Fprintf(os.Stderr, "NewSocketLogWriter(%q): %s\n", hostport, err)
-		return nil
 	}
 
-	w := SocketLogWriter(make(chan *LogRecord, LogBufferLength))
-
+	w := make(SocketLogWriter, LogBufferLength)
+	socketOptionsMap.Store(w, o)
 	go func() {
 		defer func() {
-			if sock != nil && proto == "tcp" {
-				sock.Close()
+			if o.sock != nil {
+				o.sock.Close()
 			}
 		}()
 
 		for rec := range w {
-			// Marshall into JSON
-			js, err := json.Marshal(rec)
-			if err != nil {
-				fmt.Fprint(os.Stderr, "SocketLogWriter(%q): %s", hostport, err)
-				return
-			}
+			o.send(rec)
+		}
+	}()
+
+	return w
+}
+
+// connect connects to the collector, putting off the next attempt if it fails.
+// After the writer is created, it must only be called from the writer's
+// goroutine.
+func (o *socketOptions) connect() error {
+	sock, err := o.dial(o.proto, o.hostport, o.dialtimeout)
+	if err != nil {
+		o.retryAt = time.Now().Add(o.retryinterval)
+		o.setErr(err)
+		return err
+	}
+	o.sock = sock
+	o.setErr(nil)
+	return nil
+}
+
+// send writes rec to the socket, reconnecting first if the last write failed,
+// after any records queued while the collector was unreachable.  It must only
+// be called from the writer's goroutine.
+func (o *socketOptions) send(rec *LogRecord) {
+	defer reportPanic("SocketLogWriter", o.hostport)
+
+	js, err := o.encode(rec)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "SocketLogWriter(%q): %s\n", o.hostport, err)
+		atomic.AddUint64(&o.dropped, 1)
+		return
+	}
+
+	if o.sock == nil {
+		if time.Now().Before(o.retryAt) || o.connect() != nil {
+			o.hold(js)
+			return
+		}
+	}
+
+	for len(o.queue) > 0 {
+		if err := o.write(o.queue[0]); err != nil {
+			o.hold(js)
+			return
+		}
+		o.queue[0] = nil
+		o.queue = o.queue[1:]
+	}
+	if err := o.write(js); err != nil {
+		o.hold(js)
+	}
+}
+
+// write writes a record to the socket, closing it to reconnect for the next
+// record if that fails.  Over a Unix socket, it reconnects at once, in case
+// the collector recreated its socket, and tries the record once more.
+func (o *socketOptions) write(js []byte) error {
+	err := o.writeOnce(js)
+	if err != nil && (o.proto == "unix" || o.proto == "unixgram") && o.connect() == nil {
+		err = o.writeOnce(js)
+	}
+	return err
+}
+
+// writeOnce writes a record to the socket, closing it if that fails.
+func (o *socketOptions) writeOnce(js []byte) error {
+	if o.timeout > 0 {
+		o.sock.SetWriteDeadline(time.Now().Add(o.timeout))
+	}
+	_, err := o.sock.Write(js)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "SocketLogWriter(%q): %s\n", o.hostport, err)
+		o.setErr(err)
+		o.sock.Close()
+		o.sock = nil
+	}
+	return err
+}
+
+// hold queues a record that could not be sent, to send it after the next
+// reconnect, dropping the oldest queued record if the queue is full.  Without
+// a queue, the record is dropped.
+func (o *socketOptions) hold(js []byte) {
+	if o.queuesize <= 0 {
+		atomic.AddUint64(&o.dropped, 1)
+		return
+	}
+	o.queue = append(o.queue, js)
+	if len(o.queue) > o.queuesize {
+		atomic.AddUint64(&o.dropped, 1)
+		o.queue[0] = nil
+		o.queue = o.queue[1:]
+	}
+}
 
-			_, err = sock.Write(js)
-			if err != nil {
-				fmt.Fprint(os.Stderr, "SocketLogWriter(%q): %s", hostport, err)
-				return
+// encode puts rec in the writer's encoding.
+func (o *socketOptions) encode(rec *LogRecord) ([]byte, error) {
+	if o.encoding != EncodingProto {
+		return json.Marshal(rec)
+	}
+
+	var buf bytes.Buffer
+	logpb.WriteDelimited(&buf, protoRecord(rec))
+	return buf.Bytes(), nil
+}
+
+// protoRecord converts rec to a logpb.Record, carrying the fields that have no
+// counterpart of their own in Fields, under the names used in JSON output.
+// The error chain and stack are joined with newlines.
+func protoRecord(rec *LogRecord) *logpb.Record {
+	pb := &logpb.Record{
+		Level:   int32(rec.Level),
+		Source:  rec.Source,
+		Message: rec.Message,
+	}
+	if !rec.Created.IsZero() {
+		pb.Ts = rec.Created.UnixNano()
+	}
+
+	fields := map[string]string{
+		"Topic":       rec.Topic,
+		"Category":    rec.Category,
+		"caller_func": rec.Func,
+		"caller_file": rec.File,
+		"error_chain": strings.Join(rec.ErrorChain, "\n"),
+		"stack":       strings.Join(rec.Stack, "\n"),
+	}
+	if rec.Seq != 0 {
+		fields["seq"] = strconv.FormatUint(rec.Seq, 10)
+	}
+	if rec.Line != 0 {
+		fields["caller_line"] = strconv.Itoa(rec.Line)
+	}
+	for k, v := range fields {
+		if len(v) > 0 {
+			if pb.Fields == nil {
+				pb.Fields = make(map[string]string)
 			}
+			pb.Fields[k] = v
 		}
-	}()
+	}
+	return pb
+}
 
+// Good reports whether the writer is connected to the collector and its last
+// record was sent.
+func (w SocketLogWriter) Good() bool {
+	return atomic.LoadInt32(&w.options().good) != 0
+}
+
+// Err returns why the writer could not connect or send its last record, or nil
+// if it is healthy.
+func (w SocketLogWriter) Err() error {
+	o := w.options()
+	o.errMu.Lock()
+	defer o.errMu.Unlock()
+	return o.err
+}
+
+// setErr records the outcome of connecting or sending.
+func (o *socketOptions) setErr(err error) {
+	o.errMu.Lock()
+	defer o.errMu.Unlock()
+	o.err = err
+	if err != nil {
+		atomic.StoreInt32(&o.good, 0)
+	} else {
+		atomic.StoreInt32(&o.good, 1)
+	}
+}
+
+// SetWriteTimeout limits how long sending a single record may block (chainable).
+// If the receiver stops reading and the send does not complete in time, the
+// record is dropped and the connection is reestablished for the next one.  A
+// timeout of 0, the default, waits forever.  Must be called before the first
+// log message is written.
+func (w SocketLogWriter) SetWriteTimeout(d time.Duration) SocketLogWriter {
+	w.options().timeout = d
+	return w
+}
+
+// SetEncoding sets how records are put on the wire (chainable): as JSON
+// objects, the default, or as length-prefixed protobuf messages described in
+// logpb/record.proto.  Must be called before the first log message is
+// written.
+func (w SocketLogWriter) SetEncoding(encoding SocketEncoding) SocketLogWriter {
+	w.options().encoding = encoding
 	return w
 }
+
+// SetRetryQueue keeps up to size records that could not be sent while the
+// collector was unreachable (chainable), and sends them, in order, ahead of the
+// next record once the writer has reconnected.  When the queue is full, the
+// oldest record in it is dropped.  A size of 0, the default, drops records
+// that cannot be sent right away.  Must be called before the first log
+// message is written.
+func (w SocketLogWriter) SetRetryQueue(size int) SocketLogWriter {
+	w.options().queuesize = size
+	return w
+}
+
+// Dropped returns the number of records that could not be sent.
+func (w SocketLogWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.options().dropped)
+}
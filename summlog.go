@@ -0,0 +1,130 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// This log writer rolls up records into a periodic summary: instead of writing
+// each record at or below a level, it counts them and writes a single record
+// such as "in the last 1m0s: 1200 INFO, 3 WARNING" every interval.
+type SummaryLogWriter struct {
+	mu    sync.Mutex
+	inner LogWriter
+
+	// Records at or below level are summarized every interval; records at or
+	// above passthrough are also written at once
+	level       Level
+	passthrough Level
+	interval    time.Duration
+
+	// What has been summarized since the last summary
+	counts    [len(levelStrings)]int
+	lasterror string
+	since     time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewSummaryLogWriter creates a new LogWriter which writes records above lvl
+// to inner as they come, and summarizes the others in a single record written
+// to inner every interval, if there were any.
+func NewSummaryLogWriter(inner LogWriter, lvl Level, interval time.Duration) *SummaryLogWriter {
+	w := &SummaryLogWriter{
+		inner:       inner,
+		level:       lvl,
+		passthrough: lvl + 1,
+		interval:    interval,
+		since:       timeNow(),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.summarize()
+			case <-w.stop:
+				return
+			}
+		}
+	}()
+
+	return w
+}
+
+// Set the level at or above which summarized records are also written at once
+// (chainable), such as WARNING to see warnings and errors as they happen while
+// still counting them.  Must be called before the first log message is
+// written.
+func (w *SummaryLogWriter) SetPassThrough(lvl Level) *SummaryLogWriter {
+	w.passthrough = lvl
+	return w
+}
+
+// This is the SummaryLogWriter's output method
+func (w *SummaryLogWriter) LogWrite(rec *LogRecord) {
+	if rec.Level > w.level || !rec.Level.Valid() {
+		w.inner.LogWrite(rec)
+		return
+	}
+
+	w.mu.Lock()
+	w.counts[rec.Level]++
+	if rec.Level >= ERROR {
+		w.lasterror = rec.Message
+	}
+	w.mu.Unlock()
+
+	if rec.Level >= w.passthrough {
+		w.inner.LogWrite(rec)
+	}
+}
+
+// summarize writes a summary of the records counted since the last one, if
+// there were any, and starts counting afresh.
+func (w *SummaryLogWriter) summarize() {
+	w.mu.Lock()
+	now := timeNow()
+	var parts []string
+	top := Level(-1)
+	for lvl, n := range w.counts {
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, levelNames[lvl]))
+			top = Level(lvl)
+		}
+	}
+	elapsed := now.Sub(w.since).Round(time.Millisecond)
+	if elapsed >= time.Second {
+		elapsed = elapsed.Round(time.Second)
+	}
+	msg := fmt.Sprintf("in the last %s: %s", elapsed, strings.Join(parts, ", "))
+	if len(w.lasterror) > 0 {
+		msg += " (last error: " + w.lasterror + ")"
+	}
+	w.counts = [len(levelStrings)]int{}
+	w.lasterror = ""
+	w.since = now
+	w.mu.Unlock()
+
+	if len(parts) > 0 {
+		w.inner.LogWrite(&LogRecord{Level: top, Created: now, Source: "summary", Message: msg})
+	}
+}
+
+// Close writes a final summary and closes the inner writer.
+func (w *SummaryLogWriter) Close() {
+	close(w.stop)
+	<-w.done
+	w.summarize()
+	w.inner.Close()
+}
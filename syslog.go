@@ -0,0 +1,201 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Where the local syslog daemon may be listening, tried in order; tests
+// replace them with a socket of their own.
+var syslogPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// A SyslogFacility is the kind of program a syslog message comes from.
+type SyslogFacility int
+
+const (
+	LOG_KERN SyslogFacility = iota << 3
+	LOG_USER
+	LOG_MAIL
+	LOG_DAEMON
+	LOG_AUTH
+	LOG_SYSLOG
+	LOG_LPR
+	LOG_NEWS
+	LOG_UUCP
+	LOG_CRON
+	LOG_AUTHPRIV
+	LOG_FTP
+	_ // unused
+	_ // unused
+	_ // unused
+	_ // unused
+	LOG_LOCAL0
+	LOG_LOCAL1
+	LOG_LOCAL2
+	LOG_LOCAL3
+	LOG_LOCAL4
+	LOG_LOCAL5
+	LOG_LOCAL6
+	LOG_LOCAL7
+)
+
+var syslogFacilityNames = map[string]SyslogFacility{
+	"kern":     LOG_KERN,
+	"user":     LOG_USER,
+	"mail":     LOG_MAIL,
+	"daemon":   LOG_DAEMON,
+	"auth":     LOG_AUTH,
+	"syslog":   LOG_SYSLOG,
+	"lpr":      LOG_LPR,
+	"news":     LOG_NEWS,
+	"uucp":     LOG_UUCP,
+	"cron":     LOG_CRON,
+	"authpriv": LOG_AUTHPRIV,
+	"ftp":      LOG_FTP,
+	"local0":   LOG_LOCAL0,
+	"local1":   LOG_LOCAL1,
+	"local2":   LOG_LOCAL2,
+	"local3":   LOG_LOCAL3,
+	"local4":   LOG_LOCAL4,
+	"local5":   LOG_LOCAL5,
+	"local6":   LOG_LOCAL6,
+	"local7":   LOG_LOCAL7,
+}
+
+// SyslogFacilityFromString returns the facility with the given name, such as
+// "daemon" or "local3", ignoring case.
+func SyslogFacilityFromString(name string) (SyslogFacility, error) {
+	if f, ok := syslogFacilityNames[strings.ToLower(name)]; ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf("unknown syslog facility %q", name)
+}
+
+// The syslog severity of each level; the finer levels are all debugging
+var syslogSeverities = [...]int{
+	FINEST:   7,
+	FINE:     7,
+	DEBUG:    7,
+	TRACE:    7,
+	INFO:     6,
+	WARNING:  4,
+	ERROR:    3,
+	CRITICAL: 2,
+}
+
+// syslogSeverity returns the syslog severity of lvl.
+func syslogSeverity(lvl Level) int {
+	if !lvl.Valid() {
+		return 5
+	}
+	return syslogSeverities[lvl]
+}
+
+// This log writer sends output to the local syslog daemon
+type SyslogLogWriter struct {
+	rec chan *LogRecord
+
+	// Where the messages come from
+	facility SyslogFacility
+	tag      string
+
+	// The logging format of the messages
+	format string
+
+	// The connection to the daemon, if there is one
+	sock net.Conn
+}
+
+// NewSyslogLogWriter creates a new LogWriter which sends records to the local
+// syslog daemon, through /dev/log or its equivalent, as coming from facility
+// under tag; an empty tag means the name of the program.  Levels are mapped to
+// the closest syslog severities, with FINEST through TRACE sent as debugging
+// messages.  If the daemon cannot be reached, records are dropped, and
+// connecting is tried again for the next record.
+func NewSyslogLogWriter(facility SyslogFacility, tag string) *SyslogLogWriter {
+	if len(tag) == 0 {
+		tag = filepath.Base(os.Args[0])
+	}
+	w := &SyslogLogWriter{
+		rec:      make(chan *LogRecord, LogBufferLength),
+		facility: facility,
+		tag:      tag,
+		format:   "%M",
+	}
+	if err := w.connect(); err != nil {
+		fmt.Fprintf(os.Stderr, "NewSyslogLogWriter(%q): %s\n", tag, err)
+	}
+
+	go func() {
+		defer func() {
+			if w.sock != nil {
+				w.sock.Close()
+			}
+		}()
+
+		for rec := range w.rec {
+			w.send(rec)
+		}
+	}()
+
+	return w
+}
+
+// connect connects to the first syslog socket that accepts the connection.
+func (w *SyslogLogWriter) connect() (err error) {
+	for _, path := range syslogPaths {
+		for _, network := range []string{"unixgram", "unix"} {
+			var sock net.Conn
+			if sock, err = net.Dial(network, path); err == nil {
+				w.sock = sock
+				return nil
+			}
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no syslog socket")
+	}
+	return err
+}
+
+// send writes rec to the daemon, reconnecting first if the last write failed.
+// It must only be called from the writer's goroutine.
+func (w *SyslogLogWriter) send(rec *LogRecord) {
+	defer reportPanic("SyslogLogWriter", w.tag)
+
+	if w.sock == nil && w.connect() != nil {
+		return
+	}
+
+	msg := strings.TrimSuffix(FormatLogRecord(w.format, rec), "\n")
+	pri := int(w.facility) | syslogSeverity(rec.Level)
+	line := fmt.Sprintf("<%d>%s %s[%d]: %s\n", pri, rec.Created.Format("Jan _2 15:04:05"), w.tag, os.Getpid(), msg)
+	if _, err := w.sock.Write([]byte(line)); err != nil {
+		fmt.Fprintf(os.Stderr, "SyslogLogWriter(%q): %s\n", w.tag, err)
+		w.sock.Close()
+		w.sock = nil
+	}
+}
+
+// This is the SyslogLogWriter's output method
+func (w *SyslogLogWriter) LogWrite(rec *LogRecord) {
+	w.rec <- rec
+}
+
+// Close stops the writer once the records already sent to it are written.
+func (w *SyslogLogWriter) Close() {
+	close(w.rec)
+}
+
+// Set the logging format of the messages, which syslog prefixes with the time,
+// tag and process id (chainable).  The default is "%M".  Must be called before
+// the first log message is written.
+func (w *SyslogLogWriter) SetFormat(format string) *SyslogLogWriter {
+	w.format = format
+	return w
+}
@@ -0,0 +1,210 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The SD-ID under which records' attributes are sent as structured data; the
+// enterprise number is the one reserved for documentation by RFC 5612
+const syslogSDID = "log4go@32473"
+
+// This log writer sends output to a remote syslog collector, such as rsyslog
+// or syslog-ng, as RFC 5424 messages with octet-counted framing
+type SyslogNetWriter struct {
+	rec chan *LogRecord
+
+	// Where to send the messages, and the connection if there is one
+	network, addr string
+	tlsconfig     *tls.Config
+	sock          net.Conn
+
+	// How long connecting may take, and when to try again after a failure
+	dialtimeout   time.Duration
+	retryinterval time.Duration
+	retryAt       time.Time
+
+	// The fields of the header
+	facility          SyslogFacility
+	hostname, appname string
+	procid            string
+
+	// The logging format of the messages
+	format string
+}
+
+// NewSyslogNetWriter creates a new LogWriter which sends records to the syslog
+// collector at addr as RFC 5424 messages, over "tcp" or, with network "tls",
+// over TLS.  The messages come from facility, with the host's name as
+// HOSTNAME and appname, or the name of the program if empty, as APP-NAME.
+// Each record's category, if any, is its MSGID, and its level, source and
+// topic are sent as structured data.  Levels are mapped to severities as for
+// the SyslogLogWriter.  While the collector cannot be reached, records are
+// dropped, and connecting is tried again a second after each failed attempt.
+func NewSyslogNetWriter(network, addr string, facility SyslogFacility, appname string) *SyslogNetWriter {
+	hostname, _ := os.Hostname()
+	if len(appname) == 0 {
+		appname = filepath.Base(os.Args[0])
+	}
+	w := &SyslogNetWriter{
+		rec:           make(chan *LogRecord, LogBufferLength),
+		network:       network,
+		addr:          addr,
+		dialtimeout:   SocketDialTimeout,
+		retryinterval: socketRetryInterval,
+		facility:      facility,
+		hostname:      hostname,
+		appname:       appname,
+		procid:        strconv.Itoa(os.Getpid()),
+		format:        "%M",
+	}
+
+	go func() {
+		defer func() {
+			if w.sock != nil {
+				w.sock.Close()
+			}
+		}()
+
+		for rec := range w.rec {
+			w.send(rec)
+		}
+	}()
+
+	return w
+}
+
+// connect connects to the collector, putting off the next attempt if it fails.
+// It must only be called from the writer's goroutine.
+func (w *SyslogNetWriter) connect() error {
+	dialer := &net.Dialer{Timeout: w.dialtimeout}
+	var sock net.Conn
+	var err error
+	switch w.network {
+	case "tls":
+		sock, err = tls.DialWithDialer(dialer, "tcp", w.addr, w.tlsconfig)
+	default:
+		sock, err = dialer.Dial(w.network, w.addr)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "SyslogNetWriter(%q): %s\n", w.addr, err)
+		w.retryAt = time.Now().Add(w.retryinterval)
+		return err
+	}
+	w.sock = sock
+	return nil
+}
+
+// send writes rec to the collector, reconnecting first if the last write
+// failed.  It must only be called from the writer's goroutine.
+func (w *SyslogNetWriter) send(rec *LogRecord) {
+	defer reportPanic("SyslogNetWriter", w.addr)
+
+	if w.sock == nil {
+		if time.Now().Before(w.retryAt) || w.connect() != nil {
+			return
+		}
+	}
+
+	msg := w.message(rec)
+	if _, err := fmt.Fprintf(w.sock, "%d %s", len(msg), msg); err != nil {
+		fmt.Fprintf(os.Stderr, "SyslogNetWriter(%q): %s\n", w.addr, err)
+		w.sock.Close()
+		w.sock = nil
+	}
+}
+
+// message formats rec as an RFC 5424 message.
+func (w *SyslogNetWriter) message(rec *LogRecord) string {
+	pri := int(w.facility) | syslogSeverity(rec.Level)
+
+	timestamp := "-"
+	if !rec.Created.IsZero() {
+		timestamp = rec.Created.Format("2006-01-02T15:04:05.000000Z07:00")
+	}
+
+	sd := "[" + syslogSDID + ` level="` + rec.Level.String() + `"`
+	for _, param := range [...]struct{ name, value string }{
+		{"source", rec.Source},
+		{"topic", rec.Topic},
+	} {
+		if len(param.value) > 0 {
+			sd += " " + param.name + `="` + syslogSDEscape(param.value) + `"`
+		}
+	}
+	sd += "]"
+
+	body := strings.TrimSuffix(FormatLogRecord(w.format, rec), "\n")
+	return fmt.Sprintf("<%d>1 %s %s %s %s %s %s %s", pri, timestamp,
+		syslogHeaderField(w.hostname, 255), syslogHeaderField(w.appname, 48),
+		syslogHeaderField(w.procid, 128), syslogHeaderField(rec.Category, 32), sd, body)
+}
+
+// syslogHeaderField makes s fit a header field of at most max printable
+// ASCII characters, replacing the others with underscores; an empty field is
+// written as "-".
+func syslogHeaderField(s string, max int) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	if len(s) > max {
+		s = s[:max]
+	}
+	return strings.Map(func(r rune) rune {
+		if r < 33 || r > 126 {
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// syslogSDEscape escapes the characters that may not appear as such in a
+// structured data parameter value.
+var syslogSDEscape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace
+
+// This is the SyslogNetWriter's output method
+func (w *SyslogNetWriter) LogWrite(rec *LogRecord) {
+	w.rec <- rec
+}
+
+// Close stops the writer once the records already sent to it are written.
+func (w *SyslogNetWriter) Close() {
+	close(w.rec)
+}
+
+// SetTLSConfig sets the TLS configuration used with network "tls" (chainable).
+// The default verifies the collector against the system's roots.  Must be
+// called before the first log message is written.
+func (w *SyslogNetWriter) SetTLSConfig(config *tls.Config) *SyslogNetWriter {
+	w.tlsconfig = config
+	return w
+}
+
+// SetHostname sets the HOSTNAME of the messages, which defaults to the host's
+// name (chainable).  Must be called before the first log message is written.
+func (w *SyslogNetWriter) SetHostname(hostname string) *SyslogNetWriter {
+	w.hostname = hostname
+	return w
+}
+
+// SetAppName sets the APP-NAME of the messages (chainable).  Must be called
+// before the first log message is written.
+func (w *SyslogNetWriter) SetAppName(appname string) *SyslogNetWriter {
+	w.appname = appname
+	return w
+}
+
+// Set the logging format of the MSG part of the messages (chainable).  The
+// default is "%M".  Must be called before the first log message is written.
+func (w *SyslogNetWriter) SetFormat(format string) *SyslogNetWriter {
+	w.format = format
+	return w
+}
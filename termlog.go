@@ -3,33 +3,431 @@
 package log4go
 
 import (
+	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
-	"fmt"
+	"os/signal"
+	"sync"
+	"unicode"
 )
 
-var stdout io.Writer = os.Stdout
+// Where console writers write; if nil, os.Stdout as it is when the writer is
+// created, so that output redirected by swapping os.Stdout, as example tests
+// do, is followed.
+var stdout io.Writer
+
+// Where console writers write records at or above their stderr level; if nil,
+// os.Stderr as it is when the writer is created.
+var stderr io.Writer
 
 // This is the standard writer that prints to standard output.
 type ConsoleLogWriter chan *LogRecord
 
-// This creates a new ConsoleLogWriter
+// consoleOptions holds the settings and state of a ConsoleLogWriter, which as
+// a channel has no room for them.  They are kept in consoleOptionsMap from the
+// writer's creation until it is closed.
+type consoleOptions struct {
+	done chan struct{}
+
+	// Where records at or above errlevel go instead, if set
+	errout   io.Writer
+	errlevel Level
+
+	// Truncate lines to this many columns on a terminal (0 disables)
+	maxwidth int
+
+	// The widths of the terminals written to, looked up again once resized
+	widths  map[*os.File]int
+	resized chan os.Signal
+
+	// Show the source of each record, which is hidden by default
+	showsource bool
+
+	// Leave out the newline after each record
+	nonewline bool
+
+	// Formats each record in place of the console's own layout, if set
+	formatter Formatter
+
+	// The logging format, in place of the console's own layout if set, and
+	// changes to it while running
+	format string
+	refmt  chan reformatRequest
+
+	// Why output stopped, if the reader of standard output went away
+	errMu sync.Mutex
+	err   error
+}
+
+// The options of each ConsoleLogWriter, keyed by the writer
+var consoleOptionsMap sync.Map
+
+// options returns the options of the writer, creating them if need be.
+func (w ConsoleLogWriter) options() *consoleOptions {
+	if o, ok := consoleOptionsMap.Load(w); ok {
+		return o.(*consoleOptions)
+	}
+	o, _ := consoleOptionsMap.LoadOrStore(w, &consoleOptions{})
+	return o.(*consoleOptions)
+}
+
+// lookupOptions returns the options of the writer, or nil once it is closed.
+func (w ConsoleLogWriter) lookupOptions() *consoleOptions {
+	if o, ok := consoleOptionsMap.Load(w); ok {
+		return o.(*consoleOptions)
+	}
+	return nil
+}
+
+// Only the first console writer changes how SIGPIPE is handled
+var notifySIGPIPEOnce sync.Once
+
+// This creates a new ConsoleLogWriter.  If standard output is a pipe whose
+// reader goes away, as when the program's output is piped into head, the
+// writer reports it on standard error and discards its output from then on,
+// instead of letting the process be killed by SIGPIPE; from then on, other
+// writes to a broken standard output fail with EPIPE as well.
 func NewConsoleLogWriter() ConsoleLogWriter {
-	records := make(ConsoleLogWriter, LogBufferLength)
-	go records.run(stdout)
-	return records
+	return NewConsoleLogWriterTo(consoleStdout())
+}
+
+// consoleStdout returns where console writers write by default.
+func consoleStdout() io.Writer {
+	if stdout != nil {
+		return stdout
+	}
+	return os.Stdout
 }
 
-func (w ConsoleLogWriter) run(out io.Writer) {
+// NewConsoleLogWriterTo creates a new ConsoleLogWriter which writes to out in
+// place of standard output: os.Stderr, or any io.Writer, which is left open
+// when the writer is closed.  A broken standard output or error is handled as
+// for NewConsoleLogWriter.
+func NewConsoleLogWriterTo(out io.Writer) ConsoleLogWriter {
+	if out == io.Writer(os.Stdout) || out == io.Writer(os.Stderr) {
+		notifySIGPIPEOnce.Do(notifySIGPIPE)
+	}
+	return newConsoleLogWriter(out)
+}
+
+// newConsoleLogWriter creates a ConsoleLogWriter writing to out, leaving how
+// the process handles SIGPIPE alone, as the logger Global starts with must.
+func newConsoleLogWriter(out io.Writer) ConsoleLogWriter {
+	w := make(ConsoleLogWriter, LogBufferLength)
+	o := &consoleOptions{
+		done:  make(chan struct{}),
+		refmt: make(chan reformatRequest),
+	}
+	consoleOptionsMap.Store(w, o)
+	go w.run(o, out)
+	return w
+}
+
+// run writes the records handed to the writer to out, with the options o,
+// which it keeps hold of after Close releases them.
+func (w ConsoleLogWriter) run(o *consoleOptions, out io.Writer) {
 	var timestr string
 	var timestrAt int64
 
-	for rec := range w {
+	if o.done != nil {
+		defer close(o.done)
+	}
+	defer func() {
+		if o.resized != nil {
+			signal.Stop(o.resized)
+		}
+	}()
+
+	put := func(rec *LogRecord) {
 		if at := rec.Created.UnixNano() / 1e9; at != timestrAt {
 			timestr, timestrAt = rec.Created.Format("01/02/06 15:04:05"), at
 		}
-		fmt.Fprint(out, "[", timestr, "] [", levelStrings[rec.Level], "] ", rec.Message, "\n")
+		toErr := o.errout != nil && rec.Level >= o.errlevel
+		dst := out
+		if toErr {
+			dst = o.errout
+		}
+		if err := o.write(dst, timestr, rec); err != nil && isBrokenPipe(err) {
+			fmt.Fprintf(os.Stderr, "ConsoleLogWriter: %s; discarding further output\n", err)
+			o.errMu.Lock()
+			o.err = err
+			o.errMu.Unlock()
+			if toErr {
+				o.errout = ioutil.Discard
+			} else {
+				out = ioutil.Discard
+			}
+		}
+	}
+
+	for {
+		select {
+		case req := <-o.refmt:
+			// Records handed over before the change keep the old format
+			for pending := len(w); pending > 0; pending-- {
+				rec, ok := <-w
+				if !ok {
+					break
+				}
+				put(rec)
+			}
+			o.format = req.format
+			close(req.done)
+		case <-o.resized:
+			o.widths = nil
+		case rec, ok := <-w:
+			if !ok {
+				return
+			}
+			put(rec)
+		}
+	}
+}
+
+func (o *consoleOptions) write(out io.Writer, timestr string, rec *LogRecord) error {
+	defer reportPanic("ConsoleLogWriter", "")
+	var line string
+	if o.formatter != nil {
+		line = o.formatter.Format(rec)
+	} else if len(o.format) > 0 {
+		line = FormatLogRecordNoNewline(o.format, rec)
+	} else {
+		line = "[" + timestr + "] [" + rec.Level.shortName() + "] "
+		if o.showsource {
+			line += "(" + rec.Source + ") "
+		}
+		line += rec.Message
+	}
+	if o.maxwidth > 0 {
+		line = truncateLine(line, o.termWidth(out))
+	}
+	if !o.nonewline {
+		line += "\n"
+	}
+	_, err := io.WriteString(out, line)
+	return err
+}
+
+// Err returns the error that made the writer discard its output, or nil if it
+// is healthy or closed.
+func (w ConsoleLogWriter) Err() error {
+	o := w.lookupOptions()
+	if o == nil {
+		return nil
 	}
+	return o.Err()
+}
+
+func (o *consoleOptions) Err() error {
+	o.errMu.Lock()
+	defer o.errMu.Unlock()
+	return o.err
+}
+
+// termWidth returns the number of columns lines written to out may use, or 0
+// if out is not a terminal and should not be truncated.  The width of each
+// terminal is looked up once, and again after the terminal is resized.  It
+// must only be called from the writer's goroutine.
+func (o *consoleOptions) termWidth(out io.Writer) int {
+	f, ok := out.(*os.File)
+	if !ok {
+		return 0
+	}
+	if width, ok := o.widths[f]; ok {
+		return width
+	}
+
+	width := 0
+	if isTerminal(f) {
+		width = o.maxwidth
+		if cols := terminalColumns(f); cols > 0 {
+			width = cols
+		}
+		if o.resized == nil {
+			o.resized = notifyResize()
+		}
+	}
+	if o.widths == nil {
+		o.widths = make(map[*os.File]int)
+	}
+	o.widths[f] = width
+	return width
+}
+
+// truncateLine shortens line to at most width columns of a terminal, counting
+// wide characters such as CJK and emoji as two columns, and marks the cut with
+// an ellipsis.  A width of 0 leaves the line untouched.
+func truncateLine(line string, width int) string {
+	if width <= 0 || displayWidth(line) <= width {
+		return line
+	}
+	cols := 0
+	for i, r := range line {
+		if cols += runeWidth(r); cols > width-1 {
+			return line[:i] + "…"
+		}
+	}
+	return line
+}
+
+// displayWidth returns the number of terminal columns s takes up.
+func displayWidth(s string) int {
+	cols := 0
+	for _, r := range s {
+		cols += runeWidth(r)
+	}
+	return cols
+}
+
+// The ranges of characters a terminal shows two columns wide: the East Asian
+// wide and fullwidth characters, and the emoji shown as pictures
+var wideRunes = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x1100, 0x115f, 1},
+		{0x231a, 0x231b, 1},
+		{0x2329, 0x232a, 1},
+		{0x23e9, 0x23ec, 1},
+		{0x23f0, 0x23f3, 3},
+		{0x25fd, 0x25fe, 1},
+		{0x2614, 0x2615, 1},
+		{0x26aa, 0x26ab, 1},
+		{0x26bd, 0x26be, 1},
+		{0x26c4, 0x26c5, 1},
+		{0x26f2, 0x26f3, 1},
+		{0x26f5, 0x26fa, 5},
+		{0x26fd, 0x2705, 8},
+		{0x270a, 0x270b, 1},
+		{0x2728, 0x274c, 36},
+		{0x274e, 0x2753, 5},
+		{0x2754, 0x2755, 1},
+		{0x2757, 0x2795, 62},
+		{0x2796, 0x2797, 1},
+		{0x27b0, 0x27bf, 15},
+		{0x2b1b, 0x2b1c, 1},
+		{0x2b50, 0x2b55, 5},
+		{0x2e80, 0x303e, 1},
+		{0x3041, 0x33ff, 1},
+		{0x3400, 0x4dbf, 1},
+		{0x4e00, 0x9fff, 1},
+		{0xa000, 0xa4cf, 1},
+		{0xa960, 0xa97f, 1},
+		{0xac00, 0xd7a3, 1},
+		{0xf900, 0xfaff, 1},
+		{0xfe10, 0xfe19, 1},
+		{0xfe30, 0xfe6f, 1},
+		{0xff00, 0xff60, 1},
+		{0xffe0, 0xffe6, 1},
+	},
+	R32: []unicode.Range32{
+		{0x16fe0, 0x16fe4, 1},
+		{0x17000, 0x18cff, 1},
+		{0x1b000, 0x1b2ff, 1},
+		{0x1f004, 0x1f0cf, 203},
+		{0x1f18e, 0x1f191, 3},
+		{0x1f192, 0x1f19a, 1},
+		{0x1f200, 0x1f2ff, 1},
+		{0x1f300, 0x1f64f, 1},
+		{0x1f680, 0x1f6ff, 1},
+		{0x1f7e0, 0x1f7eb, 1},
+		{0x1f90c, 0x1f9ff, 1},
+		{0x1fa70, 0x1faff, 1},
+		{0x20000, 0x2fffd, 1},
+		{0x30000, 0x3fffd, 1},
+	},
+}
+
+// runeWidth returns the number of terminal columns r takes up: none for
+// combining marks and invisible formatting characters such as the zero-width
+// joiner, two for wide characters, and one for the rest.
+func runeWidth(r rune) int {
+	switch {
+	case unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case unicode.Is(wideRunes, r):
+		return 2
+	}
+	return 1
+}
+
+// isTerminal reports whether f is attached to a character device such as an
+// interactive terminal.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// SetMaxWidth truncates each line to the width of the terminal (or to n
+// columns if the terminal size is unknown) when writing to an interactive
+// terminal (chainable).  File and piped output is never truncated.  A width of
+// 0 disables truncation.  Must be called before the first log message is
+// written.
+func (w ConsoleLogWriter) SetMaxWidth(n int) ConsoleLogWriter {
+	w.options().maxwidth = n
+	return w
+}
+
+// SetStderrLevel sends records at or above lvl, such as ERROR, to standard
+// error, while the rest still go to the writer's target (chainable).  Must be
+// called before the first log message is written.
+func (w ConsoleLogWriter) SetStderrLevel(lvl Level) ConsoleLogWriter {
+	o := w.options()
+	o.errout = stderr
+	if o.errout == nil {
+		o.errout = os.Stderr
+	}
+	o.errlevel = lvl
+	return w
+}
+
+// SetShowSource sets whether each line shows the source of the record, as in
+// "[01/02/06 15:04:05] [INFO] (main.main:12) message" (chainable).  Unlike the
+// FileLogWriter, the console hides the source by default.  Must be called
+// before the first log message is written.
+func (w ConsoleLogWriter) SetShowSource(show bool) ConsoleLogWriter {
+	w.options().showsource = show
+	return w
+}
+
+// Set the logging format (chainable), in place of the console's own
+// "[time] [level] message" layout, with the pattern codes of FormatLogRecord:
+// "[%D %T] [%L] (%S) %M" shows the source as well.  Must be called before the
+// first log message is written.
+func (w ConsoleLogWriter) SetFormat(format string) ConsoleLogWriter {
+	w.options().format = format
+	return w
+}
+
+// Reformat changes the logging format once the records already handed to the
+// writer are written.  An empty format restores the console's own layout.  It
+// does nothing once the writer is closed.
+func (w ConsoleLogWriter) Reformat(format string) {
+	o := w.lookupOptions()
+	if o == nil {
+		return
+	}
+	req := reformatRequest{format: format, done: make(chan struct{})}
+	select {
+	case o.refmt <- req:
+		<-req.done
+	case <-o.done:
+	}
+}
+
+// SetFormatter formats each record with f, such as a LogfmtFormatter, in place
+// of the console's own "[time] [level] message" layout (chainable).  Must be
+// called before the first log message is written.
+func (w ConsoleLogWriter) SetFormatter(f Formatter) ConsoleLogWriter {
+	w.options().formatter = f
+	return w
+}
+
+// SetAppendNewline sets whether each record is followed by a newline
+// (chainable).  The default is true.  Must be called before the first log
+// message is written.
+func (w ConsoleLogWriter) SetAppendNewline(newline bool) ConsoleLogWriter {
+	w.options().nonewline = !newline
+	return w
 }
 
 // This is the ConsoleLogWriter's output method.  This will block if the output
@@ -40,6 +438,21 @@ func (w ConsoleLogWriter) LogWrite(rec *LogRecord) {
 
 // Close stops the logger from sending messages to standard output.  Attempts to
 // send log messages to this logger after a Close have undefined behavior.
+// Closing releases the writer's options.
 func (w ConsoleLogWriter) Close() {
+	consoleOptionsMap.Delete(w)
 	close(w)
 }
+
+// CloseErr closes the writer like Close, but waits for the remaining records
+// to be written, and reports why they could not be if the reader of standard
+// output went away.
+func (w ConsoleLogWriter) CloseErr() error {
+	o := w.lookupOptions()
+	w.Close()
+	if o == nil || o.done == nil {
+		return nil
+	}
+	<-o.done
+	return o.Err()
+}
@@ -0,0 +1,22 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package log4go
+
+import (
+	"os"
+)
+
+// terminalColumns is not supported on this platform; callers fall back to the
+// configured width.
+func terminalColumns(f *os.File) int {
+	return 0
+}
+
+// notifyResize returns nil, as there is no SIGWINCH on this platform; the
+// width first found is kept.
+func notifyResize() chan os.Signal {
+	return nil
+}
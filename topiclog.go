@@ -0,0 +1,282 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// The files opened on demand by writers such as the TopicRoutingWriter, most
+// recently used first, and how many may be open at once across all of them
+var openLogFiles struct {
+	mu      sync.Mutex
+	lru     *list.List
+	maxopen int
+}
+
+func init() {
+	openLogFiles.lru = list.New()
+}
+
+// SetMaxOpenLogFiles limits the number of files that writers opening files on
+// demand, such as the TopicRoutingWriter, keep open at once between them, so
+// that many topics cannot exhaust the process's file descriptors.  When the
+// limit is reached, the least recently used file is closed, and it is reopened
+// when it is next written to.  This applies on top of each writer's own limit.
+// A limit of 0, the default, means no limit.
+func SetMaxOpenLogFiles(n int) {
+	openLogFiles.mu.Lock()
+	openLogFiles.maxopen = n
+	var evicted []*topicFile
+	for n > 0 && openLogFiles.lru.Len() > n {
+		evicted = append(evicted, openLogFiles.lru.Back().Value.(*topicFile).evict())
+	}
+	openLogFiles.mu.Unlock()
+
+	for _, tf := range evicted {
+		tf.close()
+	}
+}
+
+// This log writer writes the records of each topic to a file of its own, so a
+// single filter can take every topic logged with LogObject.
+type TopicRoutingWriter struct {
+	// Where and under which names the topic files are kept
+	dir, template string
+
+	// The logging format of the topic files
+	format string
+
+	// The open topic files, most recently used first, and the files being
+	// closed for each topic, guarded by openLogFiles.mu as files may be
+	// closed to make room for other writers'
+	maxopen int
+	open    map[string]*list.Element
+	lru     *list.List
+	closing map[string]chan struct{}
+}
+
+// A topicFile is the file of one topic.  It is opened, written to and closed
+// outside of openLogFiles.mu, so that one slow file holds up only its own
+// topic; mu keeps it from being closed while a record is handed to it.
+type topicFile struct {
+	owner *TopicRoutingWriter
+	topic string
+	name  string
+
+	// The file's writer, or nil if it could not be opened, set before ready
+	// is closed
+	w     *FileLogWriter
+	ready chan struct{}
+
+	// Held for reading while handing the file a record, and for writing
+	// while closing it
+	mu     sync.RWMutex
+	closed bool
+	done   chan struct{}
+
+	// Where the file is in its owner's and in the global lists
+	elem, global *list.Element
+}
+
+// NewTopicRoutingWriter creates a new LogWriter which writes the records of
+// each topic to a file in dir named by template, in which %s is replaced by the
+// topic; records without a topic go to the "default" topic.  Files are opened
+// the first time their topic is seen, and at most maxopen of them are kept open
+// at once, closing the least recently used when needed (0 means no limit).
+// Path separators, NULs and ".." in topics are replaced with underscores in the
+// file names.  A file that cannot be opened is reported on standard error, and
+// the record dropped.
+func NewTopicRoutingWriter(dir, template string, maxopen int) *TopicRoutingWriter {
+	return &TopicRoutingWriter{
+		dir:      dir,
+		template: template,
+		format:   FORMAT_DEFAULT,
+		maxopen:  maxopen,
+		open:     make(map[string]*list.Element),
+		lru:      list.New(),
+		closing:  make(map[string]chan struct{}),
+	}
+}
+
+// This is the TopicRoutingWriter's output method
+func (w *TopicRoutingWriter) LogWrite(rec *LogRecord) {
+	topic := rec.Topic
+	if len(topic) == 0 {
+		topic = "default"
+	}
+
+	for {
+		tf := w.file(topic)
+		<-tf.ready
+		if tf.w == nil {
+			// It could not be opened, which was reported
+			return
+		}
+		tf.mu.RLock()
+		if tf.closed {
+			// Closed to make room since it was looked up
+			tf.mu.RUnlock()
+			continue
+		}
+		tf.w.LogWrite(rec)
+		tf.mu.RUnlock()
+		return
+	}
+}
+
+// file returns the file for topic, opening it if needed, and closing files to
+// make room for it.
+func (w *TopicRoutingWriter) file(topic string) *topicFile {
+	openLogFiles.mu.Lock()
+	if e, ok := w.open[topic]; ok {
+		tf := e.Value.(*topicFile)
+		w.lru.MoveToFront(tf.elem)
+		openLogFiles.lru.MoveToFront(tf.global)
+		openLogFiles.mu.Unlock()
+		return tf
+	}
+
+	var evicted []*topicFile
+	for w.maxopen > 0 && w.lru.Len() >= w.maxopen {
+		evicted = append(evicted, w.lru.Back().Value.(*topicFile).evict())
+	}
+	for openLogFiles.maxopen > 0 && openLogFiles.lru.Len() >= openLogFiles.maxopen {
+		evicted = append(evicted, openLogFiles.lru.Back().Value.(*topicFile).evict())
+	}
+
+	tf := &topicFile{
+		owner: w,
+		topic: topic,
+		name:  filepath.Join(w.dir, fmt.Sprintf(w.template, topicFileName(topic))),
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	tf.elem = w.lru.PushFront(tf)
+	tf.global = openLogFiles.lru.PushFront(tf)
+	w.open[topic] = tf.elem
+	format := w.format
+	prev := w.closing[topic]
+	delete(w.closing, topic)
+	openLogFiles.mu.Unlock()
+
+	for _, old := range evicted {
+		old.close()
+	}
+	// Let the file's last writer finish, so that its records come first
+	if prev != nil {
+		<-prev
+	}
+	tf.open(format)
+	return tf
+}
+
+// topicFileName returns topic made safe to put in a file name in the topic
+// directory: path separators, NULs and ".." are replaced, so that topics
+// taken from user data cannot name files elsewhere.
+func topicFileName(topic string) string {
+	name := strings.NewReplacer("/", "_", "\\", "_", "\x00", "_").Replace(topic)
+	return strings.Replace(name, "..", "__", -1)
+}
+
+// open opens the file with the given format, reporting a failure on standard
+// error and leaving the file without a writer, so that its records are
+// dropped until it is opened again.
+func (tf *topicFile) open(format string) {
+	defer close(tf.ready)
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "TopicRoutingWriter(%q): %v\n", tf.name, r)
+			tf.w = nil
+			tf.forget()
+		}
+	}()
+	tf.w = NewFileLogWriter(tf.name, false, false).SetFormat(format)
+}
+
+// forget takes a file that failed to open out of the lists, unless it was
+// evicted already, so that the next record for its topic tries again.
+func (tf *topicFile) forget() {
+	openLogFiles.mu.Lock()
+	defer openLogFiles.mu.Unlock()
+	if e, ok := tf.owner.open[tf.topic]; ok && e == tf.elem {
+		tf.evict()
+		tf.closed = true
+		close(tf.done)
+	}
+}
+
+// evict takes the file out of the lists, so that it is closed with close and
+// the next record for its topic opens it anew.  It must be called with
+// openLogFiles.mu held.
+func (tf *topicFile) evict() *topicFile {
+	tf.owner.lru.Remove(tf.elem)
+	openLogFiles.lru.Remove(tf.global)
+	delete(tf.owner.open, tf.topic)
+	tf.owner.closing[tf.topic] = tf.done
+	return tf
+}
+
+// close closes an evicted topic file once everything sent to it is written,
+// so that reopening it later keeps the records in order.  It must be called
+// without openLogFiles.mu held.
+func (tf *topicFile) close() {
+	<-tf.ready
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+	if tf.closed {
+		return
+	}
+	tf.closed = true
+	if tf.w != nil {
+		tf.w.CloseErr()
+	}
+	close(tf.done)
+}
+
+// Close closes every open topic file.
+func (w *TopicRoutingWriter) Close() {
+	openLogFiles.mu.Lock()
+	var evicted []*topicFile
+	for w.lru.Len() > 0 {
+		evicted = append(evicted, w.lru.Back().Value.(*topicFile).evict())
+	}
+	openLogFiles.mu.Unlock()
+
+	for _, tf := range evicted {
+		tf.close()
+	}
+}
+
+// Reformat changes the logging format of the topic files, open or not,
+// starting with the next record.
+func (w *TopicRoutingWriter) Reformat(format string) {
+	openLogFiles.mu.Lock()
+	w.format = format
+	var files []*topicFile
+	for e := w.lru.Front(); e != nil; e = e.Next() {
+		files = append(files, e.Value.(*topicFile))
+	}
+	openLogFiles.mu.Unlock()
+
+	for _, tf := range files {
+		<-tf.ready
+		tf.mu.RLock()
+		if !tf.closed && tf.w != nil {
+			tf.w.Reformat(format)
+		}
+		tf.mu.RUnlock()
+	}
+}
+
+// Set the logging format of the topic files (chainable).  Must be called
+// before the first log message is written.
+func (w *TopicRoutingWriter) SetFormat(format string) *TopicRoutingWriter {
+	w.format = format
+	return w
+}
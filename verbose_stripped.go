@@ -0,0 +1,37 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build nodebuglog
+// +build nodebuglog
+
+package log4go
+
+// When built with -tags nodebuglog, the FINEST, FINE and DEBUG logging calls
+// do nothing, so the compiler can drop them from release binaries entirely.
+// Their signatures match the full implementations in verbose.go.
+
+// debugLogging reports whether the FINEST, FINE and DEBUG logging calls are
+// compiled in.
+const debugLogging = false
+
+// Finest does nothing in builds tagged nodebuglog.
+func (log Logger) Finest(arg0 interface{}, args ...interface{}) {}
+
+// Fine does nothing in builds tagged nodebuglog.
+func (log Logger) Fine(arg0 interface{}, args ...interface{}) {}
+
+// Debug does nothing in builds tagged nodebuglog.
+func (log Logger) Debug(arg0 interface{}, args ...interface{}) {}
+
+// Finest does nothing in builds tagged nodebuglog.
+func Finest(arg0 interface{}, args ...interface{}) {}
+
+// Fine does nothing in builds tagged nodebuglog.
+func Fine(arg0 interface{}, args ...interface{}) {}
+
+// Debug does nothing in builds tagged nodebuglog.
+func Debug(arg0 interface{}, args ...interface{}) {}
+
+// DebugLog does nothing in builds tagged nodebuglog.
+func DebugLog(logname string, arg0 interface{}, args ...interface{}) error {
+	return nil
+}
@@ -0,0 +1,220 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
+)
+
+// The payload a WebhookLogWriter posts unless told otherwise, which Slack's
+// incoming webhooks accept
+const WEBHOOK_SLACK = `{"text": {{json .Text}}}`
+
+var webhookFuncs = template.FuncMap{
+	// Quote a value as JSON
+	"json": func(v interface{}) (string, error) {
+		js, err := json.Marshal(v)
+		return string(js), err
+	},
+}
+
+// What a webhook template is executed with
+type webhookData struct {
+	Level, Time, Source, Message, Category, Topic string
+
+	// The record in the writer's logging format
+	Text string
+}
+
+// This log writer posts records at or above a threshold level to a webhook,
+// such as a Slack incoming webhook, one request per record.
+type WebhookLogWriter struct {
+	rec  chan *LogRecord
+	done chan struct{}
+
+	// Where to post, and which records
+	url       string
+	threshold Level
+	client    *http.Client
+
+	// The logging format of .Text, and the payload template
+	format string
+	tmpl   *template.Template
+
+	// Post at most rate records a minute, in bursts of up to a minute's worth
+	rateMu   sync.Mutex
+	rate     float64
+	tokens   float64
+	rateLast time.Time
+
+	// Records over the rate limit or that could not be posted
+	dropped uint64
+}
+
+// NewWebhookLogWriter creates a new LogWriter which posts each record at or
+// above threshold to url as JSON, by default in the form Slack expects,
+// {"text": "[EROR] (source) message"}.  Records below threshold are ignored
+// regardless of the level of the filter.  Records are posted in the order they
+// are logged, from a goroutine of the writer's own; a post that fails is
+// reported on standard error and dropped.
+func NewWebhookLogWriter(url string, threshold Level) *WebhookLogWriter {
+	w := &WebhookLogWriter{
+		rec:       make(chan *LogRecord, LogBufferLength),
+		done:      make(chan struct{}),
+		url:       url,
+		threshold: threshold,
+		client:    http.DefaultClient,
+		format:    "[%L] (%S) %M",
+		tmpl:      template.Must(template.New("webhook").Funcs(webhookFuncs).Parse(WEBHOOK_SLACK)),
+	}
+
+	go func() {
+		defer close(w.done)
+		for rec := range w.rec {
+			if err := w.post(rec); err != nil {
+				fmt.Fprintf(os.Stderr, "WebhookLogWriter(%q): %s\n", w.url, err)
+				atomic.AddUint64(&w.dropped, 1)
+			}
+		}
+	}()
+
+	return w
+}
+
+// This is the WebhookLogWriter's output method.  Records below the threshold
+// or over the rate limit are dropped here.
+func (w *WebhookLogWriter) LogWrite(rec *LogRecord) {
+	if rec.Level < w.threshold {
+		return
+	}
+	if !w.withinRate() {
+		atomic.AddUint64(&w.dropped, 1)
+		return
+	}
+	w.rec <- rec
+}
+
+// withinRate reports whether another record may be posted, using up a token
+// if so.
+func (w *WebhookLogWriter) withinRate() bool {
+	w.rateMu.Lock()
+	defer w.rateMu.Unlock()
+	if w.rate <= 0 {
+		return true
+	}
+
+	// Refill the bucket for the time since the last record
+	now := timeNow()
+	if elapsed := now.Sub(w.rateLast); elapsed > 0 {
+		w.tokens += elapsed.Minutes() * w.rate
+		if w.tokens > w.rate {
+			w.tokens = w.rate
+		}
+	}
+	w.rateLast = now
+
+	if w.tokens < 1 {
+		return false
+	}
+	w.tokens--
+	return true
+}
+
+// post posts rec to the webhook.  It must only be called from the writer's
+// goroutine.
+func (w *WebhookLogWriter) post(rec *LogRecord) (err error) {
+	defer reportPanic("WebhookLogWriter", w.url)
+
+	var body bytes.Buffer
+	err = w.tmpl.Execute(&body, webhookData{
+		Level:    rec.Level.String(),
+		Time:     rec.Created.Format(time.RFC3339),
+		Source:   rec.Source,
+		Message:  rec.Message,
+		Category: rec.Category,
+		Topic:    rec.Topic,
+		Text:     strings.TrimSuffix(FormatLogRecord(w.format, rec), "\n"),
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.client.Post(w.url, "application/json", &body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// Close posts the records already handed to the writer and stops it.
+func (w *WebhookLogWriter) Close() {
+	close(w.rec)
+	<-w.done
+}
+
+// Dropped returns the number of records over the rate limit or that could not
+// be posted.
+func (w *WebhookLogWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// SetTemplate sets the payload posted for each record (chainable), as a
+// text/template executed with the record's .Level, .Time (RFC 3339), .Source,
+// .Message, .Category and .Topic, and .Text, the record in the writer's
+// logging format.  The json function quotes a value as JSON, as in the default
+// WEBHOOK_SLACK.  A template that does not parse is reported on standard
+// error and the previous one is kept.  Must be called before the first log
+// message is written.
+func (w *WebhookLogWriter) SetTemplate(text string) *WebhookLogWriter {
+	tmpl, err := template.New("webhook").Funcs(webhookFuncs).Parse(text)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "WebhookLogWriter(%q): %s\n", w.url, err)
+		return w
+	}
+	w.tmpl = tmpl
+	return w
+}
+
+// Set the logging format of .Text (chainable).  The default is
+// "[%L] (%S) %M".  Must be called before the first log message is written.
+func (w *WebhookLogWriter) SetFormat(format string) *WebhookLogWriter {
+	w.format = format
+	return w
+}
+
+// SetRateLimit posts at most perMinute records a minute, allowing bursts of
+// up to a minute's worth, so that a burst of errors cannot flood the channel
+// or get the webhook throttled (chainable).  Records over the limit are dropped
+// and counted in Dropped.  A limit of 0, the default, turns limiting off.
+// Must be called before the first log message is written.
+func (w *WebhookLogWriter) SetRateLimit(perMinute int) *WebhookLogWriter {
+	w.rateMu.Lock()
+	defer w.rateMu.Unlock()
+	w.rate = float64(perMinute)
+	w.tokens = w.rate
+	w.rateLast = timeNow()
+	return w
+}
+
+// SetHTTPClient sets the client used to post (chainable).  The default is
+// http.DefaultClient.  Must be called before the first log message is written.
+func (w *WebhookLogWriter) SetHTTPClient(client *http.Client) *WebhookLogWriter {
+	w.client = client
+	return w
+}
@@ -5,42 +5,93 @@ package log4go
 import (
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	Global Logger
+
+	// Held by the wrappers while they use Global, and exclusively by those
+	// that change it, so that it can be reset while logging
+	globalMu sync.RWMutex
 )
 
 func init() {
-	Global = NewDefaultLogger(DEBUG)
+	Global = newGlobalLogger(DEBUG)
 	// innerInit()
 }
 
+// ResetGlobal closes every filter of Global and replaces it with a fresh
+// default logger, as at startup, dropping any options set on it.  It is meant
+// for the setup and teardown of tests that use the package-level functions, so
+// that filters one test adds do not leak into the next.  It is safe to call
+// while other goroutines log through the package-level functions, but not
+// while they use Global directly.
+func ResetGlobal() {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	Global.Close()
+	Global = newGlobalLogger(DEBUG)
+}
+
 // Wrapper for (*Logger).LoadConfiguration
 func LoadConfiguration(filename string) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
 	Global.LoadConfiguration(filename)
 
 	//check defualt logger
 	_, ok := Global["stdout"]
 	if !ok {
-		Global["stdout"] = &Filter{INFO, "./logs/", NewConsoleLogWriter()}
+		Global["stdout"] = &Filter{INFO, "", newConsoleLogWriter(consoleStdout())}
 	}
 }
 
 // Wrapper for (*Logger).AddFilter
-func AddFilter(name string, lvl level, writer LogWriter) {
+func AddFilter(name string, lvl Level, writer LogWriter) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
 	Global.AddFilter(name, lvl, writer)
 
 }
 
+// Wrapper for (*Logger).AddWriter
+func AddWriter(name string, lvl Level, w io.Writer, format string) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	Global.AddWriter(name, lvl, w, format)
+}
+
+// Wrapper for (*Logger).SetFormatAll
+func SetFormatAll(format string) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	Global.SetFormatAll(format)
+}
+
 // Wrapper for (*Logger).Close (closes and removes all logwriters)
-func Close() {
-	Global.Close()
+func Close() error {
+	globalMu.Lock()
+	defer globalMu.Unlock()
+	return Global.Close()
+}
+
+// Wrapper for (*Logger).RecoverAndLog, to be deferred in the same way
+func RecoverAndLog(rethrow bool) {
+	if r := recover(); r != nil {
+		globalMu.RLock()
+		defer globalMu.RUnlock()
+		Global.logPanic(r, rethrow)
+	}
 }
 
 func Crash(args ...interface{}) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	if len(args) > 0 {
 		Global.intLogf(CRITICAL, strings.Repeat(" %v", len(args))[1:], args...)
 	}
@@ -49,6 +100,8 @@ func Crash(args ...interface{}) {
 
 // Logs the given message and crashes the program
 func Crashf(format string, args ...interface{}) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
 	Global.intLogf(CRITICAL, format, args...)
 	Global.Close() // so that hopefully the messages get logged
 	panic(fmt.Sprintf(format, args...))
@@ -56,6 +109,8 @@ func Crashf(format string, args ...interface{}) {
 
 // Compatibility with `log`
 func Exit(args ...interface{}) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
 	if len(args) > 0 {
 		Global.intLogf(ERROR, strings.Repeat(" %v", len(args))[1:], args...)
 	}
@@ -65,6 +120,8 @@ func Exit(args ...interface{}) {
 
 // Compatibility with `log`
 func Exitf(format string, args ...interface{}) {
+	globalMu.Lock()
+	defer globalMu.Unlock()
 	Global.intLogf(ERROR, format, args...)
 	Global.Close() // so that hopefully the messages get logged
 	os.Exit(0)
@@ -72,6 +129,8 @@ func Exitf(format string, args ...interface{}) {
 
 // Compatibility with `log`
 func Stderr(args ...interface{}) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	if len(args) > 0 {
 		Global.intLogf(ERROR, strings.Repeat(" %v", len(args))[1:], args...)
 	}
@@ -79,11 +138,15 @@ func Stderr(args ...interface{}) {
 
 // Compatibility with `log`
 func Stderrf(format string, args ...interface{}) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	Global.intLogf(ERROR, format, args...)
 }
 
 // Compatibility with `log`
 func Stdout(args ...interface{}) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	if len(args) > 0 {
 		Global.intLogf(INFO, strings.Repeat(" %v", len(args))[1:], args...)
 	}
@@ -91,111 +154,48 @@ func Stdout(args ...interface{}) {
 
 // Compatibility with `log`
 func Stdoutf(format string, args ...interface{}) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	Global.intLogf(INFO, format, args...)
 }
 
 // Send a log message manually
 // Wrapper for (*Logger).Log
-func Log(lvl level, source, message string) {
+func Log(lvl Level, source, message string) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	Global.Log(lvl, source, message)
 }
 
+// Send a log message created at the given time
+// Wrapper for (*Logger).LogAt
+func LogAt(t time.Time, lvl Level, source, message string) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
+	Global.LogAt(t, lvl, source, message)
+}
+
 // Send a formatted log message easily
 // Wrapper for (*Logger).Logf
-func Logf(lvl level, format string, args ...interface{}) {
+func Logf(lvl Level, format string, args ...interface{}) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	Global.intLogf(lvl, format, args...)
 }
 
 // Send a closure log message
 // Wrapper for (*Logger).Logc
-func Logc(lvl level, closure func() string) {
+func Logc(lvl Level, closure func() string) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	Global.intLogc(lvl, closure)
 }
 
-// Utility for finest log messages (see Debug() for parameter explanation)
-// Wrapper for (*Logger).Finest
-func Finest(arg0 interface{}, args ...interface{}) {
-	const (
-		lvl = FINEST
-	)
-	switch first := arg0.(type) {
-	case string:
-		// Use the string as a format string
-		Global.intLogf(lvl, first, args...)
-	case func() string:
-		// Log the closure (no other arguments used)
-		Global.intLogc(lvl, first)
-	default:
-		// Build a format string so that it will be similar to Sprint
-		Global.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
-	}
-}
-
-// Utility for fine log messages (see Debug() for parameter explanation)
-// Wrapper for (*Logger).Fine
-func Fine(arg0 interface{}, args ...interface{}) {
-	const (
-		lvl = FINE
-	)
-	switch first := arg0.(type) {
-	case string:
-		// Use the string as a format string
-		Global.intLogf(lvl, first, args...)
-	case func() string:
-		// Log the closure (no other arguments used)
-		Global.intLogc(lvl, first)
-	default:
-		// Build a format string so that it will be similar to Sprint
-		Global.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
-	}
-}
-
-// Utility for debug log messages
-// When given a string as the first argument, this behaves like Logf but with the DEBUG log level (e.g. the first argument is interpreted as a format for the latter arguments)
-// When given a closure of type func()string, this logs the string returned by the closure iff it will be logged.  The closure runs at most one time.
-// When given anything else, the log message will be each of the arguments formatted with %v and separated by spaces (ala Sprint).
-// Wrapper for (*Logger).Debug
-func Debug(arg0 interface{}, args ...interface{}) {
-	const (
-		lvl = DEBUG
-	)
-	switch first := arg0.(type) {
-	case string:
-		// Use the string as a format string
-		Global.intLogf(lvl, first, args...)
-	case func() string:
-		// Log the closure (no other arguments used)
-		Global.intLogc(lvl, first)
-	default:
-		// Build a format string so that it will be similar to Sprint
-		Global.intLogf(lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
-	}
-}
-
-// Utility for error log messages (returns an error for easy function returns) (see Debug() for parameter explanation)
-// These functions will execute a closure exactly once, to build the error message for the return
-// Wrapper for (*Logger).Error
-func DebugLog(logname string, arg0 interface{}, args ...interface{}) error {
-	const (
-		lvl = DEBUG
-	)
-	switch first := arg0.(type) {
-	case string:
-		// Use the string as a format string
-		Global.intLogNamef(logname, lvl, first, args...)
-	case func() string:
-		// Log the closure (no other arguments used)
-		Global.intLogNamec(logname, lvl, first)
-	default:
-		// Build a format string so that it will be similar to Sprint
-		Global.intLogNamef(logname, lvl, fmt.Sprint(arg0)+strings.Repeat(" %v", len(args)), args...)
-	}
-	return nil
-}
-
 // Utility for trace log messages (see Debug() for parameter explanation)
 // Wrapper for (*Logger).Trace
 func Trace(arg0 interface{}, args ...interface{}) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	const (
 		lvl = TRACE
 	)
@@ -213,6 +213,8 @@ func Trace(arg0 interface{}, args ...interface{}) {
 }
 
 func TraceLog(logname string, arg0 interface{}, args ...interface{}) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	const (
 		lvl = TRACE
 	)
@@ -233,6 +235,8 @@ func TraceLog(logname string, arg0 interface{}, args ...interface{}) {
 // Utility for info log messages (see Debug() for parameter explanation)
 // Wrapper for (*Logger).Info
 func Info(arg0 interface{}, args ...interface{}) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	const (
 		lvl = INFO
 	)
@@ -250,6 +254,8 @@ func Info(arg0 interface{}, args ...interface{}) {
 }
 
 func InfoLog(logname string, arg0 interface{}, args ...interface{}) {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	const (
 		lvl = INFO
 	)
@@ -271,6 +277,8 @@ func InfoLog(logname string, arg0 interface{}, args ...interface{}) {
 // These functions will execute a closure exactly once, to build the error message for the return
 // Wrapper for (*Logger).Warn
 func Warn(arg0 interface{}, args ...interface{}) error {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	const (
 		lvl = WARNING
 	)
@@ -293,6 +301,8 @@ func Warn(arg0 interface{}, args ...interface{}) error {
 }
 
 func WarnLog(logname string, arg0 interface{}, args ...interface{}) error {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	const (
 		lvl = WARNING
 	)
@@ -318,6 +328,8 @@ func WarnLog(logname string, arg0 interface{}, args ...interface{}) error {
 // These functions will execute a closure exactly once, to build the error message for the return
 // Wrapper for (*Logger).Error
 func Error(arg0 interface{}, args ...interface{}) error {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	const (
 		lvl = ERROR
 	)
@@ -343,6 +355,8 @@ func Error(arg0 interface{}, args ...interface{}) error {
 // These functions will execute a closure exactly once, to build the error message for the return
 // Wrapper for (*Logger).Error
 func ErrorLog(logname string, arg0 interface{}, args ...interface{}) error {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	const (
 		lvl = ERROR
 	)
@@ -368,6 +382,8 @@ func ErrorLog(logname string, arg0 interface{}, args ...interface{}) error {
 // These functions will execute a closure exactly once, to build the error message for the return
 // Wrapper for (*Logger).Critical
 func Critical(arg0 interface{}, args ...interface{}) error {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	const (
 		lvl = CRITICAL
 	)
@@ -390,6 +406,8 @@ func Critical(arg0 interface{}, args ...interface{}) error {
 }
 
 func CriticalLog(logname string, arg0 interface{}, args ...interface{}) error {
+	globalMu.RLock()
+	defer globalMu.RUnlock()
 	const (
 		lvl = CRITICAL
 	)